@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// acceptPeers is set with -accept: in server mode, incoming peers are
+// accepted without asking. Otherwise, when proxypunch runs in a terminal, the
+// host is asked whether to accept each peer once it connected, and its game
+// traffic is only forwarded once accepted.
+var acceptPeers bool
+
+// confirmTimeout is the time the host has to accept a peer, after which it
+// is rejected.
+const confirmTimeout = 60 * time.Second
+
+// confirmDelay is the time given to the peer to send its nickname before
+// asking the host, so that the question shows it.
+const confirmDelay = 1500 * time.Millisecond
+
+// rejectedMu protects rejected, the public addresses, or nicknames if they
+// are relayed, of the peers the host rejected, which are not asked about
+// again until proxypunch restarts.
+var rejectedMu sync.Mutex
+var rejected = make(map[string]struct{})
+
+// questionMu serializes the questions asked to the user, answerMu protects
+// answers, which receives the answer to the current question, nil if none.
+var questionMu sync.Mutex
+var answerMu sync.Mutex
+var answers chan string
+
+// confirmPeers returns whether the host is asked to accept incoming peers.
+func confirmPeers() bool {
+	if acceptPeers {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// the null device is a character device too
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// isRejected returns whether a peer connecting from ip, if not nil, or with
+// nickname, if not empty, was rejected.
+func isRejected(ip net.IP, nickname string) bool {
+	rejectedMu.Lock()
+	defer rejectedMu.Unlock()
+	if _, ok := rejected[ip.String()]; ip != nil && ok {
+		return true
+	}
+	_, ok := rejected[strings.ToLower(nickname)]
+	return nickname != "" && ok
+}
+
+// reject remembers the rejection of the peer, by its public address, or its
+// nickname if it is relayed.
+func (p *proxy) reject() {
+	entry := ""
+	if ip := p.publicIP(); ip != nil {
+		entry = ip.String()
+	} else {
+		p.peerMu.Lock()
+		entry = strings.ToLower(p.peerNickname)
+		p.peerMu.Unlock()
+	}
+	if entry == "" {
+		return
+	}
+	rejectedMu.Lock()
+	rejected[entry] = struct{}{}
+	rejectedMu.Unlock()
+}
+
+// prompt asks the user question, and returns the answer, or false if there was
+// none within timeout or alive returned false.
+func prompt(question string, timeout time.Duration, alive func() bool) (string, bool) {
+	questionMu.Lock()
+	defer questionMu.Unlock()
+	if !alive() {
+		return "", false
+	}
+	ch := make(chan string, 1)
+	answerMu.Lock()
+	answers = ch
+	answerMu.Unlock()
+	defer func() {
+		answerMu.Lock()
+		answers = nil
+		answerMu.Unlock()
+	}()
+	consoleMu.Lock()
+	fmt.Println(question)
+	consoleMu.Unlock()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case answer := <-ch:
+			return answer, true
+		case <-deadline:
+			return "", false
+		case <-ticker.C:
+			if !alive() {
+				return "", false
+			}
+		}
+	}
+}
+
+// answered hands line to the current question, and returns whether there
+// was one.
+func answered(line string) bool {
+	answerMu.Lock()
+	defer answerMu.Unlock()
+	if answers == nil {
+		return false
+	}
+	select {
+	case answers <- line:
+	default:
+	}
+	return true
+}
+
+// confirm asks the host whether to accept the peer that just connected,
+// ending its session unless it does.
+func (p *proxy) confirm() {
+	time.Sleep(confirmDelay)
+	p.peerMu.Lock()
+	nickname := p.peerNickname
+	p.peerMu.Unlock()
+	if isRejected(p.publicIP(), nickname) {
+		p.kick("Rejected " + p.peerName() + " again, ending its session")
+		return
+	}
+	from := "through the relay"
+	if ip := p.publicIP(); ip != nil {
+		from = "from " + ip.String()
+	}
+	answer, ok := prompt("Accept connection of "+p.peerName()+" "+from+"? y/n (rejected in "+confirmTimeout.String()+")", confirmTimeout, p.active)
+	if !p.active() {
+		return
+	}
+	if ok && strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+		atomic.StoreUint32(&p.unconfirmed, 0)
+		p.s.println("Accepted " + p.peerName() + ", forwarding its game traffic")
+		return
+	}
+	p.reject()
+	p.kick("Rejected " + p.peerName() + ", ending its session, it will not be asked about again until proxypunch restarts")
+}
+
+// confirmed returns whether the host accepted the peer, or did not need to.
+func (p *proxy) confirmed() bool {
+	return atomic.LoadUint32(&p.unconfirmed) == 0
+}
+
+// active returns whether the session is running.
+func (p *proxy) active() bool {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	_, ok := activeProxies[p]
+	return ok
+}
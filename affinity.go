@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var cpuList string
+var priority string
+
+// parseCpus parses a list of CPU indexes such as "0,2-3".
+func parseCpus(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.IndexByte(part, '-'); i != -1 {
+			from, to = part[:i], part[i+1:]
+		}
+		a, err := strconv.Atoi(from)
+		if err != nil || a < 0 {
+			return nil, errors.New("invalid cpu: " + from)
+		}
+		b, err := strconv.Atoi(to)
+		if err != nil || b < a {
+			return nil, errors.New("invalid cpu range: " + part)
+		}
+		for cpu := a; cpu <= b; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, errors.New("empty cpu list")
+	}
+	return cpus, nil
+}
+
+// applyScheduling applies the configured CPU affinity and priority; failures
+// are reported but not fatal, as they usually depend on user privileges.
+func applyScheduling() {
+	if cpuList != "" {
+		cpus, err := parseCpus(cpuList)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing cpu list "+cpuList+": "+err.Error())
+		} else if err := setAffinity(cpus); err != nil {
+			fmt.Fprintln(os.Stderr, "Error setting cpu affinity: "+err.Error())
+		}
+	}
+	switch priority {
+	case "", "normal":
+	case "high", "realtime":
+		if err := setPriority(priority == "realtime"); err != nil {
+			fmt.Fprintln(os.Stderr, "Error raising process priority: "+err.Error())
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Error unknown priority "+priority+", must be normal, high or realtime")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const schedRR = 2
+
+// tasks returns the thread ids of the process; settings applied to them are
+// inherited by threads the runtime creates afterwards.
+func tasks() ([]int, error) {
+	files, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil, err
+	}
+	var tids []int
+	for _, f := range files {
+		if tid, err := strconv.Atoi(f.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	return tids, nil
+}
+
+func setAffinity(cpus []int) error {
+	var mask [16]uint64
+	for _, cpu := range cpus {
+		if cpu >= len(mask)*64 {
+			continue
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	tids, err := tasks()
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid), uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+func setPriority(realtime bool) error {
+	tids, err := tasks()
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		if realtime {
+			param := struct{ priority int32 }{10}
+			_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, uintptr(tid), schedRR, uintptr(unsafe.Pointer(&param)))
+			if errno != 0 {
+				return errno
+			}
+		} else if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, -10); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func setAffinity(cpus []int) error {
+	return errors.New("not supported on this system")
+}
+
+func setPriority(realtime bool) error {
+	return errors.New("not supported on this system")
+}
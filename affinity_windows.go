@@ -0,0 +1,44 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const highPriorityClass = 0x80
+
+const realtimePriorityClass = 0x100
+
+var (
+	kernel32                   = syscall.NewLazyDLL("kernel32.dll")
+	procGetCurrentProcess      = kernel32.NewProc("GetCurrentProcess")
+	procSetProcessAffinityMask = kernel32.NewProc("SetProcessAffinityMask")
+	procSetPriorityClass       = kernel32.NewProc("SetPriorityClass")
+)
+
+func setAffinity(cpus []int) error {
+	var mask uintptr
+	for _, cpu := range cpus {
+		if cpu < 8*int(unsafe.Sizeof(mask)) {
+			mask |= 1 << uint(cpu)
+		}
+	}
+	process, _, _ := procGetCurrentProcess.Call()
+	if r, _, err := procSetProcessAffinityMask.Call(process, mask); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func setPriority(realtime bool) error {
+	class := uintptr(highPriorityClass)
+	if realtime {
+		// without administrator rights Windows silently uses high priority instead
+		class = realtimePriorityClass
+	}
+	process, _, _ := procGetCurrentProcess.Call()
+	if r, _, err := procSetPriorityClass.Call(process, class); r == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// allowList is the comma-separated list of addresses set with -allow or
+// allow: in the configuration file: in server mode, only peers connecting
+// from one of them are answered, others are silently ignored.
+var allowList string
+
+// allowed are the networks of allowList, nil to accept peers from anywhere.
+var allowed []*net.IPNet
+
+// parseNetwork parses an IP address, as a network of that single address, or
+// a network in CIDR notation.
+func parseNetwork(v string) (*net.IPNet, error) {
+	v = strings.TrimSpace(v)
+	if _, network, err := net.ParseCIDR(v); err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, errors.New("invalid address " + v + ", must be an IP address such as 203.0.113.7, or a network such as 203.0.113.0/24")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func applyAllow() error {
+	allowed = nil
+	if strings.TrimSpace(allowList) == "" {
+		return nil
+	}
+	for _, v := range strings.Split(allowList, ",") {
+		network, err := parseNetwork(v)
+		if err != nil {
+			return errors.New("-allow: " + err.Error())
+		}
+		allowed = append(allowed, network)
+	}
+	return nil
+}
+
+// contains returns whether ip is in one of networks.
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, v := range networks {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitted returns whether a peer connecting from its public address ip, or
+// its IPv6 address ipv6 if not nil, may connect in server mode: it is not
+// banned nor rejected by the host, and allowed by -allow.
+func admitted(ip net.IP, ipv6 net.IP) bool {
+	if isBanned(ip, "") || ipv6 != nil && isBanned(ipv6, "") {
+		return false
+	}
+	if isRejected(ip, "") || ipv6 != nil && isRejected(ipv6, "") {
+		return false
+	}
+	if allowed == nil {
+		return true
+	}
+	return contains(allowed, ip) || ipv6 != nil && contains(allowed, ipv6)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net"
+	"sync/atomic"
+)
+
+// password is required from peers in server mode and presented to the host
+// in client mode; token is the shared token of a community, which hides the
+// published sessions from other players and is required to join them.
+var password string
+var token string
+
+// nonceSize is the size of the random challenge sent to peers.
+const nonceSize = 16
+
+// hostChallengeWarning is the count of typeHostChallenge a host leaves
+// unanswered before it is reported as too old.
+const hostChallengeWarning = 5
+
+// joinSecret returns the secret peers must prove to know to join, or nil if
+// there is none.
+func joinSecret() []byte {
+	if password == "" && token == "" {
+		return nil
+	}
+	h := sha256.Sum256([]byte("proxypunch join\x00" + token + "\x00" + password))
+	return h[:]
+}
+
+// tokenTag returns the tag identifying the community token on the lobby,
+// all zeroes if there is no token.
+func tokenTag() [8]byte {
+	var tag [8]byte
+	if token != "" {
+		h := sha256.Sum256([]byte("proxypunch lobby\x00" + token))
+		copy(tag[:], h[:])
+	}
+	return tag
+}
+
+// authMac returns the MAC of a challenge, keyed by secret, for the direction
+// of label: each direction uses its own label, so that the answer of a peer
+// can never be replayed as the answer of the other direction.
+func authMac(secret []byte, label string, nonce []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(label))
+	m.Write(nonce)
+	return m.Sum(nil)
+}
+
+// clientMac returns the answer of a client to a typeChallenge.
+func clientMac(secret []byte, nonce []byte) []byte {
+	return authMac(secret, "proxypunch client\x00", nonce)
+}
+
+// hostMac returns the answer of a host to a typeHostChallenge.
+func hostMac(secret []byte, nonce []byte) []byte {
+	return authMac(secret, "proxypunch host\x00", nonce)
+}
+
+// challengeHost sends a typeHostChallenge to the host in client mode with
+// -password, until it proves to know the password too.
+func (p *proxy) challengeHost(peer *net.UDPAddr) {
+	if !p.verifyHost || atomic.LoadUint32(&p.hostVerified) != 0 {
+		return
+	}
+	p.hostChallenges++
+	if p.hostChallenges == hostChallengeWarning {
+		p.s.errorln("Error " + p.peerName() + " does not answer the authentication of -password, its proxypunch may be too old: the game traffic is not forwarded until it is updated")
+	}
+	p.c.WriteToUDP(append([]byte{typeHostChallenge}, p.nonce...), peer)
+}
+
+// hostAnswer returns the typeHostAuth answer to the typeHostChallenge data of
+// a client, or nil if it is not one.
+func (p *proxy) hostAnswer(data []byte) []byte {
+	if len(data) != 1+nonceSize || data[0] != typeHostChallenge {
+		return nil
+	}
+	auth := []byte{typeHostAuth}
+	if p.secret != nil {
+		auth = append(auth, hostMac(p.secret, data[1:])...)
+	}
+	return auth
+}
+
+// hostAnswered handles the typeHostAuth answer of the host: the MAC of the
+// challenge, or nothing if it does not require a password.
+func (p *proxy) hostAnswered(data []byte) {
+	if !p.verifyHost || atomic.LoadUint32(&p.hostVerified) != 0 {
+		return
+	}
+	if len(data) == 1+sha256.Size && hmac.Equal(data[1:], hostMac(p.secret, p.nonce)) {
+		atomic.StoreUint32(&p.hostVerified, 1)
+		p.s.println("Host authenticated")
+		return
+	}
+	atomic.StoreUint32(&p.hostVerified, 2)
+	if len(data) == 1 {
+		p.s.errorln("Error " + p.peerName() + " does not require the password of -password, check that you are connecting to the right host: the game traffic is not forwarded")
+	} else {
+		p.s.errorln("Error " + p.peerName() + " answered with a wrong password or token, check that you are connecting to the right host: the game traffic is not forwarded")
+	}
+}
+
+// hostAuthenticated returns whether the game traffic is exchanged with the
+// host: it proved to know the password of -password, or it was not given.
+func (p *proxy) hostAuthenticated() bool {
+	return !p.verifyHost || atomic.LoadUint32(&p.hostVerified) == 1
+}
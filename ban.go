@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// banMu protects bans, the IP addresses, networks and nicknames of the peers
+// banned in server mode, from bans: in the configuration file and the ban
+// command.
+var banMu sync.Mutex
+var bans []string
+
+// isBanned returns whether a peer connecting from ip, if not nil, or with
+// nickname, if not empty, is banned.
+func isBanned(ip net.IP, nickname string) bool {
+	banMu.Lock()
+	defer banMu.Unlock()
+	for _, v := range bans {
+		if network, err := parseNetwork(v); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if nickname != "" && strings.EqualFold(v, nickname) {
+			return true
+		}
+	}
+	return false
+}
+
+// addBan bans entry, and returns the bans to save, or nil if it was already
+// banned.
+func addBan(entry string) []string {
+	banMu.Lock()
+	defer banMu.Unlock()
+	for _, v := range bans {
+		if strings.EqualFold(v, entry) {
+			return nil
+		}
+	}
+	bans = append(bans, entry)
+	return append([]string(nil), bans...)
+}
+
+// removeBan lifts the ban of entry, and returns the bans to save, or nil if
+// it was not banned.
+func removeBan(entry string) []string {
+	banMu.Lock()
+	defer banMu.Unlock()
+	for i, v := range bans {
+		if strings.EqualFold(v, entry) {
+			bans = append(bans[:i:i], bans[i+1:]...)
+			return append([]string{}, bans...)
+		}
+	}
+	return nil
+}
+
+// runCommands reads the commands typed while hosting in server mode, saving
+// the bans with save when they change, and the answers to the questions.
+func runCommands(scanner *bufio.Scanner, save func(bans []string)) {
+	for scanner.Scan() {
+		if answered(scanner.Text()) {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		entry := strings.Join(fields[1:], " ")
+		switch strings.ToLower(fields[0]) {
+		case "ban":
+			if entry == "" {
+				banPeers(save)
+				continue
+			}
+			if saved := addBan(entry); saved != nil {
+				save(saved)
+			}
+			fmt.Println("Banned " + entry)
+			kickBanned()
+		case "unban":
+			if saved := removeBan(entry); saved != nil {
+				save(saved)
+				fmt.Println("Lifted the ban of " + entry)
+			} else {
+				fmt.Fprintln(os.Stderr, "Error "+entry+" is not banned")
+			}
+		default:
+			fmt.Fprintln(os.Stderr, "Error unknown command "+fields[0]+", must be ban to ban the connected peers, ban <address or nickname>, or unban <address or nickname>")
+		}
+	}
+}
+
+// banPeers bans the connected peers: their public address, or their nickname
+// if they are relayed.
+func banPeers(save func(bans []string)) {
+	activeMu.Lock()
+	var peers []*proxy
+	for p := range activeProxies {
+		if _, connected := p.connectedPeer(); connected {
+			peers = append(peers, p)
+		}
+	}
+	activeMu.Unlock()
+	if len(peers) == 0 {
+		fmt.Fprintln(os.Stderr, "Error no peer is connected, use ban <address or nickname>")
+		return
+	}
+	for _, p := range peers {
+		p.peerMu.Lock()
+		entry := p.peerNickname
+		p.peerMu.Unlock()
+		if ip := p.publicIP(); ip != nil {
+			entry = ip.String()
+		}
+		if entry == "" {
+			p.s.errorln("Error " + p.peerName() + " is relayed and did not send a nickname, it cannot be banned")
+			continue
+		}
+		if saved := addBan(entry); saved != nil {
+			save(saved)
+		}
+		p.s.println("Banned " + p.peerName() + " (" + entry + ")")
+	}
+	kickBanned()
+}
+
+// kickBanned ends the sessions of the banned peers.
+func kickBanned() {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	for p := range activeProxies {
+		p.peerMu.Lock()
+		nickname := p.peerNickname
+		p.peerMu.Unlock()
+		if isBanned(p.publicIP(), nickname) {
+			p.kick("Ending the session of " + p.peerName() + ", who is banned")
+		}
+	}
+}
+
+// publicIP returns the public address of the peer, or nil if it is relayed.
+func (p *proxy) publicIP() net.IP {
+	if p.relayed {
+		return nil
+	}
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	return p.peerAddrs[len(p.peerAddrs)-1].IP
+}
+
+// kick ends the session of a banned or rejected peer, printing message, so
+// that the host waits for other peers.
+func (p *proxy) kick(message string) {
+	p.peerMu.Lock()
+	if p.stalled {
+		p.peerMu.Unlock()
+		return
+	}
+	p.stalled = true
+	p.peerMu.Unlock()
+	p.s.println(message)
+	p.s.setState("waiting for peer")
+	p.interrupt()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// benchTimeout is the time after which outstanding benchmark packets are
+// considered lost.
+const benchTimeout = 1 * time.Second
+
+// benchConn is a connection used by the benchmark endpoints.
+type benchConn interface {
+	packetConn
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+type benchResult struct {
+	sent      int
+	latencies []time.Duration
+	duration  time.Duration
+	allocs    uint64
+}
+
+// benchNetwork creates connections on either the mock network or real
+// loopback sockets.
+type benchNetwork func(port int) (benchConn, *net.UDPAddr, error)
+
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	packets := fs.Int("packets", 100000, "count of packets to send")
+	size := fs.Int("size", 128, "size of packets in bytes")
+	window := fs.Int("window", 32, "maximum count of packets in flight")
+	network := fs.String("net", "both", "network to benchmark: mock, udp, both")
+	fs.BoolVar(&lowLatency, "lowlatency", false, "tune the runtime for latency, as in normal mode")
+	fs.Parse(args)
+
+	if *size < 16 || *size > 4000 {
+		fmt.Fprintln(os.Stderr, "Error invalid packet size, must be between 16 and 4000")
+		return
+	}
+	applyLowLatency()
+
+	fmt.Println("Benchmarking a loopback proxy: " + strconv.Itoa(*packets) + " packets of " + strconv.Itoa(*size) + " bytes, " + strconv.Itoa(*window) + " in flight")
+	if *network == "mock" || *network == "both" {
+		mock := newMockNet()
+		runBench("mock", func(port int) (benchConn, *net.UDPAddr, error) {
+			addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+			return mock.listen(addr), addr, nil
+		}, *packets, *size, *window)
+	}
+	if *network == "udp" || *network == "both" {
+		runBench("udp", func(port int) (benchConn, *net.UDPAddr, error) {
+			c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				return nil, nil, err
+			}
+			setBuffers(c)
+			return c, c.LocalAddr().(*net.UDPAddr), nil
+		}, *packets, *size, *window)
+	}
+}
+
+// runBench measures round trips from a game client to an echoing game
+// server through a client proxy and a server proxy.
+func runBench(name string, listen benchNetwork, packets int, size int, window int) {
+	var conns []benchConn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	var addrs []*net.UDPAddr
+	for i := 0; i < 4; i++ {
+		c, addr, err := listen(20000 + i)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating "+name+" benchmark socket: "+err.Error())
+			return
+		}
+		conns = append(conns, c)
+		addrs = append(addrs, addr)
+	}
+	game, clientProxy, serverProxy, echo := conns[0], conns[1], conns[2], conns[3]
+	clientAddr, serverAddr, echoAddr := addrs[1], addrs[2], addrs[3]
+	relayAddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 14761}
+
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, addr, err := echo.ReadFromUDP(buffer)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			echo.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+	for _, p := range []*proxy{
+		newProxy(&session{}, clientProxy, relayAddr, []*net.UDPAddr{serverAddr}, nil, 0),
+		newProxy(&session{}, serverProxy, relayAddr, []*net.UDPAddr{clientAddr}, echoAddr, echoAddr.Port),
+	} {
+		p.foundPeer = true
+		go p.run(make([]byte, 4096))
+	}
+
+	result := measure(game, clientAddr, packets, size, window)
+	printBench(name, result, size)
+}
+
+func measure(c benchConn, addr *net.UDPAddr, packets int, size int, window int) benchResult {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	allocs := stats.Mallocs
+
+	start := time.Now()
+	slots := make(chan struct{}, window)
+	done := make(chan struct{})
+	latencies := make([]time.Duration, 0, packets)
+	go func() {
+		defer close(done)
+		buffer := make([]byte, 4096)
+		for len(latencies) < packets {
+			c.SetReadDeadline(time.Now().Add(benchTimeout))
+			n, _, err := c.ReadFromUDP(buffer)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			if n < 16 {
+				continue
+			}
+			sent := time.Duration(binary.BigEndian.Uint64(buffer[8:16]))
+			latencies = append(latencies, time.Since(start)-sent)
+			<-slots
+		}
+	}()
+
+	sent := 0
+	payload := make([]byte, size)
+send:
+	for ; sent < packets; sent++ {
+		select {
+		case slots <- struct{}{}:
+		case <-done:
+			break send
+		}
+		binary.BigEndian.PutUint64(payload[:8], uint64(sent))
+		binary.BigEndian.PutUint64(payload[8:16], uint64(time.Since(start)))
+		c.WriteToUDP(payload, addr)
+	}
+	<-done
+	duration := time.Since(start)
+
+	runtime.ReadMemStats(&stats)
+	return benchResult{
+		sent:      sent,
+		latencies: latencies,
+		duration:  duration,
+		allocs:    stats.Mallocs - allocs,
+	}
+}
+
+func printBench(name string, r benchResult, size int) {
+	received := len(r.latencies)
+	fmt.Println(name + ": received " + strconv.Itoa(received) + "/" + strconv.Itoa(r.sent) + " packets in " + r.duration.Round(time.Millisecond).String())
+	if received == 0 {
+		return
+	}
+	// when packets were lost, the duration includes the final timeout
+	duration := r.duration
+	if received < r.sent {
+		duration -= benchTimeout
+	}
+	rate := float64(received) / duration.Seconds()
+	fmt.Println("  throughput: " + strconv.FormatFloat(rate, 'f', 0, 64) + " round trips/s, " + strconv.FormatFloat(rate*float64(size)/1e6, 'f', 2, 64) + " MB/s each way")
+	sort.Slice(r.latencies, func(i, j int) bool {
+		return r.latencies[i] < r.latencies[j]
+	})
+	percentile := func(p int) string {
+		return r.latencies[(received-1)*p/100].String()
+	}
+	fmt.Println("  latency: p50 " + percentile(50) + ", p90 " + percentile(90) + ", p99 " + percentile(99) + ", max " + percentile(100))
+	fmt.Println("  allocations: " + strconv.FormatFloat(float64(r.allocs)/float64(received), 'f', 1, 64) + " per round trip (whole process)")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// botWarnDelay is the delay after which the bot warns that the host's game
+// has not answered yet.
+const botWarnDelay = 15 * time.Second
+
+// botGame describes the client side of a game connection handshake.
+type botGame struct {
+	// hello returns the first packet a client sends to connect to the host
+	// at target.
+	hello func(target *net.UDPAddr) []byte
+	// accepted returns whether a packet from the host accepts the connection.
+	accepted func(data []byte) bool
+}
+
+const (
+	sokuHello = 0x01
+	sokuOlleh = 0x03
+)
+
+var botGames = map[string]botGame{
+	"soku": {
+		hello: func(target *net.UDPAddr) []byte {
+			hello := make([]byte, 37)
+			hello[0] = sokuHello
+			putSockaddr(hello[1:17], target)
+			putSockaddr(hello[17:33], target)
+			return hello
+		},
+		accepted: func(data []byte) bool {
+			return len(data) > 0 && data[0] == sokuOlleh
+		},
+	},
+	"none": {},
+}
+
+// putSockaddr writes addr as a Windows IPv4 sockaddr_in.
+func putSockaddr(b []byte, addr *net.UDPAddr) {
+	binary.LittleEndian.PutUint16(b[0:2], 2) // AF_INET
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[4:8], addr.IP.To4())
+}
+
+func bot(args []string) {
+	var names []string
+	for name := range botGames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fs := flag.NewFlagSet("bot", flag.ExitOnError)
+	game := fs.String("game", "none", "game handshake to simulate: "+strings.Join(names, ", "))
+	host := fs.String("host", "", "host to connect to: ipv4 or ipv6 or hostname")
+	port := fs.Int("port", 0, "port the host is hosting on")
+	fs.Parse(args)
+
+	g, ok := botGames[*game]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Error unknown game "+*game+", must be one of: "+strings.Join(names, ", "))
+		return
+	}
+	if *host == "" || *port <= 0 || *port > 65535 {
+		fmt.Fprintln(os.Stderr, "Error the bot needs the -host and -port of the host to connect to")
+		return
+	}
+
+	c := listenProxy(&session{})
+	defer c.Close()
+	fmt.Println("Bot connecting to " + net.JoinHostPort(*host, strconv.Itoa(*port)) + " as a remote peer...")
+	go runClient(&session{}, c, *host, *port)
+
+	if g.hello == nil {
+		fmt.Println("No game handshake to simulate: the bot will only connect to the host's proxypunch and idle.")
+		select {}
+	}
+
+	// the bot plays the game client, connecting to the local client proxy
+	target := &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: c.LocalAddr().(*net.UDPAddr).Port,
+	}
+	gc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: target.IP})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating bot game socket: "+err.Error())
+		return
+	}
+	defer gc.Close()
+
+	hello := g.hello(target)
+	start := time.Now()
+	warned := false
+	buffer := make([]byte, 4096)
+	for {
+		gc.WriteToUDP(hello, target)
+		gc.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, _, err := gc.ReadFromUDP(buffer)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Fprintln(os.Stderr, "Error reading from bot game socket: "+err.Error())
+				return
+			}
+			if !warned && time.Since(start) > botWarnDelay {
+				warned = true
+				fmt.Println("The host's game has not answered yet: check that it is hosting on port " + strconv.Itoa(*port) + " and that proxypunch is running in server mode.")
+			}
+			continue
+		}
+		if g.accepted(buffer[:n]) {
+			break
+		}
+	}
+	fmt.Println("The host's game accepted the bot's connection: the host setup works! The bot will now idle, close it when you are done.")
+	select {}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bridge lists the LAN discovery traffic bridged with the peer, separated by
+// commas: ports of broadcasts, or multicast group:port.
+var bridge string
+
+// bridgeAddrs are the parsed destinations of the bridged discovery traffic.
+var bridgeAddrs []*net.UDPAddr
+
+// maxSent bounds the count of recently emitted packets remembered by a bridge.
+const maxSent = 64
+
+// echoWindow is how long a packet emitted by a bridge is recognized when it
+// comes back to the bridge, so that it is not sent back to the peer.
+const echoWindow = 1 * time.Second
+
+// lanBridge relays the discovery packets of a port between the local network
+// and the peer: packets received locally on its port are sent to the peer,
+// and packets of the peer are broadcast (or multicast) locally on its port.
+type lanBridge struct {
+	c    *net.UDPConn
+	dest *net.UDPAddr
+
+	mu sync.Mutex
+	// sent holds the recently emitted packets, which come back to the bridge.
+	sent []sentPacket
+}
+
+type sentPacket struct {
+	data []byte
+	time time.Time
+}
+
+func applyBridge() error {
+	if bridge == "" {
+		return nil
+	}
+	for _, v := range strings.Split(bridge, ",") {
+		v = strings.TrimSpace(v)
+		if port, err := strconv.Atoi(v); err == nil {
+			if port <= 0 || port > 65535 {
+				return errors.New("invalid bridge port " + v)
+			}
+			bridgeAddrs = append(bridgeAddrs, &net.UDPAddr{IP: net.IPv4bcast, Port: port})
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp4", v)
+		if err != nil || !addr.IP.IsMulticast() || addr.Port == 0 {
+			return errors.New("invalid bridge " + v + ", must be a port or a multicast group:port")
+		}
+		bridgeAddrs = append(bridgeAddrs, addr)
+	}
+	return nil
+}
+
+// openBridges opens the configured bridges, reporting those that could not
+// be opened.
+func openBridges(s *session) []*lanBridge {
+	var bridges []*lanBridge
+	for _, addr := range bridgeAddrs {
+		var c *net.UDPConn
+		var err error
+		if addr.IP.IsMulticast() {
+			c, err = net.ListenMulticastUDP("udp4", nil, addr)
+		} else {
+			// share the port with games listening for discovery packets
+			lc := net.ListenConfig{Control: reuseControl}
+			var pc net.PacketConn
+			pc, err = lc.ListenPacket(context.Background(), "udp4", ":"+strconv.Itoa(addr.Port))
+			if err == nil {
+				c = pc.(*net.UDPConn)
+			}
+		}
+		if err != nil {
+			s.errorln("Error bridging discovery packets on " + addr.String() + ": " + err.Error())
+			continue
+		}
+		s.println("Bridging discovery packets on " + addr.String() + " with the peer")
+		bridges = append(bridges, &lanBridge{
+			c:    c,
+			dest: addr,
+		})
+	}
+	return bridges
+}
+
+// emit sends a packet of the peer on the local network.
+func (b *lanBridge) emit(data []byte) {
+	now := time.Now()
+	b.mu.Lock()
+	b.sent = b.expired(now)
+	if len(b.sent) >= maxSent {
+		b.sent = b.sent[1:]
+	}
+	b.sent = append(b.sent, sentPacket{
+		data: append([]byte(nil), data...),
+		time: now,
+	})
+	b.mu.Unlock()
+	if _, err := b.c.WriteToUDP(data, b.dest); err != nil && !b.dest.IP.IsMulticast() {
+		// no broadcast route, at least reach the games of this host
+		b.c.WriteToUDP(data, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.dest.Port})
+	}
+}
+
+// echo returns whether data is a packet recently emitted by the bridge.
+func (b *lanBridge) echo(data []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = b.expired(time.Now())
+	for i, v := range b.sent {
+		if bytes.Equal(v.data, data) {
+			b.sent = append(b.sent[:i], b.sent[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// expired returns sent without the packets older than echoWindow.
+func (b *lanBridge) expired(now time.Time) []sentPacket {
+	i := 0
+	for i < len(b.sent) && now.Sub(b.sent[i].time) > echoWindow {
+		i++
+	}
+	return b.sent[i:]
+}
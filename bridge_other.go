@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// reuseControl does nothing on this platform: games cannot bind the port of
+// a bridge, and TCP punching only works if the peer connects first.
+func reuseControl(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"syscall"
+)
+
+// reuseControl lets games bind the port of a bridge too, and TCP punching
+// connect from the port it listens on.
+func reuseControl(network string, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	return err
+}
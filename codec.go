@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// compress is set with -compress: the game packets sent to the peer are
+// compressed when it makes them smaller, if the peer supports it.
+var compress bool
+
+// Packet codecs a peer decodes, announced with typeCodecs along with its
+// nickname; a peer only encodes the packets it sends with the codecs the
+// other peer announced.
+const (
+	// codecCompress is the typeCompressed packets.
+	codecCompress uint32 = 1 << iota
+	// codecFec is the typeFec packets.
+	codecFec
+	// codecRedundant is the typeRedundant packets.
+	codecRedundant
+	// codecIntegrity is the typeChecked packets.
+	codecIntegrity
+	// codecOrdered is the typeOrdered packets, only announced with -reorder,
+	// which needs them.
+	codecOrdered
+)
+
+// supportedCodecs are the codecs this proxypunch decodes.
+const supportedCodecs = codecCompress | codecFec | codecRedundant | codecIntegrity
+
+// maxPacket bounds the size of decoded packets.
+const maxPacket = 65536
+
+// flateWriters are the reusable compressors of typeCompressed packets.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// codecsMessage returns the typeCodecs message announcing the codecs this
+// proxypunch decodes.
+func codecsMessage() []byte {
+	codecs := supportedCodecs
+	if reorder > 0 {
+		codecs |= codecOrdered
+	}
+	return []byte{typeCodecs, byte(codecs >> 24), byte(codecs >> 16), byte(codecs >> 8), byte(codecs)}
+}
+
+// codecsAnnounced records the codecs the peer decodes, from its typeCodecs
+// message.
+func (p *proxy) codecsAnnounced(data []byte) {
+	if len(data) != 5 {
+		return
+	}
+	codecs := uint32(data[1])<<24 | uint32(data[2])<<16 | uint32(data[3])<<8 | uint32(data[4])
+	if atomic.SwapUint32(&p.peerCodecs, codecs) != codecs && compress && codecs&codecCompress != 0 {
+		p.s.println("Compressing the game traffic sent to " + p.peerName())
+	}
+}
+
+// peerDecodes returns whether the peer announced that it decodes codec.
+func (p *proxy) peerDecodes(codec uint32) bool {
+	return atomic.LoadUint32(&p.peerCodecs)&codec != 0
+}
+
+// compressPacket returns the typeCompressed packet of the packet, or the
+// packet itself if compressing it does not make it smaller.
+func compressPacket(packet []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(typeCompressed)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&b)
+	w.Write(packet)
+	w.Close()
+	if b.Len() >= len(packet) {
+		return packet
+	}
+	return b.Bytes()
+}
+
+// decompressPacket returns the packet compressed in the typeCompressed packet
+// data, or nil if invalid.
+func decompressPacket(data []byte) []byte {
+	r := flate.NewReader(bytes.NewReader(data[1:]))
+	defer r.Close()
+	packet, err := io.ReadAll(io.LimitReader(r, maxPacket+1))
+	if err != nil || len(packet) == 0 || len(packet) > maxPacket {
+		return nil
+	}
+	return packet
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// codeMagic prefixes the connect code messages exchanged with the relay,
+// followed by an operation byte:
+//   - codeRequest: port, flags, padded to codeRequestSize
+//   - codeAllocated: code
+//   - codeLookup: code, padded to codeRequestSize
+//   - codeFound: status, IP, port, flags
+//
+// Codes are prefixed with their length on one byte. The relay gives a host a
+// short code such as BLUE-FOX-41 pointing to its public IP and port, which it
+// keeps while it requests it again. The flags tell peers looking the code up
+// whether the host requires a password.
+const codeMagic = "PPK1"
+
+const (
+	codeRequest   = 0x01
+	codeAllocated = 0x02
+	codeLookup    = 0x03
+	codeFound     = 0x04
+)
+
+// codeOk is the status of a found code.
+const codeOk = 0x00
+
+// codePassword is the flag of hosts requiring a password.
+const codePassword = 0x01
+
+// codeRequestSize is the size of the requests, excluding the magic.
+const codeRequestSize = 32
+
+// codeInterval is the interval at which the code of the host is requested
+// again while hosting.
+const codeInterval = 5 * time.Second
+
+// isCode returns whether host is a connect code: two words and two digits,
+// separated by dashes.
+func isCode(host string) bool {
+	if len(host) > codeRequestSize-1 {
+		return false
+	}
+	parts := strings.Split(host, "-")
+	if len(parts) != 3 || len(parts[2]) != 2 {
+		return false
+	}
+	for _, part := range parts[:2] {
+		if part == "" {
+			return false
+		}
+		for _, r := range strings.ToLower(part) {
+			if r < 'a' || r > 'z' {
+				return false
+			}
+		}
+	}
+	_, err := strconv.Atoi(parts[2])
+	return err == nil
+}
+
+// requestCode requests the connect code of the session hosted on port from
+// the relay until done is closed, printing it once known.
+func requestCode(s *session, relayAddr *net.UDPAddr, port int, done chan struct{}) {
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	var flags byte
+	if password != "" {
+		flags |= codePassword
+	}
+	request := append([]byte(codeMagic), codeRequest, byte(port>>8), byte(port), flags)
+	request = append(request, make([]byte, len(codeMagic)+1+codeRequestSize-len(request))...)
+	buffer := make([]byte, 64)
+	code := ""
+	for {
+		c.Write(request)
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := c.Read(buffer)
+		if err == nil && n > 6 && string(buffer[:4]) == codeMagic && buffer[4] == codeAllocated && n == 6+int(buffer[5]) && string(buffer[6:n]) != code {
+			code = string(buffer[6:n])
+			if password != "" {
+				s.println("Code: " + code + " (your peer can enter it instead of your address, with your password)")
+			} else {
+				s.println("Code: " + code + " (your peer can enter it instead of your address)")
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(codeInterval):
+		}
+	}
+}
+
+// resolveCode resolves a connect code to the host and port it points to, on
+// the relays of relayChoices, and sets the relay of the session to the relay
+// of the code.
+func resolveCode(s *session, code string) (string, int, error) {
+	code = strings.ToUpper(code)
+	waitRelays()
+	for _, choice := range relayChoices {
+		s.relay = choice
+		relayAddr, err := resolveRelay(s)
+		if err != nil {
+			continue
+		}
+		if err := pinRelay(s, relayAddr); err != nil {
+			s.errorln("Error " + err.Error())
+			continue
+		}
+		if err := authenticateRelay(s, relayAddr, nil); err != nil {
+			continue
+		}
+		ip, port, flags, err := lookupCode(relayAddr, code)
+		if err != nil {
+			continue
+		}
+		if flags&codePassword != 0 && password == "" {
+			return "", 0, errors.New("the host of code " + code + " requires a password: ask the host for it, and restart proxypunch with -password")
+		}
+		s.println("Resolved code " + code + " to " + ip.String() + " on port " + strconv.Itoa(port))
+		return ip.String(), port, nil
+	}
+	s.relay = ""
+	return "", 0, errors.New("code " + code + " is not hosting right now, check it with the host")
+}
+
+// lookupCode looks code up on the relay, returning the address of its host
+// and its flags.
+func lookupCode(relayAddr *net.UDPAddr, code string) (net.IP, int, byte, error) {
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer c.Close()
+	request := append([]byte(codeMagic), codeLookup, byte(len(code)))
+	request = append(request, code...)
+	request = append(request, make([]byte, len(codeMagic)+1+codeRequestSize-len(request))...)
+	request = sealRelay(request, relayAddr)
+	buffer := make([]byte, 64)
+	for try := 0; try < 3; try++ {
+		if _, err := c.Write(request); err != nil {
+			return nil, 0, 0, err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for {
+			n, err := c.Read(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			b := openRelay(buffer[:n], relayAddr)
+			if len(b) != 13 || string(b[:4]) != codeMagic || b[4] != codeFound {
+				continue
+			}
+			if b[5] != codeOk {
+				return nil, 0, 0, errors.New("code not found")
+			}
+			return net.IPv4(b[6], b[7], b[8], b[9]), int(binary.BigEndian.Uint16(b[10:12])), b[12], nil
+		}
+	}
+	return nil, 0, 0, errors.New("no answer from the relay")
+}
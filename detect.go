@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// stunFilterServer is a public STUN server that answers from another address
+// or port on request (RFC 5780), to find how the NAT filters incoming packets.
+const stunFilterServer = "stun.stunprotocol.org:3478"
+
+// detectSockets is the count of sockets the relay is probed from, to find how
+// the NAT allocates ports.
+const detectSockets = 3
+
+// cgnatNet is the shared address space of carrier-grade NATs (RFC 6598).
+var cgnatNet = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type natType int
+
+const (
+	natUnknown natType = iota
+	natNone
+	natFullCone
+	natRestricted
+	natPortRestricted
+	natSymmetric
+)
+
+var natTypes = []natType{natNone, natFullCone, natRestricted, natPortRestricted, natSymmetric}
+
+func (t natType) String() string {
+	switch t {
+	case natNone:
+		return "no NAT"
+	case natFullCone:
+		return "full cone NAT"
+	case natRestricted:
+		return "restricted cone NAT"
+	case natPortRestricted:
+		return "port-restricted cone NAT"
+	case natSymmetric:
+		return "symmetric NAT"
+	}
+	return "unknown NAT"
+}
+
+// punchOutcome tells whether punching between a host behind own and a peer
+// behind peer is expected to work.
+func punchOutcome(own natType, peer natType) string {
+	if own == natUnknown || peer == natUnknown {
+		return "unknown"
+	}
+	// a host that accepts packets from any address is reached by any peer
+	if own == natNone || own == natFullCone || peer == natNone || peer == natFullCone {
+		return "works"
+	}
+	if own != natSymmetric && peer != natSymmetric {
+		return "works"
+	}
+	if own == natSymmetric && peer == natSymmetric {
+		return "fails: use -private to play through the relay, or forward UDP port " + strconv.Itoa(defaultPort) + " on your router"
+	}
+	// a restricted cone learns the port of the symmetric peer from its first
+	// packet; a port-restricted cone must guess it
+	if own == natRestricted || peer == natRestricted {
+		return "works"
+	}
+	return "may work, with port prediction: otherwise use -private, or forward UDP port " + strconv.Itoa(defaultPort) + " on your router"
+}
+
+// detect probes the relay and public STUN servers to find the NAT type of
+// this host, and whether punching works with each peer NAT type.
+func detect(args []string) {
+	fs := flag.NewFlagSet("detect", flag.ExitOnError)
+	configFile := fs.String("config", "proxypunch.yml", "read the relay from file")
+	fs.StringVar(&relay, "relay", "", "relay host, optionally with its port (default: relay: in the configuration file, or "+relayHost+")")
+	fs.Parse(args)
+	applyConfig(loadConfig(*configFile))
+
+	s := &session{}
+	relayAddr, err := resolveRelay(s)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error resolving relay: "+err.Error())
+		return
+	}
+	stunAddr, err := net.ResolveUDPAddr("udp4", stunServer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error resolving STUN server: "+err.Error())
+		stunAddr = nil
+	}
+	fmt.Println("Probing relay " + relayName(s) + " from " + strconv.Itoa(detectSockets) + " sockets...")
+
+	var local, public net.IP
+	var relayPorts []int
+	t := natUnknown
+	preserved := true
+	for i := 0; i < detectSockets; i++ {
+		c, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating socket: "+err.Error())
+			return
+		}
+		localAddr := localCandidate(c, relayAddr)
+		mapped, err := relayMapped(c, relayAddr)
+		if err != nil {
+			c.Close()
+			fmt.Fprintln(os.Stderr, "Error relay "+relayName(s)+" is not answering ("+err.Error()+"): check your internet connection, or that UDP is not blocked on this network")
+			return
+		}
+		var seen *net.UDPAddr
+		if stunAddr != nil {
+			seen, _ = stunBinding(c, stunAddr)
+		}
+		c.Close()
+
+		fmt.Println("  socket " + strconv.Itoa(i+1) + ": relay saw " + mapped.String() + ", STUN server saw " + addrString(seen))
+		relayPorts = append(relayPorts, mapped.Port)
+		public = mapped.IP
+		if localAddr != nil {
+			local = localAddr.IP
+			if localAddr.Port != mapped.Port {
+				preserved = false
+			}
+			if local.Equal(mapped.IP) {
+				t = natNone
+			}
+		}
+		if t == natNone || seen == nil {
+			continue
+		}
+		if !seen.IP.Equal(mapped.IP) || seen.Port != mapped.Port {
+			t = natSymmetric
+		} else if t == natUnknown {
+			t = natPortRestricted
+		}
+	}
+	if t == natPortRestricted {
+		fmt.Println("Probing how your NAT filters incoming packets with " + stunFilterServer + "...")
+		t = detectFiltering()
+	}
+
+	fmt.Println()
+	fmt.Println("NAT type: " + t.String())
+	if t == natUnknown {
+		fmt.Println("You are behind a NAT, but the STUN servers did not answer: check that UDP is not blocked on this network")
+	} else if t != natNone {
+		if preserved {
+			fmt.Println("Port allocation: your NAT keeps the local port of sockets as public port")
+		} else if delta, ok := sequential(relayPorts); ok {
+			fmt.Println("Port allocation: your NAT allocates public ports sequentially (step " + strconv.Itoa(delta) + "), which helps port prediction")
+		} else {
+			fmt.Println("Port allocation: your NAT does not allocate public ports sequentially, port prediction rarely works")
+		}
+	}
+	if t != natNone {
+		fmt.Println("Asking your router for its WAN address...")
+		for _, line := range diagnoseNat(local, public).report() {
+			fmt.Println(line)
+		}
+	}
+	fmt.Println()
+	fmt.Println("Punching with a peer behind:")
+	for _, v := range natTypes {
+		fmt.Println("  " + v.String() + ": " + punchOutcome(t, v))
+	}
+}
+
+// detectFiltering finds the filtering of a NAT with endpoint-independent
+// mapping, by asking the STUN server to answer from another address, then
+// from another port.
+func detectFiltering() natType {
+	addr, err := net.ResolveUDPAddr("udp4", stunFilterServer)
+	if err != nil {
+		return natUnknown
+	}
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return natUnknown
+	}
+	defer c.Close()
+	b, err := stunChange(c, addr, 0)
+	if err != nil || !stunHasAttr(b, 0x802C) && !stunHasAttr(b, 0x0005) {
+		// no OTHER-ADDRESS nor CHANGED-ADDRESS: cannot answer from elsewhere
+		return natUnknown
+	}
+	if _, err := stunChange(c, addr, 0x06); err == nil {
+		return natFullCone
+	}
+	if _, err := stunChange(c, addr, 0x02); err == nil {
+		return natRestricted
+	}
+	return natPortRestricted
+}
+
+// stunChange sends a STUN binding request with a CHANGE-REQUEST attribute of
+// flags (0x04: change IP, 0x02: change port), and returns the response, from
+// any address.
+func stunChange(c *net.UDPConn, addr *net.UDPAddr, flags uint32) ([]byte, error) {
+	request := stunRequest()
+	binary.BigEndian.PutUint16(request[2:4], 8)
+	attr := make([]byte, 8)
+	binary.BigEndian.PutUint16(attr[0:2], 0x0003)
+	binary.BigEndian.PutUint16(attr[2:4], 4)
+	binary.BigEndian.PutUint32(attr[4:8], flags)
+	request = append(request, attr...)
+	buffer := make([]byte, 512)
+	for try := 0; try < 3; try++ {
+		if _, err := c.WriteToUDP(request, addr); err != nil {
+			return nil, err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for {
+			n, _, err := c.ReadFromUDP(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if stunMapped(buffer[:n], request[8:20]) != nil {
+				return buffer[:n], nil
+			}
+		}
+	}
+	return nil, errors.New("no answer from " + addr.String())
+}
+
+// stunHasAttr returns whether the STUN message b has an attribute of type t.
+func stunHasAttr(b []byte, t uint16) bool {
+	attrs := b[20:]
+	for len(attrs) >= 4 {
+		l := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if binary.BigEndian.Uint16(attrs[0:2]) == t {
+			return true
+		}
+		if len(attrs) < 4+(l+3)/4*4 {
+			return false
+		}
+		attrs = attrs[4+(l+3)/4*4:]
+	}
+	return false
+}
+
+// sequential returns the step between consecutive ports, if constant.
+func sequential(ports []int) (int, bool) {
+	if len(ports) < 2 {
+		return 0, false
+	}
+	delta := ports[1] - ports[0]
+	for i := 2; i < len(ports); i++ {
+		if ports[i]-ports[i-1] != delta {
+			return 0, false
+		}
+	}
+	return delta, delta > 0 && delta <= 16
+}
+
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return "nothing (no answer)"
+	}
+	return addr.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dscp is the DSCP class set with -dscp on the packets sent from the proxy
+// socket, so that routers with QoS enabled prioritize them: a name such as EF
+// or CS4, or a value from 0 to 63; empty leaves the system default.
+var dscp string
+
+// parseDscp returns the value of the DSCP class v.
+func parseDscp(v string) (int, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 || n > 63 {
+			return 0, errors.New("invalid DSCP value " + v + ", must be between 0 and 63")
+		}
+		return n, nil
+	}
+	switch {
+	case v == "EF":
+		return 46, nil
+	case len(v) == 3 && strings.HasPrefix(v, "CS") && v[2] >= '0' && v[2] <= '7':
+		return int(v[2]-'0') << 3, nil
+	case len(v) == 4 && strings.HasPrefix(v, "AF") && v[2] >= '1' && v[2] <= '4' && v[3] >= '1' && v[3] <= '3':
+		return int(v[2]-'0')<<3 | int(v[3]-'0')<<1, nil
+	}
+	return 0, errors.New("invalid DSCP class " + v + ", must be EF, CS0 to CS7, AF11 to AF43, or a value between 0 and 63")
+}
+
+func applyDscp() error {
+	if dscp == "" {
+		return nil
+	}
+	_, err := parseDscp(dscp)
+	return err
+}
+
+// markSocket sets the DSCP class of -dscp on the packets sent from c.
+func markSocket(s *session, c *net.UDPConn) {
+	if dscp == "" {
+		return
+	}
+	v, err := parseDscp(dscp)
+	if err == nil {
+		err = setDscp(c, v)
+	}
+	if err != nil {
+		s.errorln("Error setting the DSCP class of the proxy socket: " + err.Error())
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDscp sets the DSCP class of the IPv4 and IPv6 packets sent from c.
+func setDscp(c *net.UDPConn, v int) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var err4, err6 error
+	err = rc.Control(func(fd uintptr) {
+		err4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, v<<2)
+		err6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, v<<2)
+	})
+	if err != nil {
+		return err
+	}
+	if err4 != nil && err6 != nil {
+		// IPv4-only sockets reject IPV6_TCLASS
+		return err4
+	}
+	return nil
+}
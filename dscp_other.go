@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setDscp fails: the DSCP class is not set on this platform.
+func setDscp(c *net.UDPConn, v int) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setDscp fails: Windows ignores the DSCP class set by applications.
+func setDscp(c *net.UDPConn, v int) error {
+	return errors.New("not supported on Windows, add a QoS policy for proxypunch in the Local Group Policy Editor instead")
+}
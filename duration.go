@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// duration is the time after which proxypunch stops, 0 to run indefinitely.
+var duration time.Duration
+
+// durationWarning is how long before stopping the users and peers are
+// warned.
+const durationWarning = 5 * time.Minute
+
+// activeMu protects activeProxies, the running proxies, whose peers are
+// notified when stopping.
+var activeMu sync.Mutex
+var activeProxies = make(map[*proxy]struct{})
+
+func addActive(p *proxy) {
+	activeMu.Lock()
+	activeProxies[p] = struct{}{}
+	activeMu.Unlock()
+}
+
+func removeActive(p *proxy) {
+	activeMu.Lock()
+	delete(activeProxies, p)
+	activeMu.Unlock()
+}
+
+// limitDuration stops proxypunch once duration has elapsed, warning the
+// user and the peers durationWarning before.
+func limitDuration() {
+	if duration <= 0 {
+		return
+	}
+	if duration > durationWarning {
+		time.Sleep(duration - durationWarning)
+		fmt.Println(timestamp() + "proxypunch will stop in " + durationWarning.String() + " (time limit of " + duration.String() + " set with -duration)")
+		notifyPeers(durationWarning)
+		time.Sleep(durationWarning)
+	} else {
+		time.Sleep(duration)
+	}
+	fmt.Println(timestamp() + "Time limit of " + duration.String() + " reached, stopping proxypunch")
+	notifyPeers(0)
+	os.Exit(0)
+}
+
+// notifyPeers tells the connected peers that the session ends in remaining,
+// and ends the sessions if remaining is 0.
+func notifyPeers(remaining time.Duration) {
+	notice := make([]byte, 5)
+	notice[0] = typeClosing
+	binary.BigEndian.PutUint32(notice[1:], uint32(remaining/time.Second))
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	for p := range activeProxies {
+		peer, ok := p.connectedPeer()
+		if !ok {
+			continue
+		}
+		// the notice bypasses the queues, send it a few times in case of loss
+		for i := 0; i < 3; i++ {
+			p.c.WriteToUDP(notice, peer)
+		}
+		if remaining == 0 {
+			p.recordStats(true)
+			p.close()
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// encrypt is set with -encrypt: the game traffic exchanged with the peer is
+// encrypted, and not forwarded until the peer agreed on keys.
+var encrypt bool
+
+// Flags of typeKey messages.
+const (
+	// keyReceived is set when the sender has the key of the receiver.
+	keyReceived = 0x01
+	// keyEstablished is set when the sender also knows that the receiver
+	// has its key, and needs no answer.
+	keyEstablished = 0x02
+)
+
+// keyWarnAfter is the count of typeKey messages sent without answer after
+// which the peer is assumed not to support -encrypt.
+const keyWarnAfter = 5
+
+// keyWindow is the count of sealed packets older than the latest one that
+// are still accepted, if not received yet.
+const keyWindow = 64
+
+// peerCrypt encrypts the game packets exchanged with the peer: each side
+// sends its ephemeral X25519 public key with typeKey, along with flags, until
+// both know they have the key of the other, and answers the typeKey messages
+// of a peer that does not know it yet. A peer wanting encryption starts the
+// exchange; any peer answers it. The key of each direction is the
+// HMAC-SHA256 of "proxypunch encrypt", a zero byte, the public key of the
+// sender, the public key of the receiver and the join secret, keyed with the
+// X25519 shared secret: with a password or token, a peer in the middle cannot
+// complete the exchange without it; without either, the keys are not
+// authenticated, and a peer in the middle can exchange its own with both. The
+// first key of the peer is kept for the session, later ones are ignored.
+// Game packets are then sent as typeSealed: a counter (8 bytes), then the
+// packet sealed with AES-256-GCM, whose nonce is the counter. This exchange
+// is specific to proxypunch, not an established protocol such as Noise.
+type peerCrypt struct {
+	mu     sync.Mutex
+	secret []byte
+	key    *ecdh.PrivateKey
+	// wanted is set with -encrypt, or once the peer sent its key.
+	wanted bool
+	// peer is the public key of the peer, nil until received.
+	peer []byte
+	send cipher.AEAD
+	recv cipher.AEAD
+	// ready is set once the peer has our key.
+	ready    bool
+	counter  uint64
+	received uint64
+	window   uint64
+	// unanswered is the count of typeKey messages sent since the last one
+	// received.
+	unanswered int
+	warned     bool
+	reported   bool
+}
+
+// newPeerCrypt returns the encryption state of a session; secret is the
+// join secret, nil if none.
+func newPeerCrypt(secret []byte) (*peerCrypt, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &peerCrypt{
+		secret: secret,
+		key:    key,
+		wanted: encrypt,
+	}, nil
+}
+
+// encrypted returns whether the game packets of the peer must be sealed,
+// with -encrypt or once the peer sent its key.
+func (pc *peerCrypt) encrypted() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.wanted
+}
+
+// established returns whether game packets are encrypted.
+func (pc *peerCrypt) established() bool {
+	return pc.peer != nil && pc.ready
+}
+
+func (pc *peerCrypt) keyMessage() []byte {
+	var flags byte
+	if pc.peer != nil {
+		flags |= keyReceived
+	}
+	if pc.established() {
+		flags |= keyEstablished
+	}
+	b := append([]byte{typeKey}, pc.key.PublicKey().Bytes()...)
+	return append(b, flags)
+}
+
+// pending returns the typeKey message to send to the peer until keys are
+// established, or nil, and whether the peer should now be reported as not
+// supporting -encrypt.
+func (pc *peerCrypt) pending() ([]byte, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.wanted || pc.established() {
+		return nil, false
+	}
+	pc.unanswered++
+	warn := pc.unanswered > keyWarnAfter && pc.peer == nil && !pc.warned
+	if warn {
+		pc.warned = true
+	}
+	return pc.keyMessage(), warn
+}
+
+// receivedKey handles a typeKey message from the peer, excluding its type,
+// returning the message to answer it with, or nil, and whether keys were
+// just established.
+func (pc *peerCrypt) receivedKey(data []byte) ([]byte, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if len(data) != 32+1 {
+		return nil, false
+	}
+	public, flags := data[:32], data[32]
+	if pc.peer != nil && string(public) != string(pc.peer) {
+		// the first key of the peer is pinned for the session, so that a
+		// spoofed key cannot replace it
+		return nil, false
+	}
+	pc.wanted = true
+	pc.unanswered = 0
+	if pc.peer == nil {
+		peerKey, err := ecdh.X25519().NewPublicKey(public)
+		if err != nil {
+			return nil, false
+		}
+		shared, err := pc.key.ECDH(peerKey)
+		if err != nil {
+			return nil, false
+		}
+		own := pc.key.PublicKey().Bytes()
+		send, err := peerCipher(shared, own, public, pc.secret)
+		if err != nil {
+			return nil, false
+		}
+		recv, err := peerCipher(shared, public, own, pc.secret)
+		if err != nil {
+			return nil, false
+		}
+		pc.peer = append([]byte(nil), public...)
+		pc.send, pc.recv = send, recv
+	}
+	pc.ready = flags&keyReceived != 0
+	established := pc.established() && !pc.reported
+	if established {
+		pc.reported = true
+	}
+	if flags&keyEstablished != 0 {
+		return nil, established
+	}
+	return pc.keyMessage(), established
+}
+
+// peerCipher returns the cipher of the packets from the peer of public key
+// sender to the peer of public key receiver.
+func peerCipher(shared []byte, sender []byte, receiver []byte, secret []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, shared)
+	m.Write([]byte("proxypunch encrypt\x00"))
+	m.Write(sender)
+	m.Write(receiver)
+	m.Write(secret)
+	block, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the game packet to send to the peer: sealed once keys are
+// established, as is if encryption is not wanted, or nil to drop it until
+// keys are established.
+func (pc *peerCrypt) seal(packet []byte) []byte {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.established() {
+		if pc.wanted {
+			return nil
+		}
+		return packet
+	}
+	pc.counter++
+	b := make([]byte, 9, 9+len(packet)+pc.send.Overhead())
+	b[0] = typeSealed
+	binary.BigEndian.PutUint64(b[1:9], pc.counter)
+	nonce := make([]byte, pc.send.NonceSize())
+	copy(nonce[len(nonce)-8:], b[1:9])
+	return pc.send.Seal(b, nonce, packet, b[:1])
+}
+
+// open returns the game packet sealed in the typeSealed packet data, or nil
+// if it cannot be opened or was already received.
+func (pc *peerCrypt) open(data []byte) []byte {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.recv == nil || len(data) < 9 {
+		return nil
+	}
+	counter := binary.BigEndian.Uint64(data[1:9])
+	if counter+keyWindow <= pc.received || (counter <= pc.received && pc.window&(1<<(pc.received-counter)) != 0) {
+		return nil
+	}
+	nonce := make([]byte, pc.recv.NonceSize())
+	copy(nonce[len(nonce)-8:], data[1:9])
+	packet, err := pc.recv.Open(nil, nonce, data[9:], data[:1])
+	if err != nil || len(packet) == 0 {
+		return nil
+	}
+	if counter > pc.received {
+		if shift := counter - pc.received; shift < keyWindow {
+			pc.window = pc.window<<shift | 1
+		} else {
+			pc.window = 1
+		}
+		pc.received = counter
+	} else {
+		pc.window |= 1 << (pc.received - counter)
+	}
+	return packet
+}
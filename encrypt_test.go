@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// exchangeKeys runs the typeKey exchange between a and b until neither
+// answers.
+func exchangeKeys(t *testing.T, a *peerCrypt, b *peerCrypt) {
+	t.Helper()
+	msg := a.keyMessage()
+	to, other := b, a
+	for i := 0; msg != nil; i++ {
+		if i > 4 {
+			t.Fatal("the key exchange does not end")
+		}
+		msg, _ = to.receivedKey(msg[1:])
+		to, other = other, to
+	}
+	if !a.established() || !b.established() {
+		t.Fatal("keys not established")
+	}
+}
+
+func newTestCrypt(t *testing.T, secret string) *peerCrypt {
+	t.Helper()
+	pc, err := newPeerCrypt([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func TestPeerCrypt(t *testing.T) {
+	packet := []byte{typeData, 1, 2, 3}
+	tests := []struct {
+		name    string
+		secretA string
+		secretB string
+		// replay opens the sealed packet twice.
+		replay bool
+		opened []bool
+	}{
+		{"round trip", "", "", false, []bool{true}},
+		{"round trip with secret", "secret", "secret", false, []bool{true}},
+		{"replay", "", "", true, []bool{true, false}},
+		{"wrong secret", "secret", "other", false, []bool{false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newTestCrypt(t, tt.secretA), newTestCrypt(t, tt.secretB)
+			exchangeKeys(t, a, b)
+			sealed := a.seal(packet)
+			if sealed == nil || sealed[0] != typeSealed {
+				t.Fatalf("seal = %x, want a typeSealed packet", sealed)
+			}
+			for i, want := range tt.opened {
+				got := b.open(sealed)
+				if (got != nil) != want {
+					t.Fatalf("open %d = %x, want opened %v", i, got, want)
+				}
+				if got != nil && !bytes.Equal(got, packet) {
+					t.Fatalf("open %d = %x, want %x", i, got, packet)
+				}
+			}
+		})
+	}
+}
+
+func TestPeerCryptOutOfOrder(t *testing.T) {
+	a, b := newTestCrypt(t, ""), newTestCrypt(t, "")
+	exchangeKeys(t, a, b)
+	first, second := a.seal([]byte{typeData, 1}), a.seal([]byte{typeData, 2})
+	if b.open(second) == nil || b.open(first) == nil {
+		t.Fatal("packets received out of order were dropped")
+	}
+	if b.open(first) != nil || b.open(second) != nil {
+		t.Fatal("replayed packets were opened")
+	}
+}
+
+func TestPeerCryptWrongKey(t *testing.T) {
+	a, b, c := newTestCrypt(t, ""), newTestCrypt(t, ""), newTestCrypt(t, "")
+	exchangeKeys(t, a, b)
+	other := newTestCrypt(t, "")
+	exchangeKeys(t, c, other)
+	if b.open(c.seal([]byte{typeData, 1})) != nil {
+		t.Fatal("a packet sealed with another key was opened")
+	}
+	// a later key is ignored: the session keeps the first key of the peer
+	if reply, _ := b.receivedKey(c.keyMessage()[1:]); reply != nil {
+		t.Fatalf("answered a new key with %x", reply)
+	}
+	if b.open(a.seal([]byte{typeData, 2})) == nil {
+		t.Fatal("a new key replaced the key of the peer")
+	}
+}
+
+func TestPeerCryptPending(t *testing.T) {
+	a := newTestCrypt(t, "")
+	a.wanted = true
+	if a.seal([]byte{typeData, 1}) != nil {
+		t.Fatal("a packet was sent in clear while encryption is wanted")
+	}
+	b := newTestCrypt(t, "")
+	if got := b.seal([]byte{typeData, 1}); !bytes.Equal(got, []byte{typeData, 1}) {
+		t.Fatalf("seal = %x without encryption, want the packet as is", got)
+	}
+	if b.encrypted() {
+		t.Fatal("encryption wanted without -encrypt")
+	}
+	b.receivedKey(a.keyMessage()[1:])
+	if !b.encrypted() {
+		t.Fatal("encryption not wanted once the peer sent its key")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// multipath is set with -multipath: both address families of the peer are
+// kept alive for the whole session, switching to the other one when the one
+// in use stops answering or becomes slower.
+var multipath bool
+
+// familyPings is the count of path pings answered on each address family of
+// the peer before keeping the faster one.
+const familyPings = 3
+
+// familyRounds is the count of ping intervals spent measuring the address
+// families of the peer, after which the one in use is kept.
+const familyRounds = 10
+
+// multipathMissed is the count of consecutive path pings unanswered on the
+// address family in use after which -multipath switches to the other one.
+const multipathMissed = 3
+
+// multipathMargin is the latency by which the other address family must be
+// faster for -multipath to switch to it.
+const multipathMargin = 10 * time.Millisecond
+
+// familyPaths chooses between the IPv6 and the public IPv4 addresses of a
+// peer that has both: punch packets are sent to both at once and the first
+// one reached is used, then both are measured with typePathPing and the one
+// with the lowest latency is kept, IPv6 on a tie. With -multipath, both are
+// then still measured, and the one in use changes with their loss and
+// latency.
+type familyPaths struct {
+	// v6 and v4 are the indexes of the IPv6 and public IPv4 candidates.
+	v6 int
+	v4 int
+
+	mu     sync.Mutex
+	rounds int
+	// chosen is set once a family was kept, done once path pings stop.
+	chosen bool
+	done   bool
+	// rtt is the lowest round trip time of each family until chosen, then
+	// the smoothed one; samples the count of path pings answered, missed
+	// the count of path pings unanswered since the last answered one.
+	rtt     [2]time.Duration
+	samples [2]int
+	missed  [2]int
+}
+
+// newFamilyPaths returns the familyPaths of the peer candidates, or nil if
+// the peer does not have both an IPv6 and a public IPv4 address, or with
+// -strict, which keeps the address first reached.
+func newFamilyPaths(peerAddrs []*net.UDPAddr) *familyPaths {
+	if strict {
+		return nil
+	}
+	v4 := len(peerAddrs) - 1
+	if v4 < 1 || peerAddrs[v4].IP.To4() == nil {
+		return nil
+	}
+	for i := v4 - 1; i >= 0; i-- {
+		if peerAddrs[i].IP.To4() == nil {
+			return &familyPaths{v6: i, v4: v4}
+		}
+	}
+	return nil
+}
+
+// family returns 0 if the candidate i is the IPv6 address, 1 if it is the
+// public IPv4 address, -1 otherwise.
+func (f *familyPaths) family(i int) int {
+	switch {
+	case f == nil:
+		return -1
+	case i == f.v6:
+		return 0
+	case i == f.v4:
+		return 1
+	}
+	return -1
+}
+
+// measured records the round trip time of a path ping answered on the
+// candidate i while current is in use, and returns the candidate to switch
+// to, or -1, and whether the family was just chosen.
+func (f *familyPaths) measured(i int, current int, rtt time.Duration) (int, bool) {
+	family := f.family(i)
+	if family < 0 {
+		return -1, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return -1, false
+	}
+	f.missed[family] = 0
+	f.samples[family]++
+	if f.chosen {
+		// -multipath
+		if f.samples[family] == 1 {
+			f.rtt[family] = rtt
+		} else {
+			f.rtt[family] = (7*f.rtt[family] + rtt) / 8
+		}
+		used := f.family(current)
+		if used >= 0 && family != used && f.rtt[family]+multipathMargin < f.rtt[used] {
+			return i, false
+		}
+		return -1, false
+	}
+	if f.samples[family] == 1 || rtt < f.rtt[family] {
+		f.rtt[family] = rtt
+	}
+	if f.samples[0] < familyPings || f.samples[1] < familyPings {
+		return -1, false
+	}
+	f.chosen = true
+	f.done = !multipath
+	if f.rtt[1] < f.rtt[0] {
+		return f.v4, true
+	}
+	return f.v6, true
+}
+
+// candidate returns the index of the candidate of family.
+func (f *familyPaths) candidate(family int) int {
+	if family == 0 {
+		return f.v6
+	}
+	return f.v4
+}
+
+// familyName returns the name of the address family of the candidate i.
+func (f *familyPaths) familyName(i int) string {
+	if f.family(i) == 0 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// pingFamilies sends a path ping to both address families of the connected
+// peer, until one of them is kept, or for the whole session with -multipath,
+// switching to the other family if the one in use stopped answering.
+func (p *proxy) pingFamilies() {
+	f := p.paths
+	if f == nil {
+		return
+	}
+	p.peerMu.Lock()
+	current := p.peerIndex
+	v6, v4 := p.peerAddrs[f.v6], p.peerAddrs[f.v4]
+	p.peerMu.Unlock()
+	switchTo := -1
+	f.mu.Lock()
+	f.rounds++
+	family := f.family(current)
+	switch {
+	case f.done:
+	case family < 0:
+		// reached on its local network
+		f.done = true
+	case !f.chosen && f.rounds > familyRounds:
+		// one family does not answer
+		f.chosen = true
+		f.done = !multipath
+	case f.chosen && f.missed[family] >= multipathMissed && f.missed[1-family] == 0:
+		switchTo = f.candidate(1 - family)
+	}
+	f.missed[0]++
+	f.missed[1]++
+	done := f.done
+	f.mu.Unlock()
+	if done {
+		return
+	}
+	if switchTo >= 0 {
+		p.s.println("The " + f.familyName(current) + " address of " + p.peerName() + " stopped answering, switching to its " + f.familyName(switchTo) + " address")
+		p.setPeer(switchTo)
+	}
+	ping := make([]byte, 9)
+	ping[0] = typePathPing
+	binary.BigEndian.PutUint64(ping[1:], uint64(time.Since(p.start)))
+	p.c.WriteToUDP(ping, v6)
+	p.c.WriteToUDP(ping, v4)
+}
+
+// pathReceived handles the path pings the peer candidate i sent from addr,
+// and returns whether data was one.
+func (p *proxy) pathReceived(i int, addr *net.UDPAddr, data []byte) bool {
+	switch data[0] {
+	case typePathPing:
+		if len(data) == 9 {
+			data[0] = typePathPong
+			p.c.WriteToUDP(data, addr)
+		}
+		return true
+	case typePathPong:
+		if len(data) != 9 {
+			return true
+		}
+		rtt := time.Since(p.start) - time.Duration(binary.BigEndian.Uint64(data[1:]))
+		f := p.paths
+		current := p.currentIndex()
+		kept, chosen := f.measured(i, current, rtt)
+		switch {
+		case chosen:
+			f.mu.Lock()
+			v4, v6 := f.rtt[1], f.rtt[0]
+			f.mu.Unlock()
+			p.s.println("Reached peer on both IPv4 (" + strconv.Itoa(int(v4/time.Millisecond)) + "ms) and IPv6 (" + strconv.Itoa(int(v6/time.Millisecond)) + "ms), keeping the faster one")
+		case kept >= 0:
+			p.s.println("The " + f.familyName(kept) + " address of " + p.peerName() + " is now faster, switching to it")
+		}
+		if kept >= 0 && kept != current {
+			p.setPeer(kept)
+		}
+		return true
+	}
+	return false
+}
+
+// prefers returns whether a packet from the peer candidate i switches the
+// peer to it: the first one reached, then the ones preferred to it, except
+// between its two address families, chosen by latency, and with -strict.
+func (p *proxy) prefers(i int) bool {
+	if !p.foundPeer {
+		return true
+	}
+	if p.strict {
+		return false
+	}
+	current := p.currentIndex()
+	if p.paths.family(i) >= 0 && p.paths.family(current) >= 0 {
+		return false
+	}
+	return i < current
+}
+
+// currentIndex returns the index of the peer candidate packets are sent to.
+func (p *proxy) currentIndex() int {
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	return p.peerIndex
+}
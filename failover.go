@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// backupRelays are the relays a session registers on in turn when its relay
+// stops answering during the session.
+var backupRelays []string
+
+// relayTimeout is the time without answer from the relay after which it is
+// considered down during a session.
+const relayTimeout = 5 * time.Second
+
+// relaySwitch holds the relay a session keeps registering on, so that the
+// session stays known to a relay. When the relay stops answering, while
+// waiting for a peer or once connected, it switches to the next backup relay;
+// the connection to the peer does not depend on the relay and is not
+// affected.
+type relaySwitch struct {
+	s  *session
+	mu sync.Mutex
+	// addr is the current relay, and name its name.
+	addr  *net.UDPAddr
+	name  string
+	heard time.Time
+	// relays are all the relays registered on, whose packets are not from
+	// the peer.
+	relays  []*net.UDPAddr
+	backups []string
+	// lost is set when the current relay stopped answering and no backup
+	// relay is left, until it answers again.
+	lost bool
+	// searching are the other relays a client registers on until one of
+	// them answers with the host, see findHost.
+	searching []relayChoice
+	// keep is the keepalive of the registrations in server mode, nil in
+	// client mode.
+	keep *keepalive
+	// reseal is set when the keys exchanged with the current relay were
+	// forgotten because it stopped answering, until they are exchanged
+	// again.
+	reseal bool
+}
+
+func newRelaySwitch(s *session, addr *net.UDPAddr) *relaySwitch {
+	r := &relaySwitch{
+		s:      s,
+		addr:   addr,
+		name:   relayName(s),
+		heard:  time.Now(),
+		relays: []*net.UDPAddr{addr},
+	}
+	// the other relays of -relay answered, try them first
+	for _, v := range s.alternates {
+		r.relays = append(r.relays, v.addr)
+		r.backups = append(r.backups, v.name)
+	}
+	r.backups = append(r.backups, backupRelays...)
+	return r
+}
+
+// findHost makes a client register on all the relays that answered
+// selectRelay rather than on the fastest only, until one of them answers
+// with the host, which may have chosen another relay.
+func (r *relaySwitch) findHost() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.searching = r.s.alternates
+}
+
+// registering returns the relays to send registrations to.
+func (r *relaySwitch) registering() []*net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := []*net.UDPAddr{r.addr}
+	for _, v := range r.searching {
+		addrs = append(addrs, v.addr)
+	}
+	return addrs
+}
+
+// settle returns whether addr is the current relay or one of the relays
+// searched by findHost, switching to it: it answered with the host.
+func (r *relaySwitch) settle(addr *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addr.IP.Equal(r.addr.IP) && addr.Port == r.addr.Port {
+		r.searching = nil
+		return true
+	}
+	for _, v := range r.searching {
+		if !addr.IP.Equal(v.addr.IP) || addr.Port != v.addr.Port {
+			continue
+		}
+		r.s.println("The host registered on relay " + v.name + ", using it")
+		r.addr = v.addr
+		r.name = v.name
+		r.heard = time.Now()
+		for i, b := range r.backups {
+			if b == v.name {
+				r.backups = append(r.backups[:i:i], r.backups[i+1:]...)
+				break
+			}
+		}
+		r.searching = nil
+		return true
+	}
+	return false
+}
+
+// current returns the relay to register on.
+func (r *relaySwitch) current() *net.UDPAddr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addr
+}
+
+// from returns whether addr is one of the relays, recording the answers of
+// the current one.
+func (r *relaySwitch) from(addr *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if addr.IP.Equal(r.addr.IP) && addr.Port == r.addr.Port {
+		r.heard = time.Now()
+		if r.lost {
+			r.lost = false
+			r.s.println("Relay " + r.name + " is answering again, registered again")
+		}
+		return true
+	}
+	for _, v := range r.relays {
+		if addr.IP.Equal(v.IP) && addr.Port == v.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// check switches to the next backup relay if the current one stopped
+// answering.
+func (r *relaySwitch) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	timeout := relayTimeout
+	if r.keep != nil {
+		// the relay answers each registration, sent less often once adapted
+		timeout += r.keep.next()
+	}
+	if time.Since(r.heard) < timeout {
+		return
+	}
+	// the relay may have restarted with a new key, which it cannot open the
+	// messages sealed with the old one with
+	if forgetSealer(r.addr) {
+		r.reseal = true
+	}
+	for len(r.backups) > 0 {
+		backup := r.backups[0]
+		r.backups = r.backups[1:]
+		addr, err := resolveRelayHost(backup)
+		if err != nil {
+			r.s.errorln("Error resolving backup relay " + backup + ": " + err.Error())
+			continue
+		}
+		// a relay registered on earlier may have restarted since
+		forgetSealer(addr)
+		if relayKey != "" {
+			if err := sealRelayMessages(addr); err != nil {
+				r.s.errorln("Error backup relay " + backup + " is not trusted with -relay-key: " + err.Error())
+				continue
+			}
+		} else {
+			// backup relays predating sealed messages do not answer
+			sealRelayMessages(addr)
+		}
+		msg := "Relay " + r.name + " stopped answering, registering on backup relay " + backup + " instead"
+		if r.s.isConnected() {
+			msg += "; the connection to your peer is not affected"
+		}
+		r.s.println(msg)
+		r.addr = addr
+		r.name = backup
+		r.heard = time.Now()
+		r.relays = append(r.relays, addr)
+		r.lost = false
+		r.reseal = false
+		return
+	}
+	if r.reseal || relayKey != "" {
+		// exchange keys again as soon as the relay is back
+		if err := sealRelayMessages(r.addr); err == nil {
+			r.reseal = false
+			r.heard = time.Now()
+		}
+	}
+	if !r.lost {
+		r.lost = true
+		msg := "Relay " + r.name + " stopped answering and no backup relay is left (relays: in the configuration file), registering again until it answers"
+		if r.s.isConnected() {
+			msg += "; the connection to your peer is not affected"
+		}
+		r.s.println(msg)
+		if r.keep != nil {
+			// the relay may be restarting: register again as soon as it is back
+			r.keep.reset()
+		}
+	}
+}
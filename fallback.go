@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// watchFallback ends the session if the peer is not reached directly after
+// punchTimeout, so that it continues through the relay, until done is
+// closed.
+func (p *proxy) watchFallback(done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-time.After(punchTimeout):
+	}
+	if _, connected := p.connectedPeer(); !connected {
+		p.fallBack()
+	}
+}
+
+// fallBack ends the direct session, to continue it through the relay.
+func (p *proxy) fallBack() {
+	p.peerMu.Lock()
+	p.fellBack = true
+	p.peerMu.Unlock()
+	p.interrupt()
+}
+
+// interrupt unblocks the read loop of the session, which then returns.
+func (p *proxy) interrupt() {
+	if c, ok := p.c.(interface{ SetReadDeadline(time.Time) error }); ok {
+		c.SetReadDeadline(time.Now())
+	}
+}
+
+// fallingBack returns whether the session ended to continue through the relay.
+func (p *proxy) fallingBack() bool {
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	return p.fellBack
+}
+
+// runFallback continues a session whose peer could not be reached directly
+// through the channel id of the relay, which the host keeps open. localAddr
+// and localPort are the game address of the host, nil and 0 for clients.
+func runFallback(s *session, c *net.UDPConn, relayAddr *net.UDPAddr, id []byte, localAddr *net.UDPAddr, localPort int) {
+	c.SetReadDeadline(time.Time{})
+	if proto == "tcp" {
+		s.errorln("Error could not reach the peer directly, and TCP sessions cannot be relayed: forward UDP port " + strconv.Itoa(defaultPort) + " on your router, or ask your peer to, or use -proto tcp-udp")
+		return
+	}
+	s.errorln("Error could not reach the peer directly, relaying the traffic through " + relayName(s) + " instead: this adds latency (the relayed ping is shown once connected)")
+	s.setState("connecting to peer through the relay")
+
+	rc := newRelayedConn(c, relayAddr, id, nil)
+	peerAddrs := []*net.UDPAddr{relayAddr}
+	chPunch := make(chan struct{})
+	go punch(rc, peerAddrs, s.punchPayload(), chPunch)
+	defer close(chPunch)
+
+	p := newProxy(s, rc, nil, peerAddrs, localAddr, localPort)
+	p.relayed = true
+	if localPort != 0 {
+		p.authenticate = p.secret != nil
+		p.confirmPeer = confirmPeers()
+		if targeting() {
+			go followProcess(p)
+		}
+	} else {
+		p.verifyHost = password != ""
+	}
+	p.run(make([]byte, 4096))
+}
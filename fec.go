@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// fec is the group size of -fec: after every fec game packets sent to the
+// peer, a parity packet is sent, from which the peer recovers any one packet
+// of the group it lost; 0 disables it.
+var fec int
+
+// maxFec bounds the group size of -fec.
+const maxFec = 64
+
+// fecGroups is the count of recent groups the receiver keeps to recover
+// packets.
+const fecGroups = 16
+
+// fecEncoder groups the game packets sent to the peer.
+type fecEncoder struct {
+	mu     sync.Mutex
+	group  uint32
+	index  int
+	parity []byte
+}
+
+// wrap returns the typeFec packets to send for the game packet: the packet,
+// followed by the parity of its group if it is the last one.
+func (e *fecEncoder) wrap(packet []byte, size int) [][]byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	packets := [][]byte{fecPacket(e.group, e.index, size, packet)}
+	if len(e.parity) < 2+len(packet) {
+		e.parity = append(e.parity, make([]byte, 2+len(packet)-len(e.parity))...)
+	}
+	e.parity[0] ^= byte(len(packet) >> 8)
+	e.parity[1] ^= byte(len(packet))
+	for i, v := range packet {
+		e.parity[2+i] ^= v
+	}
+	e.index++
+	if e.index == size {
+		packets = append(packets, fecPacket(e.group, size, size, e.parity))
+		e.group++
+		e.index = 0
+		e.parity = e.parity[:0]
+	}
+	return packets
+}
+
+// fecPacket returns the typeFec packet carrying a game packet of a group, or
+// its parity: group (4 bytes), index in the group (1 byte, the group size for
+// the parity), group size (1 byte), then the payload. The parity is the XOR
+// of the lengths of the packets of the group (2 bytes), then the XOR of the
+// packets, padded with zeroes to the longest.
+func fecPacket(group uint32, index int, size int, payload []byte) []byte {
+	b := make([]byte, 7, 7+len(payload))
+	b[0] = typeFec
+	binary.BigEndian.PutUint32(b[1:5], group)
+	b[5], b[6] = byte(index), byte(size)
+	return append(b, payload...)
+}
+
+// fecGroup is a group of packets received from the peer.
+type fecGroup struct {
+	group uint32
+	// packets are the packets of the group by index, then its parity; nil
+	// if not received.
+	packets  [][]byte
+	received int
+	done     bool
+}
+
+// fecDecoder recovers the game packets the peer sent with -fec that were
+// lost.
+type fecDecoder struct {
+	groups [fecGroups]*fecGroup
+	// recovered is the count of recovered packets, accessed atomically.
+	recovered int32
+}
+
+// receive handles the typeFec packet data, returning the game packet it
+// carries, if any, and the packet of its group it recovered, if any.
+func (d *fecDecoder) receive(data []byte) ([]byte, []byte) {
+	if len(data) < 7 {
+		return nil, nil
+	}
+	group := binary.BigEndian.Uint32(data[1:5])
+	index, size := int(data[5]), int(data[6])
+	if size < 1 || size > maxFec || index > size {
+		return nil, nil
+	}
+	payload := data[7:]
+	var packet []byte
+	if index < size {
+		packet = payload
+	}
+	g := d.groups[group%fecGroups]
+	if g == nil || g.group != group || len(g.packets) != size+1 {
+		if g != nil && int32(group-g.group) < 0 {
+			// a late packet of a forgotten group
+			return packet, nil
+		}
+		g = &fecGroup{
+			group:   group,
+			packets: make([][]byte, size+1),
+		}
+		d.groups[group%fecGroups] = g
+	}
+	if g.done || g.packets[index] != nil {
+		return packet, nil
+	}
+	g.packets[index] = append([]byte(nil), payload...)
+	g.received++
+	if g.received == size+1 {
+		g.done = true
+	}
+	if g.received != size || g.packets[size] == nil {
+		return packet, nil
+	}
+	// all but one packet of the group and its parity were received
+	g.done = true
+	missing := 0
+	for i, v := range g.packets[:size] {
+		if v == nil {
+			missing = i
+		}
+	}
+	parity := append([]byte(nil), g.packets[size]...)
+	if len(parity) < 2 {
+		return packet, nil
+	}
+	for _, v := range g.packets[:size] {
+		if v == nil {
+			continue
+		}
+		parity[0] ^= byte(len(v) >> 8)
+		parity[1] ^= byte(len(v))
+		for i, b := range v {
+			if 2+i < len(parity) {
+				parity[2+i] ^= b
+			}
+		}
+	}
+	length := int(binary.BigEndian.Uint16(parity[:2]))
+	if length == 0 || 2+length > len(parity) {
+		return packet, nil
+	}
+	g.packets[missing] = parity[2 : 2+length]
+	atomic.AddInt32(&d.recovered, 1)
+	return packet, g.packets[missing]
+}
+
+// takeRecovered returns the count of packets recovered since the last call.
+func (d *fecDecoder) takeRecovered() int {
+	return int(atomic.SwapInt32(&d.recovered, 0))
+}
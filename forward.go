@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net"
+	"strconv"
+	"time"
+)
+
+// forwardMagic prefixes the messages relays forward on a channel: channel
+// ID, then payload. A relay forwards the payload to the other address sending
+// on the same channel, so that the peers never learn each other's address.
+const forwardMagic = "PPF1"
+
+// chainMagic prefixes the messages sent to a first relay to be forwarded on
+// the channel of a next relay: channel ID, next relay address, then payload.
+// Each relay then only learns the address of one of the peers.
+const chainMagic = "PPC1"
+
+// via is the first relay to chain through in client mode, empty to connect
+// without it. With private, sessions stay relayed so that peers never learn
+// each other's address.
+var via string
+var private bool
+
+// channelId returns the ID of the relayed channel to the session hosted on ip
+// and port. It includes the join secret, without which relays cannot tell
+// which host a channel leads to by trying all addresses.
+func channelId(ip net.IP, port int) []byte {
+	h := sha256.New()
+	h.Write([]byte("proxypunch channel\x00"))
+	h.Write(ip.To4())
+	h.Write([]byte{byte(port >> 8), byte(port)})
+	h.Write(joinSecret())
+	return h.Sum(nil)[:8]
+}
+
+// relayedConn exchanges the packets of the peer through a relay channel.
+// hop is the relay the packets are sent through, which stands for the peer
+// address; other packets are sent and received as is.
+type relayedConn struct {
+	*net.UDPConn
+	hop *net.UDPAddr
+	id  []byte
+	// header prefixes the packets sent to hop.
+	header []byte
+}
+
+// newRelayedConn returns a relayed connection on channel id of hop, chained
+// to the channel of the relay next if not nil.
+func newRelayedConn(c *net.UDPConn, hop *net.UDPAddr, id []byte, next *net.UDPAddr) *relayedConn {
+	var header []byte
+	if next != nil {
+		header = append([]byte(chainMagic), id...)
+		header = append(header, make([]byte, 6)...)
+		putAddr(header[len(header)-6:], next)
+	} else {
+		header = append([]byte(forwardMagic), id...)
+	}
+	return &relayedConn{
+		UDPConn: c,
+		hop:     hop,
+		id:      id,
+		header:  header,
+	}
+}
+
+func (c *relayedConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFromUDP(b)
+		if err != nil || !addr.IP.Equal(c.hop.IP) || addr.Port != c.hop.Port {
+			return n, addr, err
+		}
+		if !isChannel(b[:n], c.id) {
+			// other relay messages
+			continue
+		}
+		return copy(b, b[len(forwardMagic)+len(c.id):n]), addr, nil
+	}
+}
+
+func (c *relayedConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if !addr.IP.Equal(c.hop.IP) || addr.Port != c.hop.Port {
+		return c.UDPConn.WriteToUDP(b, addr)
+	}
+	packet := make([]byte, 0, len(c.header)+len(b))
+	packet = append(append(packet, c.header...), b...)
+	if _, err := c.UDPConn.WriteToUDP(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// resolveVia resolves the first relay to chain through.
+func resolveVia() (*net.UDPAddr, error) {
+	return resolveRelayHost(via)
+}
+
+// runRelayed connects to the session of channel id through the relay of the
+// host, or first through the via relay, so that the peer never learns the
+// address of this host. target describes the host.
+func runRelayed(s *session, c *net.UDPConn, id []byte, target string) {
+	relayAddr, err := resolveRelay(s)
+	if err != nil {
+		s.errorln("Error resolving relay: " + err.Error())
+		return
+	}
+	if err := negotiateRelay(s, relayAddr); err != nil {
+		s.errorln("Error " + err.Error())
+		return
+	}
+	chAuth := make(chan struct{})
+	defer close(chAuth)
+	if err := authenticateRelay(s, relayAddr, chAuth); err != nil {
+		s.errorln("Error " + err.Error())
+		return
+	}
+	if !s.relayHas(capChannels, "relayed sessions") {
+		return
+	}
+	hop, next, hopName := relayAddr, (*net.UDPAddr)(nil), relayName(s)
+	if via != "" {
+		viaAddr, err := resolveVia()
+		if err != nil {
+			s.errorln("Error resolving relay " + via + ": " + err.Error())
+			return
+		}
+		hop, next, hopName = viaAddr, relayAddr, via
+	}
+
+	rtt, err := relayRtt(hop)
+	if err != nil {
+		s.errorln("Error relay " + hopName + " is not answering: " + err.Error())
+		return
+	}
+	if next != nil {
+		s.println("Relaying through " + via + " then " + relayName(s) + ": neither relay learns both your address and your peer's")
+	} else {
+		s.println("Relaying through " + hopName + ": your peer does not learn your address")
+	}
+	s.println("Round trip to " + hopName + ": " + strconv.Itoa(int(rtt/time.Millisecond)) + "ms; the relayed ping to your peer is shown once connected")
+	s.setState("connecting to " + target + " through " + hopName)
+
+	rc := newRelayedConn(c, hop, id, next)
+	peerAddrs := []*net.UDPAddr{hop}
+	chPunch := make(chan struct{})
+	go punch(rc, peerAddrs, s.punchPayload(), chPunch)
+	defer close(chPunch)
+
+	p := newProxy(s, rc, nil, peerAddrs, nil, 0)
+	p.verifyHost = password != ""
+	p.relayed = true
+	p.run(make([]byte, 4096))
+}
+
+// openChannel keeps the relayed channel id open on the relay until done is
+// closed, so that peers can connect through it.
+func openChannel(c packetConn, relayAddr *net.UDPAddr, id []byte, done chan struct{}) {
+	payload := append([]byte(forwardMagic), id...)
+	for {
+		c.WriteToUDP(payload, relayAddr)
+		select {
+		case <-done:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// isChannel returns whether data was forwarded on the channel id.
+func isChannel(data []byte, id []byte) bool {
+	return id != nil && len(data) > len(forwardMagic)+len(id) && string(data[:len(forwardMagic)]) == forwardMagic && bytes.Equal(data[len(forwardMagic):len(forwardMagic)+len(id)], id)
+}
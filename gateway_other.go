@@ -0,0 +1,29 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway returns the IPv4 address of the default gateway.
+func defaultGateway() (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "gateway:" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no default gateway")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const desktopFile = "proxypunch.desktop"
+
+func applicationsDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "applications"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "applications"), nil
+}
+
+func registerUriHandler(exe string) error {
+	dir, err := applicationsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entry := strings.Join([]string{
+		"[Desktop Entry]",
+		"Type=Application",
+		"Name=proxypunch",
+		"Exec=\"" + exe + "\" %u",
+		"Terminal=true",
+		"NoDisplay=true",
+		"MimeType=x-scheme-handler/" + uriScheme + ";",
+	}, "\n") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, desktopFile), []byte(entry), 0644); err != nil {
+		return err
+	}
+	return exec.Command("xdg-mime", "default", desktopFile, "x-scheme-handler/"+uriScheme).Run()
+}
+
+func unregisterUriHandler() error {
+	dir, err := applicationsDir()
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(dir, desktopFile))
+}
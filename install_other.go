@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func registerUriHandler(exe string) error {
+	return errors.New("not supported on this platform")
+}
+
+func unregisterUriHandler() error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os/exec"
+)
+
+const uriKey = `HKCU\Software\Classes\` + uriScheme
+
+func registerUriHandler(exe string) error {
+	commands := [][]string{
+		{"add", uriKey, "/ve", "/d", "URL:proxypunch link", "/f"},
+		{"add", uriKey, "/v", "URL Protocol", "/d", "", "/f"},
+		{"add", uriKey + `\shell\open\command`, "/ve", "/d", `"` + exe + `" "%1"`, "/f"},
+	}
+	for _, args := range commands {
+		if err := exec.Command("reg", args...).Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unregisterUriHandler() error {
+	return exec.Command("reg", "delete", uriKey, "/f").Run()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+)
+
+// integrity is set with -integrity: the game packets sent to the peer carry
+// a sequence number and a checksum, so that it drops corrupted and truncated
+// packets rather than handing them to the game, and counts them apart from
+// lost packets.
+var integrity bool
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// integritySender numbers the game packets sent with -integrity.
+type integritySender struct {
+	// sequence is the number of the last packet, accessed atomically.
+	sequence uint32
+}
+
+// wrap returns the typeChecked packet carrying the packet: its sequence
+// number (4 bytes), the CRC-32C of the sequence number and the packet (4
+// bytes), then the packet.
+func (is *integritySender) wrap(packet []byte) []byte {
+	b := make([]byte, 9, 9+len(packet))
+	b[0] = typeChecked
+	binary.BigEndian.PutUint32(b[1:5], atomic.AddUint32(&is.sequence, 1))
+	b = append(b, packet...)
+	sum := crc32.Update(crc32.Checksum(b[1:5], castagnoli), castagnoli, b[9:])
+	binary.BigEndian.PutUint32(b[5:9], sum)
+	return b
+}
+
+// integrityChecker checks the game packets the peer sent with -integrity,
+// and counts the corrupted and lost ones.
+type integrityChecker struct {
+	mu      sync.Mutex
+	started bool
+	// highest is the highest sequence number received, base the one at the
+	// start of the current count, received the count of packets received
+	// since.
+	highest  uint32
+	base     uint32
+	received int
+	// corrupted is the count of corrupted packets, accessed atomically.
+	corrupted int32
+}
+
+// check returns the packet carried by the typeChecked packet data, or nil if
+// it is corrupted or truncated.
+func (ic *integrityChecker) check(data []byte) []byte {
+	if len(data) < 10 || binary.BigEndian.Uint32(data[5:9]) != crc32.Update(crc32.Checksum(data[1:5], castagnoli), castagnoli, data[9:]) {
+		atomic.AddInt32(&ic.corrupted, 1)
+		return nil
+	}
+	sequence := binary.BigEndian.Uint32(data[1:5])
+	ic.mu.Lock()
+	if !ic.started {
+		ic.started = true
+		ic.highest, ic.base = sequence, sequence-1
+	} else if int32(sequence-ic.highest) > 0 {
+		ic.highest = sequence
+	}
+	ic.received++
+	ic.mu.Unlock()
+	return data[9:]
+}
+
+// takeLost returns the count of packets lost since the last call, from the
+// gaps in the sequence numbers.
+func (ic *integrityChecker) takeLost() int {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	lost := int(ic.highest-ic.base) - ic.received
+	ic.base, ic.received = ic.highest, 0
+	if lost < 0 {
+		// packets of the previous count arrived late
+		return 0
+	}
+	return lost
+}
+
+// takeCorrupted returns the count of corrupted packets since the last call.
+func (ic *integrityChecker) takeCorrupted() int {
+	return int(atomic.SwapInt32(&ic.corrupted, 0))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// relayMagic6 prefixes the extended relay messages that also carry the IPv6
+// candidate of the peers after their local address: 16 bytes of IPv6 and 2
+// bytes of port, all zeroes if unknown. Relays only know peers by their IPv4
+// address, but peers with IPv6 connectivity then also punch each other over
+// IPv6, where there is usually no NAT at all. Relays listening on IPv6 are
+// also sent these messages over IPv6, and use the address they receive them
+// from as the IPv6 candidate of the identical message received over IPv4.
+const relayMagic6 = "PPX2"
+
+// registrationTries is the count of registrations sent with relayMagic6
+// before falling back to relayMagic, if the relay does not answer them.
+const registrationTries = 4
+
+// ipv6Route is a public IPv6 address, to find the local IPv6 address used
+// to reach the Internet; no packet is sent to it.
+var ipv6Route = &net.UDPAddr{IP: net.ParseIP("2001:4860:4860::8888"), Port: 53}
+
+// listenDualStack binds a UDP socket on port for both IPv4 and IPv6, or
+// only IPv4 if IPv6 is disabled on the system.
+func listenDualStack(port int) (*net.UDPConn, error) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{
+		Port: port,
+	})
+	if err != nil {
+		return net.ListenUDP("udp4", &net.UDPAddr{
+			Port: port,
+		})
+	}
+	return c, nil
+}
+
+// dualStack returns whether c accepts both IPv4 and IPv6 packets.
+func dualStack(c *net.UDPConn) bool {
+	return c.LocalAddr().(*net.UDPAddr).IP.To4() == nil
+}
+
+// ipv6Candidate returns the public IPv6 address of c, or nil if unknown.
+func ipv6Candidate(c *net.UDPConn) *net.UDPAddr {
+	if !dualStack(c) {
+		return nil
+	}
+	route, err := net.DialUDP("udp6", nil, ipv6Route)
+	if err != nil {
+		return nil
+	}
+	defer route.Close()
+	ip := route.LocalAddr().(*net.UDPAddr).IP
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || ip.To4() != nil {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: c.LocalAddr().(*net.UDPAddr).Port,
+	}
+}
+
+// relayIpv6Candidate returns the IPv6 candidate of c to register on the
+// relay of the session, or nil if the relay does not support IPv6 candidates.
+func relayIpv6Candidate(s *session, c *net.UDPConn) *net.UDPAddr {
+	if s.relayCaps&capIpv6 == 0 {
+		return nil
+	}
+	return ipv6Candidate(c)
+}
+
+func putAddr6(b []byte, addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	copy(b[:16], addr.IP.To16())
+	b[16], b[17] = byte(addr.Port>>8), byte(addr.Port)
+}
+
+func getAddr6(b []byte) *net.UDPAddr {
+	ip := make(net.IP, 16)
+	copy(ip, b[:16])
+	port := int(b[16])<<8 | int(b[17])
+	if ip.IsUnspecified() || ip.To4() != nil || port == 0 {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: port,
+	}
+}
+
+// registration is the registration message of a peer on the relay, sent
+// with relayMagic6 and its IPv6 candidate if it has one, unless the relay
+// does not answer these.
+type registration struct {
+	mu sync.Mutex
+	v4 []byte
+	// v6 is nil without IPv6 candidate.
+	v6       []byte
+	sent     int
+	answered bool
+	// relay6 is the IPv6 address of the relay at relay4, nil unless it
+	// listens on IPv6.
+	relay4 *net.UDPAddr
+	relay6 *net.UDPAddr
+	// legacy is set for relays predating versions, which only know the
+	// legacy registrations, see relayMagic.
+	legacy bool
+}
+
+// newRegistration returns the registration of a peer from its relayMagic
+// registration message and its IPv6 candidate, which may be nil.
+func newRegistration(v4 []byte, candidate *net.UDPAddr) *registration {
+	r := &registration{
+		v4: v4,
+	}
+	r.setIpv6(candidate)
+	return r
+}
+
+// setIpv6 builds the relayMagic6 message from the relayMagic one and the IPv6
+// candidate, if any.
+func (r *registration) setIpv6(candidate *net.UDPAddr) {
+	r.v6 = nil
+	if candidate != nil {
+		r.v6 = append([]byte(relayMagic6), r.v4[len(relayMagic):]...)
+		r.v6 = append(r.v6, make([]byte, 18)...)
+		putAddr6(r.v6[len(r.v6)-18:], candidate)
+	}
+}
+
+// moved updates the local candidates of the registration, whose relayMagic
+// message ends with the IPv4 one, after the network of this host changed.
+func (r *registration) moved(local *net.UDPAddr, candidate *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copy(r.v4[len(r.v4)-6:], make([]byte, 6))
+	putAddr(r.v4[len(r.v4)-6:], local)
+	r.setIpv6(candidate)
+}
+
+// payload returns the registration message to send.
+func (r *registration) payload() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.legacy {
+		return r.v4[len(relayMagic) : len(r.v4)-6]
+	}
+	if r.v6 == nil || (!r.answered && r.sent >= registrationTries) {
+		return r.v4
+	}
+	r.sent++
+	return r.v6
+}
+
+// sendIpv6 sends the relayMagic6 message to the relay at relayAddr over IPv6
+// too, if it listens on IPv6, so that it sees the IPv6 address of this host
+// from the Internet.
+func (r *registration) sendIpv6(c *net.UDPConn, relayAddr *net.UDPAddr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.v6 == nil || (!r.answered && r.sent >= registrationTries) || r.relay6 == nil || !r.relay4.IP.Equal(relayAddr.IP) || r.relay4.Port != relayAddr.Port {
+		return
+	}
+	c.WriteToUDP(r.v6, r.relay6)
+}
+
+// answer records that the relay answered a relayMagic6 registration.
+func (r *registration) answer() {
+	r.mu.Lock()
+	r.answered = true
+	r.mu.Unlock()
+}
+
+// splitHost splits a host typed by the user into host and port, 0 if none;
+// IPv6 addresses with a port are written in brackets, e.g. [2001:db8::1]:10800.
+func splitHost(h string) (string, int, error) {
+	if ip := net.ParseIP(h); ip != nil {
+		return h, 0, nil
+	}
+	if h, p, err := net.SplitHostPort(h); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return "", 0, err
+		}
+		return h, port, nil
+	}
+	if strings.HasPrefix(h, "[") && strings.HasSuffix(h, "]") {
+		return h[1 : len(h)-1], 0, nil
+	}
+	return h, 0, nil
+}
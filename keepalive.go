@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keepaliveSeconds is the interval between the registrations to the relay
+// set with -keepalive, 0 to adapt it to the NAT.
+var keepaliveSeconds int
+
+// keepaliveMin is the initial interval between the registrations to the
+// relay, which also keep the NAT mapping toward the relay alive.
+const keepaliveMin = 500 * time.Millisecond
+
+// keepaliveMax bounds the interval between the registrations: the relay
+// forgets registrations after 15 seconds.
+const keepaliveMax = 10 * time.Second
+
+// keepaliveStable is the count of registrations answered on the same public
+// port before trying a longer interval.
+const keepaliveStable = 3
+
+// applyKeepalive checks the interval set with -keepalive.
+func applyKeepalive() error {
+	if keepaliveSeconds < 0 || time.Duration(keepaliveSeconds)*time.Second > keepaliveMax {
+		return errors.New("-keepalive must be between 1 and " + strconv.Itoa(int(keepaliveMax/time.Second)) + " seconds, or 0 to adapt it to your NAT")
+	}
+	return nil
+}
+
+// keepalive adapts the interval between the registrations of a host to the
+// time its NAT keeps an idle mapping: the interval doubles while the relay
+// keeps seeing the same public port, and settles on the last interval that
+// kept it once the port changes, that is once the mapping expired.
+type keepalive struct {
+	s *session
+
+	mu       sync.Mutex
+	interval time.Duration
+	// good is the longest interval that kept the mapping.
+	good    time.Duration
+	port    int
+	stable  int
+	settled bool
+}
+
+func newKeepalive(s *session) *keepalive {
+	k := &keepalive{
+		s:        s,
+		interval: keepaliveMin,
+		good:     keepaliveMin,
+	}
+	if keepaliveSeconds > 0 {
+		k.interval = time.Duration(keepaliveSeconds) * time.Second
+		k.settled = true
+	}
+	return k
+}
+
+// next returns the interval before the next registration.
+func (k *keepalive) next() time.Duration {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.interval
+}
+
+// observed records the public port the relay saw in its answer to a
+// registration.
+func (k *keepalive) observed(port int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.port == 0 || k.settled {
+		k.port = port
+		return
+	}
+	if port != k.port {
+		// the mapping expired during the last interval
+		k.port = port
+		k.interval = k.good
+		k.settled = true
+		if verbose {
+			k.s.println("Your NAT forgets idle mappings after " + strconv.Itoa(int(k.good/time.Millisecond)) + " to " + strconv.Itoa(int(2*k.good/time.Millisecond)) + "ms: registering to the relay every " + strconv.Itoa(int(k.good/time.Millisecond)) + "ms")
+		}
+		return
+	}
+	k.good = k.interval
+	if k.stable++; k.stable < keepaliveStable {
+		return
+	}
+	k.stable = 0
+	if k.interval *= 2; k.interval >= keepaliveMax {
+		k.interval = keepaliveMax
+		k.settled = true
+	}
+}
+
+// reset adapts the interval again from keepaliveMin, unless set with
+// -keepalive, to register again quickly once the relay answers after it
+// stopped answering, maybe restarting.
+func (k *keepalive) reset() {
+	if keepaliveSeconds > 0 {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.interval = keepaliveMin
+	k.good = keepaliveMin
+	k.port = 0
+	k.stable = 0
+	k.settled = false
+}
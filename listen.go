@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// listenAddr restricts the local games that can use the proxy in client
+// mode: only this host by default, the devices on the local network of an
+// interface with this address, or of any interface for 0.0.0.0.
+var listenAddr = "127.0.0.1"
+
+// lanNets are the local networks whose devices are accepted as local games
+// besides this host, and lanIps the matching addresses of this host.
+var lanNets []*net.IPNet
+var lanIps []net.IP
+
+// bindAddr is the address of the proxy socket set with -bind: its port,
+// optionally prefixed with an address as -listen; bindPort is the port, 0
+// for the default port.
+var bindAddr string
+var bindPort int
+
+func applyBind() error {
+	if bindAddr == "" {
+		return nil
+	}
+	host, port := "", bindAddr
+	if h, p, err := net.SplitHostPort(bindAddr); err == nil {
+		host, port = h, p
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errors.New("invalid bind address " + bindAddr + ", must be a port, or an address and a port, e.g. 0.0.0.0:10800")
+	}
+	bindPort = n
+	if host != "" {
+		listenAddr = host
+	}
+	return nil
+}
+
+func applyListen() error {
+	if err := applyBind(); err != nil {
+		return err
+	}
+	ip := net.ParseIP(listenAddr)
+	if ip == nil || ip.To4() == nil {
+		return errors.New("invalid listen address " + listenAddr + ", must be an IPv4 address")
+	}
+	if ip.IsLoopback() {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || n.IP.To4() == nil || n.IP.IsLoopback() {
+			continue
+		}
+		if ip.IsUnspecified() || n.IP.Equal(ip) {
+			lanNets = append(lanNets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+			lanIps = append(lanIps, n.IP)
+		}
+	}
+	if len(lanNets) == 0 {
+		return errors.New("no local network interface has address " + listenAddr)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// udpListener is a local UDP socket bound by some process.
+type udpListener struct {
+	port    int
+	pid     int
+	process string
+}
+
+// ignoredPorts are well-known ports of system services that are never games.
+var ignoredPorts = map[int]bool{
+	1900: true, // SSDP
+	3702: true, // WS-Discovery
+	5353: true, // mDNS
+	5355: true, // LLMNR
+}
+
+// ignoredProcesses are system processes whose sockets are never games.
+var ignoredProcesses = map[string]bool{
+	"svchost.exe":           true,
+	"lsass.exe":             true,
+	"system":                true,
+	"spoolsv.exe":           true,
+	"avahi-daemon":          true,
+	"systemd-resolved":      true,
+	"systemd-timesyncd":     true,
+	"chronyd":               true,
+	"dhclient":              true,
+	"networkmanager":        true,
+	"rpcbind":               true,
+	"steam":                 true,
+	"steam.exe":             true,
+	"steamwebhelper.exe":    true,
+	"discord":               true,
+	"discord.exe":           true,
+	"spotify.exe":           true,
+	"msedgewebview2.exe":    true,
+	"searchapp.exe":         true,
+	"nvcontainer.exe":       true,
+	"explorer.exe":          true,
+	"chrome.exe":            true,
+	"firefox.exe":           true,
+	"msedge.exe":            true,
+	"mdnsresponder.exe":     true,
+	"ipf_helper.exe":        true,
+	"nahimicsvc64.exe":      true,
+	"lghub_agent.exe":       true,
+	"onedrive.exe":          true,
+	"teams.exe":             true,
+	"zoom.exe":              true,
+	"skype.exe":             true,
+	"dropbox.exe":           true,
+	"parsecd.exe":           true,
+	"epicgameslauncher.exe": true,
+}
+
+var noScan bool
+
+// gameListeners returns the local UDP ports that may belong to a game,
+// sorted by port.
+func gameListeners() []udpListener {
+	listeners, err := udpListeners()
+	if err != nil {
+		return nil
+	}
+	return gameListenersOf(listeners)
+}
+
+func gameListenersOf(listeners []udpListener) []udpListener {
+	var games []udpListener
+	seen := make(map[int]bool)
+	for _, l := range listeners {
+		if l.port < 1024 || ignoredPorts[l.port] || seen[l.port] {
+			continue
+		}
+		if l.pid == os.Getpid() || ignoredProcesses[strings.ToLower(l.process)] {
+			continue
+		}
+		seen[l.port] = true
+		games = append(games, l)
+	}
+	sort.Slice(games, func(i, j int) bool {
+		return games[i].port < games[j].port
+	})
+	return games
+}
+
+func (l udpListener) String() string {
+	s := strconv.Itoa(l.port)
+	if l.process != "" {
+		s += " (" + l.process + ")"
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// udpListeners parses the kernel UDP socket tables and finds the owner of
+// each socket through the process file descriptors.
+func udpListeners() ([]udpListener, error) {
+	inodes := make(map[string]int)
+	var listeners []udpListener
+	for _, table := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(table)
+		if err != nil {
+			if table == "/proc/net/udp" {
+				return nil, err
+			}
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			// only unconnected sockets
+			if fields[3] != "07" || !strings.HasSuffix(fields[2], ":0000") {
+				continue
+			}
+			i := strings.LastIndexByte(fields[1], ':')
+			if i == -1 {
+				continue
+			}
+			port, err := hex.DecodeString(fields[1][i+1:])
+			if err != nil || len(port) != 2 {
+				continue
+			}
+			inodes[fields[9]] = len(listeners)
+			listeners = append(listeners, udpListener{
+				port: int(port[0])<<8 | int(port[1]),
+			})
+		}
+		f.Close()
+	}
+
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(filepath.Base(proc))
+		if err != nil {
+			continue
+		}
+		fds, err := ioutil.ReadDir(filepath.Join(proc, "fd"))
+		if err != nil {
+			continue
+		}
+		var name string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(proc, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			i, ok := inodes[link[len("socket:["):len(link)-1]]
+			if !ok {
+				continue
+			}
+			if name == "" {
+				comm, _ := ioutil.ReadFile(filepath.Join(proc, "comm"))
+				name = strings.TrimSpace(string(comm))
+			}
+			listeners[i].pid = pid
+			listeners[i].process = name
+		}
+	}
+	return listeners, nil
+}
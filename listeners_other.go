@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func udpListeners() ([]udpListener, error) {
+	return nil, errors.New("not supported on this system")
+}
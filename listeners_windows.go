@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	afInet           = 2
+	udpTableOwnerPid = 1
+
+	errorInsufficientBuffer = 122
+
+	processQueryLimitedInformation = 0x1000
+)
+
+var (
+	iphlpapi                       = syscall.NewLazyDLL("iphlpapi.dll")
+	procGetExtendedUdpTable        = iphlpapi.NewProc("GetExtendedUdpTable")
+	procQueryFullProcessImageNameW = kernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+// udpListeners reads the system IPv4 UDP table with the owning process ids.
+func udpListeners() ([]udpListener, error) {
+	var size uint32
+	var buf []byte
+	for {
+		var p uintptr
+		if len(buf) > 0 {
+			p = uintptr(unsafe.Pointer(&buf[0]))
+		}
+		r, _, _ := procGetExtendedUdpTable.Call(p, uintptr(unsafe.Pointer(&size)), 1, afInet, udpTableOwnerPid, 0)
+		if r == 0 {
+			break
+		}
+		if r != errorInsufficientBuffer {
+			return nil, syscall.Errno(r)
+		}
+		buf = make([]byte, size)
+	}
+	if len(buf) < 4 {
+		return nil, nil
+	}
+
+	// MIB_UDPTABLE_OWNER_PID: a count then rows of address, port and pid
+	count := int(binary.LittleEndian.Uint32(buf[0:4]))
+	names := make(map[int]string)
+	var listeners []udpListener
+	for i := 0; i < count && 4+12*(i+1) <= len(buf); i++ {
+		row := buf[4+12*i : 4+12*(i+1)]
+		pid := int(binary.LittleEndian.Uint32(row[8:12]))
+		name, ok := names[pid]
+		if !ok {
+			name = processName(pid)
+			names[pid] = name
+		}
+		listeners = append(listeners, udpListener{
+			// the port is stored in network byte order
+			port:    int(row[4])<<8 | int(row[5]),
+			pid:     pid,
+			process: name,
+		})
+	}
+	return listeners, nil
+}
+
+func processName(pid int) string {
+	if pid == 4 {
+		return "System"
+	}
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return ""
+	}
+	defer syscall.CloseHandle(h)
+	var buf [syscall.MAX_PATH]uint16
+	size := uint32(len(buf))
+	if r, _, _ := procQueryFullProcessImageNameW.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size))); r == 0 {
+		return ""
+	}
+	return filepath.Base(syscall.UTF16ToString(buf[:size]))
+}
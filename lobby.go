@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lobbyMagic prefixes the lobby messages exchanged with the relay, followed
+// by an operation byte:
+//   - lobbyPublish: port, relay RTT in milliseconds, flags, token tag,
+//     channel ID if private, game, nickname, region, notes
+//   - lobbyList: page, token tag, version, padded to lobbyPageSize so that
+//     the relay does not amplify spoofed requests
+//   - lobbyEntries: page, page count, then entries: IP, port, relay RTT,
+//     flags, channel ID if private, game, nickname, region, notes
+//
+// Entries published with a token tag are only listed to requests with the
+// same tag. Private entries are listed with a zero IP, and only to requests
+// of version lobbyVersion or later, which join them through their channel.
+// Strings are prefixed with their length on one byte.
+const lobbyMagic = "PPL1"
+
+const (
+	lobbyPublish = 0x01
+	lobbyList    = 0x02
+	lobbyEntries = 0x03
+)
+
+// Flags of lobby entries.
+const (
+	lobbyPassword  = 0x01
+	lobbyCommunity = 0x02
+	lobbyPrivate   = 0x04
+)
+
+// lobbyVersion is the version of the list requests.
+const lobbyVersion = 1
+
+// lobbyPageSize is the size of the list requests, and the maximum size of
+// the pages sent back.
+const lobbyPageSize = 1200
+
+// lobbyInterval is the interval at which a published session is refreshed
+// on the relay, which forgets it after 15 seconds.
+const lobbyInterval = 5 * time.Second
+
+// maxLobbyField is the maximum length in bytes of a lobby entry string.
+const maxLobbyField = 100
+
+var publish bool
+var nickname string
+var region string
+var notes string
+
+// lobbyEntry is a session published on the lobby of the relay.
+type lobbyEntry struct {
+	// game is the name of the game preset, if any.
+	game     string
+	nickname string
+	region   string
+	notes    string
+	// rtt is the round trip time from the host to the relay, 0 if unknown.
+	rtt   time.Duration
+	flags byte
+}
+
+// lobbyListing is a lobby entry as listed by the relay.
+type lobbyListing struct {
+	lobbyEntry
+	host net.IP
+	port int
+	// channel is the ID of the relayed channel of private entries.
+	channel []byte
+}
+
+// publishPayload returns the message publishing the session hosted on port;
+// channel is the ID of its relayed channel if private.
+func publishPayload(port int, e lobbyEntry, channel []byte) []byte {
+	b := append([]byte(lobbyMagic), lobbyPublish, byte(port>>8), byte(port))
+	// round up so that a known RTT is never 0
+	ms := (e.rtt + time.Millisecond - 1) / time.Millisecond
+	b = append(b, byte(ms>>8), byte(ms), e.flags)
+	tag := tokenTag()
+	b = append(b, tag[:]...)
+	if e.flags&lobbyPrivate != 0 {
+		b = append(b, channel...)
+	}
+	return appendLobbyFields(b, e)
+}
+
+func appendLobbyFields(b []byte, e lobbyEntry) []byte {
+	for _, v := range []string{e.game, e.nickname, e.region, e.notes} {
+		if len(v) > maxLobbyField {
+			v = v[:maxLobbyField]
+		}
+		b = append(b, byte(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// readLobbyFields parses the strings of a lobby entry at the start of b, and
+// returns the rest of b.
+func readLobbyFields(b []byte) (lobbyEntry, []byte, error) {
+	var fields [4]string
+	for i := range fields {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return lobbyEntry{}, nil, errors.New("truncated lobby entry")
+		}
+		fields[i] = string(b[1 : 1+int(b[0])])
+		b = b[1+int(b[0]):]
+	}
+	return lobbyEntry{
+		game:     fields[0],
+		nickname: fields[1],
+		region:   fields[2],
+		notes:    fields[3],
+	}, b, nil
+}
+
+// publishSession publishes the session hosted on port on the lobby of the
+// relay until done is closed, that is until a peer connects.
+func publishSession(s *session, c packetConn, relayAddr *net.UDPAddr, port int, done chan struct{}) {
+	e := lobbyEntry{
+		game:     presetName(s.preset),
+		nickname: nickname,
+		region:   region,
+		notes:    notes,
+	}
+	if password != "" {
+		e.flags |= lobbyPassword
+	}
+	if token != "" {
+		e.flags |= lobbyCommunity
+	}
+	var channel []byte
+	if private {
+		e.flags |= lobbyPrivate
+		// the channel is only known with the public address of the host
+		for channel == nil {
+			select {
+			case <-done:
+				return
+			case <-time.After(500 * time.Millisecond):
+			}
+			s.mu.Lock()
+			if s.external != nil {
+				channel = channelId(s.external.IP, port)
+			}
+			s.mu.Unlock()
+		}
+	}
+	s.println("Publishing this session on the public lobby")
+
+	ticker := time.NewTicker(lobbyInterval)
+	defer ticker.Stop()
+	for {
+		if rtt, err := relayRtt(relayAddr); err == nil {
+			e.rtt = rtt
+		}
+		c.WriteToUDP(sealRelay(publishPayload(port, e, channel), relayAddr), relayAddr)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayRtt measures the round trip time to the relay with an echo message,
+// from a separate socket so as not to disturb the proxy socket.
+func relayRtt(relayAddr *net.UDPAddr) (time.Duration, error) {
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(1 * time.Second))
+	start := time.Now()
+	if _, err := c.Write([]byte{0}); err != nil {
+		return 0, err
+	}
+	buffer := make([]byte, 16)
+	for {
+		n, err := c.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if n == 1 {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// fetchLobby returns the sessions listed on the lobby of the relay.
+func fetchLobby(relayAddr *net.UDPAddr) ([]lobbyListing, error) {
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var listings []lobbyListing
+	buffer := make([]byte, 2048)
+	pages := 1
+	for page := 0; page < pages; page++ {
+		request := make([]byte, lobbyPageSize)
+		copy(request, lobbyMagic)
+		request[4] = lobbyList
+		request[5] = byte(page)
+		tag := tokenTag()
+		copy(request[6:14], tag[:])
+		request[14] = lobbyVersion
+		sealed := sealRelay(request, relayAddr)
+		received := false
+		for try := 0; try < 3 && !received; try++ {
+			if _, err := c.Write(sealed); err != nil {
+				return nil, err
+			}
+			c.SetReadDeadline(time.Now().Add(1 * time.Second))
+			for {
+				n, err := c.Read(buffer)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				b := openRelay(buffer[:n], relayAddr)
+				if len(b) < 7 || string(b[:4]) != lobbyMagic || b[4] != lobbyEntries || int(b[5]) != page {
+					continue
+				}
+				pages = int(b[6])
+				entries, err := parseListings(b[7:])
+				if err != nil {
+					return nil, err
+				}
+				listings = append(listings, entries...)
+				received = true
+				break
+			}
+		}
+		if !received {
+			return nil, errors.New("no answer from the relay")
+		}
+	}
+	return listings, nil
+}
+
+func parseListings(b []byte) ([]lobbyListing, error) {
+	var listings []lobbyListing
+	for len(b) > 0 {
+		if len(b) < 9 {
+			return nil, errors.New("truncated lobby entry")
+		}
+		l := lobbyListing{
+			host: net.IPv4(b[0], b[1], b[2], b[3]),
+			port: int(binary.BigEndian.Uint16(b[4:6])),
+		}
+		rtt := time.Duration(binary.BigEndian.Uint16(b[6:8])) * time.Millisecond
+		flags := b[8]
+		b = b[9:]
+		if flags&lobbyPrivate != 0 {
+			if len(b) < 8 {
+				return nil, errors.New("truncated lobby entry")
+			}
+			l.channel = append([]byte(nil), b[:8]...)
+			b = b[8:]
+		}
+		e, rest, err := readLobbyFields(b)
+		if err != nil {
+			return nil, err
+		}
+		l.lobbyEntry = e
+		l.rtt = rtt
+		l.flags = flags
+		listings = append(listings, l)
+		b = rest
+	}
+	return listings, nil
+}
+
+// describe formats a listing for the lobby browser; rtt is the round trip
+// time from this host to the relay, 0 if unknown.
+func (l lobbyListing) describe(rtt time.Duration) string {
+	name := l.nickname
+	if name == "" && l.flags&lobbyPrivate != 0 {
+		name = "Anonymous"
+	} else if name == "" {
+		name = l.host.String()
+	}
+	var details []string
+	if p := presets[l.game]; p != nil {
+		details = append(details, p.title)
+	} else if l.game != "" {
+		details = append(details, l.game)
+	}
+	if l.region != "" {
+		details = append(details, l.region)
+	}
+	if l.flags&lobbyCommunity != 0 {
+		details = append(details, "community")
+	}
+	if l.flags&lobbyPassword != 0 {
+		details = append(details, "password")
+	}
+	if l.flags&lobbyPrivate != 0 {
+		details = append(details, "private, relayed")
+	}
+	if l.rtt > 0 && rtt > 0 {
+		// peers reach each other directly, this is an upper bound in most cases
+		details = append(details, "ping ~"+strconv.Itoa(int((l.rtt+rtt)/time.Millisecond))+"ms")
+	}
+	desc := name
+	if len(details) > 0 {
+		desc += " (" + strings.Join(details, ", ") + ")"
+	}
+	if l.notes != "" {
+		desc += ": " + l.notes
+	}
+	return desc
+}
+
+// browseLobby shows the sessions listed on the lobby until one is chosen.
+func browseLobby(scanner *bufio.Scanner) (lobbyListing, bool) {
+	relayAddr, err := resolveRelay(&session{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error resolving relay: "+err.Error())
+		return lobbyListing{}, false
+	}
+	for {
+		fmt.Println("Fetching the public lobby...")
+		if err := pinRelay(&session{}, relayAddr); err != nil {
+			fmt.Fprintln(os.Stderr, "Error "+err.Error())
+			return lobbyListing{}, false
+		}
+		if err := authenticateRelay(&session{}, relayAddr, nil); err != nil {
+			fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		}
+		listings, err := fetchLobby(relayAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error fetching the public lobby: "+err.Error())
+		}
+		sort.Slice(listings, func(i, j int) bool {
+			// closest hosts first, unknown last
+			a, b := listings[i].rtt, listings[j].rtt
+			return a != 0 && (b == 0 || a < b)
+		})
+		rtt, _ := relayRtt(relayAddr)
+		if len(listings) == 0 {
+			fmt.Println("No open sessions.")
+		}
+		for i, l := range listings {
+			fmt.Println("[" + strconv.Itoa(i+1) + "] " + l.describe(rtt))
+		}
+		fmt.Println("Session? (type its number, or press Enter to refresh)")
+		if !scanner.Scan() {
+			return lobbyListing{}, false
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil || i < 1 || i > len(listings) {
+			continue
+		}
+		l := listings[i-1]
+		if l.flags&lobbyPassword != 0 && password == "" {
+			fmt.Println("Password?")
+			if !scanner.Scan() {
+				return lobbyListing{}, false
+			}
+			password = scanner.Text()
+		}
+		return l, true
+	}
+}
+
+// browse runs the lobby browser, then connects to the chosen session.
+func browse(args []string) {
+	fs := flag.NewFlagSet("browse", flag.ExitOnError)
+	configFile := fs.String("config", "proxypunch.yml", "load the relay configuration from file")
+	fs.StringVar(&relay, "relay", "", "relay host, optionally with its port (default: relay: in the configuration file, or "+relayHost+")")
+	fs.StringVar(&password, "password", "", "password presented to the host, prompted if needed")
+	fs.StringVar(&token, "token", "", "community token, to list and join the sessions of a community (default: token: in the configuration file)")
+	fs.Parse(args)
+
+	applyConfig(loadConfig(*configFile))
+
+	l, ok := browseLobby(bufio.NewScanner(os.Stdin))
+	if !ok {
+		return
+	}
+	client(&session{preset: presets[l.game], channel: l.channel}, l.host.String(), l.port)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// percent is a flag value for a percentage such as "2%" or "2.5".
+type percent float64
+
+func (p *percent) String() string {
+	return strconv.FormatFloat(float64(*p), 'f', -1, 64) + "%"
+}
+
+func (p *percent) Set(s string) error {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || v < 0 || v > 100 {
+		return errors.New("must be a percentage between 0% and 100%")
+	}
+	*p = percent(v)
+	return nil
+}
+
+// lossModel drops packets following a two-state Gilbert model: in the bad
+// state every packet is dropped, so that losses come in bursts of the
+// configured average length while the overall loss rate stays the same.
+type lossModel struct {
+	goodToBad float64
+	badToGood float64
+	bad       bool
+	rand      *rand.Rand
+}
+
+// newLossModel returns a loss model for a loss rate in percent and an average
+// burst length in packets, or nil if no packets are to be dropped.
+func newLossModel(loss percent, burst int) *lossModel {
+	rate := float64(loss) / 100
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	m := &lossModel{
+		badToGood: 1 / float64(burst),
+		rand:      rand.New(rand.NewSource(rand.Int63())),
+	}
+	if rate >= 1 {
+		m.goodToBad = 1
+		m.badToGood = 0
+	} else {
+		m.goodToBad = rate / (float64(burst) * (1 - rate))
+	}
+	return m
+}
+
+// drop returns whether the next packet is to be dropped. A nil model drops
+// nothing.
+func (m *lossModel) drop() bool {
+	if m == nil {
+		return false
+	}
+	if m.bad {
+		m.bad = m.rand.Float64() >= m.badToGood
+	} else {
+		m.bad = m.rand.Float64() < m.goodToBad
+	}
+	return m.bad
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// lowLatencyBuffer is the socket buffer size used in low-latency mode when
+// no explicit size is set.
+const lowLatencyBuffer = 4 * 1024 * 1024
+
+// lowLatencyMemory is the soft memory limit used in low-latency mode; the
+// garbage collector runs rarely until the heap approaches it.
+const lowLatencyMemory = 256 * 1024 * 1024
+
+var lowLatency bool
+
+func applyLowLatency() {
+	if !lowLatency {
+		return
+	}
+	debug.SetGCPercent(800)
+	debug.SetMemoryLimit(lowLatencyMemory)
+	if readBuffer == 0 {
+		readBuffer = lowLatencyBuffer
+	}
+	if writeBuffer == 0 {
+		writeBuffer = lowLatencyBuffer
+	}
+}
+
+// lockThread locks the calling forwarding goroutine to its OS thread in
+// low-latency mode, and returns the function undoing it.
+func lockThread() func() {
+	if !lowLatency {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	return runtime.UnlockOSThread
+}
@@ -3,13 +3,11 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -24,237 +22,69 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-const relayHost = "delthas.fr:14761"
+// relayHost is the public relay; its relays and ports are discovered from
+// its DNS SRV record, see srvRelays.
+const relayHost = "delthas.fr"
 
 const defaultPort = 41254
 
 var _, localIpv4, _ = net.ParseCIDR("127.0.0.0/8")
 var _, localIpv6, _ = net.ParseCIDR("fc00::/7")
 
-type Config struct {
-	Mode                string `yaml:"mode"`
-	LocalPort           int    `yaml:"local_port"`
-	Host                string `yaml:"remote_host"`
-	RemotePort          int    `yaml:"remote_port"`
-	DownloadedAutopunch bool   `yaml:"downloaded_autopunch"`
-}
-
-func client(host string, port int) {
-	c, err := net.ListenUDP("udp4", &net.UDPAddr{
-		Port: defaultPort,
-	})
-	if err != nil {
-		c, err = net.ListenUDP("udp4", nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	defer c.Close()
-
-	localPort := c.LocalAddr().(*net.UDPAddr).Port
-	fmt.Println("Listening, connect to 127.0.0.1 on port " + strconv.Itoa(localPort))
-
-	relayAddr, err := net.ResolveUDPAddr("udp4", relayHost)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	remoteAddr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(port)))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	chRelay := make(chan struct{})
-	go func() {
-		relayPayload := append([]byte{byte(port >> 8), byte(port)}, remoteAddr.IP.To4()...)
-		for {
-			select {
-			case <-chRelay:
-				return
-			default:
-			}
-			c.WriteToUDP(relayPayload, relayAddr)
-			time.Sleep(500 * time.Millisecond)
-		}
-	}()
-	defer close(chRelay)
-
-	buffer := make([]byte, 4096)
-
-	for {
-		n, addr, err := c.ReadFromUDP(buffer)
-		if err != nil {
-			// err is thrown if the buffer is too small
-			continue
-		}
-		if !addr.IP.Equal(relayAddr.IP) || addr.Port != relayAddr.Port {
-			continue
-		}
-		if n != 2 {
-			fmt.Fprintln(os.Stderr, "Error received packet of wrong size from relay. (size:"+strconv.Itoa(n)+")")
-			continue
-		}
-		remoteAddr.Port = int(binary.BigEndian.Uint16(buffer[:2]))
-		break
-	}
-
-	chPunch := make(chan struct{})
-	go func() {
-		punchPayload := []byte{0xCD}
-		for {
-			select {
-			case <-chPunch:
-				return
-			default:
-			}
-			c.WriteToUDP(punchPayload, remoteAddr)
-			time.Sleep(500 * time.Millisecond)
-		}
-	}()
-	defer close(chPunch)
-
-	foundPeer := false
-	var localAddr net.UDPAddr
-	for {
-		n, addr, err := c.ReadFromUDP(buffer[1:])
-		if err != nil {
-			// err is thrown if the buffer is too small
-			continue
-		}
-		if n > len(buffer)-1 {
-			fmt.Fprintln(os.Stderr, "Error received packet of wrong size from peer. (size:"+strconv.Itoa(n)+")")
-			continue
-		}
-		if addr.IP.Equal(relayAddr.IP) && addr.Port == relayAddr.Port {
-			continue
-		}
-		if addr.IP.Equal(remoteAddr.IP) && addr.Port == remoteAddr.Port {
-			if !foundPeer {
-				foundPeer = true
-				fmt.Println("Connected to peer")
-			}
-			if n != 0 && localAddr.Port != 0 && buffer[1] == 0xCC {
-				c.WriteToUDP(buffer[2:n+1], &localAddr)
-			}
-		} else if localIpv4.Contains(addr.IP) || localIpv6.Contains(addr.IP) {
-			localAddr = *addr
-			buffer[0] = 0xCC
-			c.WriteToUDP(buffer[:n+1], remoteAddr)
-		}
-	}
-}
-
-func server(port int) {
-	c, err := net.ListenUDP("udp4", nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer c.Close()
-
-	fmt.Println("Listening, start hosting on port " + strconv.Itoa(port))
-	fmt.Println("Connecting...")
-
-	localAddr := &net.UDPAddr{
-		IP:   net.IPv4(127, 0, 0, 1),
-		Port: port,
-	}
-
-	relayAddr, err := net.ResolveUDPAddr("udp4", relayHost)
-	if err != nil {
-		log.Fatal(err)
-	}
+var verbose bool
+var strict bool
+var rateLimitPackets int
+var rateLimitBytes int
+var readBuffer int
+var writeBuffer int
+var queueDepth = defaultQueueDepth
+var queueMemory = defaultQueueMemory
+var addLatency time.Duration
+var addLoss percent
+var lossBurst = 1
+var delayStats bool
+var fps = 60
 
-	chRelay := make(chan struct{})
-	go func() {
-		relayPayload := []byte{byte(port >> 8), byte(port)}
-		for {
-			select {
-			case <-chRelay:
-				return
-			default:
-			}
-			c.WriteToUDP(relayPayload, relayAddr)
-			time.Sleep(500 * time.Millisecond)
-		}
-	}()
-	defer close(chRelay)
-
-	var remoteAddr net.UDPAddr
-	buffer := make([]byte, 4096)
-
-	receivedIp := false
-	for {
-		n, addr, err := c.ReadFromUDP(buffer)
-		if err != nil {
-			// err is thrown if the buffer is too small
-			continue
-		}
-		if !addr.IP.Equal(relayAddr.IP) || addr.Port != relayAddr.Port {
-			continue
-		}
-		if n == 4 {
-			if !receivedIp {
-				receivedIp = true
-				ip := net.IP(buffer[:4])
-				fmt.Println("Connected. Ask your peer to connect to " + ip.String() + " on port " + strconv.Itoa(port) + " with proxypunch")
-			}
-			continue
-		}
-		if n != 6 {
-			fmt.Fprintln(os.Stderr, "Error received packet of wrong size from relay. (size:"+strconv.Itoa(n)+")")
-			continue
-		}
-		ip := make([]byte, 4)
-		copy(ip, buffer[2:6])
-		remoteAddr = net.UDPAddr{
-			IP:   net.IP(ip),
-			Port: int(binary.BigEndian.Uint16(buffer[:2])),
-		}
-		break
-	}
-
-	chPunch := make(chan struct{})
-	go func() {
-		punchPayload := []byte{0xCD}
-		for {
-			select {
-			case <-chPunch:
-				return
-			default:
-			}
-			c.WriteToUDP(punchPayload, &remoteAddr)
-			time.Sleep(500 * time.Millisecond)
-		}
-	}()
-	defer close(chPunch)
-
-	foundPeer := false
-	for {
-		n, addr, err := c.ReadFromUDP(buffer[1:])
-		if err != nil {
-			// err is thrown if the buffer is too small
-			continue
-		}
-		if n > len(buffer)-1 {
-			fmt.Fprintln(os.Stderr, "Error received packet of wrong size from peer. (size:"+strconv.Itoa(n)+")")
-			continue
-		}
-		if addr.IP.Equal(relayAddr.IP) && addr.Port == relayAddr.Port {
-			continue
-		}
-		if addr.IP.Equal(remoteAddr.IP) && addr.Port == remoteAddr.Port {
-			if !foundPeer {
-				foundPeer = true
-				fmt.Println("Connected to peer")
-			}
-			if n != 0 && buffer[1] == 0xCC {
-				c.WriteToUDP(buffer[2:n+1], localAddr)
-			}
-		} else if (localIpv4.Contains(addr.IP) || localIpv6.Contains(addr.IP)) && addr.Port == port {
-			buffer[0] = 0xCC
-			c.WriteToUDP(buffer[:n+1], &remoteAddr)
-		}
-	}
+type Config struct {
+	Mode                string           `yaml:"mode"`
+	LocalPort           int              `yaml:"local_port"`
+	Host                string           `yaml:"remote_host"`
+	RemotePort          int              `yaml:"remote_port"`
+	DownloadedAutopunch bool             `yaml:"downloaded_autopunch"`
+	Game                string           `yaml:"game,omitempty"`
+	Sessions            []SessionConfig  `yaml:"sessions,omitempty"`
+	Relay               string           `yaml:"relay,omitempty"`
+	RelayIps            []string         `yaml:"relay_ips,omitempty"`
+	Relays              []string         `yaml:"relays,omitempty"`
+	RelayToken          string           `yaml:"relay_token,omitempty"`
+	RelayKey            string           `yaml:"relay_key,omitempty"`
+	Nickname            string           `yaml:"nickname,omitempty"`
+	Region              string           `yaml:"region,omitempty"`
+	Token               string           `yaml:"token,omitempty"`
+	Name                string           `yaml:"name,omitempty"`
+	Room                string           `yaml:"room,omitempty"`
+	Via                 string           `yaml:"via,omitempty"`
+	Autostart           bool             `yaml:"autostart,omitempty"`
+	Plain               bool             `yaml:"plain,omitempty"`
+	Encrypt             bool             `yaml:"encrypt,omitempty"`
+	Compress            bool             `yaml:"compress,omitempty"`
+	Fec                 int              `yaml:"fec,omitempty"`
+	Redundancy          int              `yaml:"redundancy,omitempty"`
+	Integrity           bool             `yaml:"integrity,omitempty"`
+	Multipath           bool             `yaml:"multipath,omitempty"`
+	Reorder             int              `yaml:"reorder,omitempty"`
+	ReorderLatency      string           `yaml:"reorder_latency,omitempty"`
+	Dscp                string           `yaml:"dscp,omitempty"`
+	Socks               int              `yaml:"socks,omitempty"`
+	Forwards            []string         `yaml:"forwards,omitempty"`
+	Allow               []string         `yaml:"allow,omitempty"`
+	Bans                []string         `yaml:"bans,omitempty"`
+	Accept              bool             `yaml:"accept,omitempty"`
+	PunchTimeout        string           `yaml:"punch_timeout,omitempty"`
+	PunchRetries        int              `yaml:"punch_retries,omitempty"`
+	PunchInterval       string           `yaml:"punch_interval,omitempty"`
+	KeepalivePayload    string           `yaml:"keepalive_payload,omitempty"`
+	Schedule            []ScheduleConfig `yaml:"schedule,omitempty"`
 }
 
 func update(scanner *bufio.Scanner) bool {
@@ -444,17 +274,23 @@ func autopunch() bool {
 	}
 	pr := progress.NewReader(r.Body)
 
-	fmt.Println("===================================================")
+	decoration("===================================================")
 	fmt.Println("proxypunch will now try to download autopunch for you (will only do that once).")
-	defer fmt.Println("===================================================")
+	defer decoration("===================================================")
 
 	go func() {
 		ctx := context.Background()
 		progressChan := progress.NewTicker(ctx, pr, asset.Size, 1*time.Second)
 		for p := range progressChan {
-			fmt.Printf("\rdownload: %v remaining...", p.Remaining().Round(time.Second))
+			if !plain {
+				fmt.Printf("\rdownload: %v remaining...", p.Remaining().Round(time.Second))
+			}
+		}
+		if plain {
+			fmt.Println(timestamp() + "The download is completed.")
+		} else {
+			fmt.Println("\rdownload is completed!")
 		}
-		fmt.Println("\rdownload is completed!")
 	}()
 	_, err = io.Copy(f, pr)
 	r.Body.Close()
@@ -496,59 +332,245 @@ func main() {
 		os.Remove("proxypunch_old.exe")
 	}
 
+	for i, arg := range os.Args[1:] {
+		if !isUri(arg) {
+			continue
+		}
+		args, err := uriArgs(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing link: "+err.Error())
+			return
+		}
+		os.Args = append(append(os.Args[:i+1:i+1], args...), os.Args[i+2:]...)
+		break
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "install":
+			install(os.Args[2:])
+			return
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "bot":
+			bot(os.Args[2:])
+			return
+		case "browse":
+			browse(os.Args[2:])
+			return
+		case "list":
+			list(os.Args[2:])
+			return
+		case "setup":
+			setup(os.Args[2:])
+			return
+		case "detect":
+			detect(os.Args[2:])
+			return
+		}
+	}
+
 	var mode string
 	var host string
 	var port int
 	var noSave bool
 	var noUpdate bool
 	var configFile string
-
-	flag.StringVar(&mode, "mode", "", "connect mode: server, client")
-	flag.StringVar(&host, "host", "", "remote host for client mode: ipv4 or ipv6 or hostname")
-	flag.IntVar(&port, "port", 0, "port for client or server mode")
+	var all bool
+	var daemon bool
+	var channel []byte
+	var opponent string
+
+	flag.StringVar(&mode, "mode", "", "connect mode: server, client, browse")
+	flag.StringVar(&game, "game", "", "game preset: "+presetNames())
+	flag.StringVar(&host, "host", "", "remote host for client mode: ipv4 or ipv6 or hostname, name@relay for a name registered on a relay, the code given to the host, e.g. BLUE-FOX-41, or #room to join a room, see -room")
+	flag.Var(portValue{&port}, "port", "port for client or server mode; auto in server mode chooses a free port to host on; server mode: several ports separated by commas forward all of them in the session, for games using several UDP ports")
+	flag.IntVar(&targetPid, "pid", 0, "server mode: find the port from the UDP socket of the game process with this id, following it if it changes")
+	flag.StringVar(&targetProcess, "process", "", "server mode: find the port from the UDP socket of the game process with this name (e.g. th123.exe), following it if it changes")
 	flag.BoolVar(&noSave, "nosave", false, "disable saving configuration to file")
 	flag.BoolVar(&noUpdate, "noupdate", false, "disable automatic update")
+	flag.BoolVar(&noUpnp, "noupnp", false, "server mode: disable asking the router to forward UDP port 41254 with UPnP, PCP or NAT-PMP")
+	flag.BoolVar(&noScan, "noscan", false, "disable detecting the local UDP ports games listen on when prompted for the port in server mode")
+	flag.BoolVar(&publish, "publish", false, "server mode: publish the session on the public lobby of the relay until a peer connects, and list the room of -room on proxypunch list")
+	flag.StringVar(&nickname, "nickname", "", "nickname shown to your peer and on the public lobby (default: nickname: in the configuration file)")
+	flag.StringVar(&region, "region", "", "region shown on the public lobby, e.g. EU, and whose relays are preferred among relays tagged with their region, e.g. -relay eu=relay-eu.example.com,na=relay-na.example.com (default: region: in the configuration file)")
+	flag.StringVar(&notes, "notes", "", "notes shown on the public lobby")
+	flag.StringVar(&name, "name", "", "server mode: register this name on the relay, so that peers can connect to name@relay (default: name: in the configuration file)")
+	flag.StringVar(&room, "room", "", "server mode: host this room on the relay, e.g. \"Friday Netplay\", so that peers can join it by its name (default: room: in the configuration file); client mode: join this room")
+	flag.StringVar(&relay, "relay", "", "relay host, optionally with its port, e.g. relay.example.com:14761, to use another relay or your own, without a port the relays of its DNS SRV record _proxypunch._udp.<host> if any; several separated by commas to use the one with the lowest latency (default: relay: in the configuration file, or "+relayHost+")")
+	flag.StringVar(&relayToken, "relay-token", "", "token of the community of a restricted relay, given by its operator (default: relay_token: in the configuration file)")
+	flag.StringVar(&relayKey, "relay-key", "", "public keys of the trusted relays, separated by commas, as printed by proxypunch-relay: answers not signed by these relays are ignored (default: relay_key: in the configuration file)")
+	flag.StringVar(&via, "via", "", "client mode: chain through this relay, then the relay of the host, so that neither relay learns both peer addresses, at a latency cost (default: via: in the configuration file)")
+	flag.BoolVar(&private, "private", false, "keep the session relayed so that neither peer learns the address of the other, at a latency cost; server mode: only accept peers connecting with -private")
+	flag.StringVar(&password, "password", "", "server mode: password peers must present to join; client mode: password presented to the host")
+	flag.StringVar(&token, "token", "", "community token: published sessions are only listed to players with the same token, which they must present to join (default: token: in the configuration file)")
 	flag.StringVar(&configFile, "config", "proxypunch.yml", "load configuration from file")
+	flag.BoolVar(&all, "all", false, "run all sessions defined under sessions: in the configuration file concurrently")
+	flag.BoolVar(&daemon, "daemon", false, "run unattended, starting the sessions defined under schedule: in the configuration file at their scheduled times")
+	flag.BoolVar(&verbose, "v", false, "verbose output: log ignored packets from unexpected sources")
+	flag.BoolVar(&strict, "strict", false, "once connected, only accept packets from the peer address first reached and the game, silently dropping everything else, without ever switching to another address of the peer")
+	flag.BoolVar(&compress, "compress", false, "compress the game packets sent to the peer when it makes them smaller, for compressible games over slow upstreams; the peer needs a proxypunch supporting it (default: compress: in the configuration file)")
+	flag.IntVar(&fec, "fec", 0, "send a parity packet after every this many game packets sent to the peer, from which it recovers one lost packet of each group, e.g. 4 for 25% more packets, for lossy links such as Wi-Fi; the peer needs a proxypunch supporting it (0: disabled, default: fec: in the configuration file)")
+	flag.StringVar(&forwardList, "forward", "", "forward other game ports with the peer, as comma-separated local:remote port pairs: in server mode, the extra game port local, which peers open on their port remote; in client mode, the port local for the game port remote of the host, e.g. 7000:10801,7001:10802 (default: forwards: in the configuration file)")
+	flag.IntVar(&socksPort, "socks", 0, "open a local SOCKS5 proxy on this port once connected, through which applications reach the TCP ports of the computer of the peer, e.g. 1080; only if the peer also runs -socks, which lets it reach the TCP ports of this computer (0: disabled, default: socks: in the configuration file)")
+	flag.IntVar(&redundancy, "redundancy", 0, "send each game packet this many times to the peer, which keeps the first copy received, e.g. 2 for tournament matches over flaky connections, at the cost of as many times the bandwidth; the peer needs a proxypunch supporting it (0: disabled, default: redundancy: in the configuration file)")
+	flag.BoolVar(&integrity, "integrity", false, "add a sequence number and a checksum to the game packets sent to the peer, which drops corrupted and truncated ones rather than handing them to the game, and counts them apart from lost ones; the peer needs a proxypunch supporting it (default: integrity: in the configuration file)")
+	flag.IntVar(&reorder, "reorder", 0, "hold the game packets of the peer received out of order until the ones before them arrive, at most this many of them, for games that behave badly with out-of-order packets; the peer needs a proxypunch supporting it (0: disabled, at most 64, default: reorder: in the configuration file)")
+	flag.DurationVar(&reorderLatency, "reorder-latency", reorderLatency, "longest time a packet is held by -reorder, after which the packets before it are skipped (at most 20ms, or reorder_latency: in the configuration file)")
+	flag.BoolVar(&multipath, "multipath", false, "when the peer is reached on both its IPv4 and IPv6 addresses, keep both alive for the whole session, switching to the other one when the one in use stops answering or becomes slower, so that a failing path does not end the match (default: multipath: in the configuration file)")
+	flag.BoolVar(&encrypt, "encrypt", false, "encrypt the game traffic exchanged with the peer, and only forward it encrypted; the peer needs a proxypunch supporting it; the peer is only authenticated with -password: without it, someone able to intercept and alter the traffic can sit in the middle and read it (default: encrypt: in the configuration file)")
+	flag.IntVar(&rateLimitPackets, "ratelimit-pps", 0, "maximum packets per second accepted from each remote source (0: unlimited)")
+	flag.IntVar(&rateLimitBytes, "ratelimit-bps", 0, "maximum bytes per second accepted from each remote source, in bursts of up to one second of traffic or 64KiB (0: unlimited)")
+	flag.IntVar(&readBuffer, "rcvbuf", 0, "socket receive buffer size in bytes (0: system default)")
+	flag.IntVar(&writeBuffer, "sndbuf", 0, "socket send buffer size in bytes (0: system default)")
+	flag.StringVar(&dscp, "dscp", "", "DSCP class of the packets sent to the peer, for routers prioritizing traffic with QoS: EF, CS0 to CS7, AF11 to AF43, or a value between 0 and 63, e.g. EF; Linux only (default: dscp: in the configuration file, or system default)")
+	flag.IntVar(&queueDepth, "queue-depth", queueDepth, "maximum count of packets queued for the peer and for the game each, dropping the oldest when full")
+	flag.IntVar(&queueMemory, "queue-memory", queueMemory, "maximum total bytes of queued packets, dropping the oldest when reached (0: unlimited)")
+	flag.BoolVar(&lowLatency, "lowlatency", false, "tune the runtime for latency: rare garbage collection, dedicated threads, large socket buffers")
+	flag.DurationVar(&addLatency, "add-latency", 0, "artificial latency added to the round trip time, split between both directions, e.g. 60ms")
+	flag.Var(&addLoss, "add-loss", "artificial packet loss rate on each direction, e.g. 2%")
+	flag.IntVar(&lossBurst, "loss-burst", lossBurst, "average length in packets of artificial loss bursts (1: independent losses)")
+	flag.BoolVar(&delayStats, "delaystats", false, "periodically report the recommended rollback frame delay and how often latency exceeded each frame budget")
+	flag.IntVar(&fps, "fps", fps, "game frame rate used for frame delay statistics")
+	flag.StringVar(&bindAddr, "bind", "", "port of the proxy socket, optionally after an address as -listen, e.g. 0.0.0.0:10800 to let the devices of your local network connect to this port (default: 41254 if free)")
+	flag.StringVar(&allowList, "allow", "", "server mode: only answer peers connecting from these comma-separated IP addresses or networks, e.g. 203.0.113.7,198.51.100.0/24, silently ignoring others; such peers must connect directly rather than through the relay (default: allow: in the configuration file)")
+	flag.BoolVar(&acceptPeers, "accept", false, "server mode: accept incoming peers without asking; otherwise, when run in a terminal, you are asked whether to accept each peer once it connected, by answering y or n (default: accept: in the configuration file)")
+	flag.BoolVar(&transparent, "transparent", false, "server mode: send the packets of the peer to the game from the address of the peer rather than from 127.0.0.1, for games that show or check the address of their opponent; Linux only, needs root and the routing rules printed once connected")
+	flag.StringVar(&targetAddr, "target", "", "server mode: forward to the game hosted on another device of your local network at this address, optionally with its port, e.g. 192.168.1.50:10800")
+	flag.StringVar(&listenAddr, "listen", listenAddr, "client mode: accept games from this host only (127.0.0.1), from the local network of the interface with this address, or from all local networks (0.0.0.0)")
+	flag.DurationVar(&punchTimeout, "punch-timeout", punchTimeout, "time spent trying to reach the peer directly before relaying the traffic through the relay (or punch_timeout: in the configuration file)")
+	flag.IntVar(&punchRetries, "punch-retries", punchRetries, "count of punch rounds sent every -punch-interval before backing off exponentially, up to 5s between rounds (or punch_retries: in the configuration file)")
+	flag.DurationVar(&punchInterval, "punch-interval", punchInterval, "interval between the first punch rounds (or punch_interval: in the configuration file)")
+	flag.IntVar(&keepaliveSeconds, "keepalive", 0, "server mode: seconds between the registrations to the relay keeping your NAT mapping alive while waiting for a peer (0: start at 0.5s and lengthen it while your NAT keeps the mapping)")
+	flag.StringVar(&keepalivePayload, "keepalive-payload", "", "payload of the punch packets keeping the connection to the peer open, if they collide with the packets of your game: hexadecimal bytes, or silent for empty packets; the peer must use the same (or keepalive_payload: in the configuration file, also per session under sessions:)")
+	flag.IntVar(&maxPeers, "max-peers", maxPeers, "server mode: count of peers forwarded to the game at once, each seen by the game as a separate player on its own local port, for spectators and lobbies of 3 players or more")
+	flag.IntVar(&spectators, "spectators", 0, "server mode: count of spectators accepted besides the peers, who receive a copy of the packets the game sends to the first peer, and cannot send packets to the game")
+	flag.IntVar(&spectatorPort, "spectator-port", 0, "server mode: forward the spectators to this port of the game instead, for games with a spectator port")
+	flag.StringVar(&proto, "proto", proto, "transport of the game: udp, tcp to punch a TCP connection to the peer and proxy the TCP stream of the game over it, or tcp-udp to proxy the TCP stream of the game over the UDP session, with its own retransmissions")
+	flag.StringVar(&bridge, "bridge", "", "bridge the LAN discovery packets of games with the peer, separated by commas: broadcast ports, or multicast group:port, e.g. 6112,239.255.0.1:5000")
+	flag.BoolVar(&plain, "plain", false, "screen reader friendly output: timestamped sentences for every state change, without decorations or lines rewritten in place (default: plain: in the configuration file)")
+	flag.DurationVar(&duration, "duration", 0, "stop proxypunch after this time, e.g. 2h, warning you and the peer 5 minutes before (0: run indefinitely)")
+	flag.StringVar(&statsFile, "stats-file", "", "append the ping, loss and throughput of every 10 seconds of the session to this file, as CSV, or as JSON lines if it ends with .json")
+	flag.StringVar(&statusFile, "status-file", "", "write the live status of the session (state, opponent, ping) to this file every second, for streaming software overlays: as JSON if it ends with .json, otherwise formatted with -status-template")
+	flag.StringVar(&statusTemplate, "status-template", defaultStatusTemplate, "Go template of the status file, with fields .State, .Opponent, .Ping (ms), .Connected and .Game")
+	flag.StringVar(&cpuList, "cpus", "", "pin proxypunch to these cpus, e.g. 2,3 or 0-1")
+	flag.StringVar(&priority, "priority", "normal", "process priority: normal, high, realtime (may require elevated privileges)")
 	flag.Parse()
 
+	if fps <= 0 {
+		fps = 60
+	}
+	applyLowLatency()
+	applyScheduling()
+	if err := applyListen(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyTarget(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyPunch(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyKeepalive(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyKeepalivePayload(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyTransparent(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyDscp(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyProto(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyMaxPeers(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyBridge(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := openStatsFile(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening the statistics file: "+err.Error())
+		return
+	}
+
+	go limitDuration()
+
 	scanner := bufio.NewScanner(os.Stdin)
 
-	if !noUpdate && ProgramArch != "" && ProgramVersion != "[Custom Build]" {
+	if !noUpdate && !daemon && ProgramArch != "" && ProgramVersion != "[Custom Build]" {
 		if update(scanner) {
 			return
 		}
 	}
 
-	var config Config
+	// in client mode, -room joins the room, unlike room: in the config file
+	joinRoom := room
+	if mode == "client" && host == "" && joinRoom != "" {
+		host = "#" + joinRoom
+	}
+	noConfig := !all && ((mode == "server" && (port != 0 || targeting())) || (mode == "client" && host != "" && (port != 0 || isName(host) || isCode(host) || isRoom(host))))
+	// settings are always read from the config file, but the prompt defaults are
+	// only saved back when prompting
+	config := loadConfig(configFile)
+	applyConfig(config)
+	if err := applyForwards(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	if err := applyAllow(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		return
+	}
+	keyFile = filepath.Join(filepath.Dir(configFile), keyFile)
 
-	noConfig := (mode == "server" && port != 0) || (mode == "client" && host != "" && port != 0)
-	if !noConfig {
-		file, err := os.Open(configFile)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				fmt.Fprintln(os.Stderr, "Error opening file "+configFile+": "+err.Error())
-			}
-		} else {
-			decoder := yaml.NewDecoder(file)
-			err = decoder.Decode(&config)
-			file.Close()
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "Error decoding config file "+configFile+". ("+err.Error()+")")
-			}
-			if config.Mode != "server" && config.Mode != "client" {
-				config.Mode = ""
-			}
-			if config.LocalPort <= 0 || config.LocalPort > 65535 {
-				config.LocalPort = 0
-			}
-			if config.RemotePort <= 0 || config.RemotePort > 65535 {
-				config.RemotePort = 0
-			}
+	saveBans := func(bans []string) {
+		if noSave {
+			return
+		}
+		// only change the bans of the file, even without prompts
+		config := loadConfig(configFile)
+		config.Bans = bans
+		saveConfig(configFile, config)
+	}
+
+	if all {
+		go runCommands(scanner, saveBans)
+		runAll(config.Sessions)
+		return
+	}
+	if daemon {
+		runSchedule(configFile, config)
+		return
+	}
+
+	if game == "" {
+		game = config.Game
+	}
+	if game != "" {
+		gamePreset = presets[game]
+		if gamePreset == nil {
+			fmt.Fprintln(os.Stderr, "Error unknown game preset "+game+", must be one of: "+presetNames())
+			return
 		}
 	}
 
 	if !noConfig && runtime.GOOS == "windows" {
-		fmt.Println("===================================================")
+		decoration("===================================================")
 		fmt.Println("A NEW VERSION OF PROXYPUNCH IS AVAILABLE: AUTOPUNCH")
 		fmt.Println("autopunch is better and simpler than proxypunch: it is as simple as sokuroll!")
 		fmt.Println("Run an exe and that's it! the game will work without forwarding ports.")
@@ -558,7 +580,7 @@ func main() {
 		fmt.Println("- you can use it even with users who don't have it, so you can always leave it on")
 		fmt.Println("There's really no reason to use proxypunch anymore.")
 		fmt.Println("You can download it (and check out instructions) at: delthas.fr/autopunch")
-		fmt.Println("===================================================")
+		decoration("===================================================")
 		if !config.DownloadedAutopunch {
 			if autopunch() {
 				config.DownloadedAutopunch = true
@@ -574,11 +596,11 @@ func main() {
 	saveHost := host == ""
 	savePort := port == 0
 
-	for mode != "s" && mode != "server" && mode != "c" && mode != "client" {
+	for mode != "s" && mode != "server" && mode != "c" && mode != "client" && mode != "b" && mode != "browse" {
 		if config.Mode != "" {
-			fmt.Println("Mode? s(erver) / c(lient) [" + config.Mode + "]")
+			fmt.Println("Mode? s(erver) / c(lient) / b(rowse public lobby) [" + config.Mode + "]")
 		} else {
-			fmt.Println("Mode? s(erver) / c(lient) ")
+			fmt.Println("Mode? s(erver) / c(lient) / b(rowse public lobby) ")
 		}
 		if !scanner.Scan() {
 			return
@@ -588,6 +610,23 @@ func main() {
 			mode = config.Mode
 		}
 	}
+	if mode == "b" || mode == "browse" {
+		l, ok := browseLobby(scanner)
+		if !ok {
+			return
+		}
+		mode = "client"
+		host = l.host.String()
+		port = l.port
+		channel = l.channel
+		opponent = l.nickname
+		if p := presets[l.game]; p != nil {
+			gamePreset = p
+		}
+		saveMode = false
+		saveHost = false
+		savePort = false
+	}
 	if saveMode {
 		if mode == "s" {
 			mode = "server"
@@ -597,7 +636,20 @@ func main() {
 		config.Mode = mode
 	}
 
+	if host != "" && !isName(host) && !isCode(host) && !isRoom(host) {
+		// -host also accepts a port, e.g. [2001:db8::1]:10800
+		if h, p, err := splitHost(host); err == nil {
+			host = h
+			if port == 0 {
+				port = p
+			}
+		}
+	}
 	if mode == "c" || mode == "client" {
+		if host == "" && joinRoom != "" {
+			host = "#" + joinRoom
+			saveHost = false
+		}
 		for host == "" {
 			if config.Host != "" {
 				fmt.Println("Host? [" + config.Host + "]")
@@ -607,25 +659,32 @@ func main() {
 			if !scanner.Scan() {
 				return
 			}
-			h := strings.ToLower(scanner.Text())
+			h := strings.TrimSpace(scanner.Text())
+			if isRoom(h) {
+				host = h
+				continue
+			}
+			h = strings.ToLower(h)
 			if h == "" {
 				host = config.Host
 				continue
 			}
-			i := strings.IndexByte(h, ':')
-			if i != -1 {
-				var err error
-				port, err = strconv.Atoi(h[i+1:])
-				if err != nil {
-					fmt.Println("Invalid host format, must be <host> or <host>:<port>")
-					continue
-				}
-			} else {
-				i = len(h)
+			if isName(h) || isCode(h) {
+				host = h
+				continue
+			}
+			hostPart, hostPort, err := splitHost(h)
+			if err != nil {
+				fmt.Println("Invalid host format, must be <host>, <host>:<port>, [<ipv6>]:<port>, <name>@<relay>, a code such as BLUE-FOX-41 or #<room>")
+				continue
+			}
+			host = hostPart
+			if hostPort != 0 {
+				port = hostPort
 			}
-			host = h[:i]
 		}
-		if saveHost {
+		// codes only last as long as the session of the host
+		if saveHost && !isCode(host) {
 			config.Host = host
 		}
 	}
@@ -636,11 +695,37 @@ func main() {
 	} else {
 		configPort = config.LocalPort
 	}
-	for port == 0 {
+	if configPort == 0 && gamePreset != nil {
+		configPort = gamePreset.port
+	}
+	if port == 0 && (mode == "s" || mode == "server") && targetPort != 0 {
+		port = targetPort
+		savePort = false
+	}
+	if port == 0 && (mode == "s" || mode == "server") && targeting() {
+		port = waitForProcessPort()
+		savePort = false
+	}
+	var detected []udpListener
+	if port == 0 && (mode == "s" || mode == "server") && !noScan && targetIP == nil {
+		detected = gameListeners()
+		if len(detected) > 0 {
+			fmt.Println("Detected local programs listening on UDP ports (type the number in brackets to choose one):")
+			for i, l := range detected {
+				fmt.Println("  [" + strconv.Itoa(i+1) + "] " + l.String())
+			}
+		}
+	}
+	// registered names, codes and rooms resolve to the port too
+	prompt := "Port? "
+	if mode == "s" || mode == "server" {
+		prompt = "Port? (auto: choose a free port) "
+	}
+	for port == 0 && !isName(host) && !isCode(host) && !isRoom(host) {
 		if configPort != 0 {
-			fmt.Println("Port? [" + strconv.Itoa(configPort) + "]")
+			fmt.Println(prompt + "[" + strconv.Itoa(configPort) + "]")
 		} else {
-			fmt.Println("Port? ")
+			fmt.Println(prompt)
 		}
 		if !scanner.Scan() {
 			return
@@ -650,9 +735,38 @@ func main() {
 			port = configPort
 			continue
 		}
+		if p == "auto" && (mode == "s" || mode == "server") {
+			port = autoPort
+			break
+		}
 		port, _ = strconv.Atoi(scanner.Text())
+		// detected ports are all above 1024, so small numbers are choices
+		if port >= 1 && port <= len(detected) {
+			port = detected[port-1].port
+		}
+	}
+	if len(extraPorts) > 0 && (mode == "c" || mode == "client") {
+		fmt.Fprintln(os.Stderr, "Error several ports are only given in server mode: the client learns the other ports from the host")
+		return
 	}
-	if savePort {
+	if transparent && (mode == "c" || mode == "client") {
+		fmt.Fprintln(os.Stderr, "Error -transparent is only available in server mode")
+		return
+	}
+	if port == autoPort {
+		if mode == "c" || mode == "client" {
+			fmt.Fprintln(os.Stderr, "Error -port auto is only available in server mode")
+			return
+		}
+		near := configPort
+		if near == 0 {
+			near = autoPortBase
+		}
+		port = freePort(near)
+		fmt.Println("Chose free port " + strconv.Itoa(port) + " to host on")
+		savePort = false
+	}
+	if savePort && port != 0 {
 		if mode == "c" || mode == "client" {
 			config.RemotePort = port
 		} else {
@@ -664,11 +778,147 @@ func main() {
 		saveConfig(configFile, config)
 	}
 
+	s := &session{
+		preset:   gamePreset,
+		channel:  channel,
+		opponent: opponent,
+	}
+	defer writeStatus(s)()
 	if mode == "c" || mode == "client" {
-		client(host, port)
+		client(s, host, port)
 	} else {
-		server(port)
+		go runCommands(scanner, saveBans)
+		server(s, port)
+	}
+}
+
+func loadConfig(configFile string) Config {
+	var config Config
+	file, err := os.Open(configFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintln(os.Stderr, "Error opening file "+configFile+": "+err.Error())
+		}
+		return config
+	}
+	decoder := yaml.NewDecoder(file)
+	err = decoder.Decode(&config)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error decoding config file "+configFile+". ("+err.Error()+")")
+	}
+	if config.Mode != "server" && config.Mode != "client" {
+		config.Mode = ""
+	}
+	if config.LocalPort <= 0 || config.LocalPort > 65535 {
+		config.LocalPort = 0
+	}
+	if config.RemotePort <= 0 || config.RemotePort > 65535 {
+		config.RemotePort = 0
+	}
+	return config
+}
+
+// applyConfig applies the settings of the config that have no prompt, unless
+// they were set by flags.
+func applyConfig(config Config) {
+	if relay == "" {
+		relay = config.Relay
+	}
+	discoverRelays(relay)
+	relayIps = config.RelayIps
+	backupRelays = config.Relays
+	if relayToken == "" {
+		relayToken = config.RelayToken
+	}
+	if relayKey == "" {
+		relayKey = config.RelayKey
+	}
+	if nickname == "" {
+		nickname = config.Nickname
+	}
+	if region == "" {
+		region = config.Region
+	}
+	if token == "" {
+		token = config.Token
+	}
+	if name == "" {
+		name = config.Name
+	}
+	if room == "" {
+		room = config.Room
+	}
+	if via == "" {
+		via = config.Via
+	}
+	if config.Plain {
+		plain = true
+	}
+	if config.Encrypt {
+		encrypt = true
+	}
+	if config.Compress {
+		compress = true
+	}
+	if fec == 0 {
+		fec = config.Fec
+	}
+	if fec < 0 {
+		fec = 0
+	} else if fec > maxFec {
+		fec = maxFec
+	}
+	if redundancy == 0 {
+		redundancy = config.Redundancy
+	}
+	if config.Integrity {
+		integrity = true
+	}
+	if config.Multipath {
+		multipath = true
+	}
+	if reorder == 0 {
+		reorder = config.Reorder
+	}
+	if reorder < 0 {
+		reorder = 0
+	} else if reorder > maxReorder {
+		reorder = maxReorder
+	}
+	if reorderLatency == defaultReorderLatency && config.ReorderLatency != "" {
+		reorderLatency = parsePunchDuration("reorder_latency", config.ReorderLatency, defaultReorderLatency)
+	}
+	if reorderLatency <= 0 {
+		reorderLatency = defaultReorderLatency
+	} else if reorderLatency > maxReorderLatency {
+		reorderLatency = maxReorderLatency
+	}
+	if dscp == "" {
+		dscp = config.Dscp
+	}
+	if socksPort == 0 {
+		socksPort = config.Socks
+	}
+	if forwardList == "" {
+		forwardList = strings.Join(config.Forwards, ",")
+	}
+	if allowList == "" {
+		allowList = strings.Join(config.Allow, ",")
+	}
+	bans = config.Bans
+	if config.Accept {
+		acceptPeers = true
+	}
+	if redundancy < 0 {
+		redundancy = 0
+	} else if redundancy > maxRedundancy {
+		redundancy = maxRedundancy
+	}
+	if keepalivePayload == "" {
+		keepalivePayload = config.KeepalivePayload
 	}
+	applyPunchConfig(config)
 }
 
 func saveConfig(configFile string, config Config) {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// mockQueueSize is the count of packets a mock connection buffers before
+// dropping incoming packets, like a full socket receive buffer.
+const mockQueueSize = 1024
+
+// mockNet is an in-memory network of packet connections, used to measure
+// the forwarding path without the kernel network stack.
+type mockNet struct {
+	sync.Mutex
+	conns map[string]*mockConn
+}
+
+type mockPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+type mockConn struct {
+	net      *mockNet
+	addr     *net.UDPAddr
+	ch       chan mockPacket
+	closed   chan struct{}
+	once     sync.Once
+	deadline time.Time
+}
+
+func newMockNet() *mockNet {
+	return &mockNet{
+		conns: make(map[string]*mockConn),
+	}
+}
+
+func (n *mockNet) listen(addr *net.UDPAddr) *mockConn {
+	c := &mockConn{
+		net:    n,
+		addr:   addr,
+		ch:     make(chan mockPacket, mockQueueSize),
+		closed: make(chan struct{}),
+	}
+	n.Lock()
+	n.conns[addr.String()] = c
+	n.Unlock()
+	return c
+}
+
+func (c *mockConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	var timeout <-chan time.Time
+	if !c.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(c.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-c.ch:
+		return copy(b, p.data), p.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *mockConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	c.net.Lock()
+	dst, ok := c.net.conns[addr.String()]
+	c.net.Unlock()
+	if !ok {
+		return len(b), nil
+	}
+	select {
+	case dst.ch <- mockPacket{data: append([]byte(nil), b...), addr: c.addr}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *mockConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *mockConn) Close() error {
+	c.once.Do(func() {
+		c.net.Lock()
+		delete(c.net.conns, c.addr.String())
+		c.net.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mtuProbeDelay is the time after connecting before probing the path to the
+// peer, so that the probes do not slow down the start of the session.
+const mtuProbeDelay = 2 * time.Second
+
+// mtuProbeSizes are the sizes of the probes sent to the peer, from the
+// largest UDP payload of a 1500 bytes MTU down to the minimum IPv4 MTU, with
+// the common sizes of PPPoE and VPN links in between.
+var mtuProbeSizes = []int{1472, 1452, 1432, 1412, 1392, 1372, 1352, 1280, 1200, 1024, 548}
+
+// pathMtu probes the largest packet that reaches the peer, and warns when the
+// game sends larger packets: they are fragmented, and fragments are silently
+// dropped on some VPN and PPPoE links, causing desyncs.
+type pathMtu struct {
+	mu sync.Mutex
+	// largest is the size of the largest probe the peer received, 0 if none.
+	largest int
+	// probed is set once the probe results are known.
+	probed bool
+	warned bool
+}
+
+// probeMtu probes the path to the peer once connected, until done is closed.
+func (p *proxy) probeMtu(done chan struct{}) {
+	for {
+		if _, connected := p.connectedPeer(); connected {
+			break
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(pingInterval):
+		}
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(mtuProbeDelay):
+	}
+	probe := make([]byte, mtuProbeSizes[0])
+	probe[0] = typeMtuProbe
+	for try := 0; try < 3; try++ {
+		for _, size := range mtuProbeSizes {
+			p.c.WriteToUDP(probe[:size], p.peer())
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(2 * time.Second):
+	}
+
+	p.mtu.mu.Lock()
+	p.mtu.probed = true
+	largest := p.mtu.largest
+	p.mtu.mu.Unlock()
+	switch {
+	case largest == 0:
+		// the peer runs a version that does not answer probes
+	case largest < mtuProbeSizes[0]:
+		p.s.println("Packets larger than " + strconv.Itoa(largest-1) + " bytes of game data do not reach " + p.peerName() + " on this path (path MTU about " + strconv.Itoa(largest+28) + " bytes, as on VPN and PPPoE links): you will be warned if the game sends larger packets")
+	case verbose:
+		p.s.println("Packets of up to " + strconv.Itoa(largest-1) + " bytes of game data reach " + p.peerName() + " unfragmented")
+	}
+}
+
+// mtuProbed records that the peer received a probe of the size in data.
+func (p *proxy) mtuProbed(data []byte) {
+	if len(data) != 3 {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(data[1:3]))
+	p.mtu.mu.Lock()
+	if size > p.mtu.largest {
+		p.mtu.largest = size
+	}
+	p.mtu.mu.Unlock()
+}
+
+// checkMtu warns once if a game packet of n bytes does not fit in the path to
+// the peer.
+func (p *proxy) checkMtu(n int) {
+	p.mtu.mu.Lock()
+	largest := p.mtu.largest
+	exceeds := p.mtu.probed && !p.mtu.warned && largest != 0 && n+1 > largest
+	if exceeds {
+		p.mtu.warned = true
+	}
+	p.mtu.mu.Unlock()
+	if exceeds {
+		p.s.errorln("Error the game sent a packet of " + strconv.Itoa(n) + " bytes, larger than the " + strconv.Itoa(largest-1) + " bytes that reach " + p.peerName() + " on this path: such packets are fragmented and their fragments may be dropped, which can cause desyncs; try playing without a VPN on both sides")
+	}
+}
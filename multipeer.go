@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPeers is the count of peers a host forwards to its game at once, set
+// with -max-peers, for games with spectators or lobbies of 3 players or more.
+var maxPeers = 1
+
+// maxPeersLimit bounds -max-peers.
+const maxPeersLimit = 64
+
+// peerQueueSize is the count of packets a peer connection buffers before
+// dropping incoming packets, like a full socket receive buffer.
+const peerQueueSize = 1024
+
+func applyMaxPeers() error {
+	if maxPeers < 1 || maxPeers > maxPeersLimit {
+		return errors.New("-max-peers must be between 1 and " + strconv.Itoa(maxPeersLimit))
+	}
+	if spectators < 0 || spectators > maxPeersLimit {
+		return errors.New("-spectators must be between 0 and " + strconv.Itoa(maxPeersLimit))
+	}
+	if spectatorPort < 0 || spectatorPort > 65535 {
+		return errors.New("-spectator-port must be a port number")
+	}
+	if (maxPeers > 1 || spectators > 0) && (private || proto != "udp" || bridge != "") {
+		return errors.New("-max-peers and -spectators need direct connections to the peers, they cannot be used with -private, -proto tcp or tcp-udp, or -bridge")
+	}
+	return nil
+}
+
+type peerPacket struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// peerConn is the connection of the proxy of one of the peers of a host with
+// -max-peers. The packets of the peer are received on the proxy socket shared
+// by all peers and dispatched by a peerTable, and the game exchanges the
+// packets of the peer with a local socket of its own, so that it sees each
+// peer as a separate player.
+type peerConn struct {
+	t    *peerTable
+	c    *net.UDPConn
+	game *net.UDPConn
+	// spectator is set for the spectators of -spectators; readOnly is set
+	// when they watch the traffic of the first player rather than connect to
+	// a spectator port, and the game does not receive their packets.
+	spectator bool
+	readOnly  bool
+	// peerAddrs are the candidate addresses of the peer; public is its
+	// public address, as seen by the relay.
+	peerAddrs []*net.UDPAddr
+	public    *net.UDPAddr
+	ch        chan peerPacket
+	// wake interrupts a read when the deadline changes.
+	wake   chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	// mu protects deadline.
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newPeerConn(t *peerTable, c *net.UDPConn, peerAddrs []*net.UDPAddr, spectator bool) (*peerConn, error) {
+	game, err := net.ListenUDP("udp4", &net.UDPAddr{IP: gameBindIP()})
+	if err != nil {
+		return nil, err
+	}
+	setBuffers(game)
+	pc := &peerConn{
+		t:         t,
+		c:         c,
+		game:      game,
+		spectator: spectator,
+		readOnly:  spectator && spectatorPort == 0,
+		peerAddrs: peerAddrs,
+		public:    peerAddrs[len(peerAddrs)-1],
+		ch:        make(chan peerPacket, peerQueueSize),
+		wake:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	go pc.readGame()
+	return pc, nil
+}
+
+// readGame queues the packets of the game, until the connection is closed.
+func (c *peerConn) readGame() {
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := c.game.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		c.push(buffer[:n], addr)
+		c.t.fanOut(c, buffer[:n], addr)
+	}
+}
+
+// push queues a packet, dropping it if the queue is full.
+func (c *peerConn) push(data []byte, addr *net.UDPAddr) {
+	select {
+	case c.ch <- peerPacket{data: append([]byte(nil), data...), addr: addr}:
+	default:
+	}
+}
+
+func (c *peerConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case p := <-c.ch:
+			if timer != nil {
+				timer.Stop()
+			}
+			return copy(b, p.data), p.addr, nil
+		case <-c.closed:
+			return 0, nil, net.ErrClosed
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-c.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// WriteToUDP sends packets to the game on the local socket of the peer, and
+// other packets on the shared proxy socket.
+func (c *peerConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if isLocal(addr.IP) && !c.isPeer(addr) {
+		if c.readOnly {
+			return len(b), nil
+		}
+		return c.game.WriteToUDP(b, addr)
+	}
+	return c.c.WriteToUDP(b, addr)
+}
+
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *peerConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.game.Close()
+	})
+	return nil
+}
+
+// isPeer returns whether addr is one of the candidate addresses of the peer.
+func (c *peerConn) isPeer(addr *net.UDPAddr) bool {
+	for _, v := range c.peerAddrs {
+		if v.IP.Equal(addr.IP) && v.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// peerTable holds the peers a host is connected to with -max-peers, and
+// dispatches the packets received on the shared proxy socket to them.
+type peerTable struct {
+	mu    sync.Mutex
+	peers []*peerConn
+	// fullReported is set once a peer was refused, until a peer leaves.
+	fullReported bool
+}
+
+// dispatch queues data from addr for the peer it is from, and returns
+// whether it is from one. Punch packets from other ports of the public IP of
+// a single peer are also its, as the ports of a peer behind a symmetric NAT
+// are predicted.
+func (t *peerTable) dispatch(s *session, data []byte, addr *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	punch := isPunch(s, data)
+	var match *peerConn
+	for _, pc := range t.peers {
+		if pc.isPeer(addr) {
+			pc.push(data, addr)
+			return true
+		}
+		if punch && pc.public.IP.Equal(addr.IP) {
+			if match != nil {
+				// several peers behind the same public IP
+				return false
+			}
+			match = pc
+		}
+	}
+	if match == nil {
+		return false
+	}
+	match.push(data, addr)
+	return true
+}
+
+// known returns whether public is the public address of a connected peer.
+func (t *peerTable) known(public *net.UDPAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pc := range t.peers {
+		if pc.public.IP.Equal(public.IP) && pc.public.Port == public.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// admit returns whether a new session should be started for the peer with
+// the public address public: it is not connected yet, and there is room for
+// it, as a player first, then as a spectator.
+func (t *peerTable) admit(s *session, public *net.UDPAddr) (ok bool, spectator bool) {
+	if t.known(public) {
+		// its registrations keep reaching the relay
+		return false, false
+	}
+	players, watching := t.count()
+	if players < maxPeers {
+		return true, false
+	}
+	if watching < spectators {
+		return true, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.fullReported {
+		t.fullReported = true
+		s.errorln("Error peer " + public.String() + " tried to connect, but " + strconv.Itoa(players) + " peers and " + strconv.Itoa(watching) + " spectators are already connected: restart proxypunch with a higher -max-peers or -spectators to accept more")
+	}
+	return false, false
+}
+
+// count returns the count of connected players and spectators.
+func (t *peerTable) count() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	players, watching := 0, 0
+	for _, pc := range t.peers {
+		if pc.spectator {
+			watching++
+		} else {
+			players++
+		}
+	}
+	return players, watching
+}
+
+func (t *peerTable) add(pc *peerConn) {
+	t.mu.Lock()
+	t.peers = append(t.peers, pc)
+	t.mu.Unlock()
+}
+
+func (t *peerTable) remove(pc *peerConn) {
+	t.mu.Lock()
+	for i, v := range t.peers {
+		if v == pc {
+			t.peers = append(t.peers[:i], t.peers[i+1:]...)
+			break
+		}
+	}
+	t.fullReported = false
+	t.mu.Unlock()
+}
+
+// open adds the peer with the candidate addresses peerAddrs, connecting to
+// it on the shared proxy socket c; it returns nil on error.
+func (t *peerTable) open(s *session, c *net.UDPConn, peerAddrs []*net.UDPAddr, spectator bool) *peerConn {
+	pc, err := newPeerConn(t, c, peerAddrs, spectator)
+	if err != nil {
+		s.errorln("Error opening a local socket for the peer " + peerAddrs[len(peerAddrs)-1].String() + ": " + err.Error())
+		return nil
+	}
+	t.add(pc)
+	players, watching := t.count()
+	if spectator {
+		s.println("Spectator " + pc.public.String() + " connecting, " + strconv.Itoa(watching) + " of up to " + strconv.Itoa(spectators) + " spectators")
+	} else {
+		s.println("Peer " + pc.public.String() + " connecting, " + strconv.Itoa(players) + " of up to " + strconv.Itoa(maxPeers) + " peers")
+	}
+	return pc
+}
+
+// servePeer runs the session of the peer of pc until it ends, with -max-peers
+// or -spectators.
+func servePeer(s *session, t *peerTable, pc *peerConn, localAddr *net.UDPAddr, localPort int, predict bool) {
+	defer pc.Close()
+	if pc.spectator && spectatorPort != 0 {
+		localAddr = &net.UDPAddr{IP: localAddr.IP, Port: spectatorPort}
+		localPort = spectatorPort
+	}
+	chPunch := make(chan struct{})
+	go punch(pc, pc.peerAddrs, s.punchPayload(), chPunch)
+	p := newProxy(s, pc, nil, pc.peerAddrs, localAddr, localPort)
+	p.predict = predict
+	// a peer that never completes the punch must not hold its slot
+	p.giveUp = true
+	p.authenticate = p.secret != nil
+	p.confirmPeer = confirmPeers()
+	p.run(make([]byte, 4096))
+	close(chPunch)
+
+	t.remove(pc)
+	players, watching := t.count()
+	kind := "Peer "
+	if pc.spectator {
+		kind = "Spectator "
+	}
+	s.println(kind + pc.public.String() + " left, " + strconv.Itoa(players) + " peers and " + strconv.Itoa(watching) + " spectators still connected")
+}
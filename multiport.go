@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// extraPorts are the game ports forwarded in server mode besides the main
+// port, for games using several UDP ports, e.g. for game data and voice.
+var extraPorts []int
+
+// maxExtraPorts bounds the count of extra game ports, indexed by a byte.
+const maxExtraPorts = 16
+
+// portForward maps a port of this computer to a port of the computer of the
+// peer, set with -forward or forwards: in the configuration file. In server
+// mode, local is an extra game port, and remote the port peers open for it;
+// in client mode, local is the port opened for the game port remote of the
+// host.
+type portForward struct {
+	local  int
+	remote int
+}
+
+// forwardList is the value of -forward, parsed into forwards.
+var forwardList string
+var forwards []portForward
+
+// applyForwards parses forwardList, comma-separated local:remote port pairs.
+func applyForwards() error {
+	forwards = nil
+	if strings.TrimSpace(forwardList) == "" {
+		return nil
+	}
+	for _, v := range strings.Split(forwardList, ",") {
+		i := strings.IndexByte(v, ':')
+		if i < 0 {
+			return errors.New("invalid forward " + v + ", must be a local port and a remote port separated by a colon, e.g. 7000:10801")
+		}
+		local, err1 := strconv.Atoi(strings.TrimSpace(v[:i]))
+		remote, err2 := strconv.Atoi(strings.TrimSpace(v[i+1:]))
+		if err1 != nil || err2 != nil || local < 1 || local > 65535 || remote < 1 || remote > 65535 {
+			return errors.New("invalid forward " + v + ", must be a local port and a remote port separated by a colon, e.g. 7000:10801")
+		}
+		forwards = append(forwards, portForward{local: local, remote: remote})
+	}
+	if len(forwards) > maxExtraPorts {
+		return errors.New("at most " + strconv.Itoa(maxExtraPorts) + " ports can be forwarded with -forward")
+	}
+	return nil
+}
+
+// hostPorts returns the extra game ports of the host of main port main: those
+// of -port, then the local ports of -forward.
+func hostPorts(main int) []int {
+	ports := append([]int(nil), extraPorts...)
+next:
+	for _, f := range forwards {
+		if f.local == main || len(ports) >= maxExtraPorts {
+			continue
+		}
+		for _, port := range ports {
+			if port == f.local {
+				continue next
+			}
+		}
+		ports = append(ports, f.local)
+	}
+	return ports
+}
+
+// gamePort relays an extra game port with the peer: packets of the game
+// received on its socket are sent to the peer with the index of the port,
+// and packets of the peer with that index are sent to the game.
+type gamePort struct {
+	c *net.UDPConn
+	// index is the position of the port in the extra ports of the host, from 1.
+	index int
+	// learn is set in client mode, where game is nil until the game sends its
+	// first packet, and follows its source address.
+	learn bool
+	// mu protects game, the address of the game.
+	mu   sync.Mutex
+	game *net.UDPAddr
+}
+
+// parsePorts parses a comma-separated list of ports into the main port and
+// extraPorts.
+func parsePorts(s string) (int, error) {
+	var ports []int
+	for _, v := range strings.Split(s, ",") {
+		port, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || port < 1 || port > 65535 {
+			return 0, errors.New("must be a port number, a list of port numbers separated by commas, or auto")
+		}
+		ports = append(ports, port)
+	}
+	if len(ports)-1 > maxExtraPorts {
+		return 0, errors.New("at most " + strconv.Itoa(maxExtraPorts+1) + " ports can be forwarded")
+	}
+	extraPorts = ports[1:]
+	return ports[0], nil
+}
+
+// openGamePorts opens the sockets forwarding the extra ports of the host of
+// main port main to its game, in server mode.
+func openGamePorts(s *session, main int) []*gamePort {
+	var ports []*gamePort
+	for i, port := range hostPorts(main) {
+		c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: gameBindIP()})
+		if err != nil {
+			s.errorln("Error forwarding game port " + strconv.Itoa(port) + ": " + err.Error())
+			continue
+		}
+		ports = append(ports, &gamePort{
+			c:     c,
+			index: i + 1,
+			game:  &net.UDPAddr{IP: gameIP(), Port: port},
+		})
+	}
+	return ports
+}
+
+// announcePorts returns the typePorts packet listing the extra ports of the
+// host, nil if there are none or in client mode.
+func (p *proxy) announcePorts() []byte {
+	_, main := p.local()
+	ports := hostPorts(main)
+	if main == 0 || len(ports) == 0 {
+		return nil
+	}
+	b := make([]byte, 3+2*len(ports))
+	b[0] = typePorts
+	binary.BigEndian.PutUint16(b[1:3], uint16(main))
+	for i, port := range ports {
+		binary.BigEndian.PutUint16(b[3+2*i:], uint16(port))
+	}
+	return b
+}
+
+// announcePortMap returns the typePortMap packet listing the extra ports of
+// the host along with the ports peers open for them, nil if -forward sets
+// none or in client mode.
+func (p *proxy) announcePortMap() []byte {
+	_, main := p.local()
+	ports := hostPorts(main)
+	if main == 0 || len(forwards) == 0 || len(ports) == 0 {
+		return nil
+	}
+	b := make([]byte, 3+4*len(ports))
+	b[0] = typePortMap
+	binary.BigEndian.PutUint16(b[1:3], uint16(main))
+	for i, port := range ports {
+		binary.BigEndian.PutUint16(b[3+4*i:], uint16(port))
+		for _, f := range forwards {
+			if f.local == port {
+				binary.BigEndian.PutUint16(b[5+4*i:], uint16(f.remote))
+			}
+		}
+	}
+	return b
+}
+
+// portsAnnounced opens the sockets games connect to for the extra ports the
+// host announced in the typePorts or typePortMap packet data, in client mode:
+// on the port set with -forward for it, or else on the port the host set for
+// it, or else keeping the offset of each port to the main port when it is
+// free.
+func (p *proxy) portsAnnounced(data []byte) {
+	step := 2
+	if data[0] == typePortMap {
+		step = 4
+	}
+	if p.gamePorts != nil || len(data) < 3+step || (len(data)-3)%step != 0 {
+		return
+	}
+	if _, localPort := p.local(); localPort != 0 {
+		return
+	}
+	p.gamePorts = []*gamePort{}
+	main := int(binary.BigEndian.Uint16(data[1:3]))
+	listen := 0
+	if c, ok := p.c.(interface{ LocalAddr() net.Addr }); ok {
+		listen = c.LocalAddr().(*net.UDPAddr).Port
+	}
+	announced := make(map[int]bool)
+	for i := 3; i+step <= len(data) && len(p.gamePorts) < maxExtraPorts; i += step {
+		port := int(binary.BigEndian.Uint16(data[i : i+2]))
+		announced[port] = true
+		wanted := 0
+		if step == 4 {
+			wanted = int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		}
+		for _, f := range forwards {
+			if f.remote == port {
+				wanted = f.local
+			}
+		}
+		var c *net.UDPConn
+		err := errors.New("no port near the main port")
+		if wanted != 0 {
+			if c, err = net.ListenUDP("udp4", &net.UDPAddr{Port: wanted}); err != nil {
+				p.s.errorln("Error opening local port " + strconv.Itoa(wanted) + " for game port " + strconv.Itoa(port) + " of the host, using another port instead: " + err.Error())
+			}
+		} else if near := listen + port - main; listen != 0 && near > 0 && near <= 65535 {
+			c, err = net.ListenUDP("udp4", &net.UDPAddr{Port: near})
+		}
+		if err != nil {
+			c, err = net.ListenUDP("udp4", nil)
+		}
+		if err != nil {
+			p.s.errorln("Error opening a local port for game port " + strconv.Itoa(port) + " of the host: " + err.Error())
+			continue
+		}
+		g := &gamePort{
+			c:     c,
+			index: (i-3)/step + 1,
+			learn: true,
+		}
+		p.gamePorts = append(p.gamePorts, g)
+		p.s.println("The host also forwards its game port " + strconv.Itoa(port) + ": the game connects to 127.0.0.1 on port " + strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port) + " for it")
+		go p.relayGamePort(g)
+	}
+	for _, f := range forwards {
+		if f.remote == main {
+			p.s.errorln("Error -forward " + strconv.Itoa(f.local) + ":" + strconv.Itoa(f.remote) + ": the main port of the host is reached on the port of proxypunch, set it with -bind instead")
+		} else if !announced[f.remote] {
+			p.s.errorln("Error -forward " + strconv.Itoa(f.local) + ":" + strconv.Itoa(f.remote) + ": the host does not forward its game port " + strconv.Itoa(f.remote) + ", it must also host with it")
+		}
+	}
+}
+
+// relayGamePort sends the packets of the game received on g to the peer,
+// until its socket is closed.
+func (p *proxy) relayGamePort(g *gamePort) {
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := g.c.ReadFromUDP(buffer[2:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !isLocal(addr.IP) {
+			continue
+		}
+		g.mu.Lock()
+		known := g.game != nil && addr.IP.Equal(g.game.IP) && addr.Port == g.game.Port
+		if !known && g.learn {
+			g.game = addr
+		}
+		g.mu.Unlock()
+		if !known && !g.learn {
+			continue
+		}
+		peer, ok := p.connectedPeer()
+		if !ok {
+			continue
+		}
+		buffer[0] = typePortData
+		buffer[1] = byte(g.index)
+		p.interval.sent(n)
+		p.pushPeer(buffer[:n+2], peer)
+	}
+}
+
+// portData sends a packet of the peer for an extra port to the game.
+func (p *proxy) portData(data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	for _, g := range p.gamePorts {
+		if g.index != int(data[1]) {
+			continue
+		}
+		g.mu.Lock()
+		game := g.game
+		g.mu.Unlock()
+		if game != nil {
+			p.interval.received(len(data) - 2)
+			g.c.WriteToUDP(data[2:], game)
+		}
+		return
+	}
+}
+
+// closeGamePorts closes the sockets of the extra ports.
+func (p *proxy) closeGamePorts() {
+	for _, g := range p.gamePorts {
+		g.c.Close()
+	}
+}
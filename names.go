@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nameMagic prefixes the registered name messages exchanged with the relay,
+// followed by an operation byte:
+//   - nameClaim: port, unix time, public IP, public key, name, then the
+//     signature of the message
+//   - nameClaimed: status
+//   - nameResolve: name
+//   - nameResolved: status, IP, port
+//
+// Names are prefixed with their length on one byte. The relay binds a name to
+// the first key claiming it, then points it at the current public IP and port
+// of the host claiming it with that key.
+const nameMagic = "PPN1"
+
+const (
+	nameClaim    = 0x01
+	nameClaimed  = 0x02
+	nameResolve  = 0x03
+	nameResolved = 0x04
+)
+
+// Status of name messages.
+const (
+	nameOk       = 0x00
+	nameTaken    = 0x01
+	nameInvalid  = 0x02
+	nameNotFound = 0x03
+)
+
+// nameInterval is the interval at which a registered name is claimed again
+// while hosting.
+const nameInterval = 5 * time.Second
+
+// defaultRelayPort is the relay port used for name@relay without a port.
+const defaultRelayPort = "14761"
+
+// name is the name claimed on the relay in server mode; keyFile stores the
+// key owning it.
+var name string
+var keyFile = "proxypunch.key"
+
+// isName returns whether host is a registered name: name@relay, or name@
+// for the default relay.
+func isName(host string) bool {
+	return !isRoom(host) && strings.Contains(host, "@")
+}
+
+// validName returns whether name can be registered on a relay.
+func validName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// loadKey loads the key owning the registered names, creating it if needed.
+func loadKey() (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid key file " + keyFile)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// claimName claims the registered name for the session hosted on port, once
+// the public address of the host is known, until done is closed.
+func claimName(s *session, c packetConn, relayAddr *net.UDPAddr, port int, done chan struct{}) {
+	if !validName(name) {
+		s.errorln("Error invalid name " + name + ", names are 1 to 32 lowercase letters, digits, - or _")
+		return
+	}
+	key, err := loadKey()
+	if err != nil {
+		s.errorln("Error loading the key of registered names: " + err.Error())
+		return
+	}
+
+	interval := 500 * time.Millisecond
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+		s.mu.Lock()
+		external := s.external
+		s.mu.Unlock()
+		if external == nil {
+			continue
+		}
+		if interval != nameInterval {
+			interval = nameInterval
+			s.println("Registering name " + name + ", peers can connect to " + name + "@" + relayName(s) + " with proxypunch, or open " + uriScheme + "://" + name + "@" + relayName(s))
+		}
+
+		b := append([]byte(nameMagic), nameClaim, byte(port>>8), byte(port))
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().Unix()))
+		b = append(b, external.IP.To4()...)
+		b = append(b, key.Public().(ed25519.PublicKey)...)
+		b = append(b, byte(len(name)))
+		b = append(b, name...)
+		b = append(b, ed25519.Sign(key, b)...)
+		c.WriteToUDP(sealRelay(b, relayAddr), relayAddr)
+	}
+}
+
+// relayName returns the relay host of the session, as used in name@relay.
+func relayName(s *session) string {
+	waitRelays()
+	hostPort := relay
+	if s.relay != "" {
+		hostPort = s.relay
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil || port != defaultRelayPort {
+		return hostPort
+	}
+	return host
+}
+
+// resolveName resolves a registered name to the current host and port it
+// points to, and sets the relay of the session to the relay of the name.
+func resolveName(s *session, host string) (string, int, error) {
+	i := strings.LastIndexByte(host, '@')
+	name, relayHost := strings.ToLower(host[:i]), host[i+1:]
+	if !validName(name) {
+		return "", 0, errors.New("invalid name " + name)
+	}
+	if relayHost != "" {
+		if _, _, err := net.SplitHostPort(relayHost); err != nil {
+			relayHost = net.JoinHostPort(relayHost, defaultRelayPort)
+		}
+		s.relay = relayHost
+	}
+	relayAddr, err := resolveRelay(s)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := pinRelay(s, relayAddr); err != nil {
+		return "", 0, err
+	}
+	if err := authenticateRelay(s, relayAddr, nil); err != nil {
+		return "", 0, err
+	}
+
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return "", 0, err
+	}
+	defer c.Close()
+	request := append([]byte(nameMagic), nameResolve, byte(len(name)))
+	request = append(request, name...)
+	// pad the request so that the relay answer is never larger
+	request = append(request, make([]byte, 16)...)
+	request = sealRelay(request, relayAddr)
+	buffer := make([]byte, 64)
+	for try := 0; try < 3; try++ {
+		if _, err := c.Write(request); err != nil {
+			return "", 0, err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for {
+			n, err := c.Read(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return "", 0, err
+			}
+			b := openRelay(buffer[:n], relayAddr)
+			if len(b) != 12 || string(b[:4]) != nameMagic || b[4] != nameResolved {
+				continue
+			}
+			if b[5] != nameOk {
+				return "", 0, errors.New("name " + name + " is not hosting right now")
+			}
+			ip := net.IPv4(b[6], b[7], b[8], b[9])
+			port := int(binary.BigEndian.Uint16(b[10:12]))
+			s.println("Resolved " + host + " to " + ip.String() + " on port " + strconv.Itoa(port))
+			return ip.String(), port, nil
+		}
+	}
+	return "", 0, errors.New("no answer from the relay")
+}
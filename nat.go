@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// stunServer is the public STUN server whose view of the public address is
+// compared with the relay's to detect symmetric NATs.
+const stunServer = "stun.l.google.com:19302"
+
+const stunCookie = 0x2112A442
+
+// natReport is the result of the NAT detection.
+type natReport struct {
+	// local is the address of the socket, relay and stun its public address
+	// as seen by the relay and the STUN server; stun is nil if unknown.
+	local *net.UDPAddr
+	relay *net.UDPAddr
+	stun  *net.UDPAddr
+}
+
+// detectNat finds how the NAT of this host maps the address of a socket, by
+// asking the relay and a STUN server for its public address.
+func detectNat(relayAddr *net.UDPAddr) (natReport, error) {
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return natReport{}, err
+	}
+	defer c.Close()
+
+	var r natReport
+	r.local = localCandidate(c, relayAddr)
+	r.relay, err = relayMapped(c, relayAddr)
+	if err != nil {
+		return natReport{}, err
+	}
+	if stunAddr, err := net.ResolveUDPAddr("udp4", stunServer); err == nil {
+		r.stun, _ = stunBinding(c, stunAddr)
+	}
+	return r, nil
+}
+
+// relayMapped returns the public address of c as seen by the relay.
+func relayMapped(c *net.UDPConn, relayAddr *net.UDPAddr) (*net.UDPAddr, error) {
+	// port 0 is never hosted: the registration only asks for the public address
+	query := make([]byte, 12)
+	copy(query, relayMagic)
+	return natQuery(c, relayAddr, query, func(b []byte) *net.UDPAddr {
+		if len(b) != 10 || string(b[:4]) != relayMagic {
+			return nil
+		}
+		return getAddr(b[4:10])
+	})
+}
+
+// stunBinding returns the public address of c as seen by the STUN server
+// stunAddr.
+func stunBinding(c *net.UDPConn, stunAddr *net.UDPAddr) (*net.UDPAddr, error) {
+	request := stunRequest()
+	return natQuery(c, stunAddr, request, func(b []byte) *net.UDPAddr {
+		return stunMapped(b, request[8:20])
+	})
+}
+
+// stunRequest returns a new STUN binding request.
+func stunRequest() []byte {
+	request := make([]byte, 20)
+	binary.BigEndian.PutUint16(request[0:2], 0x0001)
+	binary.BigEndian.PutUint32(request[4:8], stunCookie)
+	rand.Read(request[8:20])
+	return request
+}
+
+// natQuery sends request to addr until parse returns an address from an
+// answer.
+func natQuery(c *net.UDPConn, addr *net.UDPAddr, request []byte, parse func(b []byte) *net.UDPAddr) (*net.UDPAddr, error) {
+	buffer := make([]byte, 512)
+	for try := 0; try < 3; try++ {
+		if _, err := c.WriteToUDP(request, addr); err != nil {
+			return nil, err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for {
+			n, from, err := c.ReadFromUDP(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !from.IP.Equal(addr.IP) || from.Port != addr.Port {
+				continue
+			}
+			if mapped := parse(buffer[:n]); mapped != nil {
+				return mapped, nil
+			}
+		}
+	}
+	return nil, errors.New("no answer from " + addr.String())
+}
+
+// stunMapped returns the mapped address of a STUN binding response to the
+// transaction id, or nil.
+func stunMapped(b []byte, id []byte) *net.UDPAddr {
+	if len(b) < 20 || binary.BigEndian.Uint16(b[0:2]) != 0x0101 || binary.BigEndian.Uint32(b[4:8]) != stunCookie || !bytes.Equal(b[8:20], id) {
+		return nil
+	}
+	attrs := b[20:]
+	for len(attrs) >= 4 {
+		t := binary.BigEndian.Uint16(attrs[0:2])
+		l := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+l {
+			return nil
+		}
+		v := attrs[4 : 4+l]
+		// XOR-MAPPED-ADDRESS or MAPPED-ADDRESS, IPv4
+		if (t == 0x0020 || t == 0x0001) && l == 8 && v[1] == 0x01 {
+			port := binary.BigEndian.Uint16(v[2:4])
+			ip := net.IPv4(v[4], v[5], v[6], v[7]).To4()
+			if t == 0x0020 {
+				port ^= stunCookie >> 16
+				for i := range ip {
+					ip[i] ^= b[4+i]
+				}
+			}
+			return &net.UDPAddr{
+				IP:   ip,
+				Port: int(port),
+			}
+		}
+		// attributes are padded to 4 bytes
+		attrs = attrs[4+(l+3)/4*4:]
+	}
+	return nil
+}
+
+// describe explains the NAT of this host and how well punching works with it.
+func (r natReport) describe() string {
+	public := "Your public address is " + r.relay.String() + "."
+	if r.local != nil && r.local.IP.Equal(r.relay.IP) {
+		return public + " You are not behind a NAT: peers can connect to you directly."
+	}
+	if r.stun == nil {
+		return public + " You are behind a NAT; its type is unknown because " + stunServer + " did not answer."
+	}
+	if r.stun.IP.Equal(r.relay.IP) && r.stun.Port == r.relay.Port {
+		kind := "keeps the same public port for every destination"
+		if r.local != nil && r.local.Port == r.relay.Port {
+			kind = "keeps your local port as public port"
+		}
+		return public + " Your NAT " + kind + ": punching works with most peers."
+	}
+	return public + " Your NAT is symmetric (it changes the public port for every destination): punching fails with peers behind symmetric NATs too. Forward UDP port " + strconv.Itoa(defaultPort) + " on your router to this computer, or play with -private relayed sessions."
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// natLayers describes the NATs between this host and the Internet, found by
+// comparing the addresses of this host, the WAN address its router reports,
+// and the public address the relay sees.
+type natLayers struct {
+	// local is the address of this host on the route to the relay.
+	local net.IP
+	// gateway is the default gateway, nil if unknown.
+	gateway net.IP
+	// router is the WAN address the router reports with UPnP or NAT-PMP, nil
+	// if it does not answer.
+	router net.IP
+	// public is the address the relay sees.
+	public net.IP
+}
+
+// natLayout is the arrangement of NATs in front of a host.
+type natLayout int
+
+const (
+	layoutUnknown natLayout = iota
+	// layoutNone: this host has the public address.
+	layoutNone
+	// layoutSingle: the router of this host has the public address.
+	layoutSingle
+	// layoutDouble: the router of this host is behind another router of the
+	// local network, e.g. the modem of the ISP.
+	layoutDouble
+	// layoutCgnat: this host or its router is behind a carrier-grade NAT of
+	// the ISP, shared with other customers.
+	layoutCgnat
+)
+
+// diagnoseNat finds the NATs between this host, whose address on the route
+// to the relay is local, and the public address public seen by the relay.
+func diagnoseNat(local net.IP, public net.IP) natLayers {
+	l := natLayers{
+		local:  local,
+		public: public,
+	}
+	l.gateway, _ = defaultGateway()
+	if ip, err := routerExternalIP(l.gateway); err == nil {
+		l.router = ip
+	}
+	return l
+}
+
+// routerExternalIP asks the router for its WAN address with UPnP, then
+// NAT-PMP.
+func routerExternalIP(gateway net.IP) (net.IP, error) {
+	var errs []string
+	if g, err := discoverGateway(); err != nil {
+		errs = append(errs, "UPnP: "+err.Error())
+	} else if ip, err := g.externalIP(); err != nil {
+		errs = append(errs, "UPnP: "+err.Error())
+	} else {
+		return net.ParseIP(ip), nil
+	}
+	if gateway != nil {
+		if ip, err := newPmpGateway(gateway, false).externalIP(); err != nil {
+			errs = append(errs, "NAT-PMP: "+err.Error())
+		} else {
+			return net.ParseIP(ip), nil
+		}
+	}
+	return nil, errors.New(strings.Join(errs, ", "))
+}
+
+// interfaceAddrs returns the IPv4 addresses of the interfaces of this host,
+// but loopback and link-local ones.
+func interfaceAddrs() []net.IP {
+	var ips []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		n, ok := addr.(*net.IPNet)
+		if !ok || n.IP.To4() == nil || n.IP.IsLoopback() || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, n.IP.To4())
+	}
+	return ips
+}
+
+func (l natLayers) layout() natLayout {
+	if l.public == nil {
+		return layoutUnknown
+	}
+	for _, ip := range interfaceAddrs() {
+		if ip.Equal(l.public) {
+			return layoutNone
+		}
+	}
+	if l.local != nil && cgnatNet.Contains(l.local) {
+		return layoutCgnat
+	}
+	if l.router == nil {
+		return layoutUnknown
+	}
+	switch {
+	case l.router.Equal(l.public):
+		return layoutSingle
+	case cgnatNet.Contains(l.router):
+		return layoutCgnat
+	case l.router.IsPrivate():
+		return layoutDouble
+	}
+	// a public address other than the one seen by the relay: a carrier-grade
+	// NAT with public addresses, or a provider proxying the traffic
+	return layoutCgnat
+}
+
+// report describes the NATs and their effect on punching, one sentence per
+// line.
+func (l natLayers) report() []string {
+	var lines []string
+	router := "did not answer UPnP nor NAT-PMP"
+	if l.router != nil {
+		router = "reports the WAN address " + l.router.String()
+	}
+	if l.gateway != nil {
+		lines = append(lines, "Your router "+l.gateway.String()+" "+router+", the relay sees "+addrIP(l.public))
+	} else {
+		lines = append(lines, "Your router "+router+", the relay sees "+addrIP(l.public))
+	}
+	switch l.layout() {
+	case layoutNone:
+		lines = append(lines, "You are not behind a NAT: peers reach you directly")
+	case layoutSingle:
+		lines = append(lines, "You are behind a single NAT, your router: forwarding UDP port "+strconv.Itoa(defaultPort)+" on it lets peers reach you directly")
+	case layoutDouble:
+		lines = append(lines, "Double NAT: your router is itself behind another router of your network ("+l.router.String()+" is a private address), likely the modem of your ISP: punching works as with the NAT type above, but forwarding ports on your router has no effect unless the modem forwards them too, or is set to bridge mode")
+	case layoutCgnat:
+		lines = append(lines, "CGNAT: your ISP shares your public address with other customers behind a carrier-grade NAT: punching usually still works, but you cannot forward ports, ask your ISP for a public IPv4 address or use IPv6; if punching fails, use -private to play through the relay")
+	default:
+		lines = append(lines, "Could not tell whether you are behind several NATs: your router does not report its WAN address")
+	}
+	return lines
+}
+
+func addrIP(ip net.IP) string {
+	if ip == nil {
+		return "nothing (no answer)"
+	}
+	return ip.String()
+}
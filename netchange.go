@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// networkInterval is the interval between two checks of the local address of
+// this host.
+const networkInterval = 1 * time.Second
+
+// routeAddress returns the local address of this host on the route to addr,
+// nil if there is none, e.g. while switching networks.
+func routeAddress(addr *net.UDPAddr) net.IP {
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	route, err := net.DialUDP(network, nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer route.Close()
+	ip := route.LocalAddr().(*net.UDPAddr).IP
+	if ip.IsUnspecified() {
+		return nil
+	}
+	return ip
+}
+
+// watchNetwork punches the peer again when the local address of this host on
+// the route to the relay, or to the peer without relay, changes once
+// connected, e.g. after switching Wi-Fi networks, so that the peer learns the
+// new public address of this host from the relay, until done is closed.
+func (p *proxy) watchNetwork(done chan struct{}) {
+	target := p.relayAddr
+	if target == nil {
+		target = p.peer()
+	}
+	local := routeAddress(target)
+	ticker := time.NewTicker(networkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		ip := routeAddress(target)
+		if ip == nil {
+			// no route yet, the network is changing
+			continue
+		}
+		if local == nil {
+			local = ip
+			continue
+		}
+		if ip.Equal(local) {
+			continue
+		}
+		if _, connected := p.connectedPeer(); !connected {
+			local = ip
+			continue
+		}
+		p.reconnect("Error your network changed (your address is now " + ip.String() + " instead of " + local.String() + "), reaching " + p.peerName() + " again; the game keeps its connection to proxypunch")
+		return
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNickname is the maximum length in bytes of a nickname exchanged with
+// the peer.
+const maxNickname = 32
+
+// helloCount is the count of typeHello packets sent once connected, one per
+// ping, so that the nickname arrives despite losses.
+const helloCount = 5
+
+// cleanNickname removes the characters of a nickname that cannot be printed,
+// and truncates it to maxNickname.
+func cleanNickname(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, v)
+	v = strings.TrimSpace(v)
+	for len(v) > maxNickname {
+		_, size := utf8.DecodeLastRuneInString(v)
+		v = v[:len(v)-size]
+	}
+	return v
+}
+
+// peerName returns the nickname of the peer, or "the peer" if unknown.
+func (p *proxy) peerName() string {
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	if p.peerNickname != "" {
+		return p.peerNickname
+	}
+	return "the peer"
+}
+
+// setPeerNickname records the nickname sent by the peer.
+func (p *proxy) setPeerNickname(v string) {
+	v = cleanNickname(v)
+	p.peerMu.Lock()
+	changed := v != "" && v != p.peerNickname
+	if changed {
+		p.peerNickname = v
+	}
+	p.peerMu.Unlock()
+	if !changed {
+		return
+	}
+	if _, localPort := p.local(); localPort != 0 {
+		// in server mode
+		if isBanned(nil, v) {
+			p.kick("Ending the session of " + p.peerName() + ", who is banned")
+			return
+		}
+		if isRejected(nil, v) {
+			p.kick("Rejected " + p.peerName() + " again, ending its session")
+			return
+		}
+	}
+	p.s.setOpponent(v)
+	p.s.println("Your peer is " + v)
+	p.setConnectedState()
+}
+
+// setConnectedState updates the state of the session once connected.
+func (p *proxy) setConnectedState() {
+	if p.relayed {
+		p.s.setState("connected to " + p.peerName() + " through the relay")
+		return
+	}
+	p.s.setState("connected to " + p.peerName() + " at " + p.peer().String())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// plain makes the output easy to follow with a screen reader: every line is
+// a complete sentence prefixed with the time, state changes are printed as
+// they happen, and nothing is decorative or rewritten in place.
+var plain bool
+
+// timestamp returns the prefix of lines in plain mode.
+func timestamp() string {
+	if !plain {
+		return ""
+	}
+	return time.Now().Format("15:04:05") + " "
+}
+
+// decoration prints a decorative line, such as a separator, unless in plain
+// mode.
+func decoration(line string) {
+	if !plain {
+		fmt.Println(line)
+	}
+}
+
+// sentence turns a state into a sentence.
+func sentence(state string) string {
+	if state == "" {
+		return state
+	}
+	return strings.ToUpper(state[:1]) + state[1:] + "."
+}
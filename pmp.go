@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// pmpPort is the port routers answer PCP and NAT-PMP requests on.
+const pmpPort = 5351
+
+// pmpGateway asks the router to forward a port with PCP (RFC 6887), or with
+// its predecessor NAT-PMP (RFC 6886), common on Apple routers.
+type pmpGateway struct {
+	gateway *net.UDPAddr
+	pcp     bool
+	// nonce identifies the PCP mapping, to renew and remove it.
+	nonce []byte
+	port  int
+	// external is the external IP assigned with PCP.
+	external net.IP
+}
+
+func newPmpGateway(gateway net.IP, pcp bool) *pmpGateway {
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	return &pmpGateway{
+		gateway: &net.UDPAddr{IP: gateway, Port: pmpPort},
+		pcp:     pcp,
+		nonce:   nonce,
+	}
+}
+
+func (g *pmpGateway) name() string {
+	if g.pcp {
+		return "PCP"
+	}
+	return "NAT-PMP"
+}
+
+func (g *pmpGateway) add(port int) (time.Duration, error) {
+	g.port = port
+	external, lease, err := g.request(port, mappingLease)
+	if err != nil {
+		return 0, err
+	}
+	if external != defaultPort {
+		g.remove()
+		return 0, refusedError{errors.New("the router forwards port " + strconv.Itoa(external) + " instead")}
+	}
+	return lease, nil
+}
+
+func (g *pmpGateway) remove() error {
+	_, _, err := g.request(g.port, 0)
+	return err
+}
+
+// request maps defaultPort to port for lease, or removes the mapping if lease
+// is 0, and returns the external port and lease granted by the router.
+func (g *pmpGateway) request(port int, lease time.Duration) (external int, granted time.Duration, err error) {
+	c, err := net.DialUDP("udp4", nil, g.gateway)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+
+	var request []byte
+	if g.pcp {
+		// common header, then the MAP opcode
+		request = make([]byte, 60)
+		request[0] = 2
+		request[1] = 1
+		binary.BigEndian.PutUint32(request[4:8], uint32(lease.Seconds()))
+		copy(request[8:24], c.LocalAddr().(*net.UDPAddr).IP.To16())
+		copy(request[24:36], g.nonce)
+		request[36] = 17 // UDP
+		binary.BigEndian.PutUint16(request[40:42], uint16(port))
+		binary.BigEndian.PutUint16(request[42:44], uint16(defaultPort))
+		copy(request[44:60], net.IPv4zero.To16())
+	} else {
+		request = make([]byte, 12)
+		request[1] = 1 // UDP
+		binary.BigEndian.PutUint16(request[4:6], uint16(port))
+		if lease != 0 {
+			// removals suggest no port
+			binary.BigEndian.PutUint16(request[6:8], uint16(defaultPort))
+		}
+		binary.BigEndian.PutUint32(request[8:12], uint32(lease.Seconds()))
+	}
+
+	buffer := make([]byte, 1100)
+	for try := 0; try < 3; try++ {
+		if _, err := c.Write(request); err != nil {
+			return 0, 0, err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for {
+			n, err := c.Read(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return 0, 0, err
+			}
+			b := buffer[:n]
+			if g.pcp && n >= 60 && b[0] == 2 && b[1] == 0x81 && string(b[24:36]) == string(g.nonce) {
+				if b[3] != 0 {
+					return 0, 0, refusedError{errors.New("router error " + strconv.Itoa(int(b[3])))}
+				}
+				g.external = net.IP(append([]byte(nil), b[44:60]...))
+				return int(binary.BigEndian.Uint16(b[42:44])), time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Second, nil
+			}
+			if g.pcp && n >= 4 && b[1]&0x80 != 0 && b[0] != 2 {
+				// a NAT-PMP router answers PCP requests with an unsupported version error
+				return 0, 0, errors.New("PCP not supported")
+			}
+			if !g.pcp && n >= 16 && b[0] == 0 && b[1] == 0x81 {
+				if code := binary.BigEndian.Uint16(b[2:4]); code != 0 {
+					return 0, 0, refusedError{errors.New("router error " + strconv.Itoa(int(code)))}
+				}
+				return int(binary.BigEndian.Uint16(b[10:12])), time.Duration(binary.BigEndian.Uint32(b[12:16])) * time.Second, nil
+			}
+		}
+	}
+	return 0, 0, errors.New("no answer from " + g.gateway.String())
+}
+
+func (g *pmpGateway) externalIP() (string, error) {
+	if g.pcp {
+		if g.external == nil || g.external.IsUnspecified() {
+			return "", errors.New("unknown external IP")
+		}
+		return g.external.String(), nil
+	}
+	c, err := net.DialUDP("udp4", nil, g.gateway)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	buffer := make([]byte, 16)
+	for try := 0; try < 3; try++ {
+		if _, err := c.Write([]byte{0, 0}); err != nil {
+			return "", err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := c.Read(buffer)
+		if err != nil {
+			continue
+		}
+		if n == 12 && buffer[0] == 0 && buffer[1] == 0x80 && binary.BigEndian.Uint16(buffer[2:4]) == 0 {
+			return net.IP(buffer[8:12]).String(), nil
+		}
+	}
+	return "", errors.New("no answer from " + g.gateway.String())
+}
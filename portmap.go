@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// noUpnp disables asking the router to forward defaultPort with UPnP, PCP or
+// NAT-PMP.
+var noUpnp bool
+
+// mappingLease is the lease of the port mapping, renewed at half of it; a
+// mapping left by a killed proxypunch expires after it.
+const mappingLease = 1 * time.Hour
+
+// portMapper asks the router to forward defaultPort with a protocol.
+type portMapper interface {
+	name() string
+	// add forwards defaultPort to port, and returns the lease of the
+	// mapping, 0 if permanent.
+	add(port int) (time.Duration, error)
+	remove() error
+	externalIP() (string, error)
+}
+
+// forwardPort asks the router to forward UDP port defaultPort to the proxy
+// socket c, in the background, so that peers reach this host directly even
+// if its NAT is symmetric. The mapping is removed by the returned stop
+// function.
+func forwardPort(s *session, c *net.UDPConn) (stop func()) {
+	if noUpnp {
+		return func() {}
+	}
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	chStop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		m, lease, err := mapPort(port)
+		if err != nil {
+			if _, ok := err.(refusedError); ok {
+				s.errorln("Error asking your router to forward UDP port " + strconv.Itoa(defaultPort) + ": " + err.Error())
+			} else if verbose {
+				s.println("No router accepted to forward port " + strconv.Itoa(defaultPort) + ": " + err.Error())
+			}
+			return
+		}
+		external := "your public IP"
+		if ip, err := m.externalIP(); err == nil {
+			external = ip
+			go checkForwarded(s, net.ParseIP(ip), chStop)
+		}
+		s.println("Your router forwards UDP port " + strconv.Itoa(defaultPort) + " of " + external + " to proxypunch (" + m.name() + "): peers can connect directly, even if your NAT is symmetric")
+		defer m.remove()
+		for {
+			var renew <-chan time.Time
+			if lease > 0 {
+				renew = time.After(lease / 2)
+			}
+			select {
+			case <-chStop:
+				return
+			case <-renew:
+				if l, err := m.add(port); err == nil {
+					lease = l
+				}
+			}
+		}
+	}()
+	return func() {
+		close(chStop)
+		select {
+		case <-stopped:
+		case <-time.After(upnpTimeout):
+		}
+	}
+}
+
+// checkForwarded warns if router, the WAN address of the router forwarding the
+// port, is not the public address of this host once the relay tells it: the
+// router is behind another NAT, which does not forward the port.
+func checkForwarded(s *session, router net.IP, done chan struct{}) {
+	for {
+		s.mu.Lock()
+		external := s.external
+		s.mu.Unlock()
+		if external != nil {
+			l := natLayers{router: router, public: external.IP}
+			switch l.layout() {
+			case layoutDouble:
+				s.errorln("Error your router is behind another router (its WAN address " + router.String() + " is private, the relay sees " + external.IP.String() + "), which does not forward the port: peers connect by punching instead, forward UDP port " + strconv.Itoa(defaultPort) + " on the modem of your ISP too, or set it to bridge mode")
+			case layoutCgnat:
+				s.errorln("Error your router is behind the carrier-grade NAT of your ISP (its WAN address is " + router.String() + ", the relay sees " + external.IP.String() + "), which does not forward the port: peers connect by punching instead")
+			}
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// refusedError is returned when a router supporting a mapping protocol
+// refused the mapping.
+type refusedError struct {
+	error
+}
+
+// mapPort asks the router to forward defaultPort to port with UPnP, then PCP,
+// then NAT-PMP.
+func mapPort(port int) (portMapper, time.Duration, error) {
+	var errs []string
+	refused := false
+	if g, err := discoverGateway(); err != nil {
+		errs = append(errs, "UPnP: "+err.Error())
+	} else if lease, err := g.add(port); err != nil {
+		refused = true
+		errs = append(errs, "UPnP: "+err.Error())
+	} else {
+		return g, lease, nil
+	}
+	if gateway, err := defaultGateway(); err != nil {
+		errs = append(errs, "PCP and NAT-PMP: "+err.Error())
+	} else {
+		for _, pcp := range []bool{true, false} {
+			m := newPmpGateway(gateway, pcp)
+			lease, err := m.add(port)
+			if err == nil {
+				return m, lease, nil
+			}
+			if _, ok := err.(refusedError); ok {
+				refused = true
+			}
+			errs = append(errs, m.name()+": "+err.Error())
+		}
+	}
+	err := errors.New(strings.Join(errs, ", "))
+	if refused {
+		return nil, 0, refusedError{err}
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+)
+
+// autoPort is the port value requesting a free port to host on.
+const autoPort = -1
+
+// autoPortBase is the port near which a free port is chosen without a
+// preset or saved port.
+const autoPortBase = 10800
+
+// portValue is a port flag that also accepts auto, or a list of ports whose
+// first is the main port and the others extraPorts.
+type portValue struct {
+	port *int
+}
+
+func (v portValue) String() string {
+	if v.port == nil || *v.port == 0 {
+		return ""
+	}
+	if *v.port == autoPort {
+		return "auto"
+	}
+	return strconv.Itoa(*v.port)
+}
+
+func (v portValue) Set(s string) error {
+	if s == "auto" {
+		*v.port = autoPort
+		return nil
+	}
+	port, err := parsePorts(s)
+	if err != nil {
+		return err
+	}
+	*v.port = port
+	return nil
+}
+
+// portOwner describes the process bound to a local UDP port, or returns an
+// empty string if the port is free or the process is unknown.
+func portOwner(port int) string {
+	listeners, err := udpListeners()
+	if err != nil {
+		return ""
+	}
+	for _, l := range listeners {
+		if l.port != port || l.pid == os.Getpid() {
+			continue
+		}
+		if l.pid == 0 {
+			return "another process"
+		}
+		if l.process == "" {
+			return "process " + strconv.Itoa(l.pid)
+		}
+		return l.process + " (pid " + strconv.Itoa(l.pid) + ")"
+	}
+	return ""
+}
+
+// freePort returns a free local UDP port at or after near.
+func freePort(near int) int {
+	for port := near; port < near+100 && port <= 65535; port++ {
+		if !udpPortInUse(port) {
+			return port
+		}
+	}
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return near
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
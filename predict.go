@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// predictionDelay is the time spent punching the peer candidates before also
+// punching predicted ports, in case the peer is behind a symmetric NAT.
+const predictionDelay = 3 * time.Second
+
+// predictionRange is the count of ports after the public port of the peer
+// that are punched first: most symmetric NATs allocate their ports
+// sequentially, so the port mapped for this host is usually close to the
+// port mapped for the relay.
+const predictionRange = 128
+
+// predictionBatch is the count of predicted ports punched every round, half
+// sequential and half random: NATs that allocate ports randomly are only
+// reached by chance, which grows with every port punched while the peer
+// punches its own mappings.
+const predictionBatch = 32
+
+// predictPorts punches predicted ports of the public address of the peer, the
+// last candidate, until connected to the peer or done is closed. A peer
+// behind a symmetric NAT reaches this host from a port the relay never saw:
+// its packets are accepted once this host punched that port, and the peer
+// learns the port of this host with endpoint-independent mapping from the
+// relay as usual.
+func (p *proxy) predictPorts(done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-time.After(predictionDelay):
+	}
+	if _, connected := p.connectedPeer(); connected {
+		return
+	}
+	public := p.peerAddrs[len(p.peerAddrs)-1]
+	p.s.mu.Lock()
+	external := p.s.external
+	p.s.mu.Unlock()
+	if external != nil && external.IP.Equal(public.IP) {
+		// the peer is behind the same NAT: ports of the NAT lead back here
+		return
+	}
+	if verbose {
+		p.s.println("Peer not reached yet, also trying ports near " + strconv.Itoa(public.Port) + " in case it is behind a symmetric NAT")
+	}
+	punchPayload := p.s.punchPayload()
+	next := 1
+	for {
+		for i := 0; i < predictionBatch/2; i++ {
+			port := public.Port + next
+			if next++; next > predictionRange {
+				next = 1
+			}
+			if port > 65535 {
+				port -= 65535 - 1024
+			}
+			p.c.WriteToUDP(punchPayload, &net.UDPAddr{IP: public.IP, Port: port})
+			p.c.WriteToUDP(punchPayload, &net.UDPAddr{IP: public.IP, Port: 1024 + rand.Intn(65536-1024)})
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+		if _, connected := p.connectedPeer(); connected {
+			return
+		}
+	}
+}
+
+// predicted switches the public candidate of the peer to addr, a port of its
+// public IP punching this host, and returns its index, or -1 if addr is not
+// the peer.
+func (p *proxy) predicted(addr *net.UDPAddr) int {
+	i := len(p.peerAddrs) - 1
+	if !addr.IP.Equal(p.peerAddrs[i].IP) {
+		return -1
+	}
+	p.peerMu.Lock()
+	p.peerAddrs[i] = &net.UDPAddr{
+		IP:   addr.IP,
+		Port: addr.Port,
+	}
+	p.peerMu.Unlock()
+	p.s.println("Peer is behind a symmetric NAT, reached it on its port " + strconv.Itoa(addr.Port))
+	return i
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// preset holds game-specific defaults and instructions.
+type preset struct {
+	title string
+	port  int
+	// hostHelp and connectHelp are printed in server and client mode, with
+	// the port to host on or to connect to.
+	hostHelp    func(port int) string
+	connectHelp func(port int) string
+}
+
+var presets = map[string]*preset{
+	"soku": {
+		title: "Hisoutensoku",
+		port:  10800,
+		hostHelp: func(port int) string {
+			return "In Hisoutensoku (or sokuroll), go to Network, choose Host a game, and host on port " + strconv.Itoa(port) + "."
+		},
+		connectHelp: func(port int) string {
+			return "In Hisoutensoku (or sokuroll), go to Network, choose Connect to a server, and enter IP 127.0.0.1 and port " + strconv.Itoa(port) + "."
+		},
+	},
+}
+
+var game string
+var gamePreset *preset
+
+func presetNames() string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// presetName returns the name of a preset, or an empty string.
+func presetName(p *preset) string {
+	for name, v := range presets {
+		if v == p {
+			return name
+		}
+	}
+	return ""
+}
+
+// udpPortInUse returns whether a local UDP port is bound, which means that
+// the game is listening on it.
+func udpPortInUse(port int) bool {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{
+		Port: port,
+	})
+	if err != nil {
+		return true
+	}
+	c.Close()
+	return false
+}
+
+// waitForGame waits until the preset game listens on port, so that the
+// session is only advertised once the game is actually hosting.
+func waitForGame(s *session, port int) {
+	if udpPortInUse(port) {
+		s.println(s.preset.title + " is hosting on port " + strconv.Itoa(port) + ".")
+		return
+	}
+	s.println("Waiting for " + s.preset.title + " to host on port " + strconv.Itoa(port) + "...")
+	s.setState("waiting for " + s.preset.title + " to host")
+	for !udpPortInUse(port) {
+		time.Sleep(1 * time.Second)
+	}
+	s.println(s.preset.title + " is now hosting on port " + strconv.Itoa(port) + ".")
+}
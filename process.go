@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// followInterval is the interval at which the targeted process sockets are
+// checked for changes.
+const followInterval = 2 * time.Second
+
+var targetPid int
+var targetProcess string
+
+// targeting returns whether the game port is found from its process.
+func targeting() bool {
+	return targetPid != 0 || targetProcess != ""
+}
+
+func targetName() string {
+	if targetProcess != "" {
+		return targetProcess
+	}
+	return "process " + strconv.Itoa(targetPid)
+}
+
+// processPorts returns the UDP ports the targeted process listens on, sorted.
+func processPorts() []int {
+	listeners, err := udpListeners()
+	if err != nil {
+		return nil
+	}
+	var ports []int
+	for _, l := range gameListenersOf(listeners) {
+		if targetPid != 0 && l.pid != targetPid {
+			continue
+		}
+		if targetProcess != "" && !strings.EqualFold(l.process, targetProcess) && !strings.EqualFold(strings.TrimSuffix(l.process, ".exe"), targetProcess) {
+			continue
+		}
+		ports = append(ports, l.port)
+	}
+	return ports
+}
+
+// waitForProcessPort waits until the targeted process listens on a UDP port
+// and returns it.
+func waitForProcessPort() int {
+	ports := processPorts()
+	if len(ports) == 0 {
+		fmt.Println("Waiting for " + targetName() + " to listen on a UDP port...")
+		for len(ports) == 0 {
+			time.Sleep(1 * time.Second)
+			ports = processPorts()
+		}
+	}
+	if len(ports) > 1 {
+		var list []string
+		for _, port := range ports {
+			list = append(list, strconv.Itoa(port))
+		}
+		fmt.Println(targetName() + " listens on UDP ports " + strings.Join(list, ", ") + ", using port " + list[0] + " (use -port to choose another one).")
+	} else {
+		fmt.Println(targetName() + " listens on UDP port " + strconv.Itoa(ports[0]) + ".")
+	}
+	return ports[0]
+}
+
+// followProcess forwards to the new port of the targeted process whenever
+// the game closes its socket and binds another one.
+func followProcess(p *proxy) {
+	for {
+		time.Sleep(followInterval)
+		ports := processPorts()
+		if len(ports) == 0 {
+			continue
+		}
+		_, current := p.local()
+		found := false
+		for _, port := range ports {
+			if port == current {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		p.s.println(targetName() + " now listens on UDP port " + strconv.Itoa(ports[0]) + ", forwarding to it.")
+		p.setLocal(&net.UDPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: ports[0],
+		}, ports[0])
+	}
+}
@@ -0,0 +1,1067 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Packets between peers start with a type byte.
+const (
+	typeData  = 0xCC
+	typePunch = 0xCD
+	typePing  = 0xCE
+	typePong  = 0xCF
+	// a client probes whether the host is publicly reachable on the default
+	// port with typeProbe, the host answers with typeProbeReply
+	typeProbe      = 0xD0
+	typeProbeReply = 0xD1
+	// a host requiring a password or token sends typeChallenge with a nonce,
+	// the peer answers typeAuth with its HMAC keyed by the join secret, see
+	// clientMac
+	typeChallenge = 0xD2
+	typeAuth      = 0xD3
+	// typeBroadcast carries a LAN discovery packet: port, then payload
+	typeBroadcast = 0xD4
+	// typeClosing tells that the session of the peer ends: seconds left as 4
+	// bytes, 0 if it ends now
+	typeClosing = 0xD5
+	// typeHello carries the nickname of the peer
+	typeHello = 0xD6
+	// typeTcp carries the public and local TCP ports of the peer with
+	// -proto tcp, 2 bytes each
+	typeTcp = 0xD7
+	// typePorts lists the main and extra game ports of the host, 2 bytes
+	// each; typePortData carries a packet of an extra port: its index from
+	// 1, then payload
+	typePorts    = 0xD8
+	typePortData = 0xD9
+	// typeMtuProbe is padded to the probed size, the peer answers
+	// typeMtuReply with the size received as 2 bytes
+	typeMtuProbe = 0xDA
+	typeMtuReply = 0xDB
+	// typeKey carries the X25519 public key of the peer and flags, and
+	// typeSealed a game packet encrypted with the keys derived from both,
+	// see peerCrypt
+	typeKey    = 0xDC
+	typeSealed = 0xDD
+	// typeCodecs carries the packet codecs the peer decodes (4 bytes), and
+	// typeCompressed a game packet compressed with deflate, see codec.go
+	typeCodecs     = 0xDE
+	typeCompressed = 0xDF
+	// typeFec carries a game packet of a -fec group, or its parity, see
+	// fecPacket
+	typeFec = 0xE0
+	// typeRedundant carries a copy of a game packet sent with -redundancy:
+	// its sequence number (4 bytes), then the packet
+	typeRedundant = 0xE1
+	// typeStream carries a segment of the TCP stream of the game with
+	// -proto tcp-udp, and typeStreamAck acknowledges them, see tcpTunnel
+	typeStream    = 0xE2
+	typeStreamAck = 0xE3
+	// typeSocksOpen asks the peer to open a connection of -socks: stream key
+	// (4 bytes), then port (2 bytes), answered with typeSocksReply: stream
+	// key, then status (1 byte); typeSocksData and typeSocksAck are the
+	// packets of its stream, after the stream key, see socksMux
+	typeSocksOpen  = 0xE4
+	typeSocksReply = 0xE5
+	typeSocksData  = 0xE6
+	typeSocksAck   = 0xE7
+	// typePortMap lists the main and extra game ports of the host as
+	// typePorts, each followed by the port peers open for it, 0 for any (2
+	// bytes each)
+	typePortMap = 0xE8
+	// typeChecked carries a game packet sent with -integrity, see
+	// integritySender
+	typeChecked = 0xE9
+	// typePathPing is sent to a candidate of the peer with a timestamp (8
+	// bytes), the peer answers typePathPong with it to the address it came
+	// from, see familyPaths
+	typePathPing = 0xEA
+	typePathPong = 0xEB
+	// typeOrdered carries a game packet sent to a peer running -reorder: its
+	// sequence number (4 bytes), then the packet
+	typeOrdered = 0xEC
+	// a client with -password sends typeHostChallenge with a nonce, the
+	// host answers typeHostAuth with its HMAC, see hostMac, or nothing after
+	// the type if it does not require a password
+	typeHostChallenge = 0xED
+	typeHostAuth      = 0xEE
+)
+
+// challengeInterval is the minimum interval between two challenges sent to
+// an unauthenticated peer.
+const challengeInterval = 200 * time.Millisecond
+
+// pingInterval is the interval at which the peer is pinged.
+const pingInterval = 1 * time.Second
+
+// summaryInterval is the interval at which unexpected packets are summarized.
+const summaryInterval = 1 * time.Minute
+
+// packetConn is the subset of *net.UDPConn used by the proxy, so that it can
+// also run over an in-memory network.
+type packetConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+type proxy struct {
+	s         *session
+	c         packetConn
+	relayAddr *net.UDPAddr
+	// relays switches to a backup relay when the relay stops answering
+	// during the session, nil if not registered on a relay.
+	relays *relaySwitch
+	// peerAddrs are the candidate addresses of the peer, by order of
+	// preference: its local network addresses, then its IPv6 address and
+	// its public address, whichever is faster, see familyPaths.
+	// Packets from any of them are accepted.
+	peerAddrs []*net.UDPAddr
+	// peerMu protects peerIndex, the index of the best candidate the peer
+	// was reached on, which packets are sent to.
+	peerMu    sync.Mutex
+	peerIndex int
+	// paths chooses between the IPv6 and IPv4 addresses of the peer, nil
+	// unless it has both.
+	paths *familyPaths
+	// connected is set once a packet was accepted from the peer, lastPeer
+	// is the time of the last one. peerNickname is the nickname the peer
+	// sent, if any.
+	connected    bool
+	lastPeer     time.Time
+	peerNickname string
+	// localMu protects localAddr and localPort, which change while running
+	// when following a game process.
+	localMu sync.Mutex
+	// localAddr is the address of the local game; in client mode it is nil
+	// until the game sends its first packet.
+	localAddr *net.UDPAddr
+	// localPort restricts the local packets that are forwarded to the peer
+	// to this source port; 0 accepts any local port.
+	localPort int
+	// strict drops everything but the peer address first reached and the
+	// first local game address once the peer is connected, without
+	// accounting for it, and never switches to another peer address.
+	strict bool
+	// limiter limits the rate of packets from each non-local source.
+	limiter *rateLimiter
+	// peerQueue and localQueue hold the packets waiting to be sent to the
+	// peer and to the game.
+	peerQueue  *packetQueue
+	localQueue *packetQueue
+	// peerLoss and localLoss drop packets to simulate a lossy link.
+	peerLoss  *lossModel
+	localLoss *lossModel
+	// secret answers the challenges of the peer; with authenticate, the peer
+	// must answer ours before any of its packets are accepted.
+	secret        []byte
+	authenticate  bool
+	authenticated bool
+	authFailed    bool
+	nonce         []byte
+	challengeTime time.Time
+	// verifyHost is set in client mode with -password: the host must answer
+	// our typeHostChallenge before the game traffic is exchanged with it.
+	// hostVerified is 1 once it did, 2 once it answered wrongly, accessed
+	// atomically.
+	verifyHost     bool
+	hostVerified   uint32
+	hostChallenges int
+	// confirmPeer is set in server mode when the host is asked to accept the
+	// peer once connected; unconfirmed is 1 until it did, accessed
+	// atomically.
+	confirmPeer bool
+	unconfirmed uint32
+	// giveUp is set for the sessions of a host that cannot fall back to the
+	// relay: they end if the peer is not reached in time, see watchConnect.
+	giveUp bool
+	// relayed is set when the peer is reached through a relay channel, whose
+	// latency is reported once known.
+	relayed     bool
+	rttReported bool
+	// peerClosing is set once the peer warned that its session ends soon.
+	peerClosing bool
+	// predict is set when the public address of the peer is the one seen
+	// by the relay, whose ports are predicted if the peer is not reached.
+	predict bool
+	// fallback is the relay channel of the session, which the session
+	// continues through if the peer is not reached directly; nil to never
+	// fall back. fellBack is set once falling back, under peerMu.
+	fallback []byte
+	fellBack bool
+	// stalled is set once the connected peer stopped responding and the
+	// session ends to punch it again, or once it was banned and the session
+	// ends to wait for other peers, under peerMu.
+	stalled bool
+	// tcp opens the TCP connection to the peer with -proto tcp, nil
+	// otherwise.
+	tcp *tcpPunch
+	// tunnel proxies the TCP stream of the game over the session with
+	// -proto tcp-udp, nil otherwise.
+	tunnel *tcpTunnel
+	// socks accepts the connections of the local SOCKS5 proxy of -socks,
+	// nil otherwise.
+	socks *socksMux
+	// bridges relay LAN discovery packets with the peer.
+	bridges []*lanBridge
+	// gamePorts relay the extra game ports with the peer; in client mode they
+	// are nil until the host announces them.
+	gamePorts []*gamePort
+	// mtu is the largest packet that reaches the peer.
+	mtu pathMtu
+	// crypt encrypts the game packets exchanged with the peer, with -encrypt
+	// or if the peer asks for it.
+	crypt *peerCrypt
+	// peerCodecs are the packet codecs the peer announced, accessed
+	// atomically.
+	peerCodecs uint32
+	// fecOut groups the game packets sent with -fec, fecIn recovers the
+	// lost packets of the peer.
+	fecOut fecEncoder
+	fecIn  fecDecoder
+	// redundantOut numbers the game packets sent with -redundancy,
+	// redundantIn drops the copies received.
+	redundantOut redundantSender
+	redundantIn  redundantReceiver
+	// checkOut numbers the game packets sent with -integrity, checkIn checks
+	// those received.
+	checkOut integritySender
+	checkIn  integrityChecker
+	// orderedOut numbers the game packets sent to a peer running -reorder,
+	// reorderIn holds those received out of order with -reorder, nil
+	// otherwise.
+	orderedOut orderedSender
+	reorderIn  *reorderBuffer
+	// asPeer sends the packets of the peer to the game from its address
+	// with -transparent.
+	asPeer transparentGame
+
+	// unreachableMu protects unreachableTime, the time of the last reported
+	// ICMP error, and peerRejected, whether an ICMP error from the peer was
+	// reported.
+	unreachableMu   sync.Mutex
+	unreachableTime time.Time
+	peerRejected    bool
+
+	foundPeer  bool
+	start      time.Time
+	unexpected unexpectedStats
+	rtt        rttStats
+	interval   intervalStats
+}
+
+// maxUnexpectedSources bounds the sources of unexpected packets counted apart
+// in a summary interval, so that spoofed sources cannot make it grow.
+const maxUnexpectedSources = 256
+
+// maxUnexpectedLogs bounds the unexpected packets logged in verbose mode in a
+// summary interval.
+const maxUnexpectedLogs = 20
+
+type unexpectedStats struct {
+	sync.Mutex
+	packets int
+	bytes   int
+	sources map[string]int
+	// overflow is set once more than maxUnexpectedSources sent packets.
+	overflow bool
+}
+
+func newProxy(s *session, c packetConn, relayAddr *net.UDPAddr, peerAddrs []*net.UDPAddr, localAddr *net.UDPAddr, localPort int) *proxy {
+	budget := newMemoryBudget(queueMemory)
+	return &proxy{
+		s:          s,
+		c:          c,
+		relayAddr:  relayAddr,
+		peerAddrs:  peerAddrs,
+		peerIndex:  len(peerAddrs) - 1,
+		paths:      newFamilyPaths(peerAddrs),
+		localAddr:  localAddr,
+		localPort:  localPort,
+		strict:     strict,
+		limiter:    newRateLimiter(s, rateLimitPackets, rateLimitBytes),
+		peerQueue:  newPacketQueue(queueDepth, budget, addLatency/2),
+		localQueue: newPacketQueue(queueDepth, budget, addLatency-addLatency/2),
+		peerLoss:   newLossModel(addLoss, lossBurst),
+		localLoss:  newLossModel(addLoss, lossBurst),
+		secret:     joinSecret(),
+		start:      time.Now(),
+	}
+}
+
+func (p *proxy) run(buffer []byte) {
+	crypt, err := newPeerCrypt(p.secret)
+	if err != nil {
+		p.s.errorln("Error generating the encryption key of the session: " + err.Error())
+		return
+	}
+	p.crypt = crypt
+	if p.verifyHost {
+		p.nonce = make([]byte, nonceSize)
+		rand.Read(p.nonce)
+	}
+	if p.confirmPeer {
+		p.unconfirmed = 1
+	}
+	if reorder > 0 {
+		p.reorderIn = newReorderBuffer(func(packet []byte) {
+			if packet[0] != typeOrdered && packet[0] != typeFec && packet[0] != typeRedundant && packet[0] != typeChecked {
+				p.handleGame(packet)
+			}
+		})
+	}
+	addActive(p)
+	defer removeActive(p)
+
+	chSummary := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(summaryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-chSummary:
+				return
+			case <-ticker.C:
+				p.unexpected.summarize(p.s)
+				if dropped := p.peerQueue.takeDropped() + p.localQueue.takeDropped(); dropped > 0 {
+					p.s.println("Dropped " + strconv.Itoa(dropped) + " queued packets in the last minute (queue full or memory limit reached).")
+				}
+				if corrupted := p.checkIn.takeCorrupted(); corrupted > 0 {
+					p.s.println("Dropped " + strconv.Itoa(corrupted) + " corrupted packets of " + p.peerName() + " in the last minute.")
+				}
+				if recovered := p.fecIn.takeRecovered(); recovered > 0 {
+					p.s.println("Recovered " + strconv.Itoa(recovered) + " lost packets of " + p.peerName() + " with its -fec parity in the last minute.")
+				}
+				if delayStats {
+					p.s.println(p.rtt.delayReport())
+				}
+			}
+		}
+	}()
+	defer close(chSummary)
+
+	if statsFile != "" {
+		chStats := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(statsFileInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-chStats:
+					return
+				case <-ticker.C:
+					p.recordStats(false)
+				}
+			}
+		}()
+		defer p.recordStats(true)
+		defer close(chStats)
+	}
+
+	chPing := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping := make([]byte, 9)
+		ping[0] = typePing
+		hello := append([]byte{typeHello}, cleanNickname(nickname)...)
+		codecs := codecsMessage()
+		hellos := 0
+		ports := p.announcePorts()
+		portMap := p.announcePortMap()
+		for {
+			select {
+			case <-chPing:
+				return
+			case <-ticker.C:
+				binary.BigEndian.PutUint64(ping[1:], uint64(time.Since(p.start)))
+				p.c.WriteToUDP(ping, p.peer())
+				if peer, ok := p.connectedPeer(); ok {
+					if p.relays != nil {
+						p.relays.check()
+					}
+					p.interval.ping()
+					p.pingFamilies()
+					p.challengeHost(peer)
+					if hellos < helloCount {
+						hellos++
+						if len(hello) > 1 {
+							p.c.WriteToUDP(hello, peer)
+						}
+						p.c.WriteToUDP(codecs, peer)
+						if portMap != nil {
+							// before typePorts, so that peers supporting it open the mapped ports
+							p.c.WriteToUDP(portMap, peer)
+						}
+						if ports != nil {
+							p.c.WriteToUDP(ports, peer)
+						}
+					}
+					if key, warn := p.crypt.pending(); key != nil {
+						p.c.WriteToUDP(key, peer)
+						if warn {
+							p.s.errorln("Error " + p.peerName() + " does not answer the encryption of -encrypt, its proxypunch may be too old: the game traffic is not forwarded until it is updated")
+						}
+					}
+				}
+				for _, u := range pollUnreachable(p.c) {
+					if p.unreachable(u) {
+						p.close()
+						return
+					}
+				}
+			}
+		}
+	}()
+	defer close(chPing)
+
+	p.bridges = openBridges(p.s)
+	for _, b := range p.bridges {
+		go p.bridgeLocal(b)
+		defer b.c.Close()
+	}
+	if p.announcePorts() != nil {
+		_, main := p.local()
+		p.gamePorts = openGamePorts(p.s, main)
+		for _, g := range p.gamePorts {
+			go p.relayGamePort(g)
+		}
+	}
+	defer p.closeGamePorts()
+
+	if p.predict {
+		chPredict := make(chan struct{})
+		go p.predictPorts(chPredict)
+		defer close(chPredict)
+	}
+	if p.fallback != nil {
+		chFallback := make(chan struct{})
+		go p.watchFallback(chFallback)
+		defer close(chFallback)
+	} else if p.giveUp {
+		chConnect := make(chan struct{})
+		go p.watchConnect(chConnect)
+		defer close(chConnect)
+	}
+
+	if !p.relayed && proto != "tcp" {
+		// a TCP stream cannot survive punching the peer again
+		chStall := make(chan struct{})
+		go p.watchStall(chStall)
+		go p.watchNetwork(chStall)
+		defer close(chStall)
+	}
+	if proto == "tcp" {
+		if p.relayed {
+			p.s.errorln("Error TCP sessions cannot be relayed, the peer must be reached directly, or use -proto tcp-udp")
+			return
+		}
+		p.tcp = newTcpPunch(p)
+		chTcp := make(chan struct{})
+		go p.tcp.run(chTcp)
+		defer close(chTcp)
+	}
+	if socksPort != 0 {
+		m, err := newSocksMux(p)
+		if err != nil {
+			p.s.errorln("Error listening on the -socks port " + strconv.Itoa(socksPort) + ": " + err.Error())
+		} else {
+			p.s.println("Applications can reach the TCP ports of the computer of the peer through the SOCKS5 proxy 127.0.0.1:" + strconv.Itoa(socksPort))
+			p.socks = m
+			go m.run()
+			defer m.close()
+		}
+	}
+	if proto == "tcp-udp" {
+		p.tunnel = newTcpTunnel(p, []byte{typeStream}, []byte{typeStreamAck})
+		chTunnel := make(chan struct{})
+		go p.tunnel.run(chTunnel)
+		defer close(chTunnel)
+	}
+
+	if transparent {
+		chTransparent := make(chan struct{})
+		go p.runTransparent(chTransparent)
+		defer close(chTransparent)
+	}
+
+	chMtu := make(chan struct{})
+	go p.probeMtu(chMtu)
+	defer close(chMtu)
+
+	go p.send(p.peerQueue)
+	defer p.peerQueue.close()
+	go p.send(p.localQueue)
+	defer p.localQueue.close()
+
+	defer lockThread()()
+
+	for {
+		n, addr, err := p.c.ReadFromUDP(buffer[1:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || p.fallingBack() || p.reconnecting() {
+				return
+			}
+			if u, ok := readUnreachable(err); ok && p.unreachable(u) {
+				return
+			}
+			// err is thrown if the buffer is too small
+			continue
+		}
+		if n > len(buffer)-1 {
+			p.s.errorln("Error received packet of wrong size from peer. (size:" + strconv.Itoa(n) + ")")
+			continue
+		}
+		if p.fallback != nil && addr.IP.Equal(p.relayAddr.IP) && addr.Port == p.relayAddr.Port && isChannel(buffer[1:n+1], p.fallback) {
+			// the peer could not reach this host and fell back to the relay
+			p.fallBack()
+			return
+		}
+		if p.relays != nil && p.relays.from(addr) {
+			continue
+		}
+		if p.relayAddr != nil && addr.IP.Equal(p.relayAddr.IP) && addr.Port == p.relayAddr.Port {
+			continue
+		}
+		if p.strict && p.foundPeer && !p.bound(addr) {
+			continue
+		}
+		i := p.candidate(addr)
+		if i < 0 && p.predict && !p.foundPeer && isPunch(p.s, buffer[1:n+1]) {
+			i = p.predicted(addr)
+		}
+		if i < 0 && !isLocal(addr.IP) {
+			// a source that did not complete the punch, such as a scanner:
+			// dropped before anything else, only counted
+			p.unexpected.add(p.s, addr, n)
+			continue
+		}
+		if i >= 0 && !p.limiter.allow(addr, n) {
+			continue
+		}
+		if i >= 0 {
+			if p.authenticate && !p.authenticated {
+				p.checkAuth(i, buffer[1:n+1])
+				continue
+			}
+			if p.prefers(i) {
+				p.setPeer(i)
+			}
+			p.heard()
+			if n != 0 && !p.pathReceived(i, addr, buffer[1:n+1]) {
+				p.handlePeer(buffer[1 : n+1])
+			}
+		} else if _, localPort := p.local(); isLocal(addr.IP) && (localPort == 0 || addr.Port == localPort) {
+			p.gamePacket(buffer, n, addr)
+		} else {
+			p.unexpected.add(p.s, addr, n)
+		}
+	}
+}
+
+// gamePacket forwards the packet of the game from addr to the peer, read in
+// buffer after a byte for its type.
+func (p *proxy) gamePacket(buffer []byte, n int, addr *net.UDPAddr) {
+	localAddr, localPort := p.local()
+	if localPort == 0 && (localAddr == nil || !addr.IP.Equal(localAddr.IP) || addr.Port != localAddr.Port) {
+		p.setLocal(addr, 0)
+	}
+	if p.authenticate && !p.authenticated {
+		return
+	}
+	if p.peerLoss.drop() {
+		return
+	}
+	p.checkMtu(n)
+	buffer[0] = typeData
+	p.interval.sent(n)
+	p.pushPeer(buffer[:n+1], p.peer())
+}
+
+func (p *proxy) handlePeer(data []byte) {
+	switch data[0] {
+	case typeData, typeBroadcast, typePortData, typeCompressed, typeFec, typeRedundant, typeStream, typeStreamAck,
+		typeSocksOpen, typeSocksReply, typeSocksData, typeSocksAck, typeChecked, typeOrdered:
+		if p.crypt.encrypted() || !p.hostAuthenticated() || !p.confirmed() {
+			// game packets must be sealed, the host authenticated, and the
+			// peer accepted
+			return
+		}
+		p.handleGame(data)
+	case typeSealed:
+		if !p.hostAuthenticated() || !p.confirmed() {
+			return
+		}
+		if packet := p.crypt.open(data); packet != nil {
+			p.handleGame(packet)
+		}
+	case typeKey:
+		reply, established := p.crypt.receivedKey(data[1:])
+		if reply != nil {
+			p.c.WriteToUDP(reply, p.peer())
+		}
+		if established {
+			p.s.println("Encrypting the game traffic with " + p.peerName())
+		}
+	default:
+		p.handleControl(data)
+	}
+}
+
+// pushPeer queues the game packet for the peer, compressed with -compress,
+// numbered for a peer running -reorder, along with parity packets with -fec,
+// copied with -redundancy, checksummed with -integrity, and encrypted if keys
+// are established with it. Nothing is sent to a host that did not prove to
+// know the password of -password yet, nor to a peer the host did not accept.
+func (p *proxy) pushPeer(packet []byte, addr *net.UDPAddr) {
+	if !p.hostAuthenticated() || !p.confirmed() {
+		return
+	}
+	if compress && p.peerDecodes(codecCompress) {
+		packet = compressPacket(packet)
+	}
+	if p.peerDecodes(codecOrdered) {
+		packet = p.orderedOut.wrap(packet)
+	}
+	packets := [][]byte{packet}
+	if fec > 0 && p.peerDecodes(codecFec) {
+		packets = p.fecOut.wrap(packet, fec)
+	}
+	if redundancy > 1 && p.peerDecodes(codecRedundant) {
+		var copies [][]byte
+		for _, packet := range packets {
+			copies = append(copies, p.redundantOut.wrap(packet, redundancy)...)
+		}
+		packets = copies
+	}
+	if integrity && p.peerDecodes(codecIntegrity) {
+		for i, packet := range packets {
+			packets[i] = p.checkOut.wrap(packet)
+		}
+	}
+	for _, packet := range packets {
+		if packet = p.crypt.seal(packet); packet != nil {
+			p.peerQueue.push(packet, addr)
+		}
+	}
+}
+
+// handleGame handles a game packet from the peer.
+func (p *proxy) handleGame(data []byte) {
+	switch data[0] {
+	case typeData:
+		p.interval.received(len(data) - 1)
+		if localAddr, _ := p.local(); localAddr != nil && !p.localLoss.drop() {
+			p.localQueue.push(data[1:], localAddr)
+		}
+	case typeBroadcast:
+		if len(data) < 3 {
+			return
+		}
+		port := int(binary.BigEndian.Uint16(data[1:3]))
+		for _, b := range p.bridges {
+			if b.dest.Port == port {
+				b.emit(data[3:])
+			}
+		}
+	case typePortData:
+		p.portData(data)
+	case typeCompressed:
+		if packet := decompressPacket(data); packet != nil && packet[0] != typeCompressed && packet[0] != typeFec && packet[0] != typeRedundant && packet[0] != typeOrdered {
+			p.handleGame(packet)
+		}
+	case typeFec:
+		packet, recovered := p.fecIn.receive(data)
+		for _, v := range [][]byte{packet, recovered} {
+			if len(v) > 0 && v[0] != typeFec && v[0] != typeRedundant {
+				p.handleGame(v)
+			}
+		}
+	case typeRedundant:
+		if packet := p.redundantIn.receive(data); packet != nil && packet[0] != typeRedundant {
+			p.handleGame(packet)
+		}
+	case typeChecked:
+		packet := p.checkIn.check(data)
+		if packet == nil {
+			p.interval.corrupt()
+		} else if packet[0] != typeChecked {
+			p.handleGame(packet)
+		}
+	case typeOrdered:
+		if p.reorderIn != nil {
+			p.reorderIn.receive(data)
+		}
+	case typeStream:
+		p.tunnelReceived(data)
+	case typeSocksOpen, typeSocksReply, typeSocksData, typeSocksAck:
+		p.socksReceived(data)
+	case typeStreamAck:
+		if p.tunnel != nil {
+			p.tunnel.receivedAck(data)
+		}
+	}
+}
+
+// handleControl handles a packet from the peer other than game packets.
+func (p *proxy) handleControl(data []byte) {
+	switch data[0] {
+	case typeHostChallenge:
+		if auth := p.hostAnswer(data); auth != nil {
+			p.c.WriteToUDP(auth, p.peer())
+		}
+	case typeHostAuth:
+		p.hostAnswered(data)
+	case typeChallenge:
+		if len(data) != 1+nonceSize {
+			// only our own fixed-size nonces are answered
+			return
+		}
+		if p.secret == nil {
+			if !p.authFailed {
+				p.authFailed = true
+				p.s.errorln("Error the host requires a password, restart proxypunch with -password (and -token for community sessions)")
+			}
+			return
+		}
+		auth := append([]byte{typeAuth}, clientMac(p.secret, data[1:])...)
+		p.c.WriteToUDP(auth, p.peer())
+	case typeHello:
+		p.setPeerNickname(string(data[1:]))
+	case typeTcp:
+		if p.tcp != nil {
+			p.tcp.received(data)
+		}
+	case typePorts, typePortMap:
+		p.portsAnnounced(data)
+	case typeCodecs:
+		p.codecsAnnounced(data)
+	case typeMtuProbe:
+		reply := []byte{typeMtuReply, byte(len(data) >> 8), byte(len(data))}
+		p.c.WriteToUDP(reply, p.peer())
+	case typeMtuReply:
+		p.mtuProbed(data)
+	case typeClosing:
+		if len(data) != 5 {
+			return
+		}
+		remaining := time.Duration(binary.BigEndian.Uint32(data[1:])) * time.Second
+		if remaining == 0 {
+			p.s.println("The session was ended by " + p.peerName() + ": its time limit was reached")
+			p.close()
+			return
+		}
+		if !p.peerClosing {
+			p.peerClosing = true
+			p.s.println("The session will be ended by " + p.peerName() + " in " + remaining.String() + ": its time limit is almost reached")
+		}
+	case typePing:
+		data[0] = typePong
+		p.c.WriteToUDP(data, p.peer())
+	case typePong:
+		if len(data) == 9 {
+			// pings bypass the queues, account for the artificial latency here
+			rtt := time.Since(p.start) - time.Duration(binary.BigEndian.Uint64(data[1:])) + addLatency
+			p.rtt.add(rtt)
+			p.interval.pong(rtt)
+			p.s.setPing(rtt)
+			if p.relayed && !p.rttReported {
+				p.rttReported = true
+				p.s.println("Ping to " + p.peerName() + " through the relay: " + strconv.Itoa(int(rtt/time.Millisecond)) + "ms, a direct connection is usually faster")
+			}
+		}
+	}
+}
+
+// bridgeLocal sends the discovery packets of the local network received on b
+// to the peer, once connected.
+func (p *proxy) bridgeLocal(b *lanBridge) {
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := b.c.ReadFromUDP(buffer[3:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !isLocal(addr.IP) && !addr.IP.IsPrivate() {
+			continue
+		}
+		if p.peerBridge(addr, b) {
+			// the peer is on this network and emitted it
+			continue
+		}
+		peer, ok := p.connectedPeer()
+		if !ok || b.echo(buffer[3:n+3]) {
+			continue
+		}
+		buffer[0] = typeBroadcast
+		binary.BigEndian.PutUint16(buffer[1:3], uint16(b.dest.Port))
+		p.pushPeer(buffer[:n+3], peer)
+	}
+}
+
+// peerBridge returns whether addr is the bridge b of the peer.
+func (p *proxy) peerBridge(addr *net.UDPAddr, b *lanBridge) bool {
+	for _, v := range p.peerAddrs {
+		if v.IP.Equal(addr.IP) && addr.Port == b.dest.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxy) send(q *packetQueue) {
+	defer lockThread()()
+	for {
+		packet, ok := q.pop()
+		if !ok {
+			return
+		}
+		if d := time.Until(packet.due); d > 0 {
+			time.Sleep(d)
+		}
+		if q == p.localQueue {
+			if c := p.asPeer.conn(); c != nil {
+				c.WriteToUDP(packet.data, packet.addr)
+				continue
+			}
+		}
+		p.c.WriteToUDP(packet.data, packet.addr)
+	}
+}
+
+// checkAuth handles a packet from the peer candidate i before it proved to
+// know the join secret, sending it a challenge unless data answers it.
+func (p *proxy) checkAuth(i int, data []byte) {
+	if auth := p.hostAnswer(data); auth != nil {
+		// the peer checks our password too, even if its own is wrong
+		p.c.WriteToUDP(auth, p.peerAddrs[i])
+		return
+	}
+	if len(data) == 1+sha256.Size && data[0] == typeAuth && p.nonce != nil {
+		if hmac.Equal(data[1:], clientMac(p.secret, p.nonce)) {
+			p.authenticated = true
+			p.s.println("Peer authenticated")
+			p.setPeer(i)
+			return
+		}
+		if !p.authFailed {
+			p.authFailed = true
+			p.s.errorln("Error peer sent a wrong password or token, ignoring it")
+		}
+	}
+	if time.Since(p.challengeTime) < challengeInterval {
+		return
+	}
+	p.challengeTime = time.Now()
+	if p.nonce == nil {
+		p.nonce = make([]byte, nonceSize)
+		rand.Read(p.nonce)
+	}
+	p.c.WriteToUDP(append([]byte{typeChallenge}, p.nonce...), p.peerAddrs[i])
+}
+
+// unreachable reports an ICMP error caused by a packet sent by the proxy,
+// and returns whether the session must end because the peer is gone.
+func (p *proxy) unreachable(u unreachable) bool {
+	p.peerMu.Lock()
+	connected, silence := p.connected, time.Since(p.lastPeer)
+	p.peerMu.Unlock()
+	peer := u.dest != nil && p.candidate(u.dest) >= 0
+	if connected && (peer || u.dest == nil) && silence > peerTimeout {
+		reason := u.reason
+		if u.dest != nil {
+			reason += " from " + u.dest.String()
+		}
+		p.s.errorln("Error " + p.peerName() + " is gone (" + reason + "): it closed proxypunch, or its network changed")
+		return true
+	}
+
+	p.unreachableMu.Lock()
+	defer p.unreachableMu.Unlock()
+	if peer {
+		if !connected && !p.peerRejected {
+			p.peerRejected = true
+			p.s.println("Peer address " + u.dest.String() + " rejected packets (" + u.reason + "), still trying: proxypunch may not be running on the peer yet")
+		}
+		return false
+	}
+	if time.Since(p.unreachableTime) < unreachableInterval {
+		return false
+	}
+	p.unreachableTime = time.Now()
+	if u.dest == nil {
+		if connected {
+			p.s.errorln("Error a packet was rejected (" + u.reason + "): check that the game is running")
+		}
+	} else if localAddr, _ := p.local(); localAddr != nil && u.dest.IP.Equal(localAddr.IP) && u.dest.Port == localAddr.Port {
+		p.s.errorln("Error the game is not reachable on " + u.dest.String() + " (" + u.reason + "): check that it is running, and hosting on this port")
+	}
+	return false
+}
+
+// close closes the proxy socket, which ends the session.
+func (p *proxy) close() {
+	if c, ok := p.c.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// heard records that a packet was accepted from the peer.
+func (p *proxy) heard() {
+	p.peerMu.Lock()
+	p.lastPeer = time.Now()
+	p.peerMu.Unlock()
+}
+
+// bound returns whether addr is one of the addresses the proxy is bound to in
+// strict mode: the peer candidate it reached, and the local game once it is
+// known.
+func (p *proxy) bound(addr *net.UDPAddr) bool {
+	if i := p.candidate(addr); i >= 0 {
+		return i == p.currentIndex()
+	}
+	localAddr, localPort := p.local()
+	if localAddr == nil {
+		return isLocal(addr.IP) && (localPort == 0 || addr.Port == localPort)
+	}
+	return addr.IP.Equal(localAddr.IP) && addr.Port == localAddr.Port
+}
+
+// candidate returns the index of addr in the peer candidates, or -1.
+func (p *proxy) candidate(addr *net.UDPAddr) int {
+	for i, v := range p.peerAddrs {
+		if addr.IP.Equal(v.IP) && addr.Port == v.Port {
+			return i
+		}
+	}
+	return -1
+}
+
+// peer returns the peer address packets are sent to.
+func (p *proxy) peer() *net.UDPAddr {
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	return p.peerAddrs[p.peerIndex]
+}
+
+// connectedPeer returns the peer address packets are sent to, and whether a
+// packet was accepted from the peer yet.
+func (p *proxy) connectedPeer() (*net.UDPAddr, bool) {
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	return p.peerAddrs[p.peerIndex], p.connected
+}
+
+// setPeer switches to the peer candidate i, after receiving a packet from it.
+func (p *proxy) setPeer(i int) {
+	p.peerMu.Lock()
+	p.peerIndex = i
+	p.connected = true
+	p.lastPeer = time.Now()
+	p.peerMu.Unlock()
+	addr := p.peerAddrs[i]
+	if !p.foundPeer {
+		p.foundPeer = true
+		p.s.setConnected()
+		p.s.println("Connected to peer")
+		if p.confirmPeer {
+			go p.confirm()
+		}
+	}
+	switch {
+	case p.relayed:
+		// addr is the relay
+	case addr.IP.To4() == nil:
+		p.s.println("Reached peer on its IPv6 address " + addr.String())
+	case addr.IP.IsLoopback():
+		p.s.println("Reached peer on this computer")
+	case i < len(p.peerAddrs)-1 && addr.IP.Equal(p.peerAddrs[len(p.peerAddrs)-1].IP):
+		p.s.println("Reached peer on its forwarded port " + strconv.Itoa(addr.Port))
+	case i < len(p.peerAddrs)-1:
+		p.s.println("Reached peer on its local network address " + addr.String())
+	}
+	p.setConnectedState()
+}
+
+// local returns the local game address, nil until known, and the port local
+// packets are restricted to, or 0.
+func (p *proxy) local() (*net.UDPAddr, int) {
+	p.localMu.Lock()
+	defer p.localMu.Unlock()
+	return p.localAddr, p.localPort
+}
+
+// setLocal changes the local game address and port restriction.
+func (p *proxy) setLocal(addr *net.UDPAddr, port int) {
+	p.localMu.Lock()
+	p.localAddr = addr
+	p.localPort = port
+	p.localMu.Unlock()
+}
+
+func isLocal(ip net.IP) bool {
+	if localIpv4.Contains(ip) || localIpv6.Contains(ip) {
+		return true
+	}
+	for _, n := range lanNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *unexpectedStats) add(out *session, addr *net.UDPAddr, n int) {
+	s.Lock()
+	defer s.Unlock()
+	if s.sources == nil {
+		s.sources = make(map[string]int)
+	}
+	s.packets++
+	s.bytes += n
+	key := addr.String()
+	if _, ok := s.sources[key]; ok || len(s.sources) < maxUnexpectedSources {
+		s.sources[key]++
+	} else {
+		s.overflow = true
+	}
+	if verbose && s.packets <= maxUnexpectedLogs {
+		out.println("Ignored packet from unexpected source " + key + ". (size:" + strconv.Itoa(n) + ")")
+		if s.packets == maxUnexpectedLogs {
+			out.println("Only counting the next packets from unexpected sources until the summary.")
+		}
+	}
+}
+
+func (s *unexpectedStats) summarize(out *session) {
+	s.Lock()
+	defer s.Unlock()
+	if s.packets == 0 {
+		return
+	}
+	sources := strconv.Itoa(len(s.sources))
+	if s.overflow {
+		sources += " or more"
+	}
+	out.println("Ignored " + strconv.Itoa(s.packets) + " packets (" + strconv.Itoa(s.bytes) + " bytes) from " + sources + " unexpected sources in the last minute.")
+	if verbose {
+		for source, packets := range s.sources {
+			out.println("  " + source + ": " + strconv.Itoa(packets) + " packets")
+		}
+	}
+	s.packets = 0
+	s.bytes = 0
+	s.sources = nil
+	s.overflow = false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// stats are the counters of the relay exposed on the admin endpoint, guarded
+// by the mutex of the relay.
+type stats struct {
+	// pairings counts the clients registering on a registered host, that is
+	// the sessions starting to punch, and relayedSessions the channels
+	// joined by their second endpoint, mostly sessions whose punch failed.
+	pairings        int64
+	relayedSessions int64
+	// dropped counts the dropped messages by reason.
+	dropped map[string]int64
+	// received and sent count the bytes by region, the region published on
+	// the lobby by the host of the IP, if any.
+	received map[string]int64
+	sent     map[string]int64
+	regions  map[[4]byte]string
+}
+
+func newStats() *stats {
+	return &stats{
+		dropped:  make(map[string]int64),
+		received: make(map[string]int64),
+		sent:     make(map[string]int64),
+		regions:  make(map[[4]byte]string),
+	}
+}
+
+// region returns the region of ip for the traffic counters.
+func (st *stats) region(ip net.IP) string {
+	var key [4]byte
+	copy(key[:], ip.To4())
+	if region, ok := st.regions[key]; ok && region != "" {
+		return region
+	}
+	return "unknown"
+}
+
+// serveAdmin serves the admin endpoint on addr:
+//   - /metrics: the metrics of the relay in the Prometheus text format
+//   - /registrations: the current registrations as JSON
+//
+// It exposes the addresses of the peers, keep it private.
+func (r *relay) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", r.serveMetrics)
+	mux.HandleFunc("/registrations", r.serveRegistrations)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, "Error serving the admin endpoint: "+err.Error())
+	}
+}
+
+func (r *relay) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP proxypunch_relay_%s %s\n# TYPE proxypunch_relay_%s %s\n", name, help, name, kind)
+	}
+	labeled := func(name string, label string, values map[string]int64) {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "proxypunch_relay_%s{%s=%s} %d\n", name, label, strconv.Quote(k), values[k])
+		}
+	}
+
+	metric("registrations", "gauge", "Registered peers waiting to be paired or keeping their registration.")
+	fmt.Fprintf(w, "proxypunch_relay_registrations{role=\"host\"} %d\n", len(r.servers))
+	fmt.Fprintf(w, "proxypunch_relay_registrations{role=\"client\"} %d\n", len(r.clients))
+	metric("lobby_sessions", "gauge", "Sessions published on the lobby.")
+	fmt.Fprintf(w, "proxypunch_relay_lobby_sessions %d\n", len(r.sessions))
+	metric("names", "gauge", "Registered names.")
+	fmt.Fprintf(w, "proxypunch_relay_names %d\n", len(r.registered.entries))
+	metric("codes", "gauge", "Allocated connect codes.")
+	fmt.Fprintf(w, "proxypunch_relay_codes %d\n", len(r.codes.byHost))
+	metric("rooms", "gauge", "Hosted rooms.")
+	fmt.Fprintf(w, "proxypunch_relay_rooms %d\n", len(r.rooms))
+	metric("federated_hosts", "gauge", "Hosts registered on the peer relays of the federation.")
+	fmt.Fprintf(w, "proxypunch_relay_federated_hosts %d\n", len(r.federation.hosts))
+	metric("sealed_peers", "gauge", "Peers sealing their messages to the relay.")
+	fmt.Fprintf(w, "proxypunch_relay_sealed_peers %d\n", len(r.seals.peers))
+	metric("channels", "gauge", "Relayed channels.")
+	fmt.Fprintf(w, "proxypunch_relay_channels %d\n", len(r.relayed))
+	metric("streams", "gauge", "Peers connected over TLS.")
+	fmt.Fprintf(w, "proxypunch_relay_streams %d\n", len(r.streams))
+	metric("pairings_total", "counter", "Clients paired with their host, that is sessions starting to punch.")
+	fmt.Fprintf(w, "proxypunch_relay_pairings_total %d\n", r.stats.pairings)
+	metric("relayed_sessions_total", "counter", "Sessions relayed by the relay, mostly because punching failed.")
+	fmt.Fprintf(w, "proxypunch_relay_relayed_sessions_total %d\n", r.stats.relayedSessions)
+	metric("dropped_total", "counter", "Dropped messages by reason.")
+	labeled("dropped_total", "reason", r.stats.dropped)
+	metric("received_bytes_total", "counter", "Bytes received by region published on the lobby by the host of the IP.")
+	labeled("received_bytes_total", "region", r.stats.received)
+	metric("sent_bytes_total", "counter", "Bytes sent by region published on the lobby by the host of the IP.")
+	labeled("sent_bytes_total", "region", r.stats.sent)
+}
+
+// registration is a registration listed on /registrations.
+type registration struct {
+	Role    string `json:"role"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	NatPort int    `json:"nat_port"`
+	Age     int    `json:"age_seconds"`
+	// Format is the format a host registered with, Host the public IP of
+	// the host a client registered for.
+	Format string `json:"format,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+func (r *relay) serveRegistrations(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	now := time.Now()
+	registrations := make([]registration, 0, len(r.servers)+len(r.clients))
+	for k, v := range r.servers {
+		format := "plain"
+		if v.ipv6 {
+			format = "ipv6"
+		} else if v.extended {
+			format = "extended"
+		}
+		registrations = append(registrations, registration{
+			Role:    "host",
+			IP:      net.IP(k.ip[:]).String(),
+			Port:    k.port,
+			NatPort: v.natPort,
+			Age:     int(now.Sub(v.time) / time.Second),
+			Format:  format,
+		})
+	}
+	for k, v := range r.clients {
+		registrations = append(registrations, registration{
+			Role:    "client",
+			IP:      net.IP(v.localIp[:]).String(),
+			Port:    k.port,
+			NatPort: v.natPort,
+			Age:     int(now.Sub(v.time) / time.Second),
+			Host:    net.IP(k.ip[:]).String(),
+		})
+	}
+	r.mu.Unlock()
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].Age < registrations[j].Age
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(registrations)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// authMagic prefixes the authentication messages, with which peers of a
+// relay restricted to a community prove they know one of its tokens,
+// followed by an operation byte:
+//   - authRequest: unix time (8 bytes), then the first 16 bytes of the
+//     HMAC-SHA256 of "proxypunch relay", a zero byte and the time, keyed
+//     with the token
+//   - authReply: status, padded to 8 bytes
+//
+// A restricted relay then handles the other messages from the IP of the peer
+// until flushInterval after its last authentication, and drops the messages
+// of other IPs, except the echo, version and authentication messages.
+// Tokens are never sent in clear, and a request can only be replayed for
+// authValidity.
+const authMagic = "PPA1"
+
+const (
+	authRequest = 0x01
+	authReply   = 0x02
+)
+
+// Status of authentication messages.
+const (
+	authOk     = 0x00
+	authDenied = 0x01
+)
+
+// authValidity is the maximum difference between the time of a request and
+// the time of the relay.
+const authValidity = 1 * time.Minute
+
+// maxAuthenticated bounds the count of authenticated IPs.
+const maxAuthenticated = 100000
+
+// auth holds the tokens of a restricted relay, and the IPs authenticated
+// with them by time of authentication.
+type auth struct {
+	tokens []string
+	ips    map[[4]byte]time.Time
+}
+
+// loadTokens loads the tokens of file, one per line; the relay is not
+// restricted without file.
+func loadTokens(file string) (*auth, error) {
+	a := &auth{
+		ips: make(map[[4]byte]time.Time),
+	}
+	if file == "" {
+		return a, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			a.tokens = append(a.tokens, token)
+		}
+	}
+	return a, scanner.Err()
+}
+
+// restricted returns whether peers must authenticate.
+func (a *auth) restricted() bool {
+	return len(a.tokens) > 0
+}
+
+// allowed returns whether the messages of senderIp are handled.
+func (a *auth) allowed(senderIp [4]byte) bool {
+	if !a.restricted() {
+		return true
+	}
+	_, ok := a.ips[senderIp]
+	return ok
+}
+
+// handle handles an authentication message, excluding the magic.
+func (a *auth) handle(c packetWriter, addr *net.UDPAddr, senderIp [4]byte, data []byte) {
+	if len(data) != 1+8+16 || data[0] != authRequest {
+		return
+	}
+	status := byte(authDenied)
+	if a.verify(data[1:9], data[9:]) && (len(a.ips) < maxAuthenticated || a.allowed(senderIp)) {
+		status = authOk
+		a.ips[senderIp] = time.Now()
+	}
+	c.WriteToUDP(append([]byte(authMagic), authReply, status, 0, 0), addr)
+}
+
+// verify returns whether mac is the proof of one of the tokens for stamp.
+func (a *auth) verify(stamp []byte, mac []byte) bool {
+	t := time.Unix(int64(binary.BigEndian.Uint64(stamp)), 0)
+	if d := time.Since(t); d > authValidity || d < -authValidity {
+		return false
+	}
+	for _, token := range a.tokens {
+		m := hmac.New(sha256.New, []byte(token))
+		m.Write([]byte("proxypunch relay\x00"))
+		m.Write(stamp)
+		if hmac.Equal(m.Sum(nil)[:16], mac) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *auth) flush(now time.Time) {
+	for ip, t := range a.ips {
+		if now.Sub(t) > flushInterval {
+			delete(a.ips, ip)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// codeMagic prefixes the connect code messages, followed by an operation
+// byte:
+//   - codeRequest: port, flags, padded to codeRequestSize
+//   - codeAllocated: code
+//   - codeLookup: code, padded to codeRequestSize
+//   - codeFound: status, IP, port, flags
+//
+// Codes are prefixed with their length on one byte. A code such as
+// BLUE-FOX-41 points to the public IP and port of the host requesting it,
+// until flushInterval after its last request; a host requesting again keeps
+// its code. The flags are passed from the host to the peers looking its code
+// up, see codePassword. Requests are padded so that the relay does not amplify spoofed
+// requests.
+const codeMagic = "PPK1"
+
+const (
+	codeRequest   = 0x01
+	codeAllocated = 0x02
+	codeLookup    = 0x03
+	codeFound     = 0x04
+)
+
+// Status of code messages.
+const (
+	codeOk       = 0x00
+	codeNotFound = 0x01
+)
+
+// codePassword is the flag of hosts requiring a password, which peers
+// present in the challenge of the host before reaching its game.
+const codePassword = 0x01
+
+// codeRequestSize is the size of the requests, excluding the magic.
+const codeRequestSize = 32
+
+// maxCodes bounds the count of allocated codes, well below the count of
+// possible codes so that allocation finds a free one quickly.
+const maxCodes = 50000
+
+var codeAdjectives = []string{
+	"amber", "black", "blue", "bold", "brave", "bright", "calm", "cold",
+	"cool", "dark", "deep", "fast", "gold", "gray", "green", "happy",
+	"iron", "jade", "keen", "kind", "lucky", "mint", "pink", "proud",
+	"quick", "red", "royal", "silver", "swift", "tall", "warm", "wild",
+}
+
+var codeNouns = []string{
+	"ant", "bat", "bear", "bee", "bird", "boar", "bull", "cat",
+	"cod", "crab", "crow", "deer", "dog", "dove", "duck", "eel",
+	"elk", "emu", "fish", "fox", "frog", "goat", "hare", "hawk",
+	"ibis", "jay", "kiwi", "koi", "lamb", "lion", "lynx", "mole",
+	"moth", "mouse", "mule", "newt", "owl", "ox", "panda", "pig",
+	"puma", "ram", "rat", "raven", "seal", "shark", "sheep", "slug",
+	"snail", "snake", "swan", "tiger", "toad", "trout", "tuna", "viper",
+	"wasp", "whale", "wolf", "worm", "wren", "yak", "zebra", "gecko",
+}
+
+type codeValue struct {
+	code  string
+	flags byte
+	time  time.Time
+}
+
+// codes holds the allocated codes, by host and by code.
+type codes struct {
+	byHost map[key]codeValue
+	byCode map[string]key
+}
+
+func newCodes() *codes {
+	return &codes{
+		byHost: make(map[key]codeValue),
+		byCode: make(map[string]key),
+	}
+}
+
+// handle handles a code message, excluding the magic.
+func (cs *codes) handle(c packetWriter, addr *net.UDPAddr, senderIp [4]byte, data []byte) {
+	if len(data) != 1+codeRequestSize {
+		return
+	}
+	switch data[0] {
+	case codeRequest:
+		k := key{
+			ip:   senderIp,
+			port: int(binary.BigEndian.Uint16(data[1:3])),
+		}
+		code := cs.allocate(k, data[3])
+		if code == "" {
+			return
+		}
+		c.WriteToUDP(append(append([]byte(codeMagic), codeAllocated, byte(len(code))), code...), addr)
+	case codeLookup:
+		n := int(data[1])
+		if n > codeRequestSize-1 {
+			return
+		}
+		reply := append([]byte(codeMagic), codeFound, codeNotFound)
+		reply = append(reply, make([]byte, 7)...)
+		if k, ok := cs.byCode[strings.ToUpper(string(data[2:2+n]))]; ok {
+			reply[len(codeMagic)+1] = codeOk
+			copy(reply[len(codeMagic)+2:], k.ip[:])
+			binary.BigEndian.PutUint16(reply[len(codeMagic)+6:], uint16(k.port))
+			reply[len(codeMagic)+8] = cs.byHost[k].flags
+		}
+		c.WriteToUDP(reply, addr)
+	}
+}
+
+// allocate returns the code of the host k requesting it with flags,
+// allocating one if needed, or an empty string if none is left.
+func (cs *codes) allocate(k key, flags byte) string {
+	now := time.Now()
+	if v, ok := cs.byHost[k]; ok {
+		v.flags = flags
+		v.time = now
+		cs.byHost[k] = v
+		return v.code
+	}
+	if len(cs.byHost) >= maxCodes {
+		return ""
+	}
+	for try := 0; try < 16; try++ {
+		code := strings.ToUpper(randomWord(codeAdjectives) + "-" + randomWord(codeNouns) + "-" + strconv.Itoa(10+randomInt(90)))
+		if _, ok := cs.byCode[code]; ok {
+			continue
+		}
+		cs.byHost[k] = codeValue{
+			code:  code,
+			flags: flags,
+			time:  now,
+		}
+		cs.byCode[code] = k
+		return code
+	}
+	return ""
+}
+
+func randomWord(words []string) string {
+	return words[randomInt(len(words))]
+}
+
+func randomInt(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0
+	}
+	return int(v.Int64())
+}
+
+func (cs *codes) flush(now time.Time) {
+	for k, v := range cs.byHost {
+		if now.Sub(v.time) > flushInterval {
+			delete(cs.byHost, k)
+			delete(cs.byCode, v.code)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// federationMagic prefixes the messages exchanged between federated relays,
+// which share their host registrations so that a client can find a host
+// registered on another relay of the federation, followed by an operation
+// byte and unix time (8 bytes):
+//   - federationHosts: entries of the hosts registered on the relay: IP,
+//     port, NAT port, format, local network address, IPv6 address
+//   - federationClient: IP and port of the host, then the client: IP, NAT
+//     port, local network address, IPv6 address
+//
+// Each message ends with the first 16 bytes of its HMAC-SHA256 keyed with
+// the federation secret, and is only accepted from the address of a peer
+// relay within authValidity of its time. A relay sends its hosts to its
+// peers every federationInterval, and remembers the hosts of its peers until
+// flushInterval after they sent them. A client registering for a host of a
+// peer is answered the host right away, and the relay forwards the
+// registration to the peer, which tells the host about the client as if the
+// client registered on it. Hosts are only shared with direct peers, so every
+// relay of a federation must peer with all the others.
+const federationMagic = "PPG1"
+
+const (
+	federationHosts  = 0x01
+	federationClient = 0x02
+)
+
+// Formats of the registration of a host.
+const (
+	federationExtended = 0x01
+	federationIpv6     = 0x02
+)
+
+// federationInterval is the interval at which relays send their hosts to
+// their peers.
+const federationInterval = 5 * time.Second
+
+// federationMacSize is the size of the truncated HMAC of the messages.
+const federationMacSize = 16
+
+// federationHostSize is the size of a host entry.
+const federationHostSize = 4 + 2 + 2 + 1 + 6 + 18
+
+// federationPageSize bounds the size of federationHosts messages.
+const federationPageSize = 1200
+
+// maxFederatedHosts bounds the count of hosts learned from peers.
+const maxFederatedHosts = 100000
+
+// federatedHost is a host registered on a peer relay.
+type federatedHost struct {
+	server serverValue
+	// relay is the peer relay the host is registered on.
+	relay *net.UDPAddr
+}
+
+// federation holds the peer relays and the hosts registered on them.
+type federation struct {
+	secret []byte
+	peers  []*net.UDPAddr
+	hosts  map[key]federatedHost
+}
+
+// newFederation resolves the peer relays of peers, separated by commas;
+// there is no federation without peers.
+func newFederation(peers string, secret string) (*federation, error) {
+	addrs, err := resolveRelays(peers)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) > 0 && secret == "" {
+		return nil, errors.New("-peers requires -federation-secret, shared by the relays of the federation")
+	}
+	return &federation{
+		secret: []byte(secret),
+		peers:  addrs,
+		hosts:  make(map[key]federatedHost),
+	}, nil
+}
+
+// resolveRelays resolves the relays of relays, separated by commas, on the
+// default port unless they have one.
+func resolveRelays(relays string) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, relay := range strings.Split(relays, ",") {
+		relay = strings.TrimSpace(relay)
+		if relay == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(relay); err != nil {
+			relay = net.JoinHostPort(relay, strconv.Itoa(defaultPort))
+		}
+		addr, err := net.ResolveUDPAddr("udp4", relay)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// peer returns the peer relay at addr, or nil.
+func (f *federation) peer(addr *net.UDPAddr) *net.UDPAddr {
+	return findRelay(f.peers, addr)
+}
+
+// findRelay returns the relay of relays at addr, or nil.
+func findRelay(relays []*net.UDPAddr, addr *net.UDPAddr) *net.UDPAddr {
+	for _, r := range relays {
+		if r.Port == addr.Port && r.IP.Equal(addr.IP) {
+			return r
+		}
+	}
+	return nil
+}
+
+// seal returns the message of op with body, timed and authenticated.
+func (f *federation) seal(op byte, body []byte) []byte {
+	b := append([]byte(federationMagic), op)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().Unix()))
+	b = append(b, body...)
+	return append(b, f.mac(b)...)
+}
+
+func (f *federation) mac(b []byte) []byte {
+	m := hmac.New(sha256.New, f.secret)
+	m.Write(b)
+	return m.Sum(nil)[:federationMacSize]
+}
+
+// handle handles a message from addr if it is a federation message, and
+// returns whether it was one; federation messages are not rate limited.
+func (f *federation) handle(r *relay, addr *net.UDPAddr, data []byte) bool {
+	if len(data) < len(federationMagic) || string(data[:len(federationMagic)]) != federationMagic {
+		return false
+	}
+	peer := f.peer(addr)
+	if peer == nil || len(data) < len(federationMagic)+1+8+federationMacSize {
+		return true
+	}
+	signed, mac := data[:len(data)-federationMacSize], data[len(data)-federationMacSize:]
+	if !hmac.Equal(mac, f.mac(signed)) {
+		r.stats.dropped["federation"]++
+		return true
+	}
+	now := time.Now()
+	t := time.Unix(int64(binary.BigEndian.Uint64(signed[len(federationMagic)+1:])), 0)
+	if now.Sub(t) > authValidity || t.Sub(now) > authValidity {
+		r.stats.dropped["federation"]++
+		return true
+	}
+	body := signed[len(federationMagic)+1+8:]
+	switch signed[len(federationMagic)] {
+	case federationHosts:
+		for ; len(body) >= federationHostSize; body = body[federationHostSize:] {
+			var k key
+			copy(k.ip[:], body[:4])
+			k.port = int(binary.BigEndian.Uint16(body[4:6]))
+			if _, ok := f.hosts[k]; !ok && len(f.hosts) >= maxFederatedHosts {
+				break
+			}
+			server := serverValue{
+				natPort:  int(binary.BigEndian.Uint16(body[6:8])),
+				time:     now,
+				extended: body[8]&federationExtended != 0,
+				ipv6:     body[8]&federationIpv6 != 0,
+			}
+			copy(server.private[:], body[9:15])
+			copy(server.v6[:], body[15:33])
+			f.hosts[k] = federatedHost{
+				server: server,
+				relay:  peer,
+			}
+		}
+	case federationClient:
+		if len(body) != 6+4+2+6+18 {
+			return true
+		}
+		var k key
+		copy(k.ip[:], body[:4])
+		k.port = int(binary.BigEndian.Uint16(body[4:6]))
+		client := clientValue{
+			natPort: int(binary.BigEndian.Uint16(body[10:12])),
+			time:    now,
+		}
+		copy(client.localIp[:], body[6:10])
+		copy(client.private[:], body[12:18])
+		copy(client.v6[:], body[18:36])
+		r.registerClient(k, client, false)
+	}
+	return true
+}
+
+// host returns the host k registered on a peer relay, and that relay.
+func (f *federation) host(k key) (serverValue, *net.UDPAddr, bool) {
+	h, ok := f.hosts[k]
+	if !ok || time.Since(h.server.time) > flushInterval {
+		return serverValue{}, nil, false
+	}
+	return h.server, h.relay, true
+}
+
+// forwardClient forwards the registration of client for the host k to the
+// peer relay the host is registered on.
+func (f *federation) forwardClient(r *relay, peer *net.UDPAddr, k key, client clientValue) {
+	body := append([]byte(nil), k.ip[:]...)
+	body = append(body, byte(k.port>>8), byte(k.port))
+	body = append(body, client.localIp[:]...)
+	body = append(body, byte(client.natPort>>8), byte(client.natPort))
+	body = append(body, client.private[:]...)
+	body = append(body, client.v6[:]...)
+	r.c.WriteToUDP(f.seal(federationClient, body), peer)
+}
+
+// share sends the hosts registered on the relay to the peer relays; r.mu
+// must be held.
+func (f *federation) share(r *relay) {
+	var pages [][]byte
+	var page []byte
+	now := time.Now()
+	for k, v := range r.servers {
+		if now.Sub(v.time) > flushInterval {
+			continue
+		}
+		if len(page)+federationHostSize > federationPageSize {
+			pages = append(pages, page)
+			page = nil
+		}
+		var format byte
+		if v.extended {
+			format |= federationExtended
+		}
+		if v.ipv6 {
+			format |= federationIpv6
+		}
+		page = append(page, k.ip[:]...)
+		page = append(page, byte(k.port>>8), byte(k.port), byte(v.natPort>>8), byte(v.natPort), format)
+		page = append(page, v.private[:]...)
+		page = append(page, v.v6[:]...)
+	}
+	if len(page) > 0 {
+		pages = append(pages, page)
+	}
+	for _, page := range pages {
+		b := f.seal(federationHosts, page)
+		for _, peer := range f.peers {
+			r.c.WriteToUDP(b, peer)
+		}
+	}
+}
+
+func (f *federation) flush(now time.Time) {
+	for k, h := range f.hosts {
+		if now.Sub(h.server.time) > flushInterval {
+			delete(f.hosts, k)
+		}
+	}
+}
+
+// runFederation sends the hosts of the relay to its peers every
+// federationInterval.
+func (r *relay) runFederation() {
+	for range time.Tick(federationInterval) {
+		r.mu.Lock()
+		r.federation.share(r)
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// forwardMagic prefixes the forwarded messages: channel ID, then payload.
+// The payload is forwarded to the other endpoint of the channel, that is the
+// other address sending messages with the same channel ID, so that peers of
+// a relayed session never learn each other's address.
+const forwardMagic = "PPF1"
+
+// chainMagic prefixes the chained messages: channel ID, address of the next
+// relay, then payload. The payload is forwarded on the channel of the next
+// relay, so that each relay only learns the address of one of the peers.
+const chainMagic = "PPC1"
+
+// maxChannels bounds the count of relayed channels.
+const maxChannels = 10000
+
+type endpoint struct {
+	addr *net.UDPAddr
+	time time.Time
+}
+
+// channel holds the two endpoints of a relayed channel.
+type channel [2]endpoint
+
+// channels holds the relayed channels, by channel ID.
+type channels map[[8]byte]*channel
+
+// handle handles a forwarded or chained message, excluding the magic; next
+// is the next relay of chained messages, nil otherwise. It returns whether
+// the message joined the second endpoint of the channel, that is whether a
+// session starts being relayed.
+func (chs channels) handle(c packetWriter, addr *net.UDPAddr, next *net.UDPAddr, data []byte) bool {
+	var id [8]byte
+	copy(id[:], data[:8])
+	payload := data[8:]
+
+	now := time.Now()
+	ch, ok := chs[id]
+	if !ok {
+		if len(chs) >= maxChannels {
+			return false
+		}
+		ch = &channel{}
+		chs[id] = ch
+	}
+	i, joined := ch.join(addr, now)
+	if i < 0 {
+		return false
+	}
+	other := &ch[1-i]
+	if next != nil {
+		// the other endpoint of a chained channel is always the next relay
+		other.addr = next
+		other.time = now
+	}
+	if other.addr == nil {
+		return false
+	}
+	if len(payload) > 0 {
+		c.WriteToUDP(append(append([]byte(forwardMagic), id[:]...), payload...), other.addr)
+	}
+	// empty messages only keep the endpoint registered
+	return joined
+}
+
+// join returns the index of the endpoint of addr, taking the place of a free
+// or expired endpoint if needed, or -1 if the channel is full, and whether
+// addr joined the channel.
+func (ch *channel) join(addr *net.UDPAddr, now time.Time) (int, bool) {
+	for i := range ch {
+		if e := &ch[i]; e.addr != nil && e.addr.IP.Equal(addr.IP) && e.addr.Port == addr.Port {
+			e.time = now
+			return i, false
+		}
+	}
+	for i := range ch {
+		if e := &ch[i]; e.addr == nil || now.Sub(e.time) > flushInterval {
+			*e = endpoint{
+				addr: addr,
+				time: now,
+			}
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+func (chs channels) flush(now time.Time) {
+	for id, ch := range chs {
+		if now.Sub(ch[0].time) > flushInterval && now.Sub(ch[1].time) > flushInterval {
+			delete(chs, id)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+// Peers with an IPv6 candidate also send their magic6 registrations to the
+// IPv6 address of the relay, when it listens on IPv6 (capDualStack). These
+// are not answered: the relay remembers the address it received each of them
+// from, and uses it as the IPv6 address of the peer in the identical
+// registration received over IPv4, rather than the address the peer saw
+// locally, which firewalls and NAT66 may map to another port. The peer is
+// then paired by its IPv4 registration as usual, with both addresses.
+
+// maxObserved bounds the count of IPv6 registrations remembered.
+const maxObserved = 100000
+
+// observation is the address an IPv6 registration was received from.
+type observation struct {
+	v6   [18]byte
+	time time.Time
+}
+
+// observations are the IPv6 registrations, by message.
+type observations map[string]observation
+
+func (o observations) flush(now time.Time) {
+	for k, v := range o {
+		if now.Sub(v.time) > flushInterval {
+			delete(o, k)
+		}
+	}
+}
+
+// serveIpv6 handles the messages received on the IPv6 socket of the relay.
+func (r *relay) serveIpv6() {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := r.c6.ReadFromUDP(buffer)
+		if err != nil {
+			// err is thrown if the buffer is too small
+			continue
+		}
+		r.mu.Lock()
+		r.handleIpv6(buffer[:n], addr)
+		r.mu.Unlock()
+	}
+}
+
+// handleIpv6 handles a message received over IPv6; only magic6
+// registrations are accepted.
+func (r *relay) handleIpv6(data []byte, addr *net.UDPAddr) {
+	if addr.Port == 0 || addr.IP.To4() != nil || addr.IP.IsUnspecified() || addr.IP.IsMulticast() {
+		r.stats.dropped["source"]++
+		return
+	}
+	if !r.limits.receive(quotaKey(addr.IP), len(data), false, time.Now()) {
+		r.stats.dropped["rate"]++
+		return
+	}
+	r.stats.received[r.stats.region(addr.IP)] += int64(len(data))
+	if len(data) != len(magic6)+26 && len(data) != len(magic6)+30 || string(data[:len(magic6)]) != magic6 {
+		return
+	}
+	if _, ok := r.observed[string(data)]; !ok && len(r.observed) >= maxObserved {
+		return
+	}
+	var v6 [18]byte
+	copy(v6[:16], addr.IP.To16())
+	v6[16], v6[17] = byte(addr.Port>>8), byte(addr.Port)
+	r.observed[string(data)] = observation{
+		v6:   v6,
+		time: time.Now(),
+	}
+}
+
+// observedIpv6 returns the address the IPv6 registration identical to the
+// magic6 registration msg was received from, if any.
+func (r *relay) observedIpv6(msg []byte) ([18]byte, bool) {
+	o, ok := r.observed[string(msg)]
+	if !ok || time.Since(o.time) > flushInterval {
+		return [18]byte{}, false
+	}
+	return o.v6, true
+}
+
+// quotaKey returns the key of the rate limit of ip: its IPv4 address, or for
+// IPv6, a hash of its /64 network in the reserved 240.0.0.0/4 range, so that
+// a host cannot escape the limit by changing its IPv6 interface identifier.
+func quotaKey(ip net.IP) [4]byte {
+	var key [4]byte
+	if v4 := ip.To4(); v4 != nil {
+		copy(key[:], v4)
+		return key
+	}
+	h := fnv.New32a()
+	h.Write(ip.To16()[:8])
+	sum := h.Sum32()
+	key[0] = 0xf0 | byte(sum>>24)&0x0f
+	key[1], key[2], key[3] = byte(sum>>16), byte(sum>>8), byte(sum)
+	return key
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"time"
+)
+
+// lobbyMagic prefixes the lobby messages, followed by an operation byte:
+//   - lobbyPublish: port, relay RTT in milliseconds, flags, token tag,
+//     channel ID if private, game, nickname, region, notes
+//   - lobbyList: page, token tag, version, padded to lobbyPageSize so that
+//     the relay does not amplify spoofed requests
+//   - lobbyEntries: page, page count, then entries: IP, port, relay RTT,
+//     flags, channel ID if private, game, nickname, region, notes
+//
+// Entries published with a token tag are only listed to requests with the
+// same tag. Private entries hide the IP of the host, and are only listed to
+// requests of version 1 or later, which join them through their channel.
+// Strings are prefixed with their length on one byte.
+const lobbyMagic = "PPL1"
+
+const (
+	lobbyPublish = 0x01
+	lobbyList    = 0x02
+	lobbyEntries = 0x03
+)
+
+// lobbyPrivate is the flag of private entries.
+const lobbyPrivate = 0x04
+
+// lobbyPageSize is the size of the list requests, and the maximum size of
+// the pages sent back.
+const lobbyPageSize = 1200
+
+// maxLobbyEntries bounds the count of published sessions.
+const maxLobbyEntries = 1000
+
+type lobbyValue struct {
+	// info is the encoded RTT, flags, channel ID and strings of the entry.
+	info    []byte
+	private bool
+	tag     [8]byte
+	time    time.Time
+}
+
+// lobby holds the sessions published by servers, keyed like servers; hosts
+// can only publish sessions on their own IP.
+type lobby map[key]lobbyValue
+
+func (l lobby) handle(c packetWriter, addr *net.UDPAddr, senderIp [4]byte, data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	switch data[0] {
+	case lobbyPublish:
+		data = data[1:]
+		if len(data) < 13 {
+			return
+		}
+		private := data[4]&lobbyPrivate != 0
+		fields := data[13:]
+		if private {
+			if len(fields) < 8 {
+				return
+			}
+			fields = fields[8:]
+		}
+		if !validFields(fields) {
+			return
+		}
+		key := key{
+			ip:   senderIp,
+			port: int(binary.BigEndian.Uint16(data[:2])),
+		}
+		if _, ok := l[key]; !ok && len(l) >= maxLobbyEntries {
+			return
+		}
+		value := lobbyValue{
+			info:    append(append([]byte(nil), data[2:5]...), data[13:]...),
+			private: private,
+			time:    time.Now(),
+		}
+		copy(value.tag[:], data[5:13])
+		l[key] = value
+	case lobbyList:
+		if len(data)+len(lobbyMagic) < lobbyPageSize {
+			return
+		}
+		var tag [8]byte
+		copy(tag[:], data[2:10])
+		pages := l.pages(tag, data[10] >= 1)
+		page := int(data[1])
+		if page >= len(pages) {
+			return
+		}
+		c.WriteToUDP(pages[page], addr)
+	}
+}
+
+// pages returns the encoded pages of the lobby entries listed to requests
+// with tag, including private entries if private.
+func (l lobby) pages(tag [8]byte, private bool) [][]byte {
+	keys := make([]key, 0, len(l))
+	for k, v := range l {
+		if (v.tag == tag || v.tag == [8]byte{}) && (private || !v.private) {
+			keys = append(keys, k)
+		}
+	}
+	// stable pages across requests
+	sort.Slice(keys, func(i, j int) bool {
+		if c := bytes.Compare(keys[i].ip[:], keys[j].ip[:]); c != 0 {
+			return c < 0
+		}
+		return keys[i].port < keys[j].port
+	})
+
+	header := len(lobbyMagic) + 3
+	var pages [][]byte
+	page := make([]byte, header)
+	for _, k := range keys {
+		entry := make([]byte, 6)
+		if !l[k].private {
+			copy(entry, k.ip[:])
+		}
+		binary.BigEndian.PutUint16(entry[4:6], uint16(k.port))
+		entry = append(entry, l[k].info...)
+		if len(page)+len(entry) > lobbyPageSize {
+			pages = append(pages, page)
+			page = make([]byte, header)
+		}
+		page = append(page, entry...)
+	}
+	pages = append(pages, page)
+	if len(pages) > 255 {
+		pages = pages[:255]
+	}
+	for i, page := range pages {
+		copy(page, lobbyMagic)
+		page[len(lobbyMagic)] = lobbyEntries
+		page[len(lobbyMagic)+1] = byte(i)
+		page[len(lobbyMagic)+2] = byte(len(pages))
+	}
+	return pages
+}
+
+func (l lobby) flush(now time.Time) {
+	for k, v := range l {
+		if now.Sub(v.time) > flushInterval {
+			delete(l, k)
+		}
+	}
+}
+
+// region returns the region the host of the entry published.
+func (v lobbyValue) region() string {
+	fields := v.info[3:]
+	if v.private {
+		fields = fields[8:]
+	}
+	for i := 0; i < 2; i++ {
+		fields = fields[1+int(fields[0]):]
+	}
+	return string(fields[1 : 1+int(fields[0])])
+}
+
+// validFields returns whether b is exactly four length-prefixed strings.
+func validFields(b []byte) bool {
+	for i := 0; i < 4; i++ {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return false
+		}
+		b = b[1+int(b[0]):]
+	}
+	return len(b) == 0
+}
@@ -1,11 +1,46 @@
+// Command proxypunch-relay is the relay proxypunch peers register on to learn
+// the public address of each other, run it to host your own relay.
+//
+// All messages are UDP datagrams on the relay port, integers are big endian,
+// and addresses are 4 bytes of IPv4 then 2 bytes of port. A host registers
+// with its game port every few seconds, a client with the game port and the
+// public IPv4 of the host; the relay pairs them by that IP and port:
+//   - host registration: port, then with magic, the local network address of
+//     the host, then with magic6, its IPv6 address (16 bytes of IPv6 and 2
+//     bytes of port)
+//   - client registration: port, IP of the host, then the same optional
+//     fields as the host
+//
+// A host is answered its public address (with magic or magic6, or its IP
+// alone without magic) until a client registers, then the client: port, IP
+// of the client, then its optional fields, in the format the host registered
+// with. A client is answered the host once it registered: port of the host,
+// then its optional fields, in the format the client registered with.
+// Registrations expire after flushInterval.
+//
+// Single byte messages are echoed back, to measure the round trip to the
+// relay. TCP connections on the relay port are answered with their public
+// address, see serveTcp. Hosts can get a short connect code pointing to their
+// address, see codeMagic, or a room of their choosing, see roomMagic. Relays
+// can share their hosts with other relays, see federationMagic. Peers can seal
+// their messages, see sealMagic. Peers with IPv6 also send their
+// registrations to the relay over IPv6, see serveIpv6. Relays restricted to a
+// community only handle the messages of peers authenticated with one of its
+// tokens, see authMagic. Peers whose network blocks UDP to the relay port can
+// send the same messages over TLS, see serveTls. The version messages, lobby,
+// names and relayed channels are described with their magic.
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
@@ -15,6 +50,17 @@ const defaultPort = 14761
 
 const flushInterval = 15 * time.Second
 
+// magic prefixes the extended messages, which carry the local network
+// address (4 bytes of IPv4 and 2 bytes of port) of the peers so that peers
+// on the same network can connect locally. Peers are answered in the format
+// they registered with.
+const magic = "PPX1"
+
+// magic6 prefixes the extended messages that also carry the IPv6 address (16
+// bytes of IPv6 and 2 bytes of port) of the peers after their local network
+// address, so that peers with IPv6 connectivity can also connect over IPv6.
+const magic6 = "PPX2"
+
 type key struct {
 	ip   [4]byte
 	port int
@@ -23,12 +69,68 @@ type key struct {
 type clientValue struct {
 	localIp [4]byte
 	natPort int
+	private [6]byte
+	v6      [18]byte
 	time    time.Time
 }
 
 type serverValue struct {
 	natPort int
+	private [6]byte
+	v6      [18]byte
 	time    time.Time
+	// extended and ipv6 are the format the server registered with.
+	extended bool
+	ipv6     bool
+}
+
+// pairing returns the message telling server about the client val, in the
+// format the server registered with.
+func pairing(val clientValue, server serverValue) []byte {
+	payload := append([]byte{byte(val.natPort >> 8), byte(val.natPort)}, val.localIp[:]...)
+	if server.ipv6 {
+		payload = append(append([]byte(magic6), payload...), val.private[:]...)
+		return append(payload, val.v6[:]...)
+	}
+	if server.extended {
+		payload = append(append([]byte(magic), payload...), val.private[:]...)
+	}
+	return payload
+}
+
+// packetWriter sends messages to peers.
+type packetWriter interface {
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+}
+
+// relay holds the state of the relay, shared by the UDP socket and the TLS
+// streams; mu guards all of it.
+type relay struct {
+	mu sync.Mutex
+	c  *net.UDPConn
+	// c6 is the IPv6 socket of the relay, nil if IPv6 is unavailable.
+	c6       *net.UDPConn
+	observed observations
+	chain    bool
+	// chainRelays are the relays chained sessions can be forwarded to,
+	// besides the federated peers.
+	chainRelays []*net.UDPAddr
+	registered  *names
+	codes       *codes
+	rooms       rooms
+	auth        *auth
+	federation  *federation
+	seals       *seals
+	limits      *limiter
+	stats       *stats
+	clients     map[key]clientValue
+	servers     map[key]serverValue
+	sessions    lobby
+	relayed     channels
+	// streams are the peers connected over TLS, by the address they are
+	// handled as.
+	streams   map[string]*stream
+	flushTime time.Time
 }
 
 func main() {
@@ -36,9 +138,61 @@ func main() {
 	fmt.Println()
 
 	var port int
+	var namesFile string
+	var chain bool
+	var chainTo string
+	var tokensFile string
+	var rate int
+	var channelRate int
+	var admin string
+	var tlsPort int
+	var tlsCert string
+	var tlsKey string
+	var peers string
+	var federationSecret string
+	var keyFile string
 	flag.IntVar(&port, "port", defaultPort, "relay listen port")
+	flag.StringVar(&namesFile, "names", "names.txt", "file storing the registered names and their keys (empty: do not persist)")
+	flag.StringVar(&keyFile, "key", "relay.key", "file storing the ed25519 key of the relay, generated if missing, whose public key peers can pin with -relay-key (empty: a new key at every start)")
+	flag.BoolVar(&chain, "chain", true, "forward chained sessions to the next relay, if it is a peer of -peers or a relay of -chain-to")
+	flag.StringVar(&chainTo, "chain-to", "", "relays chained sessions can be forwarded to besides the peers of -peers, separated by commas, e.g. relay.example.com:14761 (empty: only the peers)")
+	flag.IntVar(&rate, "rate", defaultRate, "messages per second accepted from each IP, besides relayed game traffic")
+	flag.IntVar(&channelRate, "channel-rate", defaultChannelRate, "relayed game traffic messages per second accepted from each IP")
+	flag.StringVar(&admin, "admin", "", "address of the HTTP admin endpoint exposing metrics and registrations, e.g. 127.0.0.1:14780 (empty: disabled)")
+	flag.StringVar(&tokensFile, "tokens", "", "file of the tokens of your community, one per line: only peers authenticated with one of them can use the relay (empty: open to all)")
+	flag.IntVar(&tlsPort, "tls-port", defaultTlsPort, "TLS listen port, for peers whose network blocks UDP to the relay port")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file of the relay host name (empty: do not listen on TLS)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&peers, "peers", "", "relays to federate with, separated by commas, e.g. relay.example.com:14761: clients can find the hosts registered on them, and theirs on this relay (empty: no federation)")
+	flag.StringVar(&federationSecret, "federation-secret", "", "secret shared by the relays of the federation, authenticating their messages")
 	flag.Parse()
 
+	registered, err := loadNames(namesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokens, err := loadTokens(tokensFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	federation, err := newFederation(peers, federationSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chainRelays, err := resolveRelays(chainTo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	identity, err := loadKey(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	seals, err := newSeals(identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Relay key: " + hex.EncodeToString(identity.Public().(ed25519.PublicKey)))
+
 	c, err := net.ListenUDP("udp4", &net.UDPAddr{
 		Port: port,
 	})
@@ -46,77 +200,346 @@ func main() {
 		log.Fatal(err)
 	}
 	defer c.Close()
+	c6, err := net.ListenUDP("udp6", &net.UDPAddr{
+		Port: port,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listening on IPv6, peers will only reach the relay over IPv4: "+err.Error())
+	}
+	go serveTcp(port)
 
-	clients := make(map[key]clientValue)
-	servers := make(map[key]serverValue)
-
-	flushTime := time.Now()
+	r := &relay{
+		c:           c,
+		c6:          c6,
+		observed:    make(observations),
+		chain:       chain,
+		chainRelays: chainRelays,
+		registered:  registered,
+		codes:       newCodes(),
+		rooms:       make(rooms),
+		auth:        tokens,
+		federation:  federation,
+		seals:       seals,
+		limits:      newLimiter(rate, channelRate),
+		stats:       newStats(),
+		clients:     make(map[key]clientValue),
+		servers:     make(map[key]serverValue),
+		sessions:    make(lobby),
+		relayed:     make(channels),
+		streams:     make(map[string]*stream),
+		flushTime:   time.Now(),
+	}
+	if tlsCert != "" {
+		go r.serveTls(tlsPort, tlsCert, tlsKey)
+	}
+	if admin != "" {
+		go r.serveAdmin(admin)
+	}
+	if len(federation.peers) > 0 {
+		go r.runFederation()
+	}
+	if c6 != nil {
+		go r.serveIpv6()
+	}
 
-	buffer := make([]byte, 6)
+	buffer := make([]byte, 8192)
 	for {
-		now := time.Now()
-		if now.Sub(flushTime) > flushInterval {
-			flushTime = now
-			for k, v := range clients {
-				if now.Sub(v.time) > flushInterval {
-					delete(clients, k)
-				}
-			}
-			for k, v := range servers {
-				if now.Sub(v.time) > flushInterval {
-					delete(servers, k)
-				}
-			}
-		}
 		n, addr, err := c.ReadFromUDP(buffer)
 		if err != nil {
 			// err is thrown if the buffer is too small
 			continue
 		}
-		if n == 1 {
-			c.WriteToUDP(buffer[:n], addr)
+		if n > len(buffer)-1 {
 			continue
 		}
-		if n != 2 && n != 6 {
-			continue
+		r.mu.Lock()
+		r.handle(buffer[:n], addr, false)
+		r.mu.Unlock()
+	}
+}
+
+// WriteToUDP sends b to addr, sealed if addr sends sealed messages, unless it
+// would amplify the messages received from addr.
+func (r *relay) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return r.write(r.seals.seal(b, addr), addr)
+}
+
+// write sends the message b to addr as is, unless it would amplify the
+// messages received from addr.
+func (r *relay) write(b []byte, addr *net.UDPAddr) (int, error) {
+	if !r.limits.send(addr.IP, len(b)) {
+		r.stats.dropped["amplification"]++
+		return 0, nil
+	}
+	return r.send(b, addr)
+}
+
+// relayedWriter sends the traffic of relayed channels, which is not bound by
+// the amplification limit, except the traffic forwarded to the next relay of
+// chained channels.
+type relayedWriter struct {
+	r *relay
+}
+
+func (w relayedWriter) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if w.r.chainable(addr) {
+		return w.r.write(b, addr)
+	}
+	return w.r.send(b, addr)
+}
+
+// chainable returns whether chained sessions can be forwarded to the relay
+// at addr, which must be a federated peer or a relay of -chain-to, so that
+// the relay cannot reflect traffic to any address.
+func (r *relay) chainable(addr *net.UDPAddr) bool {
+	return findRelay(r.federation.peers, addr) != nil || findRelay(r.chainRelays, addr) != nil
+}
+
+// send sends b to addr, over its TLS stream if it has one.
+func (r *relay) send(b []byte, addr *net.UDPAddr) (int, error) {
+	r.stats.sent[r.stats.region(addr.IP)] += int64(len(b))
+	if st, ok := r.streams[addr.String()]; ok {
+		return st.send(b)
+	}
+	return r.c.WriteToUDP(b, addr)
+}
+
+// handle handles a message from addr, which came over TLS if stream is set;
+// r.mu must be held.
+func (r *relay) handle(data []byte, addr *net.UDPAddr, stream bool) {
+	now := time.Now()
+	if now.Sub(r.flushTime) > flushInterval {
+		r.flushTime = now
+		for k, v := range r.clients {
+			if now.Sub(v.time) > flushInterval {
+				delete(r.clients, k)
+			}
 		}
-		var senderIp [4]byte
-		if senderIpSlice := addr.IP.To4(); senderIpSlice == nil {
-			continue
-		} else {
-			copy(senderIp[:], senderIpSlice)
+		for k, v := range r.servers {
+			if now.Sub(v.time) > flushInterval {
+				delete(r.servers, k)
+			}
 		}
-		if n == 2 {
-			key := key{
-				ip:   senderIp,
-				port: int(binary.BigEndian.Uint16(buffer[:2])),
+		r.sessions.flush(now)
+		r.relayed.flush(now)
+		r.codes.flush(now)
+		r.rooms.flush(now)
+		r.federation.flush(now)
+		r.seals.flush(now)
+		r.observed.flush(now)
+		r.auth.flush(now)
+		r.limits.flush(now)
+		for ip := range r.stats.regions {
+			if _, ok := r.limits.quotas[ip]; !ok {
+				delete(r.stats.regions, ip)
 			}
-			servers[key] = serverValue{
-				natPort: addr.Port,
-				time:    time.Now(),
+		}
+	}
+	if !validSource(addr) {
+		r.stats.dropped["source"]++
+		return
+	}
+	if r.federation.handle(r, addr, data) {
+		return
+	}
+	var senderIp [4]byte
+	copy(senderIp[:], addr.IP.To4())
+	n := len(data)
+	channel := (n >= len(forwardMagic)+8 && string(data[:len(forwardMagic)]) == forwardMagic) || (n >= len(chainMagic)+8+6 && string(data[:len(chainMagic)]) == chainMagic)
+	if !r.limits.receive(senderIp, n, channel, now) {
+		r.stats.dropped["rate"]++
+		return
+	}
+	r.stats.received[r.stats.region(addr.IP)] += int64(n)
+	sealed := false
+	if n > len(sealMagic) && string(data[:len(sealMagic)]) == sealMagic {
+		plain, ok := r.seals.open(r, addr, data[len(sealMagic):])
+		if !ok {
+			return
+		}
+		data, n, sealed = plain, len(plain), true
+	}
+	if n == 1 {
+		if sealed {
+			// answered sealed, for the peers pinning the relay
+			r.write(r.seals.sealEcho(data, addr), addr)
+		} else {
+			r.WriteToUDP(data, addr)
+		}
+		return
+	}
+	if n == len(versionMagic)+4 && string(data[:len(versionMagic)]) == versionMagic {
+		r.WriteToUDP(versionReply(r.chain, r.auth.restricted(), r.c6 != nil), addr)
+		return
+	}
+	if n > len(authMagic) && string(data[:len(authMagic)]) == authMagic {
+		r.auth.handle(r, addr, senderIp, data[len(authMagic):])
+		return
+	}
+	if !r.auth.allowed(senderIp) {
+		r.stats.dropped["auth"]++
+		return
+	}
+	if n > len(lobbyMagic) && string(data[:len(lobbyMagic)]) == lobbyMagic {
+		r.sessions.handle(r, addr, senderIp, data[len(lobbyMagic):])
+		if n >= len(lobbyMagic)+3 && data[len(lobbyMagic)] == lobbyPublish {
+			port := int(binary.BigEndian.Uint16(data[len(lobbyMagic)+1:]))
+			if v, ok := r.sessions[key{ip: senderIp, port: port}]; ok {
+				r.stats.regions[senderIp] = v.region()
 			}
-			if val, ok := clients[key]; ok {
-				serverPayload := append([]byte{byte(val.natPort >> 8), byte(val.natPort)}, val.localIp[:]...)
-				c.WriteToUDP(serverPayload, addr)
-			} else {
-				c.WriteToUDP(senderIp[:], addr)
+		}
+		return
+	}
+	if n > len(codeMagic) && string(data[:len(codeMagic)]) == codeMagic {
+		r.codes.handle(r, addr, senderIp, data[len(codeMagic):])
+		return
+	}
+	if n > len(roomMagic) && string(data[:len(roomMagic)]) == roomMagic {
+		r.rooms.handle(r, addr, senderIp, data[len(roomMagic):])
+		return
+	}
+	if n > len(nameMagic) && string(data[:len(nameMagic)]) == nameMagic {
+		r.registered.handle(r, addr, senderIp, data)
+		return
+	}
+	// the game traffic of relayed channels stays on UDP
+	if n >= len(forwardMagic)+8 && string(data[:len(forwardMagic)]) == forwardMagic {
+		if !stream {
+			if r.relayed.handle(relayedWriter{r}, addr, nil, data[len(forwardMagic):]) {
+				r.stats.relayedSessions++
 			}
-		} else if n == 6 {
-			var ip [4]byte
-			copy(ip[:], buffer[2:])
-			key := key{
-				ip:   ip,
-				port: int(binary.BigEndian.Uint16(buffer[:2])),
+		}
+		return
+	}
+	if n >= len(chainMagic)+8+6 && string(data[:len(chainMagic)]) == chainMagic {
+		if stream {
+			return
+		}
+		next := &net.UDPAddr{
+			IP:   net.IP(append([]byte(nil), data[12:16]...)),
+			Port: int(binary.BigEndian.Uint16(data[16:18])),
+		}
+		if !r.chain || !r.chainable(next) {
+			r.stats.dropped["chain"]++
+			return
+		}
+		if r.relayed.handle(relayedWriter{r}, addr, next, append(data[4:12:12], data[18:]...)) {
+			r.stats.relayedSessions++
+		}
+		return
+	}
+	extended := n >= 8 && string(data[:4]) == magic
+	ipv6 := n >= 8 && string(data[:4]) == magic6
+	var v6 [18]byte
+	msg := data
+	if extended || ipv6 {
+		data = data[4:]
+	}
+	if ipv6 {
+		if len(data) != 26 && len(data) != 30 {
+			return
+		}
+		copy(v6[:], data[len(data)-18:])
+		if observed, ok := r.observedIpv6(msg); ok {
+			v6 = observed
+		}
+		data = data[:len(data)-18]
+		extended = true
+	}
+	if (!extended && len(data) != 2 && len(data) != 6) || (extended && len(data) != 8 && len(data) != 12) {
+		return
+	}
+	replyMagic := magic
+	if ipv6 {
+		replyMagic = magic6
+	}
+	if len(data) == 2 || len(data) == 8 {
+		key := key{
+			ip:   senderIp,
+			port: int(binary.BigEndian.Uint16(data[:2])),
+		}
+		server := serverValue{
+			natPort:  addr.Port,
+			time:     time.Now(),
+			extended: extended,
+			ipv6:     ipv6,
+		}
+		if extended {
+			copy(server.private[:], data[2:8])
+		}
+		server.v6 = v6
+		_, known := r.servers[key]
+		r.servers[key] = server
+		if val, ok := r.clients[key]; ok {
+			if !known {
+				// the client registered first
+				r.stats.pairings++
 			}
-			clients[key] = clientValue{
-				localIp: senderIp,
-				natPort: addr.Port,
-				time:    time.Now(),
+			r.WriteToUDP(pairing(val, server), addr)
+		} else if extended {
+			serverPayload := append([]byte(replyMagic), senderIp[:]...)
+			serverPayload = append(serverPayload, byte(addr.Port>>8), byte(addr.Port))
+			r.WriteToUDP(serverPayload, addr)
+		} else {
+			r.WriteToUDP(senderIp[:], addr)
+		}
+	} else {
+		var ip [4]byte
+		copy(ip[:], data[2:6])
+		key := key{
+			ip:   ip,
+			port: int(binary.BigEndian.Uint16(data[:2])),
+		}
+		client := clientValue{
+			localIp: senderIp,
+			natPort: addr.Port,
+			time:    time.Now(),
+		}
+		if extended {
+			copy(client.private[:], data[6:12])
+		}
+		client.v6 = v6
+		if val, ok := r.registerClient(key, client, true); ok {
+			serverPayload := []byte{byte(val.natPort >> 8), byte(val.natPort)}
+			if extended {
+				serverPayload = append(append([]byte(replyMagic), serverPayload...), val.private[:]...)
 			}
-			if val, ok := servers[key]; ok {
-				serverPayload := append([]byte{byte(val.natPort >> 8), byte(val.natPort)})
-				c.WriteToUDP(serverPayload, addr)
+			if ipv6 {
+				serverPayload = append(serverPayload, val.v6[:]...)
 			}
+			r.WriteToUDP(serverPayload, addr)
 		}
 	}
 }
+
+// registerClient records the registration of client for the host k, and
+// tells the host about it right away, rather than on its next registration,
+// which it sends rarely while idle; forward is whether hosts registered on
+// peer relays are told too, through their relay. It returns the host, if
+// known.
+func (r *relay) registerClient(k key, client clientValue, forward bool) (serverValue, bool) {
+	previous, known := r.clients[k]
+	r.clients[k] = client
+	val, ok := r.servers[k]
+	var peer *net.UDPAddr
+	if !ok && forward {
+		val, peer, ok = r.federation.host(k)
+	}
+	if !ok {
+		return serverValue{}, false
+	}
+	if !known || previous.localIp != client.localIp || previous.natPort != client.natPort {
+		r.stats.pairings++
+	}
+	// the session is taken, stop listing it
+	delete(r.sessions, k)
+	if peer != nil {
+		r.federation.forwardClient(r, peer, k, client)
+	} else {
+		r.WriteToUDP(pairing(client, val), &net.UDPAddr{
+			IP:   net.IP(k.ip[:]),
+			Port: val.natPort,
+		})
+	}
+	return val, true
+}
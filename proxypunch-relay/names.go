@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// nameMagic prefixes the registered name messages, followed by an operation
+// byte:
+//   - nameClaim: port, unix time, public IP, public key, name, then the
+//     signature of the message
+//   - nameClaimed: status
+//   - nameResolve: name
+//   - nameResolved: status, IP, port
+//
+// Names are prefixed with their length on one byte. A name is bound to the
+// first key claiming it, then points at the current public IP and port of
+// the host claiming it with that key.
+const nameMagic = "PPN1"
+
+const (
+	nameClaim    = 0x01
+	nameClaimed  = 0x02
+	nameResolve  = 0x03
+	nameResolved = 0x04
+)
+
+// Status of name messages.
+const (
+	nameOk       = 0x00
+	nameTaken    = 0x01
+	nameInvalid  = 0x02
+	nameNotFound = 0x03
+)
+
+// claimValidity is the maximum difference between the time of a claim and
+// the time of the relay, bounding how long a claim can be replayed.
+const claimValidity = 5 * time.Minute
+
+// maxNames bounds the count of registered names.
+const maxNames = 100000
+
+type nameValue struct {
+	key ed25519.PublicKey
+	// ip and port are the current registration of the host, valid until
+	// flushInterval after time.
+	ip   [4]byte
+	port int
+	time time.Time
+}
+
+// names holds the registered names, saved to file as lines of name and hex
+// public key.
+type names struct {
+	file    string
+	entries map[string]*nameValue
+}
+
+func loadNames(file string) (*names, error) {
+	n := &names{
+		file:    file,
+		entries: make(map[string]*nameValue),
+	}
+	if file == "" {
+		return n, nil
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return n, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			continue
+		}
+		n.entries[fields[0]] = &nameValue{
+			key: key,
+		}
+	}
+	return n, scanner.Err()
+}
+
+func (n *names) save(name string, key ed25519.PublicKey) {
+	if n.file == "" {
+		return
+	}
+	f, err := os.OpenFile(n.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error saving name "+name+": "+err.Error())
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(name + " " + hex.EncodeToString(key) + "\n"); err != nil {
+		fmt.Fprintln(os.Stderr, "Error saving name "+name+": "+err.Error())
+	}
+}
+
+// handle handles a name message, including the magic.
+func (n *names) handle(c packetWriter, addr *net.UDPAddr, senderIp [4]byte, msg []byte) {
+	if len(msg) < len(nameMagic)+2 {
+		return
+	}
+	switch msg[len(nameMagic)] {
+	case nameClaim:
+		status := n.claim(senderIp, msg)
+		c.WriteToUDP(append([]byte(nameMagic), nameClaimed, status), addr)
+	case nameResolve:
+		data := msg[len(nameMagic)+1:]
+		if len(data) < 1+int(data[0]) || len(msg) < 12 {
+			return
+		}
+		reply := append([]byte(nameMagic), nameResolved, nameNotFound, 0, 0, 0, 0, 0, 0)
+		if v, ok := n.entries[string(data[1:1+int(data[0])])]; ok && time.Since(v.time) < flushInterval {
+			reply[5] = nameOk
+			copy(reply[6:10], v.ip[:])
+			binary.BigEndian.PutUint16(reply[10:12], uint16(v.port))
+		}
+		c.WriteToUDP(reply, addr)
+	}
+}
+
+func (n *names) claim(senderIp [4]byte, msg []byte) byte {
+	data := msg[len(nameMagic)+1:]
+	if len(data) < 2+8+4+ed25519.PublicKeySize+1 {
+		return nameInvalid
+	}
+	port := int(binary.BigEndian.Uint16(data[:2]))
+	t := time.Unix(int64(binary.BigEndian.Uint64(data[2:10])), 0)
+	var ip [4]byte
+	copy(ip[:], data[10:14])
+	key := ed25519.PublicKey(data[14 : 14+ed25519.PublicKeySize])
+	data = data[14+ed25519.PublicKeySize:]
+	if len(data) != 1+int(data[0])+ed25519.SignatureSize {
+		return nameInvalid
+	}
+	name := string(data[1 : 1+int(data[0])])
+	if !validName(name) || ip != senderIp {
+		return nameInvalid
+	}
+	if d := time.Since(t); d > claimValidity || d < -claimValidity {
+		return nameInvalid
+	}
+	if !ed25519.Verify(key, msg[:len(msg)-ed25519.SignatureSize], msg[len(msg)-ed25519.SignatureSize:]) {
+		return nameInvalid
+	}
+	v, ok := n.entries[name]
+	if !ok {
+		if len(n.entries) >= maxNames {
+			return nameInvalid
+		}
+		v = &nameValue{
+			key: append(ed25519.PublicKey(nil), key...),
+		}
+		n.entries[name] = v
+		n.save(name, key)
+	} else if !v.key.Equal(key) {
+		return nameTaken
+	}
+	v.ip = senderIp
+	v.port = port
+	v.time = time.Now()
+	return nameOk
+}
+
+func validName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// defaultRate is the default count of messages per second accepted from each
+// IP, and defaultChannelRate the default count of relayed channel messages,
+// which carry game traffic.
+const (
+	defaultRate        = 20
+	defaultChannelRate = 300
+)
+
+// amplificationFactor bounds the bytes sent to an IP to this many times the
+// bytes received from it since the last flush, plus amplificationSlack, so
+// that spoofed messages cannot make the relay flood their victim. Relayed
+// channels are not bound, their traffic is paid by the other endpoint, except
+// the traffic forwarded to the next relay of chained channels.
+const (
+	amplificationFactor = 3
+	amplificationSlack  = 64
+)
+
+// maxQuotas bounds the count of IPs tracked by the rate limiter.
+const maxQuotas = 100000
+
+// quota is the rate limit state of an IP: token buckets refilled at the rate
+// of their kind of messages, holding up to one second of messages.
+type quota struct {
+	tokens        float64
+	channelTokens float64
+	last          time.Time
+	// received and sent are the bytes received from and sent to the IP since
+	// the last flush.
+	received int
+	sent     int
+}
+
+// limiter limits the messages accepted from each IP, and the bytes sent to
+// it.
+type limiter struct {
+	rate        float64
+	channelRate float64
+	quotas      map[[4]byte]*quota
+}
+
+func newLimiter(rate int, channelRate int) *limiter {
+	return &limiter{
+		rate:        float64(rate),
+		channelRate: float64(channelRate),
+		quotas:      make(map[[4]byte]*quota),
+	}
+}
+
+// receive returns whether a message of size bytes from ip is accepted; channel
+// is set for relayed channel messages.
+func (l *limiter) receive(ip [4]byte, size int, channel bool, now time.Time) bool {
+	q, ok := l.quotas[ip]
+	if !ok {
+		if len(l.quotas) >= maxQuotas {
+			return false
+		}
+		q = &quota{
+			tokens:        l.rate,
+			channelTokens: l.channelRate,
+			last:          now,
+		}
+		l.quotas[ip] = q
+	}
+	elapsed := now.Sub(q.last).Seconds()
+	q.last = now
+	q.tokens = math.Min(q.tokens+elapsed*l.rate, l.rate)
+	q.channelTokens = math.Min(q.channelTokens+elapsed*l.channelRate, l.channelRate)
+	tokens := &q.tokens
+	if channel {
+		tokens = &q.channelTokens
+	}
+	if *tokens < 1 {
+		return false
+	}
+	*tokens--
+	q.received += size
+	return true
+}
+
+// send returns whether size bytes can be sent to ip without amplifying the
+// messages received from it.
+func (l *limiter) send(ip net.IP, size int) bool {
+	q, ok := l.quotas[quotaKey(ip)]
+	if !ok {
+		return size <= amplificationSlack
+	}
+	if q.sent+size > amplificationFactor*q.received+amplificationSlack {
+		return false
+	}
+	q.sent += size
+	return true
+}
+
+func (l *limiter) flush(now time.Time) {
+	for ip, q := range l.quotas {
+		if now.Sub(q.last) > flushInterval {
+			delete(l.quotas, ip)
+			continue
+		}
+		q.received, q.sent = 0, 0
+	}
+}
+
+// validSource returns whether addr can be the source of a message, rather
+// than a spoofed address no reply should be sent to.
+func validSource(addr *net.UDPAddr) bool {
+	ip := addr.IP.To4()
+	return ip != nil && addr.Port != 0 && !ip.IsUnspecified() && !ip.IsMulticast() && !ip.Equal(net.IPv4bcast)
+}
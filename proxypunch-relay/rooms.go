@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// roomMagic prefixes the room messages, followed by an operation byte:
+//   - roomClaim: port, flags, relay RTT in milliseconds, token tag, room,
+//     game, region, padded to roomRequestSize
+//   - roomClaimed: status
+//   - roomResolve: room, padded to roomRequestSize
+//   - roomResolved: status, IP, port, flags
+//   - roomList: page, token tag, padded to roomPageSize
+//   - roomEntries: page, page count, then entries: room, game, region, relay
+//     RTT, flags
+//
+// Strings are prefixed with their length on one byte. A room is a name
+// chosen by a host, such as "Friday Netplay", pointing to its public IP and
+// port until flushInterval after its last claim; until then other hosts
+// cannot claim it. Rooms are matched regardless of case and spacing. Rooms
+// claimed with roomListed are listed, to requests with the same token tag if
+// claimed with one. The flags are passed to the peers resolving or listing
+// the room. Requests are padded so that the relay does not amplify
+// spoofed requests.
+const roomMagic = "PPR1"
+
+const (
+	roomClaim    = 0x01
+	roomClaimed  = 0x02
+	roomResolve  = 0x03
+	roomResolved = 0x04
+	roomList     = 0x05
+	roomEntries  = 0x06
+)
+
+// Status of room messages.
+const (
+	roomOk       = 0x00
+	roomTaken    = 0x01
+	roomInvalid  = 0x02
+	roomNotFound = 0x03
+)
+
+// Flags of rooms.
+const (
+	roomListed = 0x01
+	// roomPassword is set when the host requires a password, which peers
+	// present in the challenge of the host before reaching its game.
+	roomPassword = 0x02
+)
+
+// roomRequestSize is the size of the claim and resolve requests, excluding
+// the magic.
+const roomRequestSize = 128
+
+// roomPageSize is the size of the list requests, and the maximum size of the
+// pages sent back.
+const roomPageSize = 1200
+
+// maxRoomLength bounds the length of rooms in bytes.
+const maxRoomLength = 48
+
+// maxRooms bounds the count of rooms.
+const maxRooms = 10000
+
+type roomValue struct {
+	// name is the room as claimed, for display.
+	name string
+	host key
+	// info is the encoded game, region, relay RTT and flags of listed
+	// rooms.
+	info   []byte
+	listed bool
+	tag    [8]byte
+	time   time.Time
+}
+
+// rooms holds the rooms, by normalized name.
+type rooms map[string]*roomValue
+
+// normalizeRoom returns the key of room, or an empty string if it is
+// invalid.
+func normalizeRoom(room string) string {
+	if !utf8.ValidString(room) {
+		return ""
+	}
+	for _, r := range room {
+		if r < ' ' || r == 0x7f {
+			return ""
+		}
+	}
+	return strings.ToLower(strings.Join(strings.Fields(room), " "))
+}
+
+// handle handles a room message, excluding the magic.
+func (rs rooms) handle(c packetWriter, addr *net.UDPAddr, senderIp [4]byte, data []byte) {
+	switch data[0] {
+	case roomClaim:
+		if len(data) != 1+roomRequestSize {
+			return
+		}
+		host := key{
+			ip:   senderIp,
+			port: int(binary.BigEndian.Uint16(data[1:3])),
+		}
+		c.WriteToUDP(append([]byte(roomMagic), roomClaimed, rs.claim(host, data[3:])), addr)
+	case roomResolve:
+		if len(data) != 1+roomRequestSize {
+			return
+		}
+		reply := append([]byte(roomMagic), roomResolved, roomNotFound)
+		reply = append(reply, make([]byte, 7)...)
+		if room, _, ok := readString(data[1:], maxRoomLength); ok {
+			if v, ok := rs[normalizeRoom(room)]; ok {
+				reply[len(roomMagic)+1] = roomOk
+				copy(reply[len(roomMagic)+2:], v.host.ip[:])
+				binary.BigEndian.PutUint16(reply[len(roomMagic)+6:], uint16(v.host.port))
+				reply[len(roomMagic)+8] = v.info[len(v.info)-1]
+			}
+		}
+		c.WriteToUDP(reply, addr)
+	case roomList:
+		if len(data)+len(roomMagic) < roomPageSize {
+			return
+		}
+		var tag [8]byte
+		copy(tag[:], data[2:10])
+		pages := rs.pages(tag)
+		page := int(data[1])
+		if page >= len(pages) {
+			return
+		}
+		c.WriteToUDP(pages[page], addr)
+	}
+}
+
+// readString reads a string prefixed with its length, of at most max bytes,
+// and returns the rest of b.
+func readString(b []byte, max int) (string, []byte, bool) {
+	if len(b) < 1 || int(b[0]) > max || len(b) < 1+int(b[0]) {
+		return "", nil, false
+	}
+	return string(b[1 : 1+int(b[0])]), b[1+int(b[0]):], true
+}
+
+// claim claims the room of b, starting with the flags, for host, returning
+// the status.
+func (rs rooms) claim(host key, b []byte) byte {
+	flags, rtt := b[0], b[1:3]
+	var tag [8]byte
+	copy(tag[:], b[3:11])
+	room, rest, ok := readString(b[11:], maxRoomLength)
+	if !ok {
+		return roomInvalid
+	}
+	info := rest
+	game, rest, ok := readString(rest, 255)
+	if !ok {
+		return roomInvalid
+	}
+	region, rest, ok := readString(rest, 255)
+	if !ok {
+		return roomInvalid
+	}
+	info = append(append([]byte(nil), info[:len(info)-len(rest)]...), rtt[0], rtt[1], flags)
+	k := normalizeRoom(room)
+	if k == "" || !utf8.ValidString(game) || !utf8.ValidString(region) {
+		return roomInvalid
+	}
+	now := time.Now()
+	if v, ok := rs[k]; ok && v.host != host && now.Sub(v.time) <= flushInterval {
+		return roomTaken
+	}
+	if _, ok := rs[k]; !ok && len(rs) >= maxRooms {
+		return roomInvalid
+	}
+	rs[k] = &roomValue{
+		name:   strings.Join(strings.Fields(room), " "),
+		host:   host,
+		info:   info,
+		listed: flags&roomListed != 0,
+		tag:    tag,
+		time:   now,
+	}
+	return roomOk
+}
+
+// pages returns the encoded pages of the listed rooms listed to requests
+// with tag.
+func (rs rooms) pages(tag [8]byte) [][]byte {
+	var keys []string
+	for k, v := range rs {
+		if v.listed && (v.tag == tag || v.tag == [8]byte{}) {
+			keys = append(keys, k)
+		}
+	}
+	// stable pages across requests
+	sort.Strings(keys)
+
+	header := len(roomMagic) + 3
+	var pages [][]byte
+	page := make([]byte, header)
+	for _, k := range keys {
+		v := rs[k]
+		entry := append([]byte{byte(len(v.name))}, v.name...)
+		entry = append(entry, v.info...)
+		if len(page)+len(entry) > roomPageSize {
+			pages = append(pages, page)
+			page = make([]byte, header)
+		}
+		page = append(page, entry...)
+	}
+	pages = append(pages, page)
+	if len(pages) > 255 {
+		pages = pages[:255]
+	}
+	for i, page := range pages {
+		copy(page, roomMagic)
+		page[len(roomMagic)] = roomEntries
+		page[len(roomMagic)+1] = byte(i)
+		page[len(roomMagic)+2] = byte(len(pages))
+	}
+	return pages
+}
+
+func (rs rooms) flush(now time.Time) {
+	for k, v := range rs {
+		if now.Sub(v.time) > flushInterval {
+			delete(rs, k)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// sealMagic prefixes the sealed messages, which hide the registrations and
+// the addresses the relay answers from on-path observers, followed by an
+// operation byte:
+//   - sealHello: padded to the size of the answer
+//   - sealKey: X25519 public key of the relay, then its ed25519 signature of
+//     "proxypunch relay key", a zero byte and the X25519 public key, with the
+//     key of the relay
+//   - sealRequest: X25519 public key of the peer, nonce, message sealed with
+//     AES-256-GCM
+//   - sealReply: nonce, message sealed with AES-256-GCM; the nonce is 4 zero
+//     bytes then a counter (8 bytes), raised with every sealed reply
+//
+// The key is the HMAC-SHA256 of "proxypunch seal", a zero byte, the public
+// key of the peer and the public key of the relay, keyed with their X25519
+// shared secret; the operation byte is authenticated along with the message.
+// As only the relay holding its ed25519 key can sign the X25519 key, and
+// answer sealed messages with it, peers pinning the public key of the relay
+// know the answers come from it, and drop the answers whose counter they
+// already saw.
+// Sealed requests are handled as the message they seal. Once a peer sends
+// sealed messages, the relay seals all its answers to that peer, except the
+// echo messages that were not sealed, until flushInterval after its last
+// sealed message; the traffic of relayed channels is not sealed.
+const sealMagic = "PPE1"
+
+const (
+	sealHello   = 0x01
+	sealKey     = 0x02
+	sealRequest = 0x03
+	sealReply   = 0x04
+)
+
+// maxSealed bounds the count of peers sending sealed messages.
+const maxSealed = 100000
+
+type sealedPeer struct {
+	public [32]byte
+	aead   cipher.AEAD
+	time   time.Time
+}
+
+// seals holds the key of the relay, its signature, and the ciphers of the
+// peers sending sealed messages, by address.
+type seals struct {
+	key       *ecdh.PrivateKey
+	signature []byte
+	peers     map[string]*sealedPeer
+	// counter is the counter of the last sealed reply, which starts over
+	// along with key when the relay restarts.
+	counter uint64
+}
+
+// newSeals generates the X25519 key of the relay, signed with identity.
+func newSeals(identity ed25519.PrivateKey) (*seals, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &seals{
+		key:       key,
+		signature: ed25519.Sign(identity, append([]byte("proxypunch relay key\x00"), key.PublicKey().Bytes()...)),
+		peers:     make(map[string]*sealedPeer),
+	}, nil
+}
+
+// loadKey loads the ed25519 key of the relay from file, a hex seed,
+// generating and saving it if file does not exist, or generating it without
+// saving it if file is empty.
+func loadKey(file string) (ed25519.PrivateKey, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err == nil {
+			seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, errors.New("invalid relay key in " + file)
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		if err := os.WriteFile(file, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// open handles a sealed message from addr, excluding the magic, and returns
+// the message it seals, if any.
+func (ss *seals) open(c packetWriter, addr *net.UDPAddr, data []byte) ([]byte, bool) {
+	switch data[0] {
+	case sealHello:
+		if len(data) < 1+32+ed25519.SignatureSize {
+			return nil, false
+		}
+		reply := append([]byte(sealMagic), sealKey)
+		reply = append(reply, ss.key.PublicKey().Bytes()...)
+		c.WriteToUDP(append(reply, ss.signature...), addr)
+	case sealRequest:
+		if len(data) < 1+32 {
+			return nil, false
+		}
+		header, public, sealed := append([]byte(sealMagic), data[0]), data[1:33], data[33:]
+		p, ok := ss.peers[addr.String()]
+		if !ok || string(p.public[:]) != string(public) {
+			if !ok && len(ss.peers) >= maxSealed {
+				return nil, false
+			}
+			peerKey, err := ecdh.X25519().NewPublicKey(public)
+			if err != nil {
+				return nil, false
+			}
+			shared, err := ss.key.ECDH(peerKey)
+			if err != nil {
+				return nil, false
+			}
+			aead, err := sealCipher(shared, public, ss.key.PublicKey().Bytes())
+			if err != nil {
+				return nil, false
+			}
+			p = &sealedPeer{aead: aead}
+			copy(p.public[:], public)
+		}
+		if len(sealed) < p.aead.NonceSize() {
+			return nil, false
+		}
+		plain, err := p.aead.Open(nil, sealed[:p.aead.NonceSize()], sealed[p.aead.NonceSize():], header)
+		if err != nil {
+			return nil, false
+		}
+		p.time = time.Now()
+		ss.peers[addr.String()] = p
+		return plain, true
+	}
+	return nil, false
+}
+
+// sealCipher returns the cipher of the messages between the peer of public
+// key peer and the relay of public key relay, from their shared secret.
+func sealCipher(shared []byte, peer []byte, relay []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, shared)
+	m.Write([]byte("proxypunch seal\x00"))
+	m.Write(peer)
+	m.Write(relay)
+	block, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the message b to send to addr, sealed if addr sends sealed
+// messages, unless it is an echo message.
+func (ss *seals) seal(b []byte, addr *net.UDPAddr) []byte {
+	if len(b) <= 1 {
+		return b
+	}
+	return ss.sealEcho(b, addr)
+}
+
+// sealEcho returns the message b to send to addr, sealed if addr sends sealed
+// messages, even if it is an echo message.
+func (ss *seals) sealEcho(b []byte, addr *net.UDPAddr) []byte {
+	p, ok := ss.peers[addr.String()]
+	if !ok {
+		return b
+	}
+	ss.counter++
+	sealed := append([]byte(sealMagic), sealReply)
+	nonce := make([]byte, p.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], ss.counter)
+	sealed = append(sealed, nonce...)
+	return p.aead.Seal(sealed, nonce, b, sealed[:len(sealMagic)+1])
+}
+
+func (ss *seals) flush(now time.Time) {
+	for k, p := range ss.peers {
+		if now.Sub(p.time) > flushInterval {
+			delete(ss.peers, k)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// serveTcp answers TCP connections on the relay port with the public address
+// they come from (magic, 4 bytes of IPv4 and 2 bytes of port), then closes
+// them, so that peers punching TCP connections learn their public TCP port.
+func serveTcp(port int) {
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{
+		Port: port,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listening on TCP, peers punching TCP connections will not learn their public port: "+err.Error())
+		return
+	}
+	defer l.Close()
+	for {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			continue
+		}
+		addr := c.RemoteAddr().(*net.TCPAddr)
+		if ip := addr.IP.To4(); ip != nil {
+			reply := append([]byte(magic), ip...)
+			reply = append(reply, byte(addr.Port>>8), byte(addr.Port))
+			c.SetWriteDeadline(time.Now().Add(2 * time.Second))
+			c.Write(reply)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultTlsPort is the port peers register on over TLS when their network
+// blocks UDP to the relay port.
+const defaultTlsPort = 443
+
+// maxStreams bounds the count of peers connected over TLS.
+const maxStreams = 10000
+
+// stream is a peer connected over TLS. It first sends the port of its UDP
+// socket (2 bytes), then messages prefixed with their length (2 bytes), and
+// is answered the same way. Its messages are handled as UDP messages from the
+// public IP of the connection and that port, the best guess of its public UDP
+// address: right if its NAT keeps the port of its UDP socket, or if it
+// forwarded that port.
+type stream struct {
+	out chan []byte
+}
+
+// send queues b to the peer, dropping it as UDP would if the peer does not
+// read fast enough.
+func (st *stream) send(b []byte) (int, error) {
+	select {
+	case st.out <- append([]byte{byte(len(b) >> 8), byte(len(b))}, b...):
+	default:
+	}
+	return len(b), nil
+}
+
+// serveTls accepts the streams of peers whose network blocks UDP to the relay
+// port, on port.
+func (r *relay) serveTls(port int, certFile string, keyFile string) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading the TLS certificate, peers whose network blocks UDP will not reach the relay: "+err.Error())
+		return
+	}
+	l, err := tls.Listen("tcp4", ":"+strconv.Itoa(port), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listening on TLS, peers whose network blocks UDP will not reach the relay: "+err.Error())
+		return
+	}
+	defer l.Close()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			continue
+		}
+		go r.serveStream(c)
+	}
+}
+
+func (r *relay) serveStream(c net.Conn) {
+	defer c.Close()
+	header := make([]byte, 2)
+	// peers send messages more often than flushInterval
+	c.SetReadDeadline(time.Now().Add(flushInterval))
+	if _, err := io.ReadFull(c, header); err != nil {
+		return
+	}
+	addr := &net.UDPAddr{
+		IP:   c.RemoteAddr().(*net.TCPAddr).IP,
+		Port: int(binary.BigEndian.Uint16(header)),
+	}
+	key := addr.String()
+	st := &stream{
+		out: make(chan []byte, 16),
+	}
+	r.mu.Lock()
+	if len(r.streams) >= maxStreams {
+		r.mu.Unlock()
+		return
+	}
+	r.streams[key] = st
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		if r.streams[key] == st {
+			delete(r.streams, key)
+		}
+		r.mu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case b := <-st.out:
+				c.SetWriteDeadline(time.Now().Add(2 * time.Second))
+				if _, err := c.Write(b); err != nil {
+					c.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	buffer := make([]byte, 8192)
+	for {
+		c.SetReadDeadline(time.Now().Add(flushInterval))
+		if _, err := io.ReadFull(c, header); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(header))
+		if n == 0 || n > len(buffer) {
+			return
+		}
+		if _, err := io.ReadFull(c, buffer[:n]); err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.handle(buffer[:n], addr, true)
+		r.mu.Unlock()
+	}
+}
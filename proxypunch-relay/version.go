@@ -0,0 +1,52 @@
+package main
+
+// versionMagic prefixes the version messages, with which peers learn the
+// protocol version and the features of the relay: a peer sends its protocol
+// version (1 byte) and 3 bytes of padding, and is answered the protocol
+// version of the relay, the oldest peer protocol version it accepts (1 byte
+// each) and its capabilities (2 bytes). Peers predating versions never send
+// them, and keep working with the features they know.
+const versionMagic = "PPV1"
+
+// protocolVersion is the relay protocol version of this relay, and
+// oldestVersion the oldest peer protocol version it accepts.
+const (
+	protocolVersion = 1
+	oldestVersion   = 1
+)
+
+// Capabilities announced to peers, one bit per feature of the protocol
+// beyond the registrations; new features get the next bit.
+const (
+	capIpv6 uint16 = 1 << iota
+	capLobby
+	capNames
+	capChannels
+	capChain
+	capTcp
+	capAuth
+	// capRestricted is set when peers must authenticate with a token.
+	capRestricted
+	capCodes
+	capRooms
+	capSeal
+	// capDualStack is set when the relay also listens on IPv6.
+	capDualStack
+)
+
+// versionReply returns the answer to a version message; chain is whether
+// chained sessions are forwarded, restricted whether peers must authenticate,
+// dualStack whether the relay listens on IPv6.
+func versionReply(chain bool, restricted bool, dualStack bool) []byte {
+	caps := capIpv6 | capLobby | capNames | capChannels | capTcp | capAuth | capCodes | capRooms | capSeal
+	if chain {
+		caps |= capChain
+	}
+	if restricted {
+		caps |= capRestricted
+	}
+	if dualStack {
+		caps |= capDualStack
+	}
+	return append([]byte(versionMagic), protocolVersion, oldestVersion, byte(caps>>8), byte(caps))
+}
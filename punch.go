@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxProbes bounds the count of probes a host remembers while waiting for the
+// relay to announce a peer.
+const maxProbes = 64
+
+func client(s *session, host string, port int) {
+	c := listenProxy(s)
+	defer c.Close()
+
+	localPort := c.LocalAddr().(*net.UDPAddr).Port
+	if proto != "udp" {
+		if s.tcpGame = listenGame(s, localPort); s.tcpGame == nil {
+			return
+		}
+		defer s.tcpGame.Close()
+	}
+	s.println("Listening, connect to 127.0.0.1 on port " + strconv.Itoa(localPort))
+	for _, ip := range lanIps {
+		s.println("Devices on your local network can connect to " + ip.String() + " on port " + strconv.Itoa(localPort))
+	}
+	s.setState("connecting to relay")
+	if s.preset != nil {
+		s.println(s.preset.connectHelp(localPort))
+	}
+
+	runClient(s, c, host, port)
+}
+
+// listenProxy binds the proxy socket on the port set with -bind, or on the
+// default port if available, so that peers can try reaching it directly. The
+// socket accepts both IPv4 and IPv6 packets, unless IPv6 is disabled on the
+// system.
+func listenProxy(s *session) *net.UDPConn {
+	if bindPort != 0 {
+		c, err := listenDualStack(bindPort)
+		if err != nil {
+			log.Fatal("Error binding the proxy socket to port "+strconv.Itoa(bindPort)+": ", err)
+		}
+		setBuffers(c)
+		markSocket(s, c)
+		enableUnreachable(c)
+		return c
+	}
+	c, err := listenDualStack(defaultPort)
+	if err != nil {
+		if owner := portOwner(defaultPort); owner != "" {
+			s.println("Port " + strconv.Itoa(defaultPort) + " is already used by " + owner + ", using another port instead")
+		}
+		c, err = listenDualStack(0)
+		if err != nil {
+			log.Fatal("Error creating the proxy socket: ", err)
+		}
+	}
+	setBuffers(c)
+	markSocket(s, c)
+	enableUnreachable(c)
+	return c
+}
+
+func runClient(s *session, c *net.UDPConn, host string, port int) {
+	if s.channel != nil {
+		// a private host listed on the lobby, whose address is hidden
+		runRelayed(s, c, s.channel, "the host")
+		return
+	}
+	if (isName(host) || isCode(host) || isRoom(host)) && via != "" {
+		s.errorln("Error names, codes and rooms cannot be resolved without revealing this host to the relay of the host, connect to the IP and port of the host to chain through " + via)
+		return
+	}
+	if isName(host) {
+		h, p, err := resolveName(s, host)
+		if err != nil {
+			s.errorln("Error resolving " + host + ": " + err.Error())
+			return
+		}
+		host, port = h, p
+	} else if isCode(host) {
+		h, p, err := resolveCode(s, host)
+		if err != nil {
+			s.errorln("Error resolving " + host + ": " + err.Error())
+			return
+		}
+		host, port = h, p
+	} else if isRoom(host) {
+		h, p, err := resolveRoom(s, host)
+		if err != nil {
+			s.errorln("Error joining " + host + ": " + err.Error())
+			return
+		}
+		host, port = h, p
+	}
+
+	relayAddr, err := resolveRelay(s)
+	if err != nil {
+		s.errorln("Error resolving relay, only trying to connect directly: " + err.Error())
+		relayAddr = nil
+	}
+	if relayAddr != nil {
+		var closeRelay func()
+		relayAddr, closeRelay, err = setupRelay(s, relayAddr)
+		defer closeRelay()
+		if err != nil {
+			s.errorln("Error " + err.Error() + "; only trying to connect directly")
+			relayAddr = nil
+		}
+	}
+
+	network := "udp4"
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		network = "udp6"
+	}
+	remoteAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if remoteAddr.IP.To4() == nil {
+		if private || via != "" {
+			s.errorln("Error relayed sessions need the IPv4 address of the host")
+			return
+		}
+		if !dualStack(c) {
+			s.errorln("Error cannot connect to IPv6 address " + host + ": IPv6 is disabled on this system")
+			return
+		}
+		// relays only know hosts by their IPv4 address
+		s.println("Connecting to IPv6 address " + host + " directly, without the relay: the host must accept incoming packets on UDP port " + strconv.Itoa(defaultPort))
+		relayAddr = nil
+	}
+	if private || via != "" {
+		runRelayed(s, c, channelId(remoteAddr.IP, remoteAddr.Port), "peer "+remoteAddr.String())
+		return
+	}
+	directAddr := &net.UDPAddr{
+		IP:   remoteAddr.IP,
+		Port: defaultPort,
+	}
+
+	relayPayload := make([]byte, 16)
+	copy(relayPayload, relayMagic)
+	binary.BigEndian.PutUint16(relayPayload[4:6], uint16(port))
+	copy(relayPayload[6:10], remoteAddr.IP.To4())
+	if relayAddr != nil {
+		putAddr(relayPayload[10:16], localCandidate(c, relayAddr))
+	}
+	reg := newRegistration(relayPayload, relayIpv6Candidate(s, c))
+
+	var relays *relaySwitch
+	if relayAddr != nil {
+		reg.relay4, reg.relay6 = relayAddr, resolveRelayIpv6(s)
+		reg.legacy = s.legacyRelay
+		relays = newRelaySwitch(s, relayAddr)
+		relays.findHost()
+	}
+	chRelay := make(chan struct{})
+	go func() {
+		probePayload := []byte{typeProbe, byte(port >> 8), byte(port)}
+		for {
+			select {
+			case <-chRelay:
+				return
+			default:
+			}
+			if relays != nil {
+				relays.check()
+				for _, addr := range relays.registering() {
+					reg.sendIpv6(c, addr)
+					c.WriteToUDP(sealRelay(reg.payload(), addr), addr)
+				}
+				// the relay only answers a client once the host registered:
+				// check that it is still up with an echo message
+				c.WriteToUDP(sealRelay([]byte{0}, relays.current()), relays.current())
+			}
+			c.WriteToUDP(probePayload, directAddr)
+			time.Sleep(keepaliveMin)
+		}
+	}()
+	defer close(chRelay)
+
+	buffer := make([]byte, 4096)
+	for {
+		p := connectClient(s, c, relayAddr, relays, remoteAddr, port, reg, buffer)
+		if p.fallingBack() {
+			runFallback(s, c, p.relayAddr, p.fallback, nil, 0)
+			return
+		}
+		if !p.reconnecting() {
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if relayAddr != nil {
+			// the network of this host may have changed
+			reg.moved(localCandidate(c, relayAddr), relayIpv6Candidate(s, c))
+		}
+	}
+}
+
+// connectClient waits for the address of the host from the relay or its
+// direct probe reply, then runs the session until it ends.
+func connectClient(s *session, c *net.UDPConn, relayAddr *net.UDPAddr, relays *relaySwitch, remoteAddr *net.UDPAddr, port int, reg *registration, buffer []byte) *proxy {
+	// the port of the host is set from the relay or its reply
+	remoteAddr = &net.UDPAddr{IP: remoteAddr.IP}
+	directAddr := &net.UDPAddr{
+		IP:   remoteAddr.IP,
+		Port: defaultPort,
+	}
+
+	var peerAddrs []*net.UDPAddr
+	// predict is set when the peer address comes from the relay
+	predict := false
+
+	chWait := make(chan struct{})
+	if relayAddr != nil {
+		go watchRelay(s, c, relayAddr, chWait)
+	}
+	for {
+		n, addr, err := c.ReadFromUDP(buffer)
+		if err != nil {
+			// err is thrown if the buffer is too small
+			continue
+		}
+		if n == 3 && buffer[0] == typeProbeReply && int(binary.BigEndian.Uint16(buffer[1:3])) == port && addr.IP.Equal(remoteAddr.IP) {
+			s.println("Peer is directly reachable, skipping the relay")
+			remoteAddr = addr
+			peerAddrs = []*net.UDPAddr{remoteAddr}
+			break
+		}
+		if relayAddr == nil {
+			continue
+		}
+		if relays.from(addr) {
+			plain := openRelay(buffer[:n], addr)
+			if plain == nil {
+				continue
+			}
+			if s.legacyRelay {
+				if m := legacyReply(plain, false, 0); m != nil {
+					plain = m
+				}
+			}
+			n = copy(buffer, plain)
+		}
+		if n == 1 && relays.from(addr) {
+			// an echo message from the relay
+			continue
+		}
+		if !relays.settle(addr) {
+			continue
+		}
+		// the host may have registered on another relay of -relay
+		relayAddr = relays.current()
+		var ipv6 *net.UDPAddr
+		if n == 30 && string(buffer[:4]) == relayMagic6 {
+			reg.answer()
+			ipv6 = getAddr6(buffer[12:30])
+		} else if n != 12 || string(buffer[:4]) != relayMagic {
+			s.errorln("Error received packet of wrong size from relay. (size:" + strconv.Itoa(n) + ")")
+			continue
+		}
+		remoteAddr.Port = int(binary.BigEndian.Uint16(buffer[4:6]))
+		if !dualStack(c) {
+			ipv6 = nil
+		}
+		peerAddrs = candidates(getAddr(buffer[6:12]), ipv6, remoteAddr)
+		if remoteAddr.Port != defaultPort {
+			// the host may have forwarded the default port with UPnP
+			public := peerAddrs[len(peerAddrs)-1]
+			peerAddrs = append(peerAddrs[:len(peerAddrs)-1], directAddr, public)
+		}
+		predict = true
+		break
+	}
+	close(chWait)
+	if verbose {
+		for _, addr := range peerAddrs[:len(peerAddrs)-1] {
+			s.println("Also trying the peer address " + addr.String())
+		}
+	}
+	s.setState("connecting to peer " + remoteAddr.String())
+
+	chPunch := make(chan struct{})
+	go punch(c, peerAddrs, s.punchPayload(), chPunch)
+
+	p := newProxy(s, c, relayAddr, peerAddrs, nil, 0)
+	p.verifyHost = password != ""
+	p.relays = relays
+	p.predict = predict
+	if predict {
+		p.fallback = channelId(remoteAddr.IP, port)
+	}
+	p.run(buffer)
+	close(chPunch)
+	return p
+}
+
+// punch sends punch packets with payload to the peer candidates until done is
+// closed, backing off after punchRetries rounds.
+func punch(c packetConn, peerAddrs []*net.UDPAddr, payload []byte, done chan struct{}) {
+	interval := punchInterval
+	for round := 0; ; round++ {
+		for _, addr := range peerAddrs {
+			c.WriteToUDP(payload, addr)
+		}
+		interval = punchBackoff(round, interval)
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func server(s *session, port int) {
+	c := listenProxy(s)
+	defer c.Close()
+
+	s.println("Listening, start hosting on port " + strconv.Itoa(port))
+	for _, extra := range hostPorts(port) {
+		s.println("Also forwarding game port " + strconv.Itoa(extra))
+	}
+	if targetIP != nil {
+		s.println("Forwarding to the game at " + (&net.UDPAddr{IP: targetIP, Port: port}).String())
+	} else if owner := portOwner(port); owner != "" && !targeting() {
+		s.println("Port " + strconv.Itoa(port) + " is currently used by " + owner + "; if this is not your game, restart proxypunch with another port, or with -port auto to choose a free port")
+	}
+	if s.preset != nil {
+		s.println(s.preset.hostHelp(port))
+		if targetIP == nil {
+			waitForGame(s, port)
+		}
+	}
+	s.println("Connecting...")
+	s.setState("connecting to relay")
+	if !private {
+		defer forwardPort(s, c)()
+	}
+
+	localAddr := &net.UDPAddr{
+		IP:   gameIP(),
+		Port: port,
+	}
+
+	relayAddr, err := resolveRelay(s)
+	if err != nil {
+		s.errorln("Error resolving relay: " + err.Error())
+		s.errorln("Peers can only connect if this host is publicly reachable on UDP port " + strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port))
+		relayAddr = nil
+	}
+	if relayAddr != nil {
+		var closeRelay func()
+		relayAddr, closeRelay, err = setupRelay(s, relayAddr)
+		defer closeRelay()
+		if err != nil {
+			s.errorln("Error " + err.Error())
+			s.errorln("Peers can only connect if this host is publicly reachable on UDP port " + strconv.Itoa(c.LocalAddr().(*net.UDPAddr).Port))
+			relayAddr = nil
+		}
+	}
+	if relayAddr != nil && private && !s.relayHas(capChannels, "-private") {
+		return
+	}
+
+	var relays *relaySwitch
+	var reg *registration
+	var keep *keepalive
+	chRelay := make(chan struct{})
+	if relayAddr != nil {
+		relays = newRelaySwitch(s, relayAddr)
+		relayPayload := make([]byte, 12)
+		copy(relayPayload, relayMagic)
+		binary.BigEndian.PutUint16(relayPayload[4:6], uint16(port))
+		putAddr(relayPayload[6:12], localCandidate(c, relayAddr))
+		reg = newRegistration(relayPayload, relayIpv6Candidate(s, c))
+		reg.relay4, reg.relay6 = relayAddr, resolveRelayIpv6(s)
+		reg.legacy = s.legacyRelay
+		keep = newKeepalive(s)
+		relays.keep = keep
+		go func() {
+			for {
+				select {
+				case <-chRelay:
+					return
+				default:
+				}
+				relays.check()
+				current := relays.current()
+				reg.sendIpv6(c, current)
+				c.WriteToUDP(sealRelay(reg.payload(), current), current)
+				time.Sleep(keep.next())
+			}
+		}()
+		if publish && s.relayHas(capLobby, "-publish") {
+			go publishSession(s, c, relayAddr, port, chRelay)
+		}
+		if name != "" && s.relayHas(capNames, "-name") {
+			go claimName(s, c, relayAddr, port, chRelay)
+		}
+		// the code points to the address of this host, which private
+		// sessions hide
+		if !private && s.relayCaps&capCodes != 0 {
+			go requestCode(s, relayAddr, port, chRelay)
+		}
+		// the room points to the address of this host too
+		if room != "" && private {
+			s.errorln("Error rooms point to the address of the host, which -private hides: not hosting room " + room)
+		} else if room != "" && s.relayHas(capRooms, "-room") {
+			go claimRoom(s, relayAddr, port, chRelay)
+		}
+	}
+	defer close(chRelay)
+
+	buffer := make([]byte, 4096)
+	receivedIp := false
+	claimReported := false
+	directReported := false
+	// channel is the ID of the relayed channel peers can connect through, and
+	// channelRelay the relay it is open on
+	var channel []byte
+	var channelRelay *net.UDPAddr
+	// localPort follows the game process across reconnections
+	localPort := port
+	// peers are the sessions of the peers with -max-peers, nil without
+	var peers *peerTable
+	if maxPeers > 1 || spectators > 0 {
+		peers = &peerTable{}
+	}
+	for {
+		var remoteAddr net.UDPAddr
+		var peerAddrs []*net.UDPAddr
+		// predict is set when the peer address comes from the relay
+		predict := false
+		relayed := false
+		// spectator is set when the peer joins as a spectator with -spectators
+		spectator := false
+		// probes are the addresses that probed this host, by IP address,
+		// answered once the relay announces a peer from there
+		probes := make(map[string]*net.UDPAddr)
+		chWait := make(chan struct{})
+		if relayAddr != nil {
+			go watchRelay(s, c, relayAddr, chWait)
+		}
+		for {
+			n, addr, err := c.ReadFromUDP(buffer)
+			if err != nil {
+				// err is thrown if the buffer is too small
+				continue
+			}
+			if peers != nil && peers.dispatch(s, buffer[:n], addr) {
+				continue
+			}
+			if n == 3 && buffer[0] == typeProbe && int(binary.BigEndian.Uint16(buffer[1:3])) == port && !private {
+				if !admitted(addr.IP, nil) {
+					continue
+				}
+				if relayAddr != nil {
+					// only answered once the relay announces the peer, so
+					// that a stray probe cannot be taken for a peer
+					if len(probes) < maxProbes {
+						probes[addr.IP.String()] = addr
+					}
+					continue
+				}
+				if peers != nil {
+					var ok bool
+					if ok, spectator = peers.admit(s, addr); !ok {
+						continue
+					}
+				}
+				// this host is publicly reachable: answer the peer directly
+				c.WriteToUDP([]byte{typeProbeReply, byte(port >> 8), byte(port)}, addr)
+				s.println("Peer connected directly, skipping the relay")
+				remoteAddr = *addr
+				peerAddrs = []*net.UDPAddr{&remoteAddr}
+				break
+			}
+			if relayAddr == nil || !relays.from(addr) {
+				continue
+			}
+			if current := relays.current(); !addr.IP.Equal(current.IP) || addr.Port != current.Port {
+				// a relay replaced by a backup relay
+				continue
+			}
+			// the relay may have been replaced by a backup relay
+			relayAddr = addr
+			plain := openRelay(buffer[:n], addr)
+			if plain == nil {
+				continue
+			}
+			if s.legacyRelay {
+				if m := legacyReply(plain, true, c.LocalAddr().(*net.UDPAddr).Port); m != nil {
+					plain = m
+				}
+			}
+			n = copy(buffer, plain)
+			if n == 6 && string(buffer[:4]) == nameMagic && buffer[4] == nameClaimed {
+				if !claimReported && buffer[5] != nameOk {
+					claimReported = true
+					if buffer[5] == nameTaken {
+						s.errorln("Error name " + name + " is already registered on this relay by someone else")
+					} else {
+						s.errorln("Error the relay rejected the claim of name " + name + ", check that the system clock is correct")
+					}
+				}
+				continue
+			}
+			if isChannel(buffer[:n], channel) {
+				if allowed != nil {
+					// the address of the peer is hidden by the relay
+					if verbose {
+						s.println("Ignoring a peer connecting through the relay, whose address -allow cannot check")
+					}
+					continue
+				}
+				if peers != nil {
+					if !directReported {
+						directReported = true
+						s.errorln("Error a peer could not connect directly and tried to connect through the relay, which -max-peers does not support")
+					}
+					continue
+				}
+				s.println("Peer connected through the relay, its address stays hidden")
+				relayed = true
+				break
+			}
+			if n == 10 && (string(buffer[:4]) == relayMagic || string(buffer[:4]) == relayMagic6) {
+				if string(buffer[:4]) == relayMagic6 {
+					reg.answer()
+				}
+				keep.observed(getAddr(buffer[4:10]).Port)
+				if !receivedIp {
+					receivedIp = true
+					external := getAddr(buffer[4:10])
+					s.setExternal(external)
+					channel = channelId(external.IP, port)
+					channelRelay = relayAddr
+					go openChannel(c, relayAddr, channel, chRelay)
+					s.println("Connected. Ask your peer to connect to " + external.IP.String() + " on port " + strconv.Itoa(port) + " with proxypunch")
+					s.decoration("----")
+					s.println("Host: " + external.IP.String())
+					s.println("Port: " + strconv.Itoa(port))
+					s.println("External UDP address: " + external.String())
+					s.println("Link: " + hostUri(external.IP.String(), port, s))
+					s.decoration("----")
+					if private {
+						s.println("This session is private: your peer must connect with -private or with the link, the traffic stays relayed so that neither of you learns the other's address")
+					}
+					s.setState("waiting for peer to connect to " + external.IP.String() + " on port " + strconv.Itoa(port))
+				} else if !channelRelay.IP.Equal(relayAddr.IP) || channelRelay.Port != relayAddr.Port {
+					// registered on a backup relay: let peers fall back to it
+					channelRelay = relayAddr
+					go openChannel(c, relayAddr, channel, chRelay)
+				} else if external := getAddr(buffer[4:10]); s.externalChanged(external) {
+					s.errorln("Error your public address changed to " + external.IP.String() + ", for example after switching networks: peers must now connect to " + external.IP.String() + " on port " + strconv.Itoa(port) + ", your current peer too if it lost the connection")
+					s.setState("waiting for peer to connect to " + external.IP.String() + " on port " + strconv.Itoa(port))
+				}
+				continue
+			}
+			var ipv6 *net.UDPAddr
+			if n == 34 && string(buffer[:4]) == relayMagic6 {
+				ipv6 = getAddr6(buffer[16:34])
+			} else if n != 16 || string(buffer[:4]) != relayMagic {
+				s.errorln("Error received packet of wrong size from relay. (size:" + strconv.Itoa(n) + ")")
+				continue
+			}
+			if private {
+				if !directReported {
+					directReported = true
+					s.errorln("Error a peer tried to connect directly, ignoring it: this session is private, ask your peer to connect with -private")
+				}
+				continue
+			}
+			ip := make([]byte, 4)
+			copy(ip, buffer[6:10])
+			remoteAddr = net.UDPAddr{
+				IP:   net.IP(ip),
+				Port: int(binary.BigEndian.Uint16(buffer[4:6])),
+			}
+			if !dualStack(c) {
+				ipv6 = nil
+			}
+			var ipv6IP net.IP
+			if ipv6 != nil {
+				ipv6IP = ipv6.IP
+			}
+			if !admitted(remoteAddr.IP, ipv6IP) {
+				continue
+			}
+			if peers != nil {
+				var ok bool
+				if ok, spectator = peers.admit(s, &remoteAddr); !ok {
+					continue
+				}
+			}
+			peerAddrs = candidates(getAddr(buffer[10:16]), ipv6, &remoteAddr)
+			if probe := probes[remoteAddr.IP.String()]; probe != nil {
+				// this host is publicly reachable: answer the peer directly,
+				// and try the address of its probe first
+				c.WriteToUDP([]byte{typeProbeReply, byte(port >> 8), byte(port)}, probe)
+				s.println("Peer connected directly, skipping the relay")
+				peerAddrs = append([]*net.UDPAddr{probe}, peerAddrs...)
+			}
+			predict = true
+			break
+		}
+		close(chWait)
+		if peers != nil {
+			if verbose {
+				for _, addr := range peerAddrs[:len(peerAddrs)-1] {
+					s.println("Also trying the peer address " + addr.String())
+				}
+			}
+			if pc := peers.open(s, c, peerAddrs, spectator); pc != nil {
+				go servePeer(s, peers, pc, localAddr, localPort, predict)
+			}
+			continue
+		}
+		var pc packetConn = c
+		if relayed {
+			pc = newRelayedConn(c, relayAddr, channel, nil)
+			peerAddrs = []*net.UDPAddr{relayAddr}
+			s.setState("connecting to peer through the relay")
+		} else {
+			if verbose {
+				for _, addr := range peerAddrs[:len(peerAddrs)-1] {
+					s.println("Also trying the peer address " + addr.String())
+				}
+			}
+			s.setState("connecting to peer " + remoteAddr.String())
+		}
+
+		chPunch := make(chan struct{})
+		go punch(pc, peerAddrs, s.punchPayload(), chPunch)
+
+		var p *proxy
+		if relayed {
+			p = newProxy(s, pc, nil, peerAddrs, localAddr, localPort)
+			p.relayed = true
+		} else {
+			p = newProxy(s, pc, relayAddr, peerAddrs, localAddr, localPort)
+			p.relays = relays
+			p.predict = predict
+			if predict {
+				p.fallback = channel
+			}
+		}
+		p.giveUp = true
+		p.authenticate = p.secret != nil
+		p.confirmPeer = confirmPeers()
+		if targeting() {
+			go followProcess(p)
+		}
+		p.run(buffer)
+		close(chPunch)
+		localAddr, localPort = p.local()
+		if p.fallingBack() {
+			runFallback(s, c, relayAddr, channel, localAddr, localPort)
+			return
+		}
+		if !p.reconnecting() {
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if reg != nil {
+			// the network of this host may have changed
+			reg.moved(localCandidate(c, relayAddr), relayIpv6Candidate(s, c))
+		}
+	}
+}
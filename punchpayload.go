@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// keepalivePayload is the payload of the punch packets set with
+// -keepalive-payload. Punch packets open and keep the NAT mappings toward the
+// peer alive during the whole session, and are also sent to addresses of the
+// peer that may lead to its game rather than to its proxypunch, e.g. a
+// forwarded game port; games that mistake them for their own packets can be
+// given another payload, or silent for zero-length datagrams.
+var keepalivePayload string
+
+// silentPayload selects zero-length punch packets.
+const silentPayload = "silent"
+
+// maxKeepalivePayload bounds the size of a custom punch payload.
+const maxKeepalivePayload = 64
+
+// parseKeepalivePayload parses a punch payload: empty for the default
+// typePunch byte, silent, or hexadecimal bytes.
+func parseKeepalivePayload(v string) ([]byte, error) {
+	switch v {
+	case "":
+		return []byte{typePunch}, nil
+	case silentPayload:
+		return []byte{}, nil
+	}
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(v), "0x"))
+	if err != nil || len(b) == 0 || len(b) > maxKeepalivePayload {
+		return nil, errors.New("invalid keepalive payload " + v + ", must be silent or up to 64 hexadecimal bytes, e.g. 7f00")
+	}
+	if b[0] >= typeData && b[0] <= typeMtuReply {
+		// the peer would handle it as a packet of proxypunch
+		return nil, errors.New("invalid keepalive payload " + v + ", its first byte must not be between cc and db, which proxypunch uses")
+	}
+	return b, nil
+}
+
+// applyKeepalivePayload checks the punch payload set with -keepalive-payload.
+func applyKeepalivePayload() error {
+	_, err := parseKeepalivePayload(keepalivePayload)
+	return err
+}
+
+// punchPayload returns the payload of the punch packets of the session.
+func (s *session) punchPayload() []byte {
+	v := keepalivePayload
+	if s.keepalive != "" {
+		v = s.keepalive
+	}
+	b, err := parseKeepalivePayload(v)
+	if err != nil {
+		return []byte{typePunch}
+	}
+	return b
+}
+
+// isPunch returns whether data is a punch packet, with the default payload or
+// the payload of the session s: the peer uses the same game profile.
+func isPunch(s *session, data []byte) bool {
+	return len(data) == 0 || (len(data) == 1 && data[0] == typePunch) || bytes.Equal(data, s.punchPayload())
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Default punch timing, suited to most home connections.
+const (
+	defaultPunchTimeout  = 10 * time.Second
+	defaultPunchRetries  = 10
+	defaultPunchInterval = 500 * time.Millisecond
+)
+
+// punchMaxInterval bounds the interval between punch rounds once backing off.
+const punchMaxInterval = 5 * time.Second
+
+// punchTimeout is the time spent trying to reach the peer directly before
+// relaying the traffic. punchRetries is the count of punch rounds sent every
+// punchInterval, after which the interval doubles every round.
+var punchTimeout = defaultPunchTimeout
+var punchRetries = defaultPunchRetries
+var punchInterval = defaultPunchInterval
+
+// applyPunchConfig sets the punch timing that was left to its default by the
+// flags from config.
+func applyPunchConfig(config Config) {
+	if punchTimeout == defaultPunchTimeout && config.PunchTimeout != "" {
+		punchTimeout = parsePunchDuration("punch_timeout", config.PunchTimeout, defaultPunchTimeout)
+	}
+	if punchRetries == defaultPunchRetries && config.PunchRetries > 0 {
+		punchRetries = config.PunchRetries
+	}
+	if punchInterval == defaultPunchInterval && config.PunchInterval != "" {
+		punchInterval = parsePunchDuration("punch_interval", config.PunchInterval, defaultPunchInterval)
+	}
+}
+
+// applyPunch checks the punch timing set with flags.
+func applyPunch() error {
+	if punchTimeout <= 0 || punchInterval <= 0 || punchRetries < 0 {
+		return errors.New("-punch-timeout and -punch-interval must be positive, and -punch-retries must not be negative")
+	}
+	return nil
+}
+
+func parsePunchDuration(key string, value string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		fmt.Fprintln(os.Stderr, "Error invalid "+key+" "+value+" in the configuration file, using the default "+def.String())
+		return def
+	}
+	return d
+}
+
+// punchBackoff returns the interval after the punch round round, from 0.
+func punchBackoff(round int, interval time.Duration) time.Duration {
+	if round < punchRetries || interval >= punchMaxInterval {
+		return interval
+	}
+	if interval *= 2; interval > punchMaxInterval {
+		interval = punchMaxInterval
+	}
+	return interval
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultQueueDepth = 256
+
+const defaultQueueMemory = 8 * 1024 * 1024
+
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+	// due is the time at which the packet should be sent.
+	due time.Time
+}
+
+// memoryBudget is the total amount of packet data that can be queued at once,
+// shared between all queues.
+type memoryBudget struct {
+	sync.Mutex
+	limit int
+	used  int
+}
+
+// packetQueue is a bounded packet queue that drops its oldest packets when
+// it is full or when the memory budget is exhausted.
+type packetQueue struct {
+	sync.Mutex
+	cond    *sync.Cond
+	packets []packet
+	depth   int
+	budget  *memoryBudget
+	closed  bool
+	dropped int
+	// delay is the artificial latency added to each packet.
+	delay time.Duration
+}
+
+func newMemoryBudget(limit int) *memoryBudget {
+	return &memoryBudget{
+		limit: limit,
+	}
+}
+
+func (b *memoryBudget) reserve(n int) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *memoryBudget) release(n int) {
+	b.Lock()
+	b.used -= n
+	b.Unlock()
+}
+
+func newPacketQueue(depth int, budget *memoryBudget, delay time.Duration) *packetQueue {
+	if depth <= 0 {
+		depth = 1
+	}
+	q := &packetQueue{
+		depth:  depth,
+		budget: budget,
+		delay:  delay,
+	}
+	q.cond = sync.NewCond(q)
+	return q
+}
+
+// push queues a copy of data to be sent to addr.
+func (q *packetQueue) push(data []byte, addr *net.UDPAddr) {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return
+	}
+	for len(q.packets) >= q.depth {
+		q.dropOldest()
+	}
+	for !q.budget.reserve(len(data)) {
+		if len(q.packets) == 0 {
+			q.dropped++
+			return
+		}
+		q.dropOldest()
+	}
+	q.packets = append(q.packets, packet{
+		data: append([]byte(nil), data...),
+		addr: addr,
+		due:  time.Now().Add(q.delay),
+	})
+	q.cond.Signal()
+}
+
+func (q *packetQueue) dropOldest() {
+	q.budget.release(len(q.packets[0].data))
+	q.packets[0] = packet{}
+	q.packets = q.packets[1:]
+	q.dropped++
+}
+
+// pop blocks until a packet is available, and returns false once the queue
+// is closed.
+func (q *packetQueue) pop() (packet, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for len(q.packets) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return packet{}, false
+	}
+	p := q.packets[0]
+	q.packets[0] = packet{}
+	q.packets = q.packets[1:]
+	q.budget.release(len(p.data))
+	return p, true
+}
+
+// takeDropped returns the count of dropped packets since the last call.
+func (q *packetQueue) takeDropped() int {
+	q.Lock()
+	defer q.Unlock()
+	dropped := q.dropped
+	q.dropped = 0
+	return dropped
+}
+
+func (q *packetQueue) close() {
+	q.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.Unlock()
+}
+
+func setBuffers(c *net.UDPConn) {
+	if readBuffer > 0 {
+		c.SetReadBuffer(readBuffer)
+	}
+	if writeBuffer > 0 {
+		c.SetWriteBuffer(writeBuffer)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// bucketExpiry is the idle time after which a source's bucket is forgotten.
+const bucketExpiry = 30 * time.Second
+
+// rateLimiter is a per-source token bucket limiter; a burst of up to one
+// second worth of traffic is allowed, and of at least maxPacket bytes, so
+// that packets larger than the byte rate are throttled rather than never
+// allowed.
+type rateLimiter struct {
+	s *session
+	// packets and bytes are the allowed rates per second; 0 disables the limit.
+	packets float64
+	bytes   float64
+	// byteBurst is the capacity of the byte buckets.
+	byteBurst float64
+
+	buckets   map[string]*bucket
+	flushTime time.Time
+}
+
+type bucket struct {
+	packets float64
+	bytes   float64
+	time    time.Time
+	limited bool
+}
+
+func newRateLimiter(s *session, packets int, bytes int) *rateLimiter {
+	if packets <= 0 && bytes <= 0 {
+		return nil
+	}
+	byteBurst := float64(bytes)
+	if byteBurst < maxPacket {
+		byteBurst = maxPacket
+	}
+	return &rateLimiter{
+		s:         s,
+		packets:   float64(packets),
+		bytes:     float64(bytes),
+		byteBurst: byteBurst,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+// allow returns whether a packet of size n from addr is within the limits.
+// A nil limiter allows everything.
+func (l *rateLimiter) allow(addr *net.UDPAddr, n int) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(l.flushTime) > bucketExpiry {
+		l.flushTime = now
+		for k, v := range l.buckets {
+			if now.Sub(v.time) > bucketExpiry {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	key := addr.String()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{
+			packets: l.packets,
+			bytes:   l.byteBurst,
+			time:    now,
+		}
+		l.buckets[key] = b
+	} else {
+		elapsed := now.Sub(b.time).Seconds()
+		b.time = now
+		b.packets = refill(b.packets, l.packets, l.packets, elapsed)
+		b.bytes = refill(b.bytes, l.bytes, l.byteBurst, elapsed)
+	}
+
+	if (l.packets > 0 && b.packets < 1) || (l.bytes > 0 && b.bytes < float64(n)) {
+		if !b.limited {
+			b.limited = true
+			if verbose {
+				l.s.println("Rate limiting packets from " + key + ".")
+			}
+		}
+		return false
+	}
+	b.limited = false
+	b.packets--
+	b.bytes -= float64(n)
+	return true
+}
+
+// refill returns the tokens of a bucket of capacity burst after elapsed
+// seconds at rate.
+func refill(tokens float64, rate float64, burst float64, elapsed float64) float64 {
+	tokens += rate * elapsed
+	if tokens > burst {
+		tokens = burst
+	}
+	return tokens
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// stallTimeout is how long the connected peer must have been silent for the
+// session to punch it again, for example after its router rebooted or its
+// NAT mapping expired.
+const stallTimeout = 5 * pingInterval
+
+// watchStall ends the session if the connected peer stops responding, so that
+// the peer is punched again on the same proxy socket, until done is closed.
+func (p *proxy) watchStall(done chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		p.peerMu.Lock()
+		stalled := p.connected && time.Since(p.lastPeer) > stallTimeout
+		p.peerMu.Unlock()
+		if stalled {
+			p.reconnect("Error " + p.peerName() + " stopped responding for " + strconv.Itoa(int(stallTimeout/time.Second)) + " seconds, trying to reach it again; the game keeps its connection to proxypunch")
+			return
+		}
+	}
+}
+
+// watchConnect ends the session of a host if the peer is not reached within
+// punchTimeout, so that it waits for other peers, until done is closed: a
+// peer that never completes the punch, or a stray packet taken for one, must
+// not hold the host forever.
+func (p *proxy) watchConnect(done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-time.After(punchTimeout):
+	}
+	if _, connected := p.connectedPeer(); connected {
+		return
+	}
+	p.peerMu.Lock()
+	if p.stalled {
+		p.peerMu.Unlock()
+		return
+	}
+	p.stalled = true
+	p.peerMu.Unlock()
+	p.s.errorln("Error could not reach " + p.peerName() + " within " + punchTimeout.String() + ", waiting for other peers")
+	p.s.setState("waiting for peer")
+	p.interrupt()
+}
+
+// reconnect ends the session, printing reason, so that the peer is punched
+// again on the same proxy socket, unless it is already ending to.
+func (p *proxy) reconnect(reason string) {
+	p.peerMu.Lock()
+	if p.stalled {
+		p.peerMu.Unlock()
+		return
+	}
+	p.stalled = true
+	p.peerMu.Unlock()
+	p.s.errorln(reason)
+	p.s.setState("reconnecting to " + p.peerName())
+	p.interrupt()
+}
+
+// reconnecting returns whether the session ended to punch the peer again.
+func (p *proxy) reconnecting() bool {
+	p.peerMu.Lock()
+	defer p.peerMu.Unlock()
+	return p.stalled
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// redundancy is set with -redundancy: each game packet is sent this many
+// times to the peer, which keeps the first copy it receives; 0 and 1 disable
+// it.
+var redundancy int
+
+// maxRedundancy bounds the copies sent with -redundancy.
+const maxRedundancy = 8
+
+// redundantWindow is the count of redundant packets older than the latest one
+// whose copies are still recognized.
+const redundantWindow = 64
+
+// redundantSender numbers the game packets sent with -redundancy.
+type redundantSender struct {
+	// sequence is the number of the last packet, accessed atomically.
+	sequence uint32
+}
+
+// wrap returns the copies of the typeRedundant packet carrying the game
+// packet: its sequence number (4 bytes), then the packet.
+func (rs *redundantSender) wrap(packet []byte, copies int) [][]byte {
+	b := make([]byte, 5, 5+len(packet))
+	b[0] = typeRedundant
+	binary.BigEndian.PutUint32(b[1:5], atomic.AddUint32(&rs.sequence, 1))
+	b = append(b, packet...)
+	packets := make([][]byte, copies)
+	for i := range packets {
+		packets[i] = b
+	}
+	return packets
+}
+
+// redundantReceiver keeps the first copy of the game packets the peer sent
+// with -redundancy.
+type redundantReceiver struct {
+	mu       sync.Mutex
+	started  bool
+	received uint32
+	window   uint64
+}
+
+// receive returns the game packet carried by the typeRedundant packet data,
+// or nil if invalid or a copy of it was already received.
+func (rr *redundantReceiver) receive(data []byte) []byte {
+	if len(data) < 6 {
+		return nil
+	}
+	sequence := binary.BigEndian.Uint32(data[1:5])
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	ahead := int32(sequence - rr.received)
+	switch {
+	case !rr.started || ahead <= -redundantWindow:
+		// the first packet, or a packet from a restarted peer
+		rr.started = true
+		rr.received, rr.window = sequence, 1
+	case ahead > 0:
+		if ahead < redundantWindow {
+			rr.window = rr.window<<uint(ahead) | 1
+		} else {
+			rr.window = 1
+		}
+		rr.received = sequence
+	default:
+		bit := uint64(1) << uint(-ahead)
+		if rr.window&bit != 0 {
+			return nil
+		}
+		rr.window |= bit
+	}
+	return data[5:]
+}
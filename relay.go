@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// relay is the relay host and port, set with -relay or relay: in the
+// configuration file, relayHost otherwise; relayIps are pinned relay IPs used
+// when resolving the relay host fails or returns a suspicious address.
+var relay string
+var relayIps []string
+
+// resolveRelay resolves the relay address, or the relay of the session if
+// set. Captive portals and hijacking resolvers answer with private addresses,
+// in which case (or if resolution fails) the pinned relay IPs are used
+// instead.
+func resolveRelay(s *session) (*net.UDPAddr, error) {
+	waitRelays()
+	if s.relay == "" && len(relayChoices) > 1 {
+		selectRelay(s)
+	}
+	hostPort := relay
+	if s.relay != "" {
+		hostPort = s.relay
+	}
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("invalid relay port: " + portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", hostPort)
+	if err == nil && !suspiciousIp(addr.IP) {
+		return addr, nil
+	}
+	for _, v := range relayIps {
+		if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+			if err != nil {
+				s.errorln("Error resolving relay " + host + " (" + err.Error() + "), using pinned relay IP " + v)
+			} else {
+				s.errorln("Relay " + host + " resolved to unexpected address " + addr.IP.String() + ", using pinned relay IP " + v)
+			}
+			return &net.UDPAddr{IP: ip, Port: port}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
+
+// setupRelay prepares the relay of the session for a session: it reaches it
+// over TLS if UDP to the relay is blocked, negotiates its version, exchanges
+// keys to seal the registrations and authenticates this host. It returns the
+// address to send the messages of the relay to, and a function to call once
+// the session ends.
+func setupRelay(s *session, relayAddr *net.UDPAddr) (*net.UDPAddr, func(), error) {
+	relayAddr, closeTunnel := reachRelay(s, relayAddr)
+	if err := negotiateRelay(s, relayAddr); err != nil {
+		return relayAddr, closeTunnel, err
+	}
+	if relayKey != "" {
+		if s.relayCaps&capSeal == 0 {
+			return relayAddr, closeTunnel, errors.New("relay " + relayName(s) + " is too old for -relay-key: ask its operator to update it, or use another relay with -relay")
+		}
+		if err := pinRelay(s, relayAddr); err != nil {
+			return relayAddr, closeTunnel, err
+		}
+	} else if s.relayCaps&capSeal != 0 {
+		if err := sealRelayMessages(relayAddr); err != nil {
+			s.errorln("Error exchanging keys with relay " + relayName(s) + ", registering in clear: " + err.Error())
+		}
+	}
+	done := make(chan struct{})
+	if err := authenticateRelay(s, relayAddr, done); err != nil {
+		return relayAddr, closeTunnel, err
+	}
+	return relayAddr, func() {
+		close(done)
+		closeTunnel()
+	}, nil
+}
+
+// resolveRelayIpv6 returns the IPv6 address of the relay of the session, or
+// nil if it does not listen on IPv6 or has no IPv6 address.
+func resolveRelayIpv6(s *session) *net.UDPAddr {
+	if s.relayCaps&capDualStack == 0 {
+		return nil
+	}
+	hostPort := relay
+	if s.relay != "" {
+		hostPort = s.relay
+	}
+	addr, err := net.ResolveUDPAddr("udp6", hostPort)
+	if err != nil || addr.IP.To4() != nil {
+		return nil
+	}
+	return addr
+}
+
+// resolveRelayHost resolves a relay given by the user, on the default relay
+// port if none is given.
+func resolveRelayHost(hostPort string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, defaultRelayPort)
+	}
+	return net.ResolveUDPAddr("udp4", hostPort)
+}
+
+// suspiciousIp returns whether ip cannot be the address of a public relay.
+func suspiciousIp(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast()
+}
+
+// relayMagic prefixes the extended relay messages, which carry the local
+// network address of the peers along with their registration:
+//   - server registration: magic, port, local address
+//   - client registration: magic, port, server IP, local address
+//   - reply to a server, until a client registers: magic, server public address
+//   - reply to a server: magic, client NAT port, client IP, client local address
+//   - reply to a client: magic, server NAT port, server local address
+//
+// Addresses are 4 bytes of IPv4 and 2 bytes of port, all zeroes if unknown.
+//
+// Relays predating versions only know the legacy messages, the same without
+// the magic and the local addresses, and the reply to a server until a
+// client registers without its port: those are used with such relays, see
+// legacyRelay.
+const relayMagic = "PPX1"
+
+// legacyReply returns the relayMagic message of the legacy reply b of a relay
+// predating versions, to a server if server is set, or nil if b is not one.
+// port is the local port of this host, which legacy replies do not tell and
+// which its NAT most likely kept.
+func legacyReply(b []byte, server bool, port int) []byte {
+	m := []byte(relayMagic)
+	switch {
+	case server && len(b) == 4:
+		m = append(m, b...)
+		return append(m, byte(port>>8), byte(port))
+	case server && len(b) == 6, !server && len(b) == 2:
+		m = append(m, b...)
+		// the local address is unknown
+		return append(m, make([]byte, 6)...)
+	}
+	return nil
+}
+
+// localCandidate returns the local network address of c, as seen by hosts
+// on the way to the relay, or nil if unknown, or if the relay is reached
+// through a local tunnel.
+func localCandidate(c *net.UDPConn, relayAddr *net.UDPAddr) *net.UDPAddr {
+	route, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return nil
+	}
+	defer route.Close()
+	ip := route.LocalAddr().(*net.UDPAddr).IP.To4()
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: c.LocalAddr().(*net.UDPAddr).Port,
+	}
+}
+
+// ownAddress returns whether ip is the address of an interface of this host.
+func ownAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func putAddr(b []byte, addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	copy(b[:4], addr.IP.To4())
+	binary.BigEndian.PutUint16(b[4:6], uint16(addr.Port))
+}
+
+func getAddr(b []byte) *net.UDPAddr {
+	ip := make(net.IP, 4)
+	copy(ip, b[:4])
+	port := int(binary.BigEndian.Uint16(b[4:6]))
+	if ip.IsUnspecified() || port == 0 {
+		return nil
+	}
+	return &net.UDPAddr{
+		IP:   ip,
+		Port: port,
+	}
+}
+
+// candidates returns the peer candidate addresses to punch, by order of
+// preference: its loopback address if it runs on this host, its local
+// network address, if known and different from its public address, then its
+// IPv6 address if known, then its public address.
+func candidates(local *net.UDPAddr, ipv6 *net.UDPAddr, public *net.UDPAddr) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	if local != nil && !local.IP.IsLoopback() && ownAddress(local.IP) {
+		addrs = append(addrs, &net.UDPAddr{
+			IP:   net.IPv4(127, 0, 0, 1),
+			Port: local.Port,
+		})
+	}
+	if local != nil && (!local.IP.Equal(public.IP) || local.Port != public.Port) {
+		addrs = append(addrs, local)
+	}
+	if ipv6 != nil {
+		addrs = append(addrs, ipv6)
+	}
+	return append(addrs, public)
+}
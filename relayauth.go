@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// relayToken is the token of the community of a restricted relay, set with
+// -relay-token or relay_token: in the configuration file.
+var relayToken string
+
+// relayAuthMagic prefixes the relay authentication messages, with which
+// peers of a relay restricted to a community prove they know one of its
+// tokens, followed by an operation byte:
+//   - relayAuthRequest: unix time, then the first 16 bytes of the HMAC-SHA256
+//     of "proxypunch relay", a zero byte and the time, keyed with the token
+//   - relayAuthReply: status, padded to 8 bytes
+//
+// The relay then accepts the other messages from the IP of the peer until 15
+// seconds after its last authentication.
+const relayAuthMagic = "PPA1"
+
+const (
+	relayAuthRequest = 0x01
+	relayAuthReply   = 0x02
+)
+
+// Status of relay authentication messages.
+const (
+	relayAuthOk     = 0x00
+	relayAuthDenied = 0x01
+)
+
+// relayAuthInterval is the interval between the authentications keeping this
+// host authenticated on the relay.
+const relayAuthInterval = 5 * time.Second
+
+// relayAuthPayload returns an authentication message for relayToken.
+func relayAuthPayload() []byte {
+	stamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(stamp, uint64(time.Now().Unix()))
+	m := hmac.New(sha256.New, []byte(relayToken))
+	m.Write([]byte("proxypunch relay\x00"))
+	m.Write(stamp)
+	b := append([]byte(relayAuthMagic), relayAuthRequest)
+	b = append(b, stamp...)
+	return append(b, m.Sum(nil)[:16]...)
+}
+
+// authenticateRelay authenticates this host on the relay with relayToken, if
+// set, then keeps it authenticated until done is closed, or only once if done
+// is nil.
+func authenticateRelay(s *session, relayAddr *net.UDPAddr, done chan struct{}) error {
+	if relayToken == "" {
+		return nil
+	}
+	if s.relayCaps != 0 && s.relayCaps&capAuth == 0 {
+		return errors.New("relay " + relayName(s) + " is too old for -relay-token: ask its operator to update it, or use another relay with -relay")
+	}
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, 16)
+	answered := false
+	for try := 0; try < 3 && !answered; try++ {
+		if _, err := c.Write(relayAuthPayload()); err != nil {
+			c.Close()
+			return err
+		}
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			n, err := c.Read(buffer)
+			if err != nil {
+				break
+			}
+			if n != 8 || string(buffer[:4]) != relayAuthMagic || buffer[4] != relayAuthReply {
+				continue
+			}
+			if buffer[5] != relayAuthOk {
+				c.Close()
+				return errors.New("relay " + relayName(s) + " rejected the token of -relay-token, check it and that the system clock is correct")
+			}
+			answered = true
+			break
+		}
+	}
+	if !answered && verbose {
+		s.println("Relay " + relayName(s) + " is not answering authentication")
+	}
+	if done == nil {
+		c.Close()
+		return nil
+	}
+	go func() {
+		defer c.Close()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(relayAuthInterval):
+			}
+			c.Write(relayAuthPayload())
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sealMagic prefixes the sealed relay messages, which hide the registrations
+// and the addresses the relay answers from on-path observers, followed by an
+// operation byte:
+//   - sealHello: padded to sealHelloSize
+//   - sealKey: X25519 public key of the relay, then its ed25519 signature of
+//     "proxypunch relay key", a zero byte and the X25519 public key, with the
+//     key of the relay
+//   - sealRequest: X25519 public key of the peer, nonce, message sealed with
+//     AES-256-GCM
+//   - sealReply: nonce, message sealed with AES-256-GCM; the nonce is 4 zero
+//     bytes then a counter (8 bytes), raised with every sealed reply of the
+//     relay
+//
+// The key is the HMAC-SHA256 of "proxypunch seal", a zero byte, the public
+// key of the peer and the public key of the relay, keyed with their X25519
+// shared secret; the operation byte is authenticated along with the message.
+// Once a peer sends sealed messages, the relay seals all its answers to that
+// peer, except the echo messages that were not sealed. Only the relay holding
+// its ed25519 key can sign the X25519 key and answer sealed messages with it,
+// and peers drop the replies whose counter they already saw, so that pinning
+// the public key of the relay with relayKey rules out spoofed and replayed
+// answers.
+const sealMagic = "PPE1"
+
+const (
+	sealHello   = 0x01
+	sealKey     = 0x02
+	sealRequest = 0x03
+	sealReply   = 0x04
+)
+
+// sealHelloSize is the size of the hello messages, as large as the answer.
+const sealHelloSize = len(sealMagic) + 1 + 32 + ed25519.SignatureSize
+
+// relayKey is the ed25519 public keys of the trusted relays in hex, separated
+// by commas, set with -relay-key or relay_key: in the configuration file: the
+// relays must then prove they hold one of them, and their answers that are
+// not sealed are ignored.
+var relayKey string
+
+// sealWindow is the count of sealed replies received out of order that are
+// still accepted after a later one.
+const sealWindow = 64
+
+// relaySealer seals the messages sent to a relay.
+type relaySealer struct {
+	public []byte
+	aead   cipher.AEAD
+
+	mu sync.Mutex
+	// highest is the highest counter of the replies opened, seen the bitmap
+	// of the sealWindow counters up to it that were.
+	highest uint64
+	seen    uint64
+}
+
+// fresh returns whether the sealed reply with counter was not opened yet,
+// and records it if mark is set.
+func (r *relaySealer) fresh(counter uint64, mark bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case counter > r.highest:
+		if mark {
+			if shift := counter - r.highest; shift < sealWindow {
+				r.seen = r.seen<<shift | 1
+			} else {
+				r.seen = 1
+			}
+			r.highest = counter
+		}
+		return true
+	case r.highest-counter >= sealWindow:
+		return false
+	}
+	bit := uint64(1) << (r.highest - counter)
+	if r.seen&bit != 0 {
+		return false
+	}
+	if mark {
+		r.seen |= bit
+	}
+	return true
+}
+
+// sealers are the sealers of the relays, by relay address; sessions share
+// them, so that the relay seals its answers to all of them with the same key.
+// A relay makes a new key and starts its counter over when it restarts, so
+// the sealer of a relay that stopped answering is forgotten with
+// forgetSealer: the next exchange makes a new one, along with a new window of
+// reply counters.
+var sealers = make(map[string]*relaySealer)
+var sealersMu sync.Mutex
+
+// forgetSealer forgets the keys exchanged with the relay at relayAddr, and
+// returns whether there were any.
+func forgetSealer(relayAddr *net.UDPAddr) bool {
+	sealersMu.Lock()
+	defer sealersMu.Unlock()
+	_, ok := sealers[relayAddr.String()]
+	delete(sealers, relayAddr.String())
+	return ok
+}
+
+// sealRelayMessages exchanges keys with the relay at relayAddr, unless
+// already done, so that the messages sent to it with sealRelay are sealed,
+// checking that the relay holds one of the keys of relayKey if set.
+func sealRelayMessages(relayAddr *net.UDPAddr) error {
+	sealersMu.Lock()
+	defer sealersMu.Unlock()
+	if _, ok := sealers[relayAddr.String()]; ok {
+		return nil
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	c, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	request := make([]byte, sealHelloSize)
+	copy(request, sealMagic)
+	request[len(sealMagic)] = sealHello
+	buffer := make([]byte, 128)
+	forged := false
+	for try := 0; try < 2; try++ {
+		if _, err := c.Write(request); err != nil {
+			return err
+		}
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			n, err := c.Read(buffer)
+			if err != nil {
+				break
+			}
+			if n != sealHelloSize || string(buffer[:len(sealMagic)]) != sealMagic || buffer[len(sealMagic)] != sealKey {
+				continue
+			}
+			public, signature := buffer[len(sealMagic)+1:n-ed25519.SignatureSize], buffer[n-ed25519.SignatureSize:n]
+			if relayKey != "" && !trustedRelayKey(public, signature) {
+				// keep waiting for the answer of the relay itself
+				forged = true
+				continue
+			}
+			relayPublic, err := ecdh.X25519().NewPublicKey(public)
+			if err != nil {
+				return err
+			}
+			shared, err := key.ECDH(relayPublic)
+			if err != nil {
+				return err
+			}
+			aead, err := sealCipher(shared, key.PublicKey().Bytes(), relayPublic.Bytes())
+			if err != nil {
+				return err
+			}
+			sealers[relayAddr.String()] = &relaySealer{
+				public: key.PublicKey().Bytes(),
+				aead:   aead,
+			}
+			return nil
+		}
+	}
+	if forged {
+		return errors.New("the relay does not hold a key of -relay-key")
+	}
+	return errors.New("no answer from the relay")
+}
+
+// trustedRelayKey returns whether signature is the signature of the X25519
+// public key of a relay with one of the keys of relayKey.
+func trustedRelayKey(public []byte, signature []byte) bool {
+	message := append([]byte("proxypunch relay key\x00"), public...)
+	for _, v := range strings.Split(relayKey, ",") {
+		key, err := hex.DecodeString(strings.TrimSpace(v))
+		if err == nil && len(key) == ed25519.PublicKeySize && ed25519.Verify(key, message, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinRelay checks that the relay at relayAddr holds one of the keys of
+// relayKey, if set, and exchanges keys with it.
+func pinRelay(s *session, relayAddr *net.UDPAddr) error {
+	if relayKey == "" {
+		return nil
+	}
+	if err := sealRelayMessages(relayAddr); err != nil {
+		return errors.New("relay " + relayName(s) + " is not trusted with -relay-key (" + err.Error() + "): check the key with its operator, or use another relay with -relay")
+	}
+	return nil
+}
+
+// sealCipher returns the cipher of the messages between the peer of public
+// key peer and the relay of public key relay, from their shared secret.
+func sealCipher(shared []byte, peer []byte, relay []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, shared)
+	m.Write([]byte("proxypunch seal\x00"))
+	m.Write(peer)
+	m.Write(relay)
+	block, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func relaySealerOf(relayAddr *net.UDPAddr) *relaySealer {
+	sealersMu.Lock()
+	defer sealersMu.Unlock()
+	return sealers[relayAddr.String()]
+}
+
+// sealRelay returns the message b to send to the relay at relayAddr, sealed
+// if keys were exchanged with it.
+func sealRelay(b []byte, relayAddr *net.UDPAddr) []byte {
+	sealer := relaySealerOf(relayAddr)
+	if sealer == nil {
+		return b
+	}
+	sealed := append([]byte(sealMagic), sealRequest)
+	sealed = append(sealed, sealer.public...)
+	nonce := make([]byte, sealer.aead.NonceSize())
+	rand.Read(nonce)
+	sealed = append(sealed, nonce...)
+	return sealer.aead.Seal(sealed, nonce, b, sealed[:len(sealMagic)+1])
+}
+
+// openRelay returns the message b received from the relay at relayAddr,
+// opened if sealed, or nil if it cannot be opened, was already received, or
+// is not sealed while relayKey is set.
+func openRelay(b []byte, relayAddr *net.UDPAddr) []byte {
+	if len(b) < len(sealMagic)+1 || string(b[:len(sealMagic)]) != sealMagic || b[len(sealMagic)] != sealReply {
+		if relayKey != "" {
+			return nil
+		}
+		return b
+	}
+	sealer := relaySealerOf(relayAddr)
+	if sealer == nil {
+		return nil
+	}
+	header, b := b[:len(sealMagic)+1], b[len(sealMagic)+1:]
+	size := sealer.aead.NonceSize()
+	if len(b) < size || binary.BigEndian.Uint32(b[:size-8]) != 0 {
+		return nil
+	}
+	counter := binary.BigEndian.Uint64(b[size-8 : size])
+	if !sealer.fresh(counter, false) {
+		return nil
+	}
+	plain, err := sealer.aead.Open(nil, b[:size], b[size:], header)
+	if err != nil || !sealer.fresh(counter, true) {
+		return nil
+	}
+	return plain
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRelaySealerFresh(t *testing.T) {
+	type step struct {
+		counter uint64
+		fresh   bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"in order", []step{{1, true}, {2, true}, {3, true}}},
+		{"replayed", []step{{1, true}, {2, true}, {2, false}, {1, false}}},
+		{"out of order", []step{{1, true}, {3, true}, {2, true}, {2, false}}},
+		{"within window", []step{{100, true}, {100 - sealWindow + 1, true}, {100 - sealWindow + 1, false}}},
+		{"outside window", []step{{100, true}, {100 - sealWindow, false}}},
+		{"jump past window", []step{{1, true}, {1 + sealWindow + 10, true}, {2, false}, {sealWindow + 10, true}}},
+		{"counter restart", []step{{1000, true}, {1, false}, {2, false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &relaySealer{}
+			for i, s := range tt.steps {
+				if got := r.fresh(s.counter, false); got != s.fresh {
+					t.Fatalf("step %d: fresh(%d) = %v, want %v", i, s.counter, got, s.fresh)
+				}
+				if s.fresh && !r.fresh(s.counter, true) {
+					t.Fatalf("step %d: marking %d failed", i, s.counter)
+				}
+			}
+		})
+	}
+}
+
+func TestRelaySealerRestart(t *testing.T) {
+	old := &relaySealer{}
+	for counter := uint64(1); counter <= 1000; counter++ {
+		old.fresh(counter, true)
+	}
+	if old.fresh(1, false) {
+		t.Fatal("the counter of a restarted relay was accepted by the old sealer")
+	}
+	// the sealer of the new key of the relay starts a new window
+	renewed := &relaySealer{}
+	for counter := uint64(1); counter <= 3; counter++ {
+		if !renewed.fresh(counter, true) {
+			t.Fatalf("counter %d of the restarted relay rejected", counter)
+		}
+	}
+}
+
+func TestForgetSealer(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 14761}
+	sealersMu.Lock()
+	sealers[addr.String()] = &relaySealer{}
+	sealersMu.Unlock()
+	if !forgetSealer(addr) {
+		t.Fatal("forgetSealer did not find the sealer")
+	}
+	if relaySealerOf(addr) != nil {
+		t.Fatal("the sealer was not forgotten")
+	}
+	if forgetSealer(addr) {
+		t.Fatal("forgetSealer found a forgotten sealer")
+	}
+}
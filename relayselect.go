@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// relayChoices are the relays set with -relay or relay: in the configuration
+// file, separated by commas. With several, each session registers on the one
+// with the lowest round trip time; in client mode it also registers on the
+// others until it learns which one the host registered on.
+var relayChoices []string
+
+// relayRegions are the regions of the relays of relayChoices tagged with
+// one, as region=relay; the relays of the region set with -region are
+// preferred over faster relays of other regions.
+var relayRegions = make(map[string]string)
+
+// relayChoice is a relay answering the probe of selectRelay.
+type relayChoice struct {
+	name string
+	addr *net.UDPAddr
+	rtt  time.Duration
+}
+
+// srvTimeout bounds the lookup of the DNS SRV record of a relay.
+const srvTimeout = 2 * time.Second
+
+// relaysDiscovered is closed once discoverRelays has set relayChoices and
+// relay.
+var relaysDiscovered chan struct{}
+
+// discoverRelays sets relayChoices to the relays of v, or of relayHost if v
+// has none, and relay to the first of them. The DNS SRV lookups of relays
+// without a port run in the background while proxypunch starts, so that a
+// slow or blocked DNS does not delay it; waitRelays waits for them.
+func discoverRelays(v string) {
+	relaysDiscovered = make(chan struct{})
+	go func() {
+		defer close(relaysDiscovered)
+		relayChoices = splitRelays(v)
+		if len(relayChoices) == 0 {
+			relayChoices = splitRelays(relayHost)
+		}
+		relay = relayChoices[0]
+	}()
+}
+
+// waitRelays waits until the relays set by discoverRelays are known.
+func waitRelays() {
+	<-relaysDiscovered
+}
+
+// splitRelays parses a comma-separated list of relays, optionally tagged
+// with their region as region=relay; a relay without a port is replaced with
+// the relays of its DNS SRV record, or used on the default relay port if it
+// has none.
+func splitRelays(v string) []string {
+	var relays []string
+	for _, r := range strings.Split(v, ",") {
+		r = strings.TrimSpace(r)
+		tag := ""
+		if i := strings.IndexByte(r, '='); i >= 0 {
+			tag, r = strings.TrimSpace(r[:i]), strings.TrimSpace(r[i+1:])
+		}
+		if r == "" {
+			continue
+		}
+		found := []string{r}
+		if _, _, err := net.SplitHostPort(r); err != nil {
+			found = srvRelays(r)
+			if len(found) == 0 {
+				found = []string{net.JoinHostPort(r, defaultRelayPort)}
+			}
+		}
+		for _, v := range found {
+			if tag != "" {
+				relayRegions[v] = tag
+			}
+		}
+		relays = append(relays, found...)
+	}
+	return relays
+}
+
+// srvRelays returns the relays of the DNS SRV record _proxypunch._udp of
+// host, by priority then randomly by weight, so that relay operators can
+// move, balance or add relays without a new proxypunch.
+func srvRelays(host string) []string {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), srvTimeout)
+	defer cancel()
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "proxypunch", "udp", host)
+	if err != nil {
+		return nil
+	}
+	var relays []string
+	for _, v := range records {
+		target := strings.TrimSuffix(v.Target, ".")
+		if target == "" || v.Port == 0 {
+			continue
+		}
+		relays = append(relays, net.JoinHostPort(target, strconv.Itoa(int(v.Port))))
+	}
+	if verbose && len(relays) > 0 {
+		fmt.Println("Discovered relays " + strings.Join(relays, ", ") + " from the DNS SRV record of " + host)
+	}
+	return relays
+}
+
+// selectRelay probes the relays of relayChoices in parallel and sets the
+// relay of the session to the one with the lowest round trip time, and its
+// alternates to the other relays that answered, fastest first.
+func selectRelay(s *session) {
+	choices := make([]relayChoice, len(relayChoices))
+	var wg sync.WaitGroup
+	for i, name := range relayChoices {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			choices[i].name = name
+			addr, err := resolveRelayHost(name)
+			if err != nil {
+				return
+			}
+			rtt, err := relayRtt(addr)
+			if err != nil {
+				return
+			}
+			choices[i].addr, choices[i].rtt = addr, rtt
+		}(i, name)
+	}
+	wg.Wait()
+
+	var answered []relayChoice
+	for _, v := range choices {
+		if v.addr != nil {
+			answered = append(answered, v)
+		} else if verbose {
+			s.println("Relay " + v.name + " is not answering")
+		}
+	}
+	if len(answered) == 0 {
+		s.errorln("Error none of the relays is answering, trying " + relayChoices[0])
+		s.relay = relayChoices[0]
+		return
+	}
+	sort.SliceStable(answered, func(i, j int) bool {
+		// the relays of the region first, so that candidates are not
+		// exchanged across the planet because of a lucky probe
+		if a, b := inRegion(answered[i].name), inRegion(answered[j].name); a != b {
+			return a
+		}
+		return answered[i].rtt < answered[j].rtt
+	})
+	s.relay = answered[0].name
+	s.alternates = answered[1:]
+	if inRegion(answered[0].name) {
+		count := 0
+		for _, v := range answered {
+			if inRegion(v.name) {
+				count++
+			}
+		}
+		if count == 1 {
+			s.println("Using relay " + answered[0].name + " (" + strconv.Itoa(int(answered[0].rtt/time.Millisecond)) + "ms), the only relay answering in region " + region)
+		} else {
+			s.println("Using relay " + answered[0].name + " (" + strconv.Itoa(int(answered[0].rtt/time.Millisecond)) + "ms), the fastest of " + strconv.Itoa(count) + " relays answering in region " + region)
+		}
+		return
+	}
+	if region != "" && len(relayRegions) > 0 && verbose {
+		s.println("No relay of region " + region + " is answering")
+	}
+	s.println("Using relay " + answered[0].name + " (" + strconv.Itoa(int(answered[0].rtt/time.Millisecond)) + "ms), the fastest of " + strconv.Itoa(len(answered)) + " relays answering")
+}
+
+// inRegion returns whether the relay name is tagged with the region set with
+// -region.
+func inRegion(name string) bool {
+	tag, ok := relayRegions[name]
+	return ok && region != "" && strings.EqualFold(tag, region)
+}
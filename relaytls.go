@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// relayTlsPort is the port relays accept registrations on over TLS, for
+// networks blocking UDP to the relay port.
+const relayTlsPort = "443"
+
+// reachRelay returns relayAddr if the relay answers over UDP. Otherwise, as
+// the network may block UDP to the relay port, it returns the address of a
+// tunnel to the relay over TLS if the relay accepts it, along with a function
+// closing the tunnel. The game traffic stays on UDP.
+func reachRelay(s *session, relayAddr *net.UDPAddr) (*net.UDPAddr, func()) {
+	if _, err := relayRtt(relayAddr); err == nil {
+		return relayAddr, func() {}
+	}
+	hostPort := relay
+	if s.relay != "" {
+		hostPort = s.relay
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return relayAddr, func() {}
+	}
+	t, err := tunnelRelay(host)
+	if err != nil {
+		if verbose {
+			s.println("Relay " + relayName(s) + " is not answering over TLS either: " + err.Error())
+		}
+		return relayAddr, func() {}
+	}
+	s.println("Relay " + relayName(s) + " is not answering over UDP, which this network may block: registering over TLS on port " + relayTlsPort + " instead; peers can only reach you if your NAT keeps the port of proxypunch, or if it is forwarded")
+	go t.run()
+	return t.l.LocalAddr().(*net.UDPAddr), t.close
+}
+
+// relayTunnel forwards the messages sent to its local UDP socket to the
+// relay over TLS, with one stream per local sender, and the answers back, so
+// that the rest of proxypunch talks to it as to the relay. The relay handles
+// the messages of a stream as coming from its public IP and the port of the
+// local sender.
+type relayTunnel struct {
+	host    string
+	l       *net.UDPConn
+	mu      sync.Mutex
+	streams map[string]net.Conn
+}
+
+// tunnelRelay opens a tunnel to the relay at host, checking that it accepts
+// TLS streams.
+func tunnelRelay(host string) (*relayTunnel, error) {
+	t := &relayTunnel{
+		host:    host,
+		streams: make(map[string]net.Conn),
+	}
+	// an echo message over a stream of port 0
+	c, err := t.dial(0)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte{0, 1, 0}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(reply[:2]) != 1 {
+		return nil, errors.New("unexpected answer")
+	}
+	t.l, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// dial opens a stream to the relay for the local sender of port.
+func (t *relayTunnel) dial(port int) (net.Conn, error) {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp4", net.JoinHostPort(t.host, relayTlsPort), &tls.Config{
+		ServerName: t.host,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte{byte(port >> 8), byte(port)}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *relayTunnel) run() {
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := t.l.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// err is thrown if the buffer is too small
+			continue
+		}
+		c := t.stream(addr)
+		if c == nil {
+			continue
+		}
+		c.SetWriteDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Write(append([]byte{byte(n >> 8), byte(n)}, buffer[:n]...)); err != nil {
+			t.drop(addr, c)
+		}
+	}
+}
+
+// stream returns the stream of the local sender addr, opening it if needed,
+// or nil if the relay cannot be reached.
+func (t *relayTunnel) stream(addr *net.UDPAddr) net.Conn {
+	t.mu.Lock()
+	c, ok := t.streams[addr.String()]
+	t.mu.Unlock()
+	if ok {
+		return c
+	}
+	c, err := t.dial(addr.Port)
+	if err != nil {
+		return nil
+	}
+	t.mu.Lock()
+	t.streams[addr.String()] = c
+	t.mu.Unlock()
+	go func() {
+		header := make([]byte, 2)
+		buffer := make([]byte, 4096)
+		for {
+			if _, err := io.ReadFull(c, header); err != nil {
+				break
+			}
+			n := int(binary.BigEndian.Uint16(header))
+			if n > len(buffer) {
+				break
+			}
+			if _, err := io.ReadFull(c, buffer[:n]); err != nil {
+				break
+			}
+			t.l.WriteToUDP(buffer[:n], addr)
+		}
+		t.drop(addr, c)
+	}()
+	return c
+}
+
+// drop closes the stream c of the local sender addr, so that its next
+// message opens a new one.
+func (t *relayTunnel) drop(addr *net.UDPAddr, c net.Conn) {
+	c.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.streams[addr.String()] == c {
+		delete(t.streams, addr.String())
+	}
+}
+
+func (t *relayTunnel) close() {
+	t.l.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range t.streams {
+		c.Close()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reorder is the depth of the reordering buffer of -reorder: game packets of
+// the peer received out of order are held until the ones before them arrive,
+// at most this many of them; 0 disables it.
+var reorder int
+
+// reorderLatency is the longest a packet is held by -reorder, waiting for the
+// ones before it, set with -reorder-latency.
+var reorderLatency = defaultReorderLatency
+
+// defaultReorderLatency is the default of -reorder-latency.
+const defaultReorderLatency = 5 * time.Millisecond
+
+// maxReorder and maxReorderLatency bound -reorder and -reorder-latency, so
+// that the buffer never adds more than a few milliseconds.
+const (
+	maxReorder        = 64
+	maxReorderLatency = 20 * time.Millisecond
+)
+
+// reorderRestart is the distance between sequence numbers beyond which the
+// peer is considered restarted.
+const reorderRestart = 1024
+
+// orderedSender numbers the game packets sent to a peer running -reorder.
+type orderedSender struct {
+	// sequence is the number of the last packet, accessed atomically.
+	sequence uint32
+}
+
+// wrap returns the typeOrdered packet carrying the game packet: its sequence
+// number (4 bytes), then the packet.
+func (o *orderedSender) wrap(packet []byte) []byte {
+	b := make([]byte, 5, 5+len(packet))
+	b[0] = typeOrdered
+	binary.BigEndian.PutUint32(b[1:5], atomic.AddUint32(&o.sequence, 1))
+	return append(b, packet...)
+}
+
+type heldPacket struct {
+	data []byte
+	due  time.Time
+}
+
+// reorderBuffer hands the game packets the peer numbered with typeOrdered in
+// order, holding those received after a gap until the gap is filled, the
+// buffer is full, or reorderLatency elapsed, when the missing packets are
+// skipped. Packets arriving after they were skipped are handed as they come.
+type reorderBuffer struct {
+	mu      sync.Mutex
+	started bool
+	next    uint32
+	held    map[uint32]heldPacket
+	timer   *time.Timer
+	// deliver hands a packet to the game, under mu.
+	deliver func(packet []byte)
+}
+
+func newReorderBuffer(deliver func(packet []byte)) *reorderBuffer {
+	return &reorderBuffer{
+		held:    make(map[uint32]heldPacket),
+		deliver: deliver,
+	}
+}
+
+// receive handles the typeOrdered packet data.
+func (rb *reorderBuffer) receive(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	sequence := binary.BigEndian.Uint32(data[1:5])
+	packet := data[5:]
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	ahead := int32(sequence - rb.next)
+	switch {
+	case !rb.started || ahead <= -reorderRestart || ahead >= reorderRestart:
+		// the first packet, or a packet from a restarted peer
+		rb.started = true
+		rb.held = make(map[uint32]heldPacket)
+		rb.next = sequence + 1
+		rb.deliver(packet)
+	case ahead < 0:
+		// late, its place was skipped
+		rb.deliver(packet)
+	case ahead == 0:
+		rb.next++
+		rb.deliver(packet)
+		rb.release(time.Time{})
+	default:
+		if _, ok := rb.held[sequence]; ok {
+			return
+		}
+		rb.held[sequence] = heldPacket{
+			data: append([]byte(nil), packet...),
+			due:  time.Now().Add(reorderLatency),
+		}
+		rb.release(time.Time{})
+		if len(rb.held) > 0 && rb.timer == nil {
+			rb.timer = time.AfterFunc(reorderLatency, rb.expire)
+		}
+	}
+}
+
+// release hands the held packets that follow the next one, skipping the gaps
+// before packets due by deadline, or while the buffer is full. Called with
+// mu held.
+func (rb *reorderBuffer) release(deadline time.Time) {
+	for len(rb.held) > 0 {
+		if v, ok := rb.held[rb.next]; ok {
+			delete(rb.held, rb.next)
+			rb.next++
+			rb.deliver(v.data)
+			continue
+		}
+		first := rb.first()
+		if len(rb.held) <= reorder && rb.held[first].due.After(deadline) {
+			return
+		}
+		rb.next = first
+	}
+}
+
+// first returns the lowest sequence number held.
+func (rb *reorderBuffer) first() uint32 {
+	var first uint32
+	found := false
+	for k := range rb.held {
+		if !found || int32(k-first) < 0 {
+			first, found = k, true
+		}
+	}
+	return first
+}
+
+// expire releases the packets held for reorderLatency, then waits for the
+// next one to be due.
+func (rb *reorderBuffer) expire() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.timer = nil
+	rb.release(time.Now())
+	if len(rb.held) > 0 {
+		rb.timer = time.AfterFunc(time.Until(rb.held[rb.first()].due), rb.expire)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// roomMagic prefixes the room messages exchanged with the relay, followed by
+// an operation byte:
+//   - roomClaim: port, flags, relay RTT in milliseconds, token tag, room,
+//     game, region, padded to roomRequestSize
+//   - roomClaimed: status
+//   - roomResolve: room, padded to roomRequestSize
+//   - roomResolved: status, IP, port, flags
+//   - roomList: page, token tag, padded to roomPageSize
+//   - roomEntries: page, page count, then entries: room, game, region, relay
+//     RTT, flags
+//
+// Strings are prefixed with their length on one byte. A room is a name chosen
+// by the host, such as "Friday Netplay", that the relay points to its public
+// IP and port while it claims it again, regardless of case and spacing. Unlike
+// registered names, rooms are not owned: any host can claim a room nobody is
+// hosting. Rooms claimed with roomListed are listed by proxypunch list, only
+// to peers with the same token if claimed with a token tag.
+const roomMagic = "PPR1"
+
+const (
+	roomClaim    = 0x01
+	roomClaimed  = 0x02
+	roomResolve  = 0x03
+	roomResolved = 0x04
+	roomList     = 0x05
+	roomEntries  = 0x06
+)
+
+// Status of room messages.
+const (
+	roomOk       = 0x00
+	roomTaken    = 0x01
+	roomInvalid  = 0x02
+	roomNotFound = 0x03
+)
+
+// Flags of rooms.
+const (
+	// roomListed is set for the rooms listed by proxypunch list.
+	roomListed = 0x01
+	// roomPassword is set when the host requires a password.
+	roomPassword = 0x02
+)
+
+// roomRequestSize is the size of the claim and resolve requests, excluding
+// the magic.
+const roomRequestSize = 128
+
+// roomPageSize is the size of the list requests, and the maximum size of the
+// pages sent back.
+const roomPageSize = 1200
+
+// maxRoomField bounds the length of the game and region of rooms in bytes.
+const maxRoomField = 16
+
+// maxRoomLength bounds the length of rooms in bytes.
+const maxRoomLength = 48
+
+// roomInterval is the interval at which the room is claimed again while
+// hosting.
+const roomInterval = 5 * time.Second
+
+// room is the room hosted in server mode, or joined in client mode.
+var room string
+
+// isRoom returns whether host is a room: #room.
+func isRoom(host string) bool {
+	return strings.HasPrefix(host, "#")
+}
+
+// validRoom returns whether room can be hosted on a relay.
+func validRoom(room string) bool {
+	room = strings.TrimSpace(room)
+	if room == "" || len(room) > maxRoomLength {
+		return false
+	}
+	for _, r := range room {
+		if r < ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// roomRequest returns a room request for op, with the fields before the room,
+// the room, and the fields after it.
+func roomRequest(op byte, before []byte, room string, after ...string) []byte {
+	request := append([]byte(roomMagic), op)
+	request = append(request, before...)
+	for _, v := range append([]string{room}, after...) {
+		request = append(request, byte(len(v)))
+		request = append(request, v...)
+	}
+	return append(request, make([]byte, len(roomMagic)+1+roomRequestSize-len(request))...)
+}
+
+// roomField truncates a game or region to maxRoomField bytes.
+func roomField(v string) string {
+	if len(v) > maxRoomField {
+		return v[:maxRoomField]
+	}
+	return v
+}
+
+// claimRoom claims room for the session hosted on port on the relay until
+// done is closed, listing it with -publish.
+func claimRoom(s *session, relayAddr *net.UDPAddr, port int, done chan struct{}) {
+	if !validRoom(room) {
+		s.errorln("Error invalid room " + room + ", rooms are 1 to " + strconv.Itoa(maxRoomLength) + " characters")
+		return
+	}
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	var flags byte
+	if publish {
+		flags |= roomListed
+	}
+	if password != "" {
+		flags |= roomPassword
+	}
+	tag := tokenTag()
+	buffer := make([]byte, 64)
+	var status byte = 0xFF
+	for {
+		var ms time.Duration
+		if rtt, err := relayRtt(relayAddr); err == nil {
+			// round up so that a known RTT is never 0
+			ms = (rtt + time.Millisecond - 1) / time.Millisecond
+		}
+		before := append([]byte{byte(port >> 8), byte(port), flags, byte(ms >> 8), byte(ms)}, tag[:]...)
+		c.Write(roomRequest(roomClaim, before, room, roomField(presetName(s.preset)), roomField(region)))
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := c.Read(buffer)
+		if err == nil && n == 6 && string(buffer[:4]) == roomMagic && buffer[4] == roomClaimed && buffer[5] != status {
+			status = buffer[5]
+			switch status {
+			case roomOk:
+				s.println("Hosting room " + room + ", peers can join it with -room \"" + room + "\", or by entering #" + room + " as the host")
+				if password != "" {
+					s.println("Peers must also present your password to join room " + room)
+				}
+				if publish {
+					s.println("Listing room " + room + ", peers can find it with proxypunch list")
+				}
+			case roomTaken:
+				s.errorln("Error room " + room + " is already hosted by someone else on relay " + relayName(s) + ", choose another room with -room; trying again in case it frees up")
+			default:
+				s.errorln("Error relay " + relayName(s) + " refused room " + room)
+				return
+			}
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(roomInterval):
+		}
+	}
+}
+
+// resolveRoom resolves a room, as #room, to the host and port hosting it, on
+// the relays of relayChoices, and sets the relay of the session to the relay
+// of the room.
+func resolveRoom(s *session, host string) (string, int, error) {
+	room := strings.Join(strings.Fields(host[1:]), " ")
+	if !validRoom(room) {
+		return "", 0, errors.New("invalid room " + room)
+	}
+	waitRelays()
+	for _, choice := range relayChoices {
+		s.relay = choice
+		relayAddr, err := resolveRelay(s)
+		if err != nil {
+			continue
+		}
+		if err := pinRelay(s, relayAddr); err != nil {
+			s.errorln("Error " + err.Error())
+			continue
+		}
+		if err := authenticateRelay(s, relayAddr, nil); err != nil {
+			continue
+		}
+		ip, port, flags, err := lookupRoom(relayAddr, room)
+		if err != nil {
+			continue
+		}
+		if flags&roomPassword != 0 && password == "" {
+			return "", 0, errors.New("room " + room + " requires a password: ask its host for it, and restart proxypunch with -password")
+		}
+		s.println("Joining room " + room + " hosted at " + ip.String() + " on port " + strconv.Itoa(port))
+		return ip.String(), port, nil
+	}
+	s.relay = ""
+	return "", 0, errors.New("nobody is hosting room " + room + " right now, check its name with the host")
+}
+
+// lookupRoom looks room up on the relay, returning the address of its host
+// and its flags.
+func lookupRoom(relayAddr *net.UDPAddr, room string) (net.IP, int, byte, error) {
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer c.Close()
+	request := sealRelay(roomRequest(roomResolve, nil, room), relayAddr)
+	buffer := make([]byte, 64)
+	for try := 0; try < 3; try++ {
+		if _, err := c.Write(request); err != nil {
+			return nil, 0, 0, err
+		}
+		c.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for {
+			n, err := c.Read(buffer)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			b := openRelay(buffer[:n], relayAddr)
+			if len(b) != 13 || string(b[:4]) != roomMagic || b[4] != roomResolved {
+				continue
+			}
+			if b[5] != roomOk {
+				return nil, 0, 0, errors.New("room not found")
+			}
+			return net.IPv4(b[6], b[7], b[8], b[9]), int(binary.BigEndian.Uint16(b[10:12])), b[12], nil
+		}
+	}
+	return nil, 0, 0, errors.New("no answer from the relay")
+}
+
+// roomListing is a room as listed by the relay.
+type roomListing struct {
+	room string
+	// game is the name of the game preset, if any.
+	game   string
+	region string
+	// rtt is the round trip time from the host to the relay, 0 if unknown.
+	rtt   time.Duration
+	flags byte
+}
+
+// fetchRooms returns the rooms listed on the relay.
+func fetchRooms(relayAddr *net.UDPAddr) ([]roomListing, error) {
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var listings []roomListing
+	buffer := make([]byte, 2048)
+	pages := 1
+	for page := 0; page < pages; page++ {
+		request := make([]byte, roomPageSize)
+		copy(request, roomMagic)
+		request[4] = roomList
+		request[5] = byte(page)
+		tag := tokenTag()
+		copy(request[6:14], tag[:])
+		received := false
+		for try := 0; try < 3 && !received; try++ {
+			if _, err := c.Write(request); err != nil {
+				return nil, err
+			}
+			c.SetReadDeadline(time.Now().Add(1 * time.Second))
+			for {
+				n, err := c.Read(buffer)
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+				if n < 7 || string(buffer[:4]) != roomMagic || buffer[4] != roomEntries || int(buffer[5]) != page {
+					continue
+				}
+				pages = int(buffer[6])
+				entries, err := parseRooms(buffer[7:n])
+				if err != nil {
+					return nil, err
+				}
+				listings = append(listings, entries...)
+				received = true
+				break
+			}
+		}
+		if !received {
+			return nil, errors.New("no answer from the relay")
+		}
+	}
+	return listings, nil
+}
+
+func parseRooms(b []byte) ([]roomListing, error) {
+	var listings []roomListing
+	for len(b) > 0 {
+		var fields [3]string
+		for i := range fields {
+			if len(b) < 1 || len(b) < 1+int(b[0]) {
+				return nil, errors.New("truncated room entry")
+			}
+			fields[i] = string(b[1 : 1+int(b[0])])
+			b = b[1+int(b[0]):]
+		}
+		if len(b) < 3 {
+			return nil, errors.New("truncated room entry")
+		}
+		listings = append(listings, roomListing{
+			room:   fields[0],
+			game:   fields[1],
+			region: fields[2],
+			rtt:    time.Duration(binary.BigEndian.Uint16(b[:2])) * time.Millisecond,
+			flags:  b[2],
+		})
+		b = b[3:]
+	}
+	return listings, nil
+}
+
+// describe formats a listing for the room browser; rtt is the round trip
+// time from this host to the relay, 0 if unknown.
+func (l roomListing) describe(rtt time.Duration) string {
+	var details []string
+	if p := presets[l.game]; p != nil {
+		details = append(details, p.title)
+	} else if l.game != "" {
+		details = append(details, l.game)
+	}
+	if l.region != "" {
+		details = append(details, l.region)
+	}
+	if l.flags&roomPassword != 0 {
+		details = append(details, "password")
+	}
+	if l.rtt > 0 && rtt > 0 {
+		// peers reach each other directly, this is an upper bound in most cases
+		details = append(details, "ping ~"+strconv.Itoa(int((l.rtt+rtt)/time.Millisecond))+"ms")
+	}
+	if len(details) == 0 {
+		return l.room
+	}
+	return l.room + " (" + strings.Join(details, ", ") + ")"
+}
+
+// browseRooms shows the rooms listed on the relay until one is chosen.
+func browseRooms(scanner *bufio.Scanner) (roomListing, bool) {
+	relayAddr, err := resolveRelay(&session{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error resolving relay: "+err.Error())
+		return roomListing{}, false
+	}
+	for {
+		fmt.Println("Fetching the rooms...")
+		if err := authenticateRelay(&session{}, relayAddr, nil); err != nil {
+			fmt.Fprintln(os.Stderr, "Error "+err.Error())
+		}
+		listings, err := fetchRooms(relayAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error fetching the rooms: "+err.Error())
+		}
+		sort.Slice(listings, func(i, j int) bool {
+			// closest hosts first, unknown last
+			a, b := listings[i].rtt, listings[j].rtt
+			return a != 0 && (b == 0 || a < b)
+		})
+		rtt, _ := relayRtt(relayAddr)
+		if len(listings) == 0 {
+			fmt.Println("No open rooms.")
+		}
+		for i, l := range listings {
+			fmt.Println("[" + strconv.Itoa(i+1) + "] " + l.describe(rtt))
+		}
+		fmt.Println("Room? (type its number, or press Enter to refresh)")
+		if !scanner.Scan() {
+			return roomListing{}, false
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		if err != nil || i < 1 || i > len(listings) {
+			continue
+		}
+		l := listings[i-1]
+		if l.flags&roomPassword != 0 && password == "" {
+			fmt.Println("Password?")
+			if !scanner.Scan() {
+				return roomListing{}, false
+			}
+			password = scanner.Text()
+		}
+		return l, true
+	}
+}
+
+// list runs the room browser, then joins the chosen room.
+func list(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	configFile := fs.String("config", "proxypunch.yml", "load the relay configuration from file")
+	fs.StringVar(&relay, "relay", "", "relay host, optionally with its port (default: relay: in the configuration file, or "+relayHost+")")
+	fs.StringVar(&password, "password", "", "password presented to the host, prompted if needed")
+	fs.StringVar(&token, "token", "", "community token, to list the rooms of a community (default: token: in the configuration file)")
+	fs.Parse(args)
+
+	applyConfig(loadConfig(*configFile))
+
+	l, ok := browseRooms(bufio.NewScanner(os.Stdin))
+	if !ok {
+		return
+	}
+	// join on the relay listing the room
+	relayChoices = relayChoices[:1]
+	client(&session{preset: presets[l.game]}, "#"+l.room, 0)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleConfig is a session started automatically in daemon mode.
+type ScheduleConfig struct {
+	// Start is the weekday and local time the session starts at, e.g.
+	// "sat 20:00", or only the time to start it every day.
+	Start    string `yaml:"start"`
+	Duration string `yaml:"duration"`
+	// Profile is the name of the session to start, from sessions:.
+	Profile string `yaml:"profile"`
+	// Args are additional flags, e.g. -publish.
+	Args []string `yaml:"args,omitempty"`
+}
+
+// scheduleCheckInterval bounds the time the scheduler sleeps, so that it
+// notices clock changes and system suspends.
+const scheduleCheckInterval = 1 * time.Minute
+
+// scheduleRestartDelay is the delay before restarting a scheduled session
+// that ended before the end of its slot.
+const scheduleRestartDelay = 5 * time.Second
+
+type scheduled struct {
+	desc string
+	// weekday is the day the session starts at, -1 for every day.
+	weekday  int
+	hour     int
+	minute   int
+	duration time.Duration
+	args     []string
+	// started is the last start time the session was started for.
+	started time.Time
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseSchedule(config ScheduleConfig, sessions []SessionConfig) (*scheduled, error) {
+	e := &scheduled{
+		desc:    config.Profile + " (" + config.Start + ", " + config.Duration + ")",
+		weekday: -1,
+	}
+	fields := strings.Fields(strings.ToLower(config.Start))
+	if len(fields) == 2 {
+		for i, v := range weekdays {
+			if strings.HasPrefix(fields[0], v) {
+				e.weekday = i
+			}
+		}
+		if e.weekday < 0 {
+			return nil, errors.New("invalid weekday " + fields[0] + ", must be one of: " + strings.Join(weekdays, ", "))
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return nil, errors.New("invalid start " + config.Start + ", must be a weekday and a time, e.g. sat 20:00, or a time")
+	}
+	t, err := time.Parse("15:04", fields[0])
+	if err != nil {
+		return nil, errors.New("invalid start time " + fields[0] + ", must be e.g. 20:00")
+	}
+	e.hour, e.minute = t.Hour(), t.Minute()
+	e.duration, err = time.ParseDuration(config.Duration)
+	if err != nil || e.duration <= 0 {
+		return nil, errors.New("invalid duration " + config.Duration + ", must be e.g. 3h")
+	}
+
+	for _, s := range sessions {
+		if s.Name != config.Profile {
+			continue
+		}
+		e.args, err = sessionArgs(s)
+		if err != nil {
+			return nil, err
+		}
+		e.args = append(e.args, config.Args...)
+		return e, nil
+	}
+	return nil, errors.New("unknown profile " + config.Profile + ", must be the name of a session under sessions:")
+}
+
+// sessionArgs returns the flags that start a session without prompting.
+func sessionArgs(config SessionConfig) ([]string, error) {
+	var args []string
+	var p *preset
+	if config.Game != "" {
+		p = presets[config.Game]
+		if p == nil {
+			return nil, errors.New("unknown game preset " + config.Game + ", must be one of: " + presetNames())
+		}
+		args = append(args, "-game", config.Game)
+	}
+	switch config.Mode {
+	case "server", "s":
+		port := config.LocalPort
+		if port == 0 && p != nil {
+			port = p.port
+		}
+		if port <= 0 || port > 65535 {
+			return nil, errors.New("invalid or missing local_port for server session")
+		}
+		args = append(args, "-mode", "server", "-port", strconv.Itoa(port))
+	case "client", "c":
+		port := config.RemotePort
+		if port == 0 && p != nil {
+			port = p.port
+		}
+		if config.Host == "" || ((port <= 0 || port > 65535) && !isName(config.Host) && !isRoom(config.Host)) {
+			return nil, errors.New("invalid or missing remote_host or remote_port for client session")
+		}
+		args = append(args, "-mode", "client", "-host", config.Host)
+		if port != 0 {
+			args = append(args, "-port", strconv.Itoa(port))
+		}
+	default:
+		return nil, errors.New("invalid session mode " + config.Mode + ", must be server or client")
+	}
+	return args, nil
+}
+
+// starts returns the last start time of the session not after now, and the
+// next one after now.
+func (e *scheduled) starts(now time.Time) (last time.Time, next time.Time) {
+	for i := -7; i <= 7; i++ {
+		t := time.Date(now.Year(), now.Month(), now.Day()+i, e.hour, e.minute, 0, 0, time.Local)
+		if e.weekday >= 0 && int(t.Weekday()) != e.weekday {
+			continue
+		}
+		if !t.After(now) {
+			last = t
+		} else if next.IsZero() {
+			next = t
+		}
+	}
+	return last, next
+}
+
+// runSchedule runs the scheduled sessions of the config as they come, each in
+// its own proxypunch process stopped with -duration at the end of its slot.
+func runSchedule(configFile string, config Config) {
+	if len(config.Schedule) == 0 {
+		fmt.Fprintln(os.Stderr, "Error no sessions scheduled in the config file, add them under schedule:")
+		return
+	}
+	var entries []*scheduled
+	for _, v := range config.Schedule {
+		e, err := parseSchedule(v, config.Sessions)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error in schedule "+v.Profile+": "+err.Error())
+			return
+		}
+		entries = append(entries, e)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding the proxypunch executable: "+err.Error())
+		return
+	}
+
+	var reported time.Time
+	for {
+		now := time.Now()
+		var next time.Time
+		var nextEntry *scheduled
+		for _, e := range entries {
+			last, n := e.starts(now)
+			if end := last.Add(e.duration); now.Before(end) && !e.started.Equal(last) {
+				// also start sessions whose slot began while not running
+				e.started = last
+				startScheduled(exe, configFile, e, end)
+			}
+			if next.IsZero() || n.Before(next) {
+				next, nextEntry = n, e
+			}
+		}
+		if !next.Equal(reported) {
+			reported = next
+			fmt.Println(timestamp() + "Next scheduled session: " + nextEntry.desc + " on " + next.Format("Mon Jan 2 15:04"))
+		}
+		wait := time.Until(next)
+		if wait > scheduleCheckInterval {
+			wait = scheduleCheckInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// startScheduled runs a scheduled session until end, restarting it if it
+// ends before, e.g. when the peer leaves.
+func startScheduled(exe string, configFile string, e *scheduled, end time.Time) {
+	fmt.Println(timestamp() + "Starting scheduled session " + e.desc + " until " + end.Format("15:04"))
+	go func() {
+		for {
+			remaining := time.Until(end).Round(time.Second)
+			args := append([]string{"-noupdate", "-nosave", "-config", configFile, "-duration", remaining.String()}, e.args...)
+			cmd := exec.Command(exe, args...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				fmt.Fprintln(os.Stderr, timestamp()+"Error running scheduled session "+e.desc+": "+err.Error())
+			}
+			if time.Until(end) < scheduleRestartDelay {
+				fmt.Println(timestamp() + "Scheduled session " + e.desc + " ended")
+				return
+			}
+			fmt.Println(timestamp() + "Scheduled session " + e.desc + " ended before the end of its slot, restarting it")
+			time.Sleep(scheduleRestartDelay)
+		}
+	}()
+}
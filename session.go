@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusInterval is the minimum interval between two prints of the combined
+// status of concurrent sessions.
+const statusInterval = 1 * time.Second
+
+// consoleMu serializes the output of concurrent sessions.
+var consoleMu sync.Mutex
+
+// session is a single proxied game; several sessions can run concurrently
+// with -all.
+type session struct {
+	// name prefixes the output of the session; it is empty when running a
+	// single session.
+	name   string
+	preset *preset
+	// desc describes the session in the combined status.
+	desc string
+	// relay overrides the relay host and port for this session, to reach
+	// registered names on other relays, or to use the fastest relay of
+	// relayChoices; alternates are the other relays that answered.
+	relay      string
+	alternates []relayChoice
+	// relayCaps are the capabilities of the relay, see negotiateRelay;
+	// legacyRelay is set when it predates versions, and only knows the
+	// legacy registrations.
+	relayCaps   uint16
+	legacyRelay bool
+	// channel is the ID of the relayed channel of a private host listed on
+	// the lobby, whose address is hidden.
+	channel []byte
+	// tcpGame accepts the TCP connection of the game in client mode with
+	// -proto tcp or tcp-udp.
+	tcpGame net.Listener
+	// keepalive overrides the payload of the punch packets for this session.
+	keepalive string
+
+	mu      sync.Mutex
+	state   string
+	changed bool
+	// external is the public address of the proxy socket as seen by the
+	// relay, nil until known.
+	external *net.UDPAddr
+	// opponent is the nickname of the peer, if known; connected and ping
+	// are the state of the connection to the peer.
+	opponent  string
+	connected bool
+	ping      time.Duration
+}
+
+type SessionConfig struct {
+	Name       string `yaml:"name"`
+	Mode       string `yaml:"mode"`
+	LocalPort  int    `yaml:"local_port,omitempty"`
+	Host       string `yaml:"remote_host,omitempty"`
+	RemotePort int    `yaml:"remote_port,omitempty"`
+	Game       string `yaml:"game,omitempty"`
+	Keepalive  string `yaml:"keepalive_payload,omitempty"`
+}
+
+func (s *session) println(msg string) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	fmt.Println(timestamp() + s.prefix() + msg)
+}
+
+func (s *session) errorln(msg string) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+	fmt.Fprintln(os.Stderr, timestamp()+s.prefix()+msg)
+}
+
+// decoration prints a decorative line of the session, unless in plain mode.
+func (s *session) decoration(line string) {
+	if !plain {
+		s.println(line)
+	}
+}
+
+func (s *session) prefix() string {
+	if s.name == "" {
+		return ""
+	}
+	return "[" + s.name + "] "
+}
+
+// setState updates the state shown in the combined status of sessions; in
+// plain mode, state changes are printed right away instead.
+func (s *session) setState(state string) {
+	s.mu.Lock()
+	changed := s.state != state
+	if changed {
+		s.state = state
+		s.changed = true
+	}
+	s.mu.Unlock()
+	if changed && plain {
+		s.println(sentence(state))
+	}
+}
+
+// setExternal records the public address of the proxy socket.
+func (s *session) setExternal(addr *net.UDPAddr) {
+	s.mu.Lock()
+	s.external = addr
+	s.mu.Unlock()
+}
+
+// externalChanged records the public address addr of the proxy socket, and
+// returns whether its IP differs from the previous one.
+func (s *session) externalChanged(addr *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.external != nil && !s.external.IP.Equal(addr.IP)
+	s.external = addr
+	return changed
+}
+
+// setConnected records that the peer is connected.
+func (s *session) setConnected() {
+	s.mu.Lock()
+	s.connected = true
+	s.mu.Unlock()
+}
+
+// isConnected returns whether the peer connected.
+func (s *session) isConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// setOpponent records the nickname of the peer.
+func (s *session) setOpponent(nickname string) {
+	s.mu.Lock()
+	s.opponent = nickname
+	s.mu.Unlock()
+}
+
+// setPing records the last round trip time to the peer.
+func (s *session) setPing(rtt time.Duration) {
+	s.mu.Lock()
+	s.ping = rtt
+	s.mu.Unlock()
+}
+
+// runAll runs all sessions defined in the config concurrently, printing
+// their combined status whenever it changes, until all of them stopped.
+func runAll(configs []SessionConfig) {
+	if len(configs) == 0 {
+		fmt.Fprintln(os.Stderr, "Error no sessions defined in the config file, add them under sessions:")
+		return
+	}
+	var sessions []*session
+	var wg sync.WaitGroup
+	for i, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = "session " + strconv.Itoa(i+1)
+		}
+		s := &session{
+			name:  name,
+			state: "starting",
+		}
+		if _, err := parseKeepalivePayload(config.Keepalive); err != nil {
+			s.errorln("Error " + err.Error())
+			continue
+		}
+		s.keepalive = config.Keepalive
+		if config.Game != "" {
+			s.preset = presets[config.Game]
+			if s.preset == nil {
+				s.errorln("Error unknown game preset " + config.Game + ", must be one of: " + presetNames())
+				continue
+			}
+		}
+		switch config.Mode {
+		case "server", "s":
+			port := config.LocalPort
+			if port == 0 && s.preset != nil {
+				port = s.preset.port
+			}
+			if port <= 0 || port > 65535 {
+				s.errorln("Error invalid or missing local_port for server session")
+				continue
+			}
+			s.desc = "server on port " + strconv.Itoa(port)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				server(s, port)
+			}()
+		case "client", "c":
+			port := config.RemotePort
+			if port == 0 && s.preset != nil {
+				port = s.preset.port
+			}
+			if config.Host == "" || ((port <= 0 || port > 65535) && !isName(config.Host) && !isRoom(config.Host) && !isCode(config.Host)) {
+				s.errorln("Error invalid or missing remote_host or remote_port for client session")
+				continue
+			}
+			s.desc = "client to " + net.JoinHostPort(config.Host, strconv.Itoa(port))
+			if isName(config.Host) || isRoom(config.Host) || isCode(config.Host) {
+				s.desc = "client to " + config.Host
+			}
+			host := config.Host
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				client(s, host, port)
+			}()
+		default:
+			s.errorln("Error invalid session mode " + config.Mode + ", must be server or client")
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	if len(sessions) == 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			fmt.Println("All sessions stopped")
+			return
+		case <-ticker.C:
+		}
+		changed := false
+		for _, s := range sessions {
+			s.mu.Lock()
+			changed = changed || s.changed
+			s.changed = false
+			s.mu.Unlock()
+		}
+		if !changed || plain {
+			continue
+		}
+		consoleMu.Lock()
+		fmt.Println("Status:")
+		for _, s := range sessions {
+			s.mu.Lock()
+			status := "  " + s.name + " (" + s.desc + "): " + s.state
+			if s.external != nil {
+				status += " (external address " + s.external.String() + ")"
+			}
+			fmt.Println(status)
+			s.mu.Unlock()
+		}
+		consoleMu.Unlock()
+	}
+}
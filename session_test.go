@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHostKinds(t *testing.T) {
+	tests := []struct {
+		host string
+		code bool
+		name bool
+		room bool
+	}{
+		{"BLUE-FOX-41", true, false, false},
+		{"blue-fox-41", true, false, false},
+		{"BLUE-FOX-4", false, false, false},
+		{"BLUE-FOX-4A", false, false, false},
+		{"BLUE--41", false, false, false},
+		{"BLUE-F0X-41", false, false, false},
+		{"BLUE-FOX-41-2", false, false, false},
+		{"203.0.113.5", false, false, false},
+		{"example.com", false, false, false},
+		{"alice@", false, true, false},
+		{"alice@relay.example.com", false, true, false},
+		{"#friday", false, false, true},
+		{"#me@home", false, false, true},
+		{"", false, false, false},
+	}
+	for _, tt := range tests {
+		if got := isCode(tt.host); got != tt.code {
+			t.Errorf("isCode(%q) = %v, want %v", tt.host, got, tt.code)
+		}
+		if got := isName(tt.host); got != tt.name {
+			t.Errorf("isName(%q) = %v, want %v", tt.host, got, tt.name)
+		}
+		if got := isRoom(tt.host); got != tt.room {
+			t.Errorf("isRoom(%q) = %v, want %v", tt.host, got, tt.room)
+		}
+	}
+}
+
+func TestParseKeepalivePayload(t *testing.T) {
+	tests := []struct {
+		v       string
+		payload []byte
+		err     bool
+	}{
+		{"", []byte{typePunch}, false},
+		{"silent", []byte{}, false},
+		{"7f00", []byte{0x7f, 0x00}, false},
+		{"0x7F00", []byte{0x7f, 0x00}, false},
+		{"cb", []byte{0xcb}, false},
+		{"dc", []byte{0xdc}, false},
+		{"cc", nil, true},
+		{"db01", nil, true},
+		{"7f0", nil, true},
+		{"zz", nil, true},
+		{"0x", nil, true},
+		{string(bytes.Repeat([]byte("ab"), maxKeepalivePayload)), bytes.Repeat([]byte{0xab}, maxKeepalivePayload), false},
+		{string(bytes.Repeat([]byte("ab"), maxKeepalivePayload+1)), nil, true},
+	}
+	for _, tt := range tests {
+		payload, err := parseKeepalivePayload(tt.v)
+		if (err != nil) != tt.err {
+			t.Errorf("parseKeepalivePayload(%q) error = %v, want error %v", tt.v, err, tt.err)
+			continue
+		}
+		if !tt.err && !bytes.Equal(payload, tt.payload) {
+			t.Errorf("parseKeepalivePayload(%q) = %x, want %x", tt.v, payload, tt.payload)
+		}
+	}
+}
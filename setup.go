@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// setup walks through the first-time steps: NAT detection, game preset, mode,
+// firewall rule and autostart, and saves the answers to the profile.
+func setup(args []string) {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	configFile := fs.String("config", "proxypunch.yml", "save the profile to file")
+	fs.StringVar(&relay, "relay", "", "relay host, optionally with its port (default: relay: in the configuration file, or "+relayHost+")")
+	fs.Parse(args)
+
+	config := loadConfig(*configFile)
+	applyConfig(config)
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Println("Setting up proxypunch. Press Enter to keep the answer in brackets.")
+
+	fmt.Println()
+	fmt.Println("[1/5] Checking your network...")
+	s := &session{}
+	if relayAddr, err := resolveRelay(s); err != nil {
+		fmt.Fprintln(os.Stderr, "Error resolving relay: "+err.Error())
+	} else if r, err := detectNat(relayAddr); err != nil {
+		fmt.Fprintln(os.Stderr, "Error relay "+relayName(s)+" is not answering ("+err.Error()+"): check your internet connection, or that UDP is not blocked on this network")
+	} else {
+		fmt.Println(r.describe())
+	}
+
+	fmt.Println()
+	fmt.Println("[2/5] Game")
+	for {
+		v, ok := ask(scanner, "Game preset? "+presetNames()+", or none", config.Game)
+		if !ok {
+			return
+		}
+		v = strings.ToLower(v)
+		if v == "none" {
+			config.Game = ""
+			break
+		}
+		if v == "" || presets[v] != nil {
+			config.Game = v
+			break
+		}
+		fmt.Println("Unknown game preset " + v)
+	}
+	gamePreset = presets[config.Game]
+
+	fmt.Println()
+	fmt.Println("[3/5] Mode")
+	for {
+		v, ok := ask(scanner, "Do you usually host (s(erver)) or connect to a host (c(lient))?", config.Mode)
+		if !ok {
+			return
+		}
+		v = strings.ToLower(v)
+		if v == "s" || v == "server" {
+			config.Mode = "server"
+			break
+		}
+		if v == "c" || v == "client" {
+			config.Mode = "client"
+			break
+		}
+	}
+	if config.Mode == "client" {
+		v, ok := ask(scanner, "Host you usually connect to? (empty: ask each time)", config.Host)
+		if !ok {
+			return
+		}
+		config.Host = v
+	}
+	port := config.LocalPort
+	if config.Mode == "client" {
+		port = config.RemotePort
+	}
+	if port == 0 && gamePreset != nil {
+		port = gamePreset.port
+	}
+	for {
+		v, ok := ask(scanner, "Port of the game?", portString(port))
+		if !ok {
+			return
+		}
+		p, err := strconv.Atoi(v)
+		if v == "" || err == nil && p > 0 && p <= 65535 {
+			port = p
+			break
+		}
+		fmt.Println("Invalid port " + v)
+	}
+	if config.Mode == "client" {
+		config.RemotePort = port
+	} else {
+		config.LocalPort = port
+	}
+	v, ok := ask(scanner, "Nickname shown on the public lobby?", config.Nickname)
+	if !ok {
+		return
+	}
+	config.Nickname = v
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding the proxypunch executable: "+err.Error())
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("[4/5] Firewall")
+	if yes, ok := askYes(scanner, "Allow proxypunch through the firewall, so that peers can connect directly?", true); !ok {
+		return
+	} else if yes {
+		if rule, err := addFirewallRule(exe); err != nil {
+			fmt.Fprintln(os.Stderr, "Error adding the firewall rule: "+err.Error())
+		} else {
+			fmt.Println(rule)
+		}
+	}
+
+	fmt.Println()
+	fmt.Println("[5/5] Autostart")
+	configPath, err := filepath.Abs(*configFile)
+	if err != nil {
+		configPath = *configFile
+	}
+	command := []string{exe, "-config", configPath, "-mode", config.Mode}
+	if config.Game != "" {
+		command = append(command, "-game", config.Game)
+	}
+	if config.Mode == "client" {
+		command = append(command, "-host", config.Host)
+	}
+	if port != 0 {
+		command = append(command, "-port", strconv.Itoa(port))
+	}
+	canAutostart := port != 0 && (config.Mode == "server" || config.Host != "")
+	if !canAutostart {
+		fmt.Println("Autostart needs a host and a port to start without asking, skipping.")
+	} else if yes, ok := askYes(scanner, "Start proxypunch when you log in?", config.Autostart); !ok {
+		return
+	} else if yes {
+		if err := enableAutostart(command); err != nil {
+			fmt.Fprintln(os.Stderr, "Error enabling autostart: "+err.Error())
+		} else {
+			config.Autostart = true
+			fmt.Println("proxypunch will start when you log in, with: " + strings.Join(command, " "))
+		}
+	} else if config.Autostart {
+		if err := disableAutostart(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error disabling autostart: "+err.Error())
+		} else {
+			config.Autostart = false
+			fmt.Println("Disabled autostart.")
+		}
+	}
+
+	saveConfig(*configFile, config)
+	fmt.Println()
+	fmt.Println("Saved your profile to " + configPath + ". Run proxypunch to start, or proxypunch setup again to change it.")
+}
+
+// ask prints a question with its default answer, and returns the answer, or
+// the default if empty; ok is false if the input ended.
+func ask(scanner *bufio.Scanner, question string, def string) (answer string, ok bool) {
+	if def != "" {
+		fmt.Println(question + " [" + def + "]")
+	} else {
+		fmt.Println(question)
+	}
+	if !scanner.Scan() {
+		return "", false
+	}
+	answer = strings.TrimSpace(scanner.Text())
+	if answer == "" {
+		answer = def
+	}
+	return answer, true
+}
+
+// askYes asks a yes or no question.
+func askYes(scanner *bufio.Scanner, question string, def bool) (yes bool, ok bool) {
+	d := "n"
+	if def {
+		d = "y"
+	}
+	for {
+		v, ok := ask(scanner, question+" y(es) / n(o)", d)
+		if !ok {
+			return false, false
+		}
+		v = strings.ToLower(v)
+		if v == "y" || v == "yes" {
+			return true, true
+		}
+		if v == "n" || v == "no" {
+			return false, true
+		}
+	}
+}
+
+func portString(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(port)
+}
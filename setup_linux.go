@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// addFirewallRule opens the default proxy port in ufw or firewalld, if either
+// is used.
+func addFirewallRule(exe string) (string, error) {
+	port := strconv.Itoa(defaultPort) + "/udp"
+	var command []string
+	if out, err := exec.Command("ufw", "status").Output(); err == nil && strings.Contains(string(out), "Status: active") {
+		command = []string{"ufw", "allow", port}
+	} else if exec.Command("firewall-cmd", "--state").Run() == nil {
+		command = []string{"firewall-cmd", "--permanent", "--add-port=" + port}
+	} else {
+		return "No active firewall found, nothing to do.", nil
+	}
+	if err := exec.Command(command[0], command[1:]...).Run(); err != nil {
+		return "", errors.New(err.Error() + "; run as root: " + strings.Join(command, " "))
+	}
+	if command[0] == "firewall-cmd" {
+		exec.Command("firewall-cmd", "--reload").Run()
+	}
+	return "Opened UDP port " + strconv.Itoa(defaultPort) + " in the firewall.", nil
+}
+
+func autostartFile() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "autostart", desktopFile), nil
+}
+
+func enableAutostart(command []string) error {
+	file, err := autostartFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	quoted := make([]string, len(command))
+	for i, v := range command {
+		quoted[i] = `"` + v + `"`
+	}
+	entry := strings.Join([]string{
+		"[Desktop Entry]",
+		"Type=Application",
+		"Name=proxypunch",
+		"Exec=" + strings.Join(quoted, " "),
+		"Terminal=true",
+	}, "\n") + "\n"
+	return ioutil.WriteFile(file, []byte(entry), 0644)
+}
+
+func disableAutostart() error {
+	file, err := autostartFile()
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
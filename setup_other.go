@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func addFirewallRule(exe string) (string, error) {
+	return "", errors.New("not supported on this platform")
+}
+
+func enableAutostart(command []string) error {
+	return errors.New("not supported on this platform")
+}
+
+func disableAutostart() error {
+	return errors.New("not supported on this platform")
+}
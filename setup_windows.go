@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+const autostartKey = `HKCU\Software\Microsoft\Windows\CurrentVersion\Run`
+
+func addFirewallRule(exe string) (string, error) {
+	if exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=proxypunch").Run() == nil {
+		return "The firewall rule for proxypunch already exists.", nil
+	}
+	err := exec.Command("netsh", "advfirewall", "firewall", "add", "rule", "name=proxypunch", "dir=in", "action=allow", "program="+exe, "protocol=UDP", "enable=yes").Run()
+	if err != nil {
+		return "", errors.New(err.Error() + "; run proxypunch setup as administrator, or allow proxypunch when Windows asks on its first run")
+	}
+	return "Added a firewall rule allowing proxypunch to receive UDP packets.", nil
+}
+
+func enableAutostart(command []string) error {
+	quoted := make([]string, len(command))
+	for i, v := range command {
+		quoted[i] = `"` + v + `"`
+	}
+	return exec.Command("reg", "add", autostartKey, "/v", "proxypunch", "/d", strings.Join(quoted, " "), "/f").Run()
+}
+
+func disableAutostart() error {
+	return exec.Command("reg", "delete", autostartKey, "/v", "proxypunch", "/f").Run()
+}
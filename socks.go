@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// socksPort is the port of the local SOCKS5 proxy of -socks, 0 if disabled.
+// Connections opened through it reach the same port on the computer of the
+// peer, whatever the address requested, if the peer also runs -socks.
+var socksPort int
+
+// maxSocksStreams bounds the count of -socks connections of a session.
+const maxSocksStreams = 64
+
+// socksOpenTimeout is the time the peer has to answer the opening of a
+// connection.
+const socksOpenTimeout = 5 * time.Second
+
+// socksOpener marks the stream keys of the connections opened by this
+// proxypunch. The packets of a stream carry the key of their sender, whose
+// flag the receiver flips to get its own key of the stream.
+const socksOpener = 0x80000000
+
+// Statuses of a SOCKS5 reply, also sent in typeSocksReply.
+const (
+	socksSucceeded   = 0x00
+	socksFailure     = 0x01
+	socksNotAllowed  = 0x02
+	socksRefused     = 0x05
+	socksUnsupported = 0x07
+	// socksPending is the status of a connection being opened.
+	socksPending = 0xff
+)
+
+// socksMux accepts the connections of the local SOCKS5 proxy, and opens the
+// connections of the peer on its ports.
+type socksMux struct {
+	p      *proxy
+	l      net.Listener
+	closed chan struct{}
+
+	mu      sync.Mutex
+	next    uint32
+	remote  uint32
+	streams map[uint32]*socksStream
+}
+
+type socksStream struct {
+	t *tcpTunnel
+	// status is the answer to the opening, opened receives it once.
+	status byte
+	opened chan byte
+}
+
+// newSocksMux listens on the port of -socks.
+func newSocksMux(p *proxy) (*socksMux, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(socksPort))
+	if err != nil {
+		return nil, err
+	}
+	return &socksMux{
+		p:       p,
+		l:       l,
+		closed:  make(chan struct{}),
+		streams: make(map[uint32]*socksStream),
+	}, nil
+}
+
+func (m *socksMux) run() {
+	for {
+		c, err := m.l.Accept()
+		if err != nil {
+			return
+		}
+		go m.serve(c)
+	}
+}
+
+func (m *socksMux) close() {
+	m.l.Close()
+	close(m.closed)
+}
+
+// stream returns a new stream of key, or nil if there are too many.
+func (m *socksMux) stream(key uint32) *socksStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.streams) >= maxSocksStreams {
+		return nil
+	}
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, key)
+	ss := &socksStream{
+		t:      newTcpTunnel(m.p, append([]byte{typeSocksData}, id...), append([]byte{typeSocksAck}, id...)),
+		status: socksPending,
+		opened: make(chan byte, 1),
+	}
+	m.streams[key] = ss
+	return ss
+}
+
+func (m *socksMux) remove(key uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, key)
+}
+
+func (m *socksMux) lookup(key uint32) *socksStream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.streams[key]
+}
+
+// serve handles a connection of the local SOCKS5 proxy: only CONNECT
+// requests without authentication are supported.
+func (m *socksMux) serve(c net.Conn) {
+	c.SetDeadline(time.Now().Add(socksOpenTimeout))
+	b := make([]byte, 262)
+	if _, err := io.ReadFull(c, b[:2]); err != nil || b[0] != 5 {
+		c.Close()
+		return
+	}
+	methods := b[2 : 2+int(b[1])]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		c.Close()
+		return
+	}
+	noAuth := false
+	for _, v := range methods {
+		noAuth = noAuth || v == 0
+	}
+	if !noAuth {
+		c.Write([]byte{5, 0xff})
+		c.Close()
+		return
+	}
+	c.Write([]byte{5, 0})
+	if _, err := io.ReadFull(c, b[:4]); err != nil || b[0] != 5 {
+		c.Close()
+		return
+	}
+	command := b[1]
+	var n int
+	switch b[3] {
+	case 1:
+		n = 4
+	case 3:
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			c.Close()
+			return
+		}
+		n = int(b[0])
+	case 4:
+		n = 16
+	default:
+		m.reply(c, socksUnsupported)
+		return
+	}
+	// the address is ignored: the connection reaches the computer of the peer
+	if _, err := io.ReadFull(c, b[:n+2]); err != nil {
+		c.Close()
+		return
+	}
+	port := binary.BigEndian.Uint16(b[n : n+2])
+	if command != 1 {
+		m.reply(c, socksUnsupported)
+		return
+	}
+
+	m.mu.Lock()
+	m.next++
+	key := socksOpener | m.next&^socksOpener
+	m.mu.Unlock()
+	ss := m.stream(key)
+	if ss == nil {
+		m.reply(c, socksFailure)
+		return
+	}
+	defer m.remove(key)
+	open := make([]byte, 7)
+	open[0] = typeSocksOpen
+	binary.BigEndian.PutUint32(open[1:5], key)
+	binary.BigEndian.PutUint16(open[5:7], port)
+	ticker := time.NewTicker(socksOpenTimeout / 10)
+	defer ticker.Stop()
+	timeout := time.After(socksOpenTimeout)
+	status := byte(socksFailure)
+wait:
+	for {
+		m.p.pushPeer(open, m.p.peer())
+		select {
+		case <-m.closed:
+			break wait
+		case <-timeout:
+			break wait
+		case status = <-ss.opened:
+			break wait
+		case <-ticker.C:
+		}
+	}
+	if status != socksSucceeded {
+		if status == socksNotAllowed {
+			m.p.s.errorln("Error " + m.p.peerName() + " does not accept connections through -socks, it must also run with -socks")
+		}
+		m.reply(c, status)
+		return
+	}
+	if m.reply(c, socksSucceeded) != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	ss.t.pipe(c, m.closed)
+}
+
+// reply answers the SOCKS5 request of c with status, closing c unless it
+// succeeded.
+func (m *socksMux) reply(c net.Conn, status byte) error {
+	_, err := c.Write([]byte{5, status, 0, 1, 0, 0, 0, 0, 0, 0})
+	if status != socksSucceeded {
+		c.Close()
+	}
+	return err
+}
+
+// socksKey returns the key of the stream of the -socks packet data of the
+// peer, whose sender flag is flipped.
+func socksKey(data []byte) uint32 {
+	return binary.BigEndian.Uint32(data[1:5]) ^ socksOpener
+}
+
+// opening returns the stream the peer opens with key, if it is known, and
+// whether key is a late copy of the opening of an ended connection: the peer
+// raises its keys with every connection, so a new key is recorded as its
+// latest.
+func (m *socksMux) opening(key uint32) (*socksStream, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ss, ok := m.streams[key]
+	if ok {
+		return ss, false
+	}
+	if int32(key-m.remote) <= 0 {
+		return nil, true
+	}
+	m.remote = key
+	return nil, false
+}
+
+// socksReceived handles the -socks packets of the peer.
+func (p *proxy) socksReceived(data []byte) {
+	if len(data) < 5 {
+		return
+	}
+	key := socksKey(data)
+	if data[0] == typeSocksOpen {
+		p.socksOpen(key, data)
+		return
+	}
+	if p.socks == nil {
+		return
+	}
+	ss := p.socks.lookup(key)
+	if ss == nil {
+		return
+	}
+	switch data[0] {
+	case typeSocksReply:
+		if len(data) == 6 {
+			select {
+			case ss.opened <- data[5]:
+			default:
+			}
+		}
+	case typeSocksData:
+		ss.t.received(data)
+	case typeSocksAck:
+		ss.t.receivedAck(data)
+	}
+}
+
+// socksOpen handles a typeSocksOpen packet of the peer: the connection is
+// opened to the local port it requests, if this proxypunch runs -socks.
+func (p *proxy) socksOpen(key uint32, data []byte) {
+	if len(data) != 7 || key&socksOpener != 0 {
+		return
+	}
+	reply := make([]byte, 6)
+	reply[0] = typeSocksReply
+	binary.BigEndian.PutUint32(reply[1:5], key)
+	m := p.socks
+	if m == nil {
+		reply[5] = socksNotAllowed
+		p.pushPeer(reply, p.peer())
+		return
+	}
+	ss, stale := m.opening(key)
+	if stale {
+		// a late copy of the opening of an ended connection
+		return
+	}
+	if ss != nil {
+		m.mu.Lock()
+		reply[5] = ss.status
+		m.mu.Unlock()
+		if reply[5] != socksPending {
+			p.pushPeer(reply, p.peer())
+		}
+		return
+	}
+	if ss = m.stream(key); ss == nil {
+		reply[5] = socksFailure
+		p.pushPeer(reply, p.peer())
+		return
+	}
+	port := int(binary.BigEndian.Uint16(data[5:7]))
+	go func() {
+		defer m.remove(key)
+		c, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), socksOpenTimeout/2)
+		status := byte(socksSucceeded)
+		if err != nil {
+			status = socksRefused
+		}
+		m.mu.Lock()
+		ss.status = status
+		m.mu.Unlock()
+		reply[5] = status
+		p.pushPeer(reply, p.peer())
+		if err != nil {
+			// keep answering copies of the opening for a while
+			select {
+			case <-m.closed:
+			case <-time.After(socksOpenTimeout):
+			}
+			return
+		}
+		if verbose {
+			p.s.println(p.peerName() + " opened a connection to port " + strconv.Itoa(port) + " through -socks")
+		}
+		ss.t.pipe(c, m.closed)
+	}()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func socksPacket(typ byte, key uint32) []byte {
+	b := make([]byte, 5)
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], key)
+	return b
+}
+
+func TestSocksKey(t *testing.T) {
+	tests := []struct {
+		name string
+		sent uint32
+		key  uint32
+	}{
+		{"opening of the peer", socksOpener | 1, 1},
+		{"answer of the peer", 1, socksOpener | 1},
+		{"last key", socksOpener | 0x7fffffff, 0x7fffffff},
+	}
+	for _, tt := range tests {
+		if got := socksKey(socksPacket(typeSocksOpen, tt.sent)); got != tt.key {
+			t.Errorf("%s: socksKey(%#x) = %#x, want %#x", tt.name, tt.sent, got, tt.key)
+		}
+	}
+	// the key the peer answers with is flipped back to the key of the opener
+	opener := uint32(socksOpener | 42)
+	if got := socksKey(socksPacket(typeSocksReply, socksKey(socksPacket(typeSocksOpen, opener)))); got != opener {
+		t.Errorf("round trip of %#x = %#x", opener, got)
+	}
+}
+
+func TestSocksOpening(t *testing.T) {
+	m := &socksMux{
+		streams: make(map[uint32]*socksStream),
+	}
+	known := &socksStream{}
+	steps := []struct {
+		name  string
+		key   uint32
+		known bool
+		stale bool
+		// add and remove make the key a stream before and after the step.
+		add    bool
+		remove bool
+	}{
+		{name: "first opening", key: 1, add: true},
+		{name: "copy of an opening", key: 1, known: true, remove: true},
+		{name: "copy of an ended opening", key: 1, stale: true},
+		{name: "later opening", key: 3},
+		{name: "earlier opening", key: 2, stale: true},
+		{name: "next opening", key: 4},
+	}
+	for _, s := range steps {
+		ss, stale := m.opening(s.key)
+		if (ss != nil) != s.known || stale != s.stale {
+			t.Fatalf("%s: opening(%d) = %v, %v, want known %v, stale %v", s.name, s.key, ss, stale, s.known, s.stale)
+		}
+		if s.add {
+			m.streams[s.key] = known
+		}
+		if s.remove {
+			delete(m.streams, s.key)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net"
+
+// spectators is the count of spectators a host accepts besides its peers,
+// set with -spectators. Without spectatorPort, spectators receive a copy of
+// the packets the game sends to the first peer, and their packets do not
+// reach the game; with spectatorPort, they are forwarded to that port of the
+// game, for games with a spectator port of their own.
+var spectators int
+var spectatorPort int
+
+// fanOut copies a packet the game sent to the first peer, received on from,
+// to the spectators watching its traffic.
+func (t *peerTable) fanOut(from *peerConn, data []byte, addr *net.UDPAddr) {
+	if from.spectator {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pc := range t.peers {
+		if !pc.spectator {
+			if pc != from {
+				// not the first peer
+				return
+			}
+			break
+		}
+	}
+	for _, pc := range t.peers {
+		if pc.readOnly {
+			pc.push(data, addr)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxFrames is the largest frame budget tracked by the delay statistics.
+const maxFrames = 10
+
+// rttStats tracks the round trip time to the peer, measured with pings.
+type rttStats struct {
+	sync.Mutex
+	samples  int
+	last     time.Duration
+	smoothed time.Duration
+	jitter   time.Duration
+	// exceeded[i] is the count of samples whose one-way latency exceeded a
+	// budget of i+1 frames.
+	exceeded [maxFrames]int
+}
+
+func (s *rttStats) add(rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if s.samples == 0 {
+		s.smoothed = rtt
+		s.jitter = rtt / 2
+	} else {
+		// as in RFC 6298
+		diff := s.smoothed - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		s.jitter += (diff - s.jitter) / 4
+		s.smoothed += (rtt - s.smoothed) / 8
+	}
+	s.samples++
+	s.last = rtt
+	frame := frameTime()
+	for i := range s.exceeded {
+		if rtt/2 > time.Duration(i+1)*frame {
+			s.exceeded[i]++
+		}
+	}
+}
+
+func frameTime() time.Duration {
+	return time.Duration(float64(time.Second) / float64(fps))
+}
+
+// recommendedDelay returns the frame delay a rollback game should use so
+// that most inputs arrive before they are needed.
+func (s *rttStats) recommendedDelay() int {
+	oneWay := s.smoothed/2 + s.jitter
+	return int(math.Ceil(float64(oneWay) / float64(frameTime())))
+}
+
+// delayReport describes the measured latency in terms of game frames.
+func (s *rttStats) delayReport() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.samples == 0 {
+		return "No ping measured yet (the peer may be using an older proxypunch version)."
+	}
+	delay := s.recommendedDelay()
+	report := "Ping " + s.smoothed.Round(time.Millisecond).String() + " (jitter " + s.jitter.Round(time.Millisecond).String() + "): recommended delay " + frames(delay) + " at " + strconv.Itoa(fps) + " fps."
+	report += " Latency exceeded"
+	for i, exceeded := range s.exceeded {
+		if i > 0 {
+			if exceeded == 0 && i+1 > delay {
+				break
+			}
+			report += ","
+		}
+		report += " " + frames(i+1) + " " + strconv.Itoa(exceeded*100/s.samples) + "% of the time"
+	}
+	return report + "."
+}
+
+func frames(n int) string {
+	if n == 1 {
+		return "1 frame"
+	}
+	return strconv.Itoa(n) + " frames"
+}
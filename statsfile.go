@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsFile is the file the connection statistics are appended to, as CSV,
+// or as JSON lines if it ends with .json; empty to disable.
+var statsFile string
+
+// statsFileInterval is the interval of the recorded statistics.
+const statsFileInterval = 10 * time.Second
+
+// statsOutput is the open statistics file, shared by all sessions.
+var statsOutput struct {
+	sync.Mutex
+	f    *os.File
+	json bool
+}
+
+var statsColumns = []string{"time", "session", "peer", "seconds", "rtt_min_ms", "rtt_avg_ms", "rtt_max_ms", "loss_percent", "sent_packets", "sent_kbps", "received_packets", "received_kbps", "lost_packets", "corrupted_packets"}
+
+// statsRecord holds the statistics of an interval of a session.
+type statsRecord struct {
+	Time            string  `json:"time"`
+	Session         string  `json:"session,omitempty"`
+	Peer            string  `json:"peer"`
+	Seconds         float64 `json:"seconds"`
+	RttMin          float64 `json:"rtt_min_ms"`
+	RttAvg          float64 `json:"rtt_avg_ms"`
+	RttMax          float64 `json:"rtt_max_ms"`
+	Loss            float64 `json:"loss_percent"`
+	SentPackets     int     `json:"sent_packets"`
+	SentKbps        float64 `json:"sent_kbps"`
+	ReceivedPackets int     `json:"received_packets"`
+	ReceivedKbps    float64 `json:"received_kbps"`
+	// LostPackets and CorruptedPackets are the game packets of the peer lost
+	// and dropped as corrupted, if it sends them with -integrity.
+	LostPackets      int `json:"lost_packets"`
+	CorruptedPackets int `json:"corrupted_packets"`
+}
+
+// openStatsFile opens the statistics file for appending, writing the CSV
+// header if it is new.
+func openStatsFile() error {
+	if statsFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(statsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	statsOutput.f = f
+	statsOutput.json = strings.EqualFold(filepath.Ext(statsFile), ".json")
+	if info, err := f.Stat(); err == nil && info.Size() == 0 && !statsOutput.json {
+		w := csv.NewWriter(f)
+		w.Write(statsColumns)
+		w.Flush()
+	}
+	return nil
+}
+
+func writeStats(r statsRecord) {
+	statsOutput.Lock()
+	defer statsOutput.Unlock()
+	if statsOutput.f == nil {
+		return
+	}
+	if statsOutput.json {
+		json.NewEncoder(statsOutput.f).Encode(r)
+		return
+	}
+	w := csv.NewWriter(statsOutput.f)
+	w.Write([]string{r.Time, r.Session, r.Peer, formatFloat(r.Seconds), formatFloat(r.RttMin), formatFloat(r.RttAvg), formatFloat(r.RttMax), formatFloat(r.Loss), strconv.Itoa(r.SentPackets), formatFloat(r.SentKbps), strconv.Itoa(r.ReceivedPackets), formatFloat(r.ReceivedKbps), strconv.Itoa(r.LostPackets), strconv.Itoa(r.CorruptedPackets)})
+	w.Flush()
+}
+
+// round rounds v to one decimal.
+func round(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+// intervalStats accumulates the statistics of the current interval, once
+// connected to the peer.
+type intervalStats struct {
+	sync.Mutex
+	start           time.Time
+	lastPing        time.Time
+	pings           int
+	pongs           int
+	rttMin          time.Duration
+	rttMax          time.Duration
+	rttSum          time.Duration
+	sentPackets     int
+	sentBytes       int
+	receivedPackets int
+	receivedBytes   int
+	corrupted       int
+}
+
+func (s *intervalStats) ping() {
+	s.Lock()
+	now := time.Now()
+	if s.start.IsZero() {
+		s.start = now
+	}
+	s.lastPing = now
+	s.pings++
+	s.Unlock()
+}
+
+func (s *intervalStats) pong(rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if s.pongs == 0 || rtt < s.rttMin {
+		s.rttMin = rtt
+	}
+	if rtt > s.rttMax {
+		s.rttMax = rtt
+	}
+	s.rttSum += rtt
+	s.pongs++
+}
+
+func (s *intervalStats) sent(n int) {
+	s.Lock()
+	s.sentPackets++
+	s.sentBytes += n
+	s.Unlock()
+}
+
+func (s *intervalStats) received(n int) {
+	s.Lock()
+	s.receivedPackets++
+	s.receivedBytes += n
+	s.Unlock()
+}
+
+// corrupt counts a corrupted packet of the peer.
+func (s *intervalStats) corrupt() {
+	s.Lock()
+	s.corrupted++
+	s.Unlock()
+}
+
+// take returns the record of the interval and starts the next one; ok is
+// false if nothing was measured. The final interval is recorded even if
+// short.
+func (s *intervalStats) take(now time.Time, final bool) (r statsRecord, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	// the pong of the last ping may not have arrived yet: it is accounted
+	// for in the next interval, or ignored in the final one
+	due, carried := s.pings, 0
+	if now.Sub(s.lastPing) < pingInterval {
+		due--
+		if !final {
+			carried = 1
+		}
+	}
+	if s.pings == 0 || (due <= 0 && !final) {
+		return r, false
+	}
+	seconds := now.Sub(s.start).Seconds()
+	r = statsRecord{
+		Time:             now.Format(time.RFC3339),
+		Seconds:          round(seconds),
+		SentPackets:      s.sentPackets,
+		SentKbps:         round(float64(s.sentBytes) * 8 / 1000 / seconds),
+		ReceivedPackets:  s.receivedPackets,
+		ReceivedKbps:     round(float64(s.receivedBytes) * 8 / 1000 / seconds),
+		CorruptedPackets: s.corrupted,
+	}
+	if s.pongs > 0 {
+		r.RttMin = round(float64(s.rttMin) / float64(time.Millisecond))
+		r.RttMax = round(float64(s.rttMax) / float64(time.Millisecond))
+		r.RttAvg = round(float64(s.rttSum) / float64(s.pongs) / float64(time.Millisecond))
+	}
+	if s.pongs < due {
+		r.Loss = round(float64(due-s.pongs) * 100 / float64(due))
+	}
+	s.start = now
+	s.pings, s.pongs = carried, 0
+	s.rttMin, s.rttMax, s.rttSum = 0, 0, 0
+	s.sentPackets, s.sentBytes = 0, 0
+	s.receivedPackets, s.receivedBytes = 0, 0
+	s.corrupted = 0
+	return r, true
+}
+
+// recordStats appends the statistics of the current interval to the
+// statistics file; final is set at the end of the session.
+func (p *proxy) recordStats(final bool) {
+	r, ok := p.interval.take(time.Now(), final)
+	if !ok {
+		return
+	}
+	// the sequence numbers of corrupted packets are missing as well
+	if r.LostPackets = p.checkIn.takeLost() - r.CorruptedPackets; r.LostPackets < 0 {
+		r.LostPackets = 0
+	}
+	r.Session = p.s.name
+	r.Peer = p.peer().String()
+	if p.relayed {
+		r.Peer = "relayed"
+	}
+	writeStats(r)
+}
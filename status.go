@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// statusFile is the file the live status of the session is written to, for
+// streaming software overlays: as JSON if it ends with .json, otherwise
+// formatted with statusTemplate. Empty to disable.
+var statusFile string
+var statusTemplate string
+
+const defaultStatusTemplate = "{{.State}}{{if .Opponent}} vs {{.Opponent}}{{end}}{{if .Ping}} - {{.Ping}}ms{{end}}"
+
+// statusFileInterval is the interval at which the status file is updated.
+const statusFileInterval = 1 * time.Second
+
+// status is the live status of the session; it never contains addresses,
+// which would be shown on stream.
+type status struct {
+	State     string `json:"state"`
+	Opponent  string `json:"opponent"`
+	Ping      int    `json:"ping_ms"`
+	Connected bool   `json:"connected"`
+	Game      string `json:"game"`
+}
+
+// status returns the live status of the session.
+func (s *session) status() status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := status{
+		Opponent:  s.opponent,
+		Connected: s.connected,
+	}
+	if s.preset != nil {
+		v.Game = s.preset.title
+	}
+	switch {
+	case s.connected:
+		v.State = "Connected"
+		v.Ping = int((s.ping + time.Millisecond/2) / time.Millisecond)
+	case s.external != nil:
+		v.State = "Waiting for an opponent"
+	default:
+		v.State = "Connecting"
+	}
+	return v
+}
+
+// writeStatus writes the status file until the returned function is called,
+// which writes the final status.
+func writeStatus(s *session) (stop func()) {
+	if statusFile == "" {
+		return func() {}
+	}
+	t, err := template.New("status").Parse(statusTemplate)
+	if err != nil {
+		s.errorln("Error parsing the status template: " + err.Error())
+		return func() {}
+	}
+	write := func(v status) error {
+		var b bytes.Buffer
+		var err error
+		if strings.EqualFold(filepath.Ext(statusFile), ".json") {
+			err = json.NewEncoder(&b).Encode(v)
+		} else {
+			err = t.Execute(&b, v)
+		}
+		if err == nil {
+			err = writeFileAtomic(statusFile, b.Bytes())
+		}
+		if err != nil {
+			s.errorln("Error writing the status file: " + err.Error())
+		}
+		return err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(statusFileInterval)
+		defer ticker.Stop()
+		var last status
+		for {
+			// rewrite the status if it changed, or if writing it failed
+			if v := s.status(); v != last {
+				last = v
+				if write(v) != nil {
+					last = status{}
+				}
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		write(status{State: "Disconnected"})
+	}
+}
+
+// writeFileAtomic replaces file with data, so that readers never see a
+// partially written file.
+func writeFileAtomic(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
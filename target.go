@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// targetAddr is the address of the game set with -target in server mode, for
+// a game hosted on another device of the local network, e.g. when proxypunch
+// runs on a home server or a router; empty for a game on this host.
+var targetAddr string
+
+// targetIP is the address of the device of the game with -target, nil
+// without; targetPort is its port, 0 if not given.
+var targetIP net.IP
+var targetPort int
+
+func applyTarget() error {
+	if targetAddr == "" {
+		return nil
+	}
+	if targeting() {
+		return errors.New("-target cannot be used with -process or -pid, which find the game on this host")
+	}
+	host := targetAddr
+	if h, p, err := net.SplitHostPort(targetAddr); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			return errors.New("invalid target port " + p)
+		}
+		host, targetPort = h, port
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		return errors.New("invalid target " + targetAddr + ", must be an IPv4 address, optionally with a port, e.g. 192.168.1.50:10800")
+	}
+	targetIP = ip.To4()
+	if !targetIP.IsLoopback() {
+		// the packets of the game are local packets
+		lanNets = append(lanNets, &net.IPNet{IP: targetIP, Mask: net.CIDRMask(32, 32)})
+	}
+	return nil
+}
+
+// gameIP returns the address of the game in server mode.
+func gameIP() net.IP {
+	if targetIP != nil {
+		return targetIP
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// gameBindIP returns the address of the sockets exchanging packets with the
+// game in server mode besides the proxy socket: the loopback address, unless
+// the game runs on another device.
+func gameBindIP() net.IP {
+	if targetIP != nil && !targetIP.IsLoopback() {
+		return net.IPv4zero
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// proto is the transport of the game: udp, tcp to punch a TCP connection
+// once the peer is reached over UDP, and proxy the stream of the game over
+// it, or tcp-udp to proxy the stream of the game over the UDP session, see
+// tcpTunnel.
+var proto = "udp"
+
+// tcpPunchTimeout is the time spent opening the TCP connection to the peer
+// once its ports are known.
+const tcpPunchTimeout = 15 * time.Second
+
+func applyProto() error {
+	switch proto {
+	case "udp":
+		return nil
+	case "tcp":
+		if private || via != "" {
+			return errors.New("-proto tcp needs a direct connection to the peer, it cannot be used with -private or -via")
+		}
+		return nil
+	case "tcp-udp":
+		return nil
+	}
+	return errors.New("invalid protocol " + proto + ", must be udp, tcp or tcp-udp")
+}
+
+// listenGame accepts the TCP connection of the game in client mode, on the
+// port of the proxy socket.
+func listenGame(s *session, port int) net.Listener {
+	l, err := net.Listen("tcp4", ":"+strconv.Itoa(port))
+	if err != nil {
+		s.errorln("Error listening on TCP port " + strconv.Itoa(port) + ": " + err.Error())
+		return nil
+	}
+	return l
+}
+
+// tcpPunch opens a TCP connection to the peer by simultaneous open: both
+// peers exchange their TCP ports over the UDP session, then connect to each
+// other from a port they also listen on, so that the first SYN to cross the
+// NATs opens the connection.
+type tcpPunch struct {
+	p *proxy
+	// peerPorts receives the public and local TCP ports of the peer, once;
+	// mu protects got, set once they are known.
+	peerPorts chan [2]int
+	mu        sync.Mutex
+	got       bool
+}
+
+func newTcpPunch(p *proxy) *tcpPunch {
+	return &tcpPunch{
+		p:         p,
+		peerPorts: make(chan [2]int, 1),
+	}
+}
+
+// received handles the typeTcp packet of the peer.
+func (t *tcpPunch) received(data []byte) {
+	if len(data) != 5 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.got {
+		return
+	}
+	t.got = true
+	t.peerPorts <- [2]int{int(binary.BigEndian.Uint16(data[1:3])), int(binary.BigEndian.Uint16(data[3:5]))}
+}
+
+// run opens the TCP connection to the peer once connected over UDP, then
+// proxies the game stream over it, ending the session when it ends, until
+// done is closed.
+func (t *tcpPunch) run(done chan struct{}) {
+	p := t.p
+	for {
+		if _, connected := p.connectedPeer(); connected {
+			break
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	l, public, err := listenReused(p.relayAddr)
+	if err != nil {
+		p.s.errorln("Error opening a TCP port for the peer: " + err.Error())
+		return
+	}
+	local := l.Addr().(*net.TCPAddr).Port
+	payload := make([]byte, 5)
+	payload[0] = typeTcp
+	binary.BigEndian.PutUint16(payload[1:3], uint16(public))
+	binary.BigEndian.PutUint16(payload[3:5], uint16(local))
+
+	chConn := make(chan net.Conn, 2)
+	chPunch := make(chan struct{})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !t.fromPeer(c.RemoteAddr().(*net.TCPAddr).IP) {
+				c.Close()
+				continue
+			}
+			chConn <- c
+			return
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			p.c.WriteToUDP(payload, p.peer())
+			select {
+			case <-chPunch:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var peer [2]int
+	select {
+	case <-done:
+		close(chPunch)
+		l.Close()
+		return
+	case peer = <-t.peerPorts:
+	}
+	addr := t.target(peer)
+	if verbose {
+		p.s.println("Opening the TCP connection to the peer at " + addr.String())
+	}
+	go func() {
+		deadline := time.Now().Add(tcpPunchTimeout)
+		for time.Now().Before(deadline) {
+			d := net.Dialer{
+				LocalAddr: &net.TCPAddr{Port: local},
+				Control:   reuseControl,
+				Timeout:   1 * time.Second,
+			}
+			if c, err := d.Dial("tcp4", addr.String()); err == nil {
+				chConn <- c
+				return
+			}
+			select {
+			case <-chPunch:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+
+	var c net.Conn
+	select {
+	case <-done:
+	case c = <-chConn:
+	case <-time.After(tcpPunchTimeout + 1*time.Second):
+	}
+	close(chPunch)
+	l.Close()
+	if c == nil {
+		select {
+		case <-done:
+		default:
+			p.s.errorln("Error could not open a TCP connection to the peer at " + addr.String() + ": the NATs of both peers must allow TCP hole punching, or the TCP port must be forwarded, or use -proto tcp-udp")
+			p.close()
+		}
+		return
+	}
+	go func() {
+		// a late connection of the other attempt is not used
+		select {
+		case extra := <-chConn:
+			extra.Close()
+		case <-time.After(tcpPunchTimeout):
+		}
+	}()
+	defer c.Close()
+	p.s.println("Opened the TCP connection to the peer")
+
+	game := p.gameConn(done)
+	if game == nil {
+		return
+	}
+	defer game.Close()
+	go func() {
+		<-done
+		c.Close()
+		game.Close()
+	}()
+	go func() {
+		io.Copy(c, game)
+		c.Close()
+	}()
+	io.Copy(game, c)
+	game.Close()
+	select {
+	case <-done:
+	default:
+		p.s.println("The TCP connection of the game ended, ending the session")
+		p.close()
+	}
+}
+
+// gameConn returns the TCP connection to the game: to its port in server
+// mode, or the first one it opens to the proxy in client mode.
+func (p *proxy) gameConn(done chan struct{}) net.Conn {
+	if l := p.s.tcpGame; l != nil {
+		chGame := make(chan net.Conn, 1)
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				if !isLocal(c.RemoteAddr().(*net.TCPAddr).IP) {
+					c.Close()
+					continue
+				}
+				chGame <- c
+				return
+			}
+		}()
+		select {
+		case <-done:
+			l.Close()
+			return nil
+		case c := <-chGame:
+			return c
+		}
+	}
+	localAddr, _ := p.local()
+	if localAddr == nil {
+		return nil
+	}
+	addr := &net.TCPAddr{IP: localAddr.IP, Port: localAddr.Port}
+	for {
+		c, err := net.DialTimeout("tcp4", addr.String(), 1*time.Second)
+		if err == nil {
+			return c
+		}
+		p.s.errorln("Error connecting to the game on TCP " + addr.String() + " (" + err.Error() + "): check that it is running, and hosting on this port")
+		select {
+		case <-done:
+			return nil
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// target returns the TCP address of the peer to connect to, from its public
+// and local TCP ports: on the IPv4 address it was reached on over UDP, unless
+// it was reached on IPv6.
+func (t *tcpPunch) target(ports [2]int) *net.TCPAddr {
+	peer := t.p.peer()
+	public := t.p.peerAddrs[len(t.p.peerAddrs)-1]
+	if peer.IP.To4() == nil || peer.IP.Equal(public.IP) {
+		return &net.TCPAddr{IP: public.IP, Port: ports[0]}
+	}
+	// a local network or loopback address: the local port
+	return &net.TCPAddr{IP: peer.IP, Port: ports[1]}
+}
+
+// fromPeer returns whether ip is the address of one of the peer candidates.
+func (t *tcpPunch) fromPeer(ip net.IP) bool {
+	for _, v := range t.p.peerAddrs {
+		if v.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenReused listens on a TCP port that connections can also be opened
+// from, and returns its public port as seen by the TCP listener of the relay,
+// or the local port if the relay is unknown or does not answer.
+func listenReused(relayAddr *net.UDPAddr) (net.Listener, int, error) {
+	port, public := 0, 0
+	if relayAddr != nil {
+		d := net.Dialer{
+			Control: reuseControl,
+			Timeout: 2 * time.Second,
+		}
+		if c, err := d.Dial("tcp4", relayAddr.String()); err == nil {
+			port = c.LocalAddr().(*net.TCPAddr).Port
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buffer := make([]byte, 10)
+			if _, err := io.ReadFull(c, buffer); err == nil && string(buffer[:4]) == relayMagic {
+				public = getAddr(buffer[4:10]).Port
+			}
+			c.Close()
+		}
+	}
+	lc := net.ListenConfig{
+		Control: reuseControl,
+	}
+	l, err := lc.Listen(context.Background(), "tcp4", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, 0, err
+	}
+	if public == 0 {
+		public = l.Addr().(*net.TCPAddr).Port
+	}
+	return l, public, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// transparent is set with -transparent: in server mode, the packets of the
+// peer are sent to the game from the address of the peer rather than from
+// the one of proxypunch, for games that show or check the address of their
+// opponent. The socket sending them is bound to the address of the peer,
+// which needs root, and routing rules bringing the replies of the game back
+// to it, see transparentRules; Linux only.
+var transparent bool
+
+// transparentMark marks the replies of the game routed back to proxypunch
+// with -transparent, and transparentTable is the routing table of the mark.
+const (
+	transparentMark  = 0x7070
+	transparentTable = 170
+)
+
+func applyTransparent() error {
+	if !transparent {
+		return nil
+	}
+	if targetAddr != "" {
+		return errors.New("-transparent cannot be used with -target: the replies of the game would not come back through this computer")
+	}
+	return transparentSupported()
+}
+
+// transparentRules returns the commands routing the packets the game sends
+// from port to addresses outside of this computer back to proxypunch.
+func transparentRules(port int, ipv6 bool) string {
+	ip, iptables, mark, table := "ip", "iptables", strconv.Itoa(transparentMark), strconv.Itoa(transparentTable)
+	local := "0.0.0.0/0"
+	if ipv6 {
+		ip, iptables, local = "ip -6", "ip6tables", "::/0"
+	}
+	return ip + " rule add fwmark " + mark + " lookup " + table + "\n" +
+		ip + " route add local " + local + " dev lo table " + table + "\n" +
+		iptables + " -t mangle -A OUTPUT -p udp --sport " + strconv.Itoa(port) + " -j MARK --set-mark " + mark
+}
+
+// transparentGame sends the packets of the peer to the game from the address
+// of the peer, and relays the replies of the game routed back to it.
+type transparentGame struct {
+	mu sync.Mutex
+	c  *net.UDPConn
+}
+
+// conn returns the socket bound to the address of the peer, or nil.
+func (t *transparentGame) conn() *net.UDPConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.c
+}
+
+// runTransparent opens the socket bound to the address of the peer once it
+// is reached directly, and relays the packets the game sends to it, until
+// done is closed.
+func (p *proxy) runTransparent(done chan struct{}) {
+	var peer *net.UDPAddr
+	for {
+		var connected bool
+		if peer, connected = p.connectedPeer(); connected {
+			break
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if p.relayed {
+		p.s.errorln("Error -transparent needs a direct connection to " + p.peerName() + ": the game sees the address of proxypunch")
+		return
+	}
+	if isLocal(peer.IP) {
+		return
+	}
+	c, err := listenTransparent(peer)
+	if err != nil {
+		p.s.errorln("Error opening the socket with the address of " + p.peerName() + " for -transparent, proxypunch must run as root: " + err.Error())
+		return
+	}
+	defer c.Close()
+	p.asPeer.mu.Lock()
+	p.asPeer.c = c
+	p.asPeer.mu.Unlock()
+	go func() {
+		<-done
+		c.Close()
+	}()
+	localAddr, _ := p.local()
+	p.s.println("Sending the packets of " + p.peerName() + " to the game from its address " + peer.String() + ", the replies of the game reach proxypunch if these routing rules were added, as root:")
+	p.s.println(transparentRules(localAddr.Port, peer.IP.To4() == nil))
+
+	buffer := make([]byte, 4096)
+	for {
+		n, addr, err := c.ReadFromUDP(buffer[1:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if n > len(buffer)-1 {
+			continue
+		}
+		if _, localPort := p.local(); isLocal(addr.IP) && (localPort == 0 || addr.Port == localPort) {
+			p.gamePacket(buffer, n, addr)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ipv6Transparent is IPV6_TRANSPARENT, missing from syscall.
+const ipv6Transparent = 75
+
+func transparentSupported() error {
+	return nil
+}
+
+// listenTransparent opens a socket bound to addr, an address of another
+// computer.
+func listenTransparent(addr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	level, option := syscall.SOL_IP, syscall.IP_TRANSPARENT
+	if addr.IP.To4() == nil {
+		network = "udp6"
+		level, option = syscall.SOL_IPV6, ipv6Transparent
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, rc syscall.RawConn) error {
+			var err error
+			if cerr := rc.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), level, option, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	c, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
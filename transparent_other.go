@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func transparentSupported() error {
+	return errors.New("-transparent is only supported on Linux")
+}
+
+// listenTransparent fails: sockets are not bound to the addresses of other
+// computers on this platform.
+func listenTransparent(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("not supported on this platform")
+}
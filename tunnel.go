@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// tunnelSegment is the maximum payload of a typeStream packet, so that it
+// fits in the path MTU of most links along with the headers of -encrypt.
+const tunnelSegment = 1200
+
+// tunnelWindow is the count of segments sent to the peer without being
+// acknowledged yet, and of segments buffered for the game.
+const tunnelWindow = 64
+
+// Retransmission timeouts of the tunnel: the initial one, then bounds of the
+// one derived from the round trip time.
+const (
+	tunnelInitialRto = 500 * time.Millisecond
+	tunnelMinRto     = 50 * time.Millisecond
+	tunnelMaxRto     = 4 * time.Second
+)
+
+// tunnelDrainTimeout is the time spent delivering the end of the stream of
+// the game to the peer before ending the session.
+const tunnelDrainTimeout = 5 * time.Second
+
+// tcpTunnel proxies a TCP stream over the UDP session: the stream of the
+// game with -proto tcp-udp, so that it reaches the peer wherever its UDP
+// packets do, even relayed, or a connection of -socks. The stream is cut into
+// packets: a header (typeStream with -proto tcp-udp), a sequence number (4
+// bytes), then up to tunnelSegment bytes, an empty one ending the stream. The
+// receiver answers each of them with an acknowledgement: another header
+// (typeStreamAck with -proto tcp-udp), then the sequence number of the next
+// segment it expects (4 bytes); the sender sends again the segments not
+// acknowledged within the retransmission timeout.
+type tcpTunnel struct {
+	p         *proxy
+	header    []byte
+	ackHeader []byte
+
+	mu sync.Mutex
+	// acked signals that segments were acknowledged, or that the tunnel is
+	// closed.
+	acked  *sync.Cond
+	closed bool
+	// next is the sequence number of the next segment sent, unacked the
+	// segments sent and not acknowledged, in order.
+	next    uint32
+	unacked []*tunnelPacket
+	srtt    time.Duration
+	rto     time.Duration
+	// expected is the sequence number of the next segment for the game,
+	// pending the segments received after it.
+	expected uint32
+	pending  map[uint32][]byte
+	// ended is set once the peer ended the stream, reported once the end
+	// was reported.
+	ended    bool
+	reported bool
+	// game receives the segments for the game, in order.
+	game chan []byte
+}
+
+type tunnelPacket struct {
+	seq           uint32
+	data          []byte
+	sent          time.Time
+	retransmitted bool
+}
+
+func newTcpTunnel(p *proxy, header []byte, ackHeader []byte) *tcpTunnel {
+	t := &tcpTunnel{
+		p:         p,
+		header:    header,
+		ackHeader: ackHeader,
+		rto:       tunnelInitialRto,
+		pending:   make(map[uint32][]byte),
+		game:      make(chan []byte, tunnelWindow),
+	}
+	t.acked = sync.NewCond(&t.mu)
+	return t
+}
+
+// run proxies the stream of the game over the tunnel once connected, ending
+// the session when it ends, until done is closed.
+func (t *tcpTunnel) run(done chan struct{}) {
+	p := t.p
+	for {
+		if _, connected := p.connectedPeer(); connected {
+			break
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	game := p.gameConn(done)
+	if game == nil {
+		t.close()
+		return
+	}
+	if !t.pipe(game, done) {
+		return
+	}
+	select {
+	case <-done:
+	default:
+		p.s.println("The TCP connection of the game ended, ending the session")
+		p.close()
+	}
+}
+
+// pipe proxies the stream of c over the tunnel until either ends or done is
+// closed, then closes c and the tunnel, and returns whether c ended first.
+func (t *tcpTunnel) pipe(c net.Conn, done chan struct{}) bool {
+	defer t.close()
+	defer c.Close()
+	chPipe := make(chan struct{})
+	defer close(chPipe)
+	go func() {
+		select {
+		case <-done:
+		case <-chPipe:
+		}
+		t.close()
+		c.Close()
+	}()
+	go t.retransmit(chPipe)
+	go func() {
+		defer c.Close()
+		for {
+			var data []byte
+			select {
+			case <-chPipe:
+				return
+			case data = <-t.game:
+			}
+			if len(data) == 0 {
+				return
+			}
+			if _, err := c.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	buffer := make([]byte, tunnelSegment)
+	for {
+		n, err := c.Read(buffer)
+		if n > 0 && !t.send(buffer[:n]) {
+			return false
+		}
+		if err != nil {
+			break
+		}
+	}
+	if t.endReceived() {
+		return false
+	}
+	// end the stream, and let it reach the peer
+	t.send(nil)
+	t.drain(time.Now().Add(tunnelDrainTimeout))
+	return true
+}
+
+// send sends a segment of the stream of the game, once the window has room
+// for it, and returns false if the tunnel was closed.
+func (t *tcpTunnel) send(data []byte) bool {
+	t.mu.Lock()
+	for len(t.unacked) >= tunnelWindow && !t.closed {
+		t.acked.Wait()
+	}
+	if t.closed {
+		t.mu.Unlock()
+		return false
+	}
+	packet := &tunnelPacket{
+		seq:  t.next,
+		data: t.packet(t.next, data),
+		sent: time.Now(),
+	}
+	t.next++
+	t.unacked = append(t.unacked, packet)
+	t.mu.Unlock()
+	t.p.pushPeer(packet.data, t.p.peer())
+	return true
+}
+
+func (t *tcpTunnel) packet(seq uint32, data []byte) []byte {
+	b := make([]byte, len(t.header)+4, len(t.header)+4+len(data))
+	copy(b, t.header)
+	binary.BigEndian.PutUint32(b[len(t.header):], seq)
+	return append(b, data...)
+}
+
+// drain waits until all segments are acknowledged, the tunnel is closed, or
+// deadline.
+func (t *tcpTunnel) drain(deadline time.Time) {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		t.mu.Lock()
+		t.acked.Broadcast()
+		t.mu.Unlock()
+	})
+	defer timer.Stop()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.unacked) > 0 && !t.closed && time.Now().Before(deadline) {
+		t.acked.Wait()
+	}
+}
+
+// retransmit sends again the segments not acknowledged in time, until done
+// is closed.
+func (t *tcpTunnel) retransmit(done chan struct{}) {
+	ticker := time.NewTicker(tunnelMinRto / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var resend [][]byte
+		now := time.Now()
+		t.mu.Lock()
+		for _, v := range t.unacked {
+			if now.Sub(v.sent) < t.rto {
+				continue
+			}
+			v.sent = now
+			v.retransmitted = true
+			resend = append(resend, v.data)
+		}
+		if len(resend) > 0 {
+			t.rto *= 2
+			if t.rto > tunnelMaxRto {
+				t.rto = tunnelMaxRto
+			}
+		}
+		t.mu.Unlock()
+		for _, v := range resend {
+			t.p.pushPeer(v, t.p.peer())
+		}
+	}
+}
+
+// received handles a packet of the stream from the peer, and returns whether
+// the peer just ended the stream.
+func (t *tcpTunnel) received(data []byte) bool {
+	h := len(t.header)
+	if len(data) < h+4 {
+		return false
+	}
+	seq := binary.BigEndian.Uint32(data[h : h+4])
+	t.mu.Lock()
+	if ahead := seq - t.expected; ahead < tunnelWindow && !t.ended {
+		if _, ok := t.pending[seq]; !ok {
+			t.pending[seq] = append([]byte(nil), data[h+4:]...)
+		}
+		for {
+			segment, ok := t.pending[t.expected]
+			if !ok {
+				break
+			}
+			select {
+			case t.game <- segment:
+			default:
+				// the game is not reading, the peer sends it again later
+				ok = false
+			}
+			if !ok {
+				break
+			}
+			delete(t.pending, t.expected)
+			t.expected++
+			if len(segment) == 0 {
+				t.ended = true
+				break
+			}
+		}
+	}
+	ack := make([]byte, len(t.ackHeader)+4)
+	copy(ack, t.ackHeader)
+	binary.BigEndian.PutUint32(ack[len(t.ackHeader):], t.expected)
+	ended := t.ended && !t.reported
+	t.reported = t.ended
+	t.mu.Unlock()
+	t.p.pushPeer(ack, t.p.peer())
+	return ended
+}
+
+// receivedAck handles an acknowledgement of the stream from the peer.
+func (t *tcpTunnel) receivedAck(data []byte) {
+	h := len(t.ackHeader)
+	if len(data) != h+4 {
+		return
+	}
+	ack := binary.BigEndian.Uint32(data[h : h+4])
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for n < len(t.unacked) && int32(t.unacked[n].seq-ack) < 0 {
+		if v := t.unacked[n]; !v.retransmitted {
+			rtt := now.Sub(v.sent)
+			if t.srtt == 0 {
+				t.srtt = rtt
+			} else {
+				t.srtt = (7*t.srtt + rtt) / 8
+			}
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	t.unacked = t.unacked[n:]
+	if t.srtt > 0 {
+		t.rto = 2 * t.srtt
+		if t.rto < tunnelMinRto {
+			t.rto = tunnelMinRto
+		}
+	}
+	t.acked.Broadcast()
+}
+
+// endReceived returns whether the peer ended the stream.
+func (t *tcpTunnel) endReceived() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ended
+}
+
+func (t *tcpTunnel) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.acked.Broadcast()
+	t.mu.Unlock()
+}
+
+// tunnelReceived handles a typeStream packet of the peer with -proto tcp-udp,
+// ending the session once the peer ended the stream of its game.
+func (p *proxy) tunnelReceived(data []byte) {
+	if p.tunnel == nil || !p.tunnel.received(data) {
+		return
+	}
+	p.s.println("The TCP connection of the game of " + p.peerName() + " ended, ending the session")
+	go func() {
+		// let the acknowledgement reach the peer
+		time.Sleep(pingInterval)
+		p.close()
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// unreachableInterval is the minimum interval between two reports of ICMP
+// errors that do not end the session.
+const unreachableInterval = 10 * time.Second
+
+// peerTimeout is how long the peer must have been silent for an ICMP error
+// from its address to end the session, so that a stray or spoofed error does
+// not end a working session.
+const peerTimeout = 3 * pingInterval
+
+// unreachable is an ICMP error reported on the proxy socket.
+type unreachable struct {
+	// dest is the destination of the packet that caused the error, nil if
+	// the system does not tell.
+	dest *net.UDPAddr
+	// reason describes the error, e.g. port unreachable.
+	reason string
+}
+
+type syscallConn interface {
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// icmpReason describes an ICMP destination unreachable (3) or time exceeded
+// (11) error.
+func icmpReason(icmpType byte, code byte) string {
+	if icmpType == 11 {
+		return "TTL exceeded"
+	}
+	switch code {
+	case 0:
+		return "network unreachable"
+	case 1:
+		return "host unreachable"
+	case 3:
+		return "port unreachable"
+	case 9, 10, 13:
+		return "blocked by a firewall"
+	}
+	return "destination unreachable"
+}
+
+// icmp6Reason describes an ICMPv6 error.
+func icmp6Reason(icmpType byte, code byte) string {
+	if icmpType == 3 {
+		return "TTL exceeded"
+	}
+	switch code {
+	case 0:
+		return "network unreachable"
+	case 1, 5, 6:
+		return "blocked by a firewall"
+	case 3:
+		return "host unreachable"
+	case 4:
+		return "port unreachable"
+	}
+	return "destination unreachable"
+}
+
+// watchRelay reports an ICMP error from the relay while connecting, until
+// done is closed.
+func watchRelay(s *session, c packetConn, relayAddr *net.UDPAddr, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+		for _, u := range pollUnreachable(c) {
+			if u.dest != nil && u.dest.IP.Equal(relayAddr.IP) && u.dest.Port == relayAddr.Port {
+				s.errorln("Error relay " + relayName(s) + " is not answering (" + u.reason + "): it may be down, or blocked on this network")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// enableUnreachable makes the system queue the ICMP errors caused by the
+// packets sent on c, along with their destination.
+func enableUnreachable(c *net.UDPConn) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVERR, 1)
+		// fails on IPv4 sockets
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVERR, 1)
+	})
+}
+
+// pollUnreachable returns the ICMP errors queued on c since the last call.
+func pollUnreachable(c packetConn) []unreachable {
+	sc, ok := c.(syscallConn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var found []unreachable
+	b := make([]byte, 64)
+	oob := make([]byte, 128)
+	// not Read, which waits for the pending reads of the proxy
+	raw.Control(func(fd uintptr) {
+		for {
+			_, oobn, _, from, err := syscall.Recvmsg(int(fd), b, oob, syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+			if err != nil {
+				// the queue is empty
+				return
+			}
+			msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil {
+				continue
+			}
+			for _, m := range msgs {
+				// struct sock_extended_err: errno (4 bytes), origin, type, code
+				if len(m.Data) < 8 {
+					continue
+				}
+				if !(m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR) && !(m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) {
+					continue
+				}
+				var u unreachable
+				switch m.Data[4] {
+				case 2: // SO_EE_ORIGIN_ICMP
+					u.reason = icmpReason(m.Data[5], m.Data[6])
+				case 3: // SO_EE_ORIGIN_ICMP6
+					u.reason = icmp6Reason(m.Data[5], m.Data[6])
+				default:
+					continue
+				}
+				switch sa := from.(type) {
+				case *syscall.SockaddrInet4:
+					u.dest = &net.UDPAddr{
+						IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+						Port: sa.Port,
+					}
+				case *syscall.SockaddrInet6:
+					ip := make(net.IP, 16)
+					copy(ip, sa.Addr[:])
+					u.dest = &net.UDPAddr{
+						IP:   ip,
+						Port: sa.Port,
+					}
+				}
+				found = append(found, u)
+			}
+		}
+	})
+	return found
+}
+
+// readUnreachable returns the ICMP error reported by the read error err;
+// ICMP errors are polled instead on this platform.
+func readUnreachable(err error) (unreachable, bool) {
+	return unreachable{}, false
+}
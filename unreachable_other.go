@@ -0,0 +1,19 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"net"
+)
+
+// enableUnreachable does nothing: ICMP errors are not read on this platform.
+func enableUnreachable(c *net.UDPConn) {}
+
+func pollUnreachable(c packetConn) []unreachable {
+	return nil
+}
+
+func readUnreachable(err error) (unreachable, bool) {
+	return unreachable{}, false
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// WSAECONNRESET and WSAENETRESET are returned by reads after a packet sent
+// on the socket caused an ICMP port unreachable or TTL exceeded error.
+const (
+	wsaeConnReset = syscall.Errno(10054)
+	wsaeNetReset  = syscall.Errno(10052)
+)
+
+// enableUnreachable does nothing: ICMP errors are always reported to reads
+// on this platform.
+func enableUnreachable(c *net.UDPConn) {}
+
+// pollUnreachable returns nothing: ICMP errors are reported to reads on this
+// platform.
+func pollUnreachable(c packetConn) []unreachable {
+	return nil
+}
+
+// readUnreachable returns the ICMP error reported by the read error err; the
+// system does not tell its destination.
+func readUnreachable(err error) (unreachable, bool) {
+	if errors.Is(err, wsaeConnReset) {
+		return unreachable{reason: "port unreachable"}, true
+	}
+	if errors.Is(err, wsaeNetReset) {
+		return unreachable{reason: "TTL exceeded"}, true
+	}
+	return unreachable{}, false
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const upnpTimeout = 3 * time.Second
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// upnpGateway is the WAN connection service of an Internet gateway device.
+type upnpGateway struct {
+	controlURL string
+	service    string
+	// local is the address of this host on the network of the gateway.
+	local net.IP
+}
+
+// discoverGateway finds the Internet gateway device of the local network with
+// SSDP.
+func discoverGateway() (*upnpGateway, error) {
+	c, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := c.WriteToUDP([]byte(search), ssdpAddr); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(upnpTimeout))
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := c.ReadFromUDP(buffer)
+		if err != nil {
+			return nil, errors.New("no answer to the UPnP discovery")
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := res.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		if g, err := gatewayService(location); err == nil {
+			return g, nil
+		}
+	}
+}
+
+// gatewayService reads the description of the device at location and returns
+// its WAN connection service.
+func gatewayService(location string) (*upnpGateway, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: upnpTimeout}
+	res, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// services are nested in devices at any depth: scan all of them
+	var service string
+	var g *upnpGateway
+	var text string
+	d := xml.NewDecoder(res.Body)
+	for g == nil {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			text = ""
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "serviceType":
+				service = strings.TrimSpace(text)
+			case "controlURL":
+				if !strings.Contains(service, ":WANIPConnection:") && !strings.Contains(service, ":WANPPPConnection:") {
+					continue
+				}
+				control, err := base.Parse(strings.TrimSpace(text))
+				if err != nil {
+					continue
+				}
+				g = &upnpGateway{
+					controlURL: control.String(),
+					service:    service,
+				}
+			}
+		}
+	}
+	if g == nil {
+		return nil, errors.New("no WAN connection service")
+	}
+
+	route, err := net.Dial("udp4", net.JoinHostPort(base.Hostname(), "1900"))
+	if err != nil {
+		return nil, err
+	}
+	g.local = route.LocalAddr().(*net.UDPAddr).IP
+	route.Close()
+	return g, nil
+}
+
+func (g *upnpGateway) name() string {
+	return "UPnP"
+}
+
+func (g *upnpGateway) add(port int) (time.Duration, error) {
+	if err := g.addMapping(port, mappingLease); err != nil {
+		// some routers only support permanent mappings
+		if g.addMapping(port, 0) != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+	return mappingLease, nil
+}
+
+func (g *upnpGateway) addMapping(port int, lease time.Duration) error {
+	_, err := g.call("AddPortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(defaultPort),
+		"NewProtocol", "UDP",
+		"NewInternalPort", strconv.Itoa(port),
+		"NewInternalClient", g.local.String(),
+		"NewEnabled", "1",
+		"NewPortMappingDescription", "proxypunch",
+		"NewLeaseDuration", strconv.Itoa(int(lease.Seconds())),
+	})
+	return err
+}
+
+func (g *upnpGateway) remove() error {
+	_, err := g.call("DeletePortMapping", []string{
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(defaultPort),
+		"NewProtocol", "UDP",
+	})
+	return err
+}
+
+func (g *upnpGateway) externalIP() (string, error) {
+	b, err := g.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return "", err
+	}
+	var text string
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			text = ""
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			if t.Name.Local == "NewExternalIPAddress" && net.ParseIP(strings.TrimSpace(text)) != nil {
+				return strings.TrimSpace(text), nil
+			}
+		}
+	}
+}
+
+// call calls the SOAP action of the gateway with args, a list of names and
+// values, and returns the response.
+func (g *upnpGateway) call(action string, args []string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	body.WriteString(`<u:` + action + ` xmlns:u="` + g.service + `">`)
+	for i := 0; i+1 < len(args); i += 2 {
+		body.WriteString("<" + args[i] + ">")
+		xml.EscapeText(&body, []byte(args[i+1]))
+		body.WriteString("</" + args[i] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", g.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+g.service+`#`+action+`"`)
+	client := http.Client{Timeout: upnpTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		if code := upnpError(b); code != "" {
+			return nil, errors.New("router error " + code)
+		}
+		return nil, errors.New("router answered " + res.Status)
+	}
+	return b, nil
+}
+
+// upnpError returns the UPnP error code and description of a SOAP fault.
+func upnpError(b []byte) string {
+	var code, desc, text string
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			text = ""
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "errorCode":
+				code = strings.TrimSpace(text)
+			case "errorDescription":
+				desc = strings.TrimSpace(text)
+			}
+		}
+	}
+	if desc != "" {
+		return code + " (" + desc + ")"
+	}
+	return code
+}
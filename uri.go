@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// uriScheme is the scheme of the links that start proxypunch connected to a
+// host: proxypunch://host:port?game=soku, or proxypunch://name@relay.
+const uriScheme = "proxypunch"
+
+func isUri(arg string) bool {
+	return strings.HasPrefix(strings.ToLower(arg), uriScheme+"://")
+}
+
+// uriArgs returns the command-line flags equivalent to a link.
+func uriArgs(uri string) ([]string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-mode", "client"}
+	if u.User != nil {
+		// name@relay, the port is the relay port
+		args = append(args, "-host", u.User.Username()+"@"+u.Host)
+	} else {
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			return nil, errors.New("missing port in link " + uri)
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, errors.New("invalid port in link " + uri)
+		}
+		args = append(args, "-host", host, "-port", port)
+	}
+	query := u.Query()
+	if game := query.Get("game"); game != "" {
+		args = append(args, "-game", game)
+	}
+	if password := query.Get("password"); password != "" {
+		args = append(args, "-password", password)
+	}
+	if query.Get("private") != "" {
+		args = append(args, "-private")
+	}
+	return args, nil
+}
+
+// hostUri returns the link to share to connect to a host.
+func hostUri(host string, port int, s *session) string {
+	u := url.URL{
+		Scheme: uriScheme,
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+	query := url.Values{}
+	if game := presetName(s.preset); game != "" {
+		query.Set("game", game)
+	}
+	if private {
+		query.Set("private", "1")
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// install registers proxypunch as the handler of its links.
+func install(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	remove := fs.Bool("remove", false, "unregister proxypunch as the handler of proxypunch:// links")
+	fs.Parse(args)
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error finding the proxypunch executable: "+err.Error())
+		return
+	}
+	if *remove {
+		if err := unregisterUriHandler(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error unregistering the handler of "+uriScheme+":// links: "+err.Error())
+			return
+		}
+		fmt.Println("Unregistered the handler of " + uriScheme + ":// links.")
+		return
+	}
+	if err := registerUriHandler(exe); err != nil {
+		fmt.Fprintln(os.Stderr, "Error registering the handler of "+uriScheme+":// links: "+err.Error())
+		return
+	}
+	fmt.Println("Registered " + exe + " as the handler of " + uriScheme + ":// links.")
+	fmt.Println("Clicking such a link will now start proxypunch connected to the host. Run proxypunch install -remove to undo this.")
+}
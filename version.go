@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// versionMagic prefixes the version messages, with which a peer learns the
+// protocol version and the features of its relay when starting a session:
+//   - request: protocol version of the peer, padded to the size of the reply
+//     so that the relay does not amplify spoofed requests
+//   - reply: protocol version of the relay, oldest peer protocol version it
+//     accepts, capabilities (2 bytes)
+//
+// Versions are one byte. Relays predating versions do not answer, and are
+// assumed to have legacyCaps.
+const versionMagic = "PPV1"
+
+// protocolVersion is the relay protocol version of this proxypunch, raised
+// when a change breaks older relays or peers.
+const protocolVersion = 1
+
+// Capabilities of relays. New features of the relay protocol get the next
+// bit, and are only used with relays announcing it.
+const (
+	// capIpv6 is the relayMagic6 registrations.
+	capIpv6 uint16 = 1 << iota
+	// capLobby is the public lobby, see lobbyMagic.
+	capLobby
+	// capNames is the registered names, see nameMagic.
+	capNames
+	// capChannels is the relayed channels, see forwardMagic.
+	capChannels
+	// capChain is the chained channels of -via, see chainMagic.
+	capChain
+	// capTcp is the public TCP address answered on the relay port.
+	capTcp
+	// capAuth is the authentication of peers, see relayAuthMagic.
+	capAuth
+	// capRestricted is set when the relay only accepts the peers of its
+	// community, authenticated with its token.
+	capRestricted
+	// capCodes is the connect codes, see codeMagic.
+	capCodes
+	// capRooms is the rooms, see roomMagic.
+	capRooms
+	// capSeal is the sealed messages, see sealMagic.
+	capSeal
+	// capDualStack is set when the relay also listens on IPv6, see
+	// resolveRelayIpv6.
+	capDualStack
+)
+
+// legacyCaps are the capabilities of relays predating versions, which only
+// pair hosts and peers with the legacy registrations.
+const legacyCaps uint16 = 0
+
+// negotiateRelay learns the protocol version and the capabilities of the
+// relay of the session, and returns an error if the relay does not accept
+// this proxypunch.
+func negotiateRelay(s *session, relayAddr *net.UDPAddr) error {
+	s.relayCaps = legacyCaps
+	s.legacyRelay = false
+	c, err := net.DialUDP("udp4", nil, relayAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	request := append([]byte(versionMagic), protocolVersion, 0, 0, 0)
+	buffer := make([]byte, 16)
+	for try := 0; try < 2; try++ {
+		if _, err := c.Write(request); err != nil {
+			return err
+		}
+		c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			n, err := c.Read(buffer)
+			if err != nil {
+				break
+			}
+			if n != len(versionMagic)+4 || string(buffer[:len(versionMagic)]) != versionMagic {
+				continue
+			}
+			version, oldest := int(buffer[4]), int(buffer[5])
+			s.relayCaps = binary.BigEndian.Uint16(buffer[6:8])
+			s.legacyRelay = false
+			if oldest > protocolVersion {
+				return errors.New("relay " + relayName(s) + " requires a newer proxypunch (relay protocol " + strconv.Itoa(oldest) + ", this proxypunch speaks " + strconv.Itoa(protocolVersion) + "): update proxypunch, or use another relay with -relay")
+			}
+			if s.relayCaps&capRestricted != 0 && relayToken == "" {
+				return errors.New("relay " + relayName(s) + " only accepts the players of its community: set its token with -relay-token, or use another relay with -relay")
+			}
+			if verbose {
+				s.println("Relay " + relayName(s) + " speaks protocol " + strconv.Itoa(version))
+			}
+			return nil
+		}
+	}
+	s.legacyRelay = true
+	if verbose {
+		s.println("Relay " + relayName(s) + " does not tell its version, assuming it predates versions")
+	}
+	return nil
+}
+
+// relayHas returns whether the relay of the session has the capability cap,
+// or prints that the relay is too old for feature and returns false.
+func (s *session) relayHas(cap uint16, feature string) bool {
+	if s.relayCaps&cap != 0 {
+		return true
+	}
+	s.errorln("Error relay " + relayName(s) + " is too old for " + feature + ": ask its operator to update it, or use another relay with -relay")
+	return false
+}